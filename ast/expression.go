@@ -45,6 +45,14 @@ func (n Number) String() string {
 	return strconv.FormatFloat(float64(n), 'f', -1, 64)
 }
 
+type Integer int64
+
+func (i Integer) expression() {}
+
+func (i Integer) String() string {
+	return strconv.FormatInt(int64(i), 10)
+}
+
 type Nil struct{}
 
 func (n *Nil) expression() {}
@@ -114,6 +122,17 @@ func (f *FunctionCall) String() string {
 	return fmt.Sprintf("%s:%s (%s)", f.Self.String(), f.Function.String(), f.Args.String())
 }
 
+// Parenthesized 是括号中的函数调用或者 ...，只保留第一个值
+type Parenthesized struct {
+	Expression Expression
+}
+
+func (p *Parenthesized) expression() {}
+
+func (p *Parenthesized) String() string {
+	return fmt.Sprintf("(%s)", p.Expression.String())
+}
+
 type TableAccess struct {
 	Left  Expression
 	Index Expression
@@ -125,12 +144,16 @@ func (i *TableAccess) String() string {
 	return fmt.Sprintf("%s[%s]", i.Left.String(), i.Index.String())
 }
 
+// Keypair 是表构造器中的一项, 按位置给出的值 Key 为 nil
 type Keypair struct {
 	Key   Expression
 	Value Expression
 }
 
 func (k *Keypair) String() string {
+	if k.Key == nil {
+		return k.Value.String()
+	}
 	return fmt.Sprintf("%s = %s", k.Key, k.Value)
 }
 
@@ -15,6 +15,7 @@ type Statement interface {
 
 type Block struct {
 	Statements []Statement
+	Lines      []int // 每条语句起始的行号
 	Return     *Return
 }
 
@@ -47,6 +48,7 @@ func (b Break) String() string {
 
 type Return struct {
 	Values []Expression
+	Line   int
 }
 
 func (r *Return) statement() {}
@@ -126,6 +128,8 @@ type Function struct {
 	Name       Identifier
 	Body       *Block
 	Parameters []Parameter
+	Line       int // function 关键字所在行
+	LastLine   int // end 所在行
 }
 
 func (f *Function) expression() {}
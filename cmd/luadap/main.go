@@ -0,0 +1,25 @@
+// luadap 是 lua 脚本的 Debug Adapter Protocol 服务器
+//
+// 默认通过标准输入输出和编辑器通信, 使用 -listen 时监听 TCP 地址, 例如 -listen 127.0.0.1:4711
+package main
+
+import (
+	"flag"
+	"log"
+
+	"github.com/Salpadding/lua/vm/debugger/dap"
+)
+
+func main() {
+	listen := flag.String("listen", "", "listen on a TCP address instead of using stdio")
+	flag.Parse()
+	var err error
+	if *listen != "" {
+		err = dap.ListenAndServe(*listen)
+	} else {
+		err = dap.ServeStdio()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -32,7 +32,7 @@ var escapes = map[rune]string{
 	'\'': `\'`,
 }
 
-func FromEscaped(rd io.RuneReader) (string, error) {
+func FromEscaped(rd io.RuneScanner) (string, error) {
 	var buf bytes.Buffer
 	for {
 		r, _, err := rd.ReadRune()
@@ -47,16 +47,107 @@ func FromEscaped(rd io.RuneReader) (string, error) {
 		if err != nil {
 			return "", errors.New("unexpected string end after \\")
 		}
-		switch n {
-		case 'a', 'b', 'f', 'n', 'r', 't', 'v', '"', '\'', '\\':
+		switch {
+		case n == 'a', n == 'b', n == 'f', n == 'n', n == 'r', n == 't', n == 'v', n == '"', n == '\'', n == '\\':
 			buf.WriteRune(escapeChars[n])
+		case n == '\n', n == '\r':
+			buf.WriteRune('\n')
+		case '0' <= n && n <= '9':
+			// \ddd 最多三位十进制数
+			d := int(n - '0')
+			for i := 0; i < 2; i++ {
+				c, _, err := rd.ReadRune()
+				if err != nil {
+					break
+				}
+				if c < '0' || c > '9' {
+					_ = rd.UnreadRune()
+					break
+				}
+				d = d*10 + int(c-'0')
+			}
+			if d > 0xff {
+				return "", errors.New("decimal escape too large")
+			}
+			buf.WriteByte(byte(d))
+		case n == 'x':
+			// \xXX 两位十六进制数
+			d := 0
+			for i := 0; i < 2; i++ {
+				c, _, err := rd.ReadRune()
+				if err != nil {
+					return "", errors.New("hexadecimal digit expected")
+				}
+				h, ok := hexDigit(c)
+				if !ok {
+					return "", errors.New("hexadecimal digit expected")
+				}
+				d = d*16 + h
+			}
+			buf.WriteByte(byte(d))
+		case n == 'z':
+			// 跳过之后的空白字符
+			for {
+				c, _, err := rd.ReadRune()
+				if err != nil {
+					break
+				}
+				if !isSpace(c) {
+					_ = rd.UnreadRune()
+					break
+				}
+			}
+		case n == 'u':
+			// \u{XXX} utf8 编码
+			if c, _, err := rd.ReadRune(); err != nil || c != '{' {
+				return "", errors.New("missing '{' in \\u{xxxx}")
+			}
+			d := 0
+			for {
+				c, _, err := rd.ReadRune()
+				if err != nil {
+					return "", errors.New("missing '}' in \\u{xxxx}")
+				}
+				if c == '}' {
+					break
+				}
+				h, ok := hexDigit(c)
+				if !ok {
+					return "", errors.New("hexadecimal digit expected")
+				}
+				d = d*16 + h
+				if d > 0x7FFFFFFF {
+					return "", errors.New("UTF-8 value too large")
+				}
+			}
+			buf.WriteRune(rune(d))
 		default:
-			buf.WriteRune(n)
+			return "", errors.New("invalid escape sequence \\" + string(n))
 		}
 	}
 	return buf.String(), nil
 }
 
+func hexDigit(r rune) (int, bool) {
+	switch {
+	case '0' <= r && r <= '9':
+		return int(r - '0'), true
+	case 'a' <= r && r <= 'f':
+		return int(r-'a') + 10, true
+	case 'A' <= r && r <= 'F':
+		return int(r-'A') + 10, true
+	}
+	return 0, false
+}
+
+func isSpace(r rune) bool {
+	switch r {
+	case '\t', '\n', '\v', '\f', '\r', ' ':
+		return true
+	}
+	return false
+}
+
 func Escape(rd io.RuneReader) string {
 	var buf bytes.Buffer
 	for {
@@ -0,0 +1,47 @@
+// Package compiler 把语法树编译成 lua 5.3 的函数原型
+package compiler
+
+import (
+	"io"
+
+	"github.com/Salpadding/lua/ast"
+	"github.com/Salpadding/lua/parser"
+	"github.com/Salpadding/lua/types"
+)
+
+// envName 是全局环境的名字, 主函数的第一个 upvalue
+const envName = "_ENV"
+
+// Compile 把语法树编译成主函数原型, source 是调试信息中的源文件名
+func Compile(blk *ast.Block, source string) (*types.Prototype, error) {
+	main := newFunction(nil, source)
+	main.isVararg = true
+	main.addUpValue(envName, true, 0)
+	if err := main.body(nil, blk, lastLine(blk)); err != nil {
+		return nil, err
+	}
+	return main.toPrototype()
+}
+
+// CompileReader 解析并编译源代码
+func CompileReader(rd io.RuneReader, source string) (*types.Prototype, error) {
+	p, err := parser.New(rd)
+	if err != nil {
+		return nil, err
+	}
+	blk, err := p.Parse()
+	if err != nil {
+		return nil, err
+	}
+	return Compile(blk, source)
+}
+
+func lastLine(blk *ast.Block) int {
+	if blk.Return != nil {
+		return blk.Return.Line
+	}
+	if len(blk.Lines) > 0 {
+		return blk.Lines[len(blk.Lines)-1]
+	}
+	return 0
+}
@@ -0,0 +1,162 @@
+package compiler
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/Salpadding/lua/types"
+	"github.com/Salpadding/lua/types/code"
+	"github.com/stretchr/testify/assert"
+)
+
+func compileString(s string) (*types.Prototype, error) {
+	return CompileReader(strings.NewReader(s), "=test")
+}
+
+func opcodes(p *types.Prototype) []code.Type {
+	var res []code.Type
+	for _, ins := range p.Code {
+		res = append(res, ins.Opcode().Type)
+	}
+	return res
+}
+
+func testCompileFile(t *testing.T, fname string) {
+	f, err := os.Open(fname)
+	assert.NoError(t, err)
+	defer f.Close()
+	p, err := CompileReader(bufio.NewReader(f), "@"+fname)
+	assert.NoError(t, err)
+	assert.NoError(t, types.Verify(p), fname)
+
+	// 写成二进制代码块再读回来, 再次写入的结果应该相同
+	var buf bytes.Buffer
+	assert.NoError(t, types.WritePrototype(&buf, p, false))
+	data := buf.Bytes()
+	loaded, err := types.ReadPrototype(bytes.NewReader(data))
+	assert.NoError(t, err)
+	buf = bytes.Buffer{}
+	assert.NoError(t, types.WritePrototype(&buf, loaded, false))
+	assert.Equal(t, data, buf.Bytes(), fname)
+	for _, sub := range loaded.Prototypes {
+		assert.Equal(t, p.Source, sub.Source)
+	}
+}
+
+func TestCompileFiles(t *testing.T) {
+	for _, fname := range []string{
+		"../parser/testdata/p1.lua",
+		"../parser/testdata/p2.lua",
+		"../parser/testdata/p3.lua",
+		"../parser/testdata/p4.lua",
+		"../parser/testdata/p5.lua",
+		"testdata/max.lua",
+		"testdata/counter.lua",
+	} {
+		testCompileFile(t, fname)
+	}
+}
+
+func TestCompileLocal(t *testing.T) {
+	p, err := compileString("local a = 1 + b")
+	assert.NoError(t, err)
+	assert.Equal(t, []code.Type{code.GetTableUpValue, code.Add, code.Return}, opcodes(p))
+	assert.Equal(t, []types.Value{types.Integer(1), types.String("b")}, p.Constants)
+	assert.Equal(t, "_ENV", p.UpValueNames[0])
+	assert.Equal(t, types.UpValue{1, 0}, p.UpValues[0])
+	assert.True(t, p.IsVararg)
+}
+
+func TestCompileForNum(t *testing.T) {
+	p, err := compileString("local s = 0\nfor i = 1, 10 do s = s + i end")
+	assert.NoError(t, err)
+	assert.Equal(t, []code.Type{
+		code.LoadK, code.LoadK, code.LoadK, code.LoadK, code.ForPrep,
+		code.Add, code.Move, code.ForLoop, code.Return,
+	}, opcodes(p))
+	_, sBx := p.Code[4].AsBx()
+	assert.Equal(t, 2, sBx)
+	_, sBx = p.Code[7].AsBx()
+	assert.Equal(t, -3, sBx)
+	assert.Equal(t, []uint32{1, 2, 2, 2, 2, 2, 2, 2, 2}, p.LineInfo)
+}
+
+func TestCompileLoopLines(t *testing.T) {
+	// 和 luac 一样, 循环指令使用 for 所在的行, 而不是循环体最后一行
+	p, err := compileString("local s = 0\nfor i = 1, 10 do\ns = s + i\nend")
+	assert.NoError(t, err)
+	assert.Equal(t, code.ForLoop, p.Code[7].Opcode().Type)
+	assert.Equal(t, []uint32{1, 2, 2, 2, 2, 3, 3, 2}, p.LineInfo[:8])
+
+	p, err = compileString("local t = {}\nfor k, v in pairs(t) do\nprint(k)\nend")
+	assert.NoError(t, err)
+	assert.Equal(t, []code.Type{
+		code.NewTable, code.GetTableUpValue, code.Move, code.Call, code.Jmp,
+		code.GetTableUpValue, code.Move, code.Call, code.TForCall, code.TForLoop, code.Return,
+	}, opcodes(p))
+	assert.Equal(t, []uint32{1, 2, 2, 2, 2, 3, 3, 3, 2, 2}, p.LineInfo[:10])
+}
+
+func TestCompileMethodCall(t *testing.T) {
+	p, err := compileString("local s = 'a'\nreturn s:rep(3):upper()")
+	assert.NoError(t, err)
+	assert.Equal(t, []code.Type{
+		code.LoadK, code.Self, code.LoadK, code.Call, code.Self, code.TailCall, code.Return, code.Return,
+	}, opcodes(p))
+}
+
+func TestCompileTable(t *testing.T) {
+	p, err := compileString("local t = {1, 2, x = 3, f()}")
+	assert.NoError(t, err)
+	assert.Equal(t, []code.Type{
+		code.NewTable, code.LoadK, code.LoadK, code.SetTable, code.GetTableUpValue, code.Call, code.SetList, code.Return,
+	}, opcodes(p))
+	a, b, c := p.Code[5].ABC()
+	assert.Equal(t, []int{3, 1, 0}, []int{a, b, c})
+	a, b, c = p.Code[6].ABC()
+	assert.Equal(t, []int{0, 0, 1}, []int{a, b, c})
+}
+
+func TestCompileClosure(t *testing.T) {
+	p, err := compileString("local fns = {}\nfor i = 1, 3 do fns[i] = function() return i end end")
+	assert.NoError(t, err)
+	assert.Len(t, p.Prototypes, 1)
+	child := p.Prototypes[0]
+	assert.Equal(t, []string{"i"}, child.UpValueNames)
+	assert.Equal(t, types.UpValue{1, 4}, child.UpValues[0])
+	// 每次迭代结束关闭被捕获的循环变量
+	jmp := p.Code[len(p.Code)-3]
+	assert.Equal(t, code.Jmp, jmp.Opcode().Type)
+	a, _ := jmp.AsBx()
+	assert.Equal(t, 5, a)
+}
+
+func TestCompileLongExpression(t *testing.T) {
+	// 左结合的长表达式复用目标寄存器, 不会因为嵌套层数耗尽寄存器
+	p, err := compileString("local x = 1\nreturn x" + strings.Repeat(" + x", 300))
+	assert.NoError(t, err)
+	assert.NoError(t, types.Verify(p))
+	assert.True(t, p.MaxStackSize <= 3)
+
+	// 错误信息报告寄存器耗尽的行, 而不是函数定义的行
+	_, err = compileString("local x = 1\n\nprint(" + strings.Repeat("x, ", 300) + "x)")
+	assert.EqualError(t, err, "function or expression at line 3 needs more than 255 registers")
+}
+
+func TestCompileErrors(t *testing.T) {
+	_, err := compileString("break")
+	assert.Error(t, err)
+	_, err = compileString("goto done")
+	assert.Error(t, err)
+	_, err = compileString("::a:: ::a::")
+	assert.Error(t, err)
+	_, err = compileString("goto skip\nlocal x = 1\n::skip:: print(x)")
+	assert.Error(t, err)
+	_, err = compileString("function f() return ... end")
+	assert.Error(t, err)
+	_, err = compileString("while true do if x then goto continue end ::continue:: end")
+	assert.NoError(t, err)
+}
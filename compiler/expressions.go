@@ -0,0 +1,533 @@
+package compiler
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Salpadding/lua/ast"
+	"github.com/Salpadding/lua/token"
+	"github.com/Salpadding/lua/types"
+	"github.com/Salpadding/lua/types/code"
+)
+
+var arithmeticOps = map[token.Type]code.Type{
+	token.Plus:          code.Add,
+	token.Minus:         code.Sub,
+	token.Asterisk:      code.Mul,
+	token.Divide:        code.Div,
+	token.IntegerDivide: code.IDiv,
+	token.Modular:       code.Mod,
+	token.Power:         code.Pow,
+	token.BitwiseAnd:    code.BitwiseAnd,
+	token.BitwiseOr:     code.BitwiseOr,
+	token.Wave:          code.BitwiseXor,
+	token.LeftShift:     code.ShiftLeft,
+	token.RightShift:    code.ShiftRight,
+}
+
+var unaryOps = map[token.Type]code.Type{
+	token.Minus:      code.UnaryMinus,
+	token.LogicalNot: code.LogicalNot,
+	token.Len:        code.Len,
+	token.Wave:       code.BitwiseNot,
+}
+
+// comparison 描述比较运算符对应的指令, swap 表示交换左右操作数
+type comparison struct {
+	op   code.Type
+	a    int
+	swap bool
+}
+
+var comparisonOps = map[token.Type]comparison{
+	token.Equal:              {op: code.Equal, a: 1},
+	token.NotEqual:           {op: code.Equal, a: 0},
+	token.LessThan:           {op: code.LessThan, a: 1},
+	token.LessThanOrEqual:    {op: code.LessThanOrEqual, a: 1},
+	token.GreaterThan:        {op: code.LessThan, a: 1, swap: true},
+	token.GreaterThanOrEqual: {op: code.LessThanOrEqual, a: 1, swap: true},
+}
+
+var errVarargOutsideVararg = errors.New("cannot use '...' outside a vararg function")
+
+// isMultiValued 判断表达式是否可能产生多个值
+func isMultiValued(exp ast.Expression) bool {
+	switch exp.(type) {
+	case *ast.FunctionCall, ast.Vararg:
+		return true
+	}
+	return false
+}
+
+// expression 把表达式的 n 个值放到寄存器 R(a), ..., R(a+n-1) 中,
+// n 为 -1 时保留函数调用或者 ... 的全部返回值
+func (f *function) expression(exp ast.Expression, a, n int) error {
+	switch e := exp.(type) {
+	case *ast.FunctionCall:
+		return f.callExpression(e, a, n)
+	case ast.Vararg:
+		if !f.isVararg {
+			return errVarargOutsideVararg
+		}
+		f.emitABC(code.VarArg, a, n+1, 0)
+		return nil
+	}
+	if n == 0 {
+		// 不需要值的表达式仍然要求值
+		mark := f.usedRegs
+		err := f.singleValue(exp, f.allocReg())
+		f.usedRegs = mark
+		return err
+	}
+	if err := f.singleValue(exp, a); err != nil {
+		return err
+	}
+	f.emitLoadNil(a+1, n-1)
+	return nil
+}
+
+// callExpression 编译函数调用, 函数和参数需要占用 R(a) 之上连续的寄存器,
+// 如果 R(a) 之上还有其他正在使用的寄存器, 先调用再把返回值移动到 R(a)
+func (f *function) callExpression(e *ast.FunctionCall, a, n int) error {
+	width := n
+	if width < 1 {
+		width = 1
+	}
+	if a+width >= f.usedRegs {
+		return f.call(e, a, n)
+	}
+	mark := f.usedRegs
+	tmp := f.allocRegs(width)
+	if err := f.call(e, tmp, n); err != nil {
+		return err
+	}
+	for i := 0; i < n; i++ {
+		f.emitABC(code.Move, a+i, tmp+i, 0)
+	}
+	f.usedRegs = mark
+	return nil
+}
+
+// singleValue 把表达式的第一个值放到 R(a) 中
+func (f *function) singleValue(exp ast.Expression, a int) error {
+	switch e := exp.(type) {
+	case *ast.Nil:
+		f.emitLoadNil(a, 1)
+	case ast.Boolean:
+		b := 0
+		if e {
+			b = 1
+		}
+		f.emitABC(code.LoadBool, a, b, 0)
+	case ast.Integer:
+		f.emitLoadK(a, types.Integer(e))
+	case ast.Number:
+		f.emitLoadK(a, types.Float(e))
+	case ast.String:
+		f.emitLoadK(a, types.String(e))
+	case ast.Vararg:
+		return f.expression(e, a, 1)
+	case *ast.FunctionCall:
+		return f.callExpression(e, a, 1)
+	case *ast.Parenthesized:
+		return f.singleValue(e.Expression, a)
+	case *ast.Function:
+		return f.closure(e, a)
+	case ast.Table:
+		return f.table(e, a)
+	case ast.Identifier:
+		return f.name(string(e), a)
+	case *ast.TableAccess:
+		return f.tableAccess(e, a)
+	case *ast.PrefixExpression:
+		return f.prefix(e, a)
+	case *ast.InfixExpression:
+		return f.infix(e, a)
+	default:
+		return fmt.Errorf("unexpected expression %s at line %d", exp.String(), f.line)
+	}
+	return nil
+}
+
+// register 返回保存表达式值的寄存器, 局部变量直接使用其所在的寄存器
+func (f *function) register(exp ast.Expression) (int, error) {
+	if id, ok := exp.(ast.Identifier); ok {
+		if slot := f.localSlot(string(id)); slot >= 0 {
+			return slot, nil
+		}
+	}
+	r := f.allocReg()
+	return r, f.singleValue(exp, r)
+}
+
+// rk 返回表达式的 RK 编码, 常量索引不超过 0xff 时直接使用常量
+func (f *function) rk(exp ast.Expression) (int, error) {
+	var v types.Value
+	switch e := exp.(type) {
+	case ast.Integer:
+		v = types.Integer(e)
+	case ast.Number:
+		v = types.Float(e)
+	case ast.String:
+		v = types.String(e)
+	}
+	if v != nil {
+		if idx := f.constantIndex(v); idx <= maxRK {
+			return idx | 0x100, nil
+		}
+	}
+	return f.register(exp)
+}
+
+// leftRK 返回二元运算左操作数的 RK 编码, R(a) 不是局部变量时直接把左操作数放到 R(a) 中,
+// 这样左结合的长表达式只占用一个寄存器
+func (f *function) leftRK(exp ast.Expression, a int) (int, error) {
+	switch exp.(type) {
+	case ast.Integer, ast.Number, ast.String, ast.Identifier:
+		return f.rk(exp)
+	}
+	if a < len(f.active) {
+		return f.rk(exp)
+	}
+	return a, f.singleValue(exp, a)
+}
+
+// constantRK 返回常量的 RK 编码
+func (f *function) constantRK(v types.Value) int {
+	if idx := f.constantIndex(v); idx <= maxRK {
+		return idx | 0x100
+	}
+	r := f.allocReg()
+	f.emitLoadK(r, v)
+	return r
+}
+
+// name 读取变量, 依次查找局部变量, upvalue 和全局变量
+func (f *function) name(name string, a int) error {
+	if slot := f.localSlot(name); slot >= 0 {
+		if slot != a {
+			f.emitABC(code.Move, a, slot, 0)
+		}
+		return nil
+	}
+	if idx := f.upValueIndex(name); idx >= 0 {
+		f.emitABC(code.GetUpValue, a, idx, 0)
+		return nil
+	}
+	// 全局变量 x 等价于 _ENV.x
+	mark := f.usedRegs
+	defer func() { f.usedRegs = mark }()
+	k := f.constantRK(types.String(name))
+	if slot := f.localSlot(envName); slot >= 0 {
+		f.emitABC(code.GetTable, a, slot, k)
+		return nil
+	}
+	f.emitABC(code.GetTableUpValue, a, f.upValueIndex(envName), k)
+	return nil
+}
+
+// R(a) := t[k]
+func (f *function) tableAccess(e *ast.TableAccess, a int) error {
+	mark := f.usedRegs
+	defer func() { f.usedRegs = mark }()
+	t, err := f.register(e.Left)
+	if err != nil {
+		return err
+	}
+	k, err := f.rk(e.Index)
+	if err != nil {
+		return err
+	}
+	f.emitABC(code.GetTable, a, t, k)
+	return nil
+}
+
+func (f *function) prefix(e *ast.PrefixExpression, a int) error {
+	op := e.Operator.Type()
+	// 常量折叠负数字面量
+	if op == token.Minus {
+		switch x := e.Right.(type) {
+		case ast.Integer:
+			f.emitLoadK(a, types.Integer(-x))
+			return nil
+		case ast.Number:
+			f.emitLoadK(a, types.Float(-x))
+			return nil
+		}
+	}
+	mark := f.usedRegs
+	defer func() { f.usedRegs = mark }()
+	b, err := f.register(e.Right)
+	if err != nil {
+		return err
+	}
+	f.emitABC(unaryOps[op], a, b, 0)
+	return nil
+}
+
+func (f *function) infix(e *ast.InfixExpression, a int) error {
+	op := e.Operator.Type()
+	switch op {
+	case token.LogicalAnd, token.LogicalOr:
+		return f.logical(e, a)
+	case token.Concat:
+		return f.concat(e, a)
+	}
+	mark := f.usedRegs
+	defer func() { f.usedRegs = mark }()
+	b, err := f.leftRK(e.Left, a)
+	if err != nil {
+		return err
+	}
+	c, err := f.rk(e.Right)
+	if err != nil {
+		return err
+	}
+	if arith, ok := arithmeticOps[op]; ok {
+		f.emitABC(arith, a, b, c)
+		return nil
+	}
+	cmp, ok := comparisonOps[op]
+	if !ok {
+		return fmt.Errorf("unexpected operator %s at line %d", e.Operator.String(), f.line)
+	}
+	if cmp.swap {
+		b, c = c, b
+	}
+	// if ((RK(B) op RK(C)) ~= A) then pc++
+	f.emitABC(cmp.op, cmp.a, b, c)
+	f.emitAsBx(code.Jmp, 0, 1)
+	f.emitABC(code.LoadBool, a, 0, 1)
+	f.emitABC(code.LoadBool, a, 1, 0)
+	return nil
+}
+
+// a and b, a or b 短路求值
+func (f *function) logical(e *ast.InfixExpression, a int) error {
+	if err := f.singleValue(e.Left, a); err != nil {
+		return err
+	}
+	// and: R(a) 为假时跳过右操作数, or: R(a) 为真时跳过右操作数
+	c := 0
+	if e.Operator.Type() == token.LogicalOr {
+		c = 1
+	}
+	f.emitABC(code.Test, a, 0, c)
+	jmp := f.emitJmp(0)
+	if err := f.singleValue(e.Right, a); err != nil {
+		return err
+	}
+	f.fixJmpHere(jmp)
+	return nil
+}
+
+// a .. b .. c 的操作数需要放在连续的寄存器中
+func (f *function) concat(e *ast.InfixExpression, a int) error {
+	var operands []ast.Expression
+	var exp ast.Expression = e
+	for {
+		infix, ok := exp.(*ast.InfixExpression)
+		if !ok || infix.Operator.Type() != token.Concat {
+			operands = append(operands, exp)
+			break
+		}
+		operands = append(operands, infix.Left)
+		exp = infix.Right
+	}
+	mark := f.usedRegs
+	defer func() { f.usedRegs = mark }()
+	first := f.usedRegs
+	for _, op := range operands {
+		if err := f.singleValue(op, f.allocReg()); err != nil {
+			return err
+		}
+	}
+	f.emitABC(code.Concat, a, first, f.usedRegs-1)
+	return nil
+}
+
+// call 编译函数调用, R(a) 之上的寄存器都可以用来存放参数
+func (f *function) call(e *ast.FunctionCall, a, n int) error {
+	mark := f.usedRegs
+	defer func() { f.usedRegs = mark }()
+	f.usedRegs = a
+	f.allocReg()
+	nArgs := 0
+	if e.Self != nil {
+		obj, err := f.register(e.Self)
+		if err != nil {
+			return err
+		}
+		f.usedRegs = a + 2
+		if f.usedRegs > f.maxRegs {
+			f.maxRegs = f.usedRegs
+		}
+		name, ok := e.Function.(ast.Identifier)
+		if !ok {
+			return fmt.Errorf("unexpected method name %s at line %d", e.Function.String(), f.line)
+		}
+		f.emitABC(code.Self, a, obj, f.constantRK(types.String(name)))
+		nArgs++
+	} else if err := f.singleValue(e.Function, a); err != nil {
+		return err
+	}
+	var args []ast.Expression
+	switch x := e.Args.(type) {
+	case ast.Expressions:
+		args = x
+	case nil:
+	default:
+		args = []ast.Expression{x.(ast.Expression)}
+	}
+	b := 0
+	for i, arg := range args {
+		r := f.allocReg()
+		if i == len(args)-1 && isMultiValued(arg) {
+			if err := f.expression(arg, r, -1); err != nil {
+				return err
+			}
+			b = -1
+			continue
+		}
+		if err := f.singleValue(arg, r); err != nil {
+			return err
+		}
+	}
+	nArgs += len(args)
+	if b == 0 {
+		b = nArgs + 1
+	} else {
+		b = 0
+	}
+	f.emitABC(code.Call, a, b, n+1)
+	return nil
+}
+
+// R(a) := closure(KPROTO[Bx])
+func (f *function) closure(e *ast.Function, a int) error {
+	child := newFunction(f, f.source)
+	child.lineDefined = e.Line
+	child.lastLineDefined = e.LastLine
+	child.line = e.Line
+	f.children = append(f.children, child)
+	if err := child.body(e.Parameters, e.Body, e.LastLine); err != nil {
+		return err
+	}
+	f.emitABx(code.Closure, a, len(f.children)-1)
+	return nil
+}
+
+// body 编译函数体, 参数依次占用最低的寄存器
+func (f *function) body(params []ast.Parameter, body *ast.Block, lastLine int) error {
+	f.enterScope(false)
+	for _, param := range params {
+		switch p := param.(type) {
+		case ast.Identifier:
+			f.allocReg()
+			f.addLocal(string(p))
+			f.numParams++
+		case ast.Vararg:
+			f.isVararg = true
+		}
+	}
+	if err := f.block(body); err != nil {
+		return err
+	}
+	// 和 luac 一样, 参数在最后的 RETURN 之后才失效
+	f.line = lastLine
+	f.emitABC(code.Return, 0, 1, 0)
+	return f.exitScope()
+}
+
+// R(a) := { ... }
+func (f *function) table(tb ast.Table, a int) error {
+	nArray, nHash := 0, 0
+	for _, kv := range tb {
+		if kv.Key == nil {
+			nArray++
+		} else {
+			nHash++
+		}
+	}
+	// 数组部分的值放在 R(a) 之上, 每 fieldsPerFlush 个用 SETLIST 写入一次
+	mark := f.usedRegs
+	defer func() { f.usedRegs = mark }()
+	if a+1 < f.usedRegs {
+		tmp := f.allocReg()
+		if err := f.table(tb, tmp); err != nil {
+			return err
+		}
+		f.emitABC(code.Move, a, tmp, 0)
+		return nil
+	}
+	f.emitABC(code.NewTable, a, int2fb(nArray), int2fb(nHash))
+	f.usedRegs = a + 1
+	pending, batch, multiple := 0, 0, false
+	for i, kv := range tb {
+		if kv.Key != nil {
+			keep := f.usedRegs
+			k, err := f.rk(kv.Key)
+			if err != nil {
+				return err
+			}
+			v, err := f.rk(kv.Value)
+			if err != nil {
+				return err
+			}
+			f.emitABC(code.SetTable, a, k, v)
+			f.usedRegs = keep
+			continue
+		}
+		r := f.allocReg()
+		pending++
+		if i == len(tb)-1 && isMultiValued(kv.Value) {
+			if err := f.expression(kv.Value, r, -1); err != nil {
+				return err
+			}
+			multiple = true
+			break
+		}
+		if err := f.singleValue(kv.Value, r); err != nil {
+			return err
+		}
+		if pending == fieldsPerFlush {
+			batch++
+			f.setList(a, pending, batch)
+			pending = 0
+			f.usedRegs = a + 1
+		}
+	}
+	if multiple {
+		f.setList(a, 0, batch+1)
+	} else if pending > 0 {
+		f.setList(a, pending, batch+1)
+	}
+	return nil
+}
+
+// R(A)[(C-1)*FPF+i] := R(A+i), 1 <= i <= B
+func (f *function) setList(a, b, c int) {
+	if c <= 0x1ff {
+		f.emitABC(code.SetList, a, b, c)
+		return
+	}
+	f.emitABC(code.SetList, a, b, 0)
+	f.emit(code.CreateAx(code.ExtraArg, c))
+}
+
+// int2fb 把整数编码成 NEWTABLE 使用的浮点字节 eeeeexxx
+func int2fb(x int) int {
+	e := 0
+	if x < 8 {
+		return x
+	}
+	for x >= 8<<4 {
+		x = (x + 0xf) >> 4
+		e += 4
+	}
+	for x >= 8<<1 {
+		x = (x + 1) >> 1
+		e++
+	}
+	return ((e + 1) << 3) | (x - 8)
+}
@@ -0,0 +1,394 @@
+package compiler
+
+import (
+	"fmt"
+
+	"github.com/Salpadding/lua/types"
+	"github.com/Salpadding/lua/types/code"
+)
+
+const (
+	maxRegisters   = 255
+	maxUpValues    = 255
+	maxRK          = 0xff
+	fieldsPerFlush = 50
+)
+
+// localVariable 是函数中声明的局部变量
+type localVariable struct {
+	name     string
+	slot     int  // 寄存器索引
+	startPC  int  // 变量生效的第一条指令
+	endPC    int  // 变量失效的第一条指令
+	captured bool // 是否被闭包捕获
+}
+
+// upValue 是函数引用的外部变量
+type upValue struct {
+	name    string
+	index   int
+	inStack bool // true 表示捕获外层函数的局部变量, 否则捕获外层函数的 upvalue
+	idx     int
+}
+
+type label struct {
+	name   string
+	pc     int
+	active int // 标签处活跃的局部变量数量
+	line   int
+}
+
+// scope 是一个语法块
+type scope struct {
+	active     int      // 进入语法块时活跃的局部变量数量
+	firstLocal int      // 语法块中声明的第一个局部变量在 locals 中的索引
+	breakable  bool     // 是否是循环
+	breaks     []int    // 待回填的 break 跳转
+	labels     []*label // 语法块中声明的标签
+	gotos      []*label // 待回填的 goto 跳转
+}
+
+// function 保存编译一个函数原型时的状态
+type function struct {
+	parent    *function
+	children  []*function
+	source    string
+	usedRegs  int
+	maxRegs   int
+	scopes    []*scope
+	locals    []*localVariable // 所有声明过的局部变量, 用于调试信息
+	active    []*localVariable // 当前活跃的局部变量
+	upValues  []*upValue
+	upNames   map[string]*upValue
+	constants []types.Value
+	constMap  map[types.Value]int
+	code      []code.Instruction
+	lines     []uint32
+	line      int // 当前正在编译的行号
+	regsLine  int // 寄存器数量第一次超过上限时的行号
+	numParams int
+	isVararg  bool
+
+	lineDefined     int
+	lastLineDefined int
+}
+
+func newFunction(parent *function, source string) *function {
+	return &function{
+		parent:   parent,
+		source:   source,
+		upNames:  map[string]*upValue{},
+		constMap: map[types.Value]int{},
+	}
+}
+
+func (f *function) emit(ins code.Instruction) int {
+	f.code = append(f.code, ins)
+	f.lines = append(f.lines, uint32(f.line))
+	return len(f.code) - 1
+}
+
+func (f *function) emitABC(op code.Type, a, b, c int) int {
+	return f.emit(code.CreateABC(op, a, b, c))
+}
+
+func (f *function) emitABx(op code.Type, a, bx int) int {
+	return f.emit(code.CreateABx(op, a, bx))
+}
+
+func (f *function) emitAsBx(op code.Type, a, sbx int) int {
+	return f.emit(code.CreateAsBx(op, a, sbx))
+}
+
+// emitJmp 生成跳转指令, 跳转偏移量由 fixJmp 回填
+func (f *function) emitJmp(a int) int {
+	return f.emitAsBx(code.Jmp, a, 0)
+}
+
+// fixJmp 把 pc 处的跳转指令的目标设置为 target
+func (f *function) fixJmp(pc, target int) {
+	ins := f.code[pc]
+	a, _ := ins.AsBx()
+	f.code[pc] = code.CreateAsBx(ins.Opcode().Type, a, target-pc-1)
+}
+
+// fixJmpHere 把 pc 处的跳转指令的目标设置为下一条指令
+func (f *function) fixJmpHere(pc int) {
+	f.fixJmp(pc, len(f.code))
+}
+
+func (f *function) emitLoadK(a int, v types.Value) {
+	idx := f.constantIndex(v)
+	if idx <= code.MaxArgBx {
+		f.emitABx(code.LoadK, a, idx)
+		return
+	}
+	f.emitABx(code.LoadKX, a, 0)
+	f.emit(code.CreateAx(code.ExtraArg, idx))
+}
+
+func (f *function) emitLoadNil(a, n int) {
+	if n > 0 {
+		f.emitABC(code.LoadNil, a, n-1, 0)
+	}
+}
+
+func (f *function) constantIndex(v types.Value) int {
+	if idx, ok := f.constMap[v]; ok {
+		return idx
+	}
+	idx := len(f.constants)
+	f.constants = append(f.constants, v)
+	f.constMap[v] = idx
+	return idx
+}
+
+func (f *function) allocReg() int {
+	f.usedRegs++
+	if f.usedRegs > f.maxRegs {
+		f.maxRegs = f.usedRegs
+		if f.maxRegs == maxRegisters+1 {
+			f.regsLine = f.line
+		}
+	}
+	return f.usedRegs - 1
+}
+
+func (f *function) allocRegs(n int) int {
+	for i := 0; i < n; i++ {
+		f.allocReg()
+	}
+	return f.usedRegs - n
+}
+
+func (f *function) freeRegs(n int) {
+	f.usedRegs -= n
+}
+
+func (f *function) enterScope(breakable bool) {
+	f.scopes = append(f.scopes, &scope{
+		active:     len(f.active),
+		firstLocal: len(f.locals),
+		breakable:  breakable,
+	})
+}
+
+// exitScope 离开语法块, 关闭块中被捕获的局部变量, 回填 break 和 goto
+func (f *function) exitScope() error {
+	s := f.scopes[len(f.scopes)-1]
+	f.scopes = f.scopes[:len(f.scopes)-1]
+
+	closeFrom := f.capturedFrom(s.active)
+	if closeFrom >= 0 && len(f.scopes) > 0 {
+		f.emitJmp(closeFrom + 1)
+	}
+	// break 跳出循环时, 循环中声明过的局部变量可能已经失效, 需要在 locals 中查找
+	breakClose := false
+	for _, v := range f.locals[s.firstLocal:] {
+		breakClose = breakClose || v.captured
+	}
+	for _, pc := range s.breaks {
+		f.fixJmpHere(pc)
+		if breakClose {
+			f.setJmpClose(pc, s.active)
+		}
+	}
+	if err := f.resolveGotos(s); err != nil {
+		return err
+	}
+	f.removeLocals(s.active)
+	return nil
+}
+
+// capturedFrom 返回第 from 个活跃局部变量之后第一个被捕获的变量的寄存器, 没有则返回 -1
+func (f *function) capturedFrom(from int) int {
+	for _, v := range f.active[from:] {
+		if v.captured {
+			return v.slot
+		}
+	}
+	return -1
+}
+
+// setJmpClose 设置跳转指令的 A 参数, 跳转时关闭 R(reg) 以上的 upvalue
+func (f *function) setJmpClose(pc, reg int) {
+	_, sBx := f.code[pc].AsBx()
+	f.code[pc] = code.CreateAsBx(code.Jmp, reg+1, sBx)
+}
+
+func (f *function) resolveGotos(s *scope) error {
+	var pending []*label
+	for _, g := range s.gotos {
+		l := s.findLabel(g.name)
+		if l == nil {
+			pending = append(pending, g)
+			continue
+		}
+		if l.active > g.active {
+			return fmt.Errorf("<goto %s> at line %d jumps into the scope of local '%s'", g.name, g.line, f.active[g.active].name)
+		}
+		f.fixJmp(g.pc, l.pc)
+		if l.active < g.active {
+			f.setJmpClose(g.pc, f.active[l.active].slot)
+		}
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	if len(f.scopes) == 0 {
+		g := pending[0]
+		return fmt.Errorf("no visible label '%s' for goto at line %d", g.name, g.line)
+	}
+	// 交给外层语法块处理, 跳出语法块时需要关闭其中的局部变量
+	outer := f.scopes[len(f.scopes)-1]
+	for _, g := range pending {
+		if g.active > s.active {
+			g.active = s.active
+			if from := f.capturedFrom(s.active); from >= 0 {
+				f.setJmpClose(g.pc, from)
+			}
+		}
+		outer.gotos = append(outer.gotos, g)
+	}
+	return nil
+}
+
+func (s *scope) findLabel(name string) *label {
+	for _, l := range s.labels {
+		if l.name == name {
+			return l
+		}
+	}
+	return nil
+}
+
+// addLocal 声明一个新的局部变量, 占用下一个寄存器
+func (f *function) addLocal(name string) *localVariable {
+	v := &localVariable{
+		name:    name,
+		slot:    len(f.active),
+		startPC: len(f.code),
+	}
+	f.locals = append(f.locals, v)
+	f.active = append(f.active, v)
+	return v
+}
+
+// removeLocals 使第 from 个之后的局部变量失效并释放寄存器
+func (f *function) removeLocals(from int) {
+	for _, v := range f.active[from:] {
+		v.endPC = len(f.code)
+	}
+	f.active = f.active[:from]
+	f.usedRegs = from
+}
+
+// localSlot 查找局部变量的寄存器, 找不到返回 -1
+func (f *function) localSlot(name string) int {
+	v := f.findLocal(name)
+	if v == nil {
+		return -1
+	}
+	return v.slot
+}
+
+func (f *function) findLocal(name string) *localVariable {
+	for i := len(f.active) - 1; i >= 0; i-- {
+		if f.active[i].name == name {
+			return f.active[i]
+		}
+	}
+	return nil
+}
+
+// upValueIndex 查找或者创建 upvalue, 找不到返回 -1
+func (f *function) upValueIndex(name string) int {
+	if uv, ok := f.upNames[name]; ok {
+		return uv.index
+	}
+	if f.parent == nil {
+		return -1
+	}
+	if v := f.parent.findLocal(name); v != nil {
+		v.captured = true
+		return f.addUpValue(name, true, v.slot)
+	}
+	if idx := f.parent.upValueIndex(name); idx >= 0 {
+		return f.addUpValue(name, false, idx)
+	}
+	return -1
+}
+
+func (f *function) addUpValue(name string, inStack bool, idx int) int {
+	uv := &upValue{
+		name:    name,
+		index:   len(f.upValues),
+		inStack: inStack,
+		idx:     idx,
+	}
+	f.upValues = append(f.upValues, uv)
+	f.upNames[name] = uv
+	return uv.index
+}
+
+func (f *function) loopScope() *scope {
+	for i := len(f.scopes) - 1; i >= 0; i-- {
+		if f.scopes[i].breakable {
+			return f.scopes[i]
+		}
+	}
+	return nil
+}
+
+func (f *function) currentScope() *scope {
+	return f.scopes[len(f.scopes)-1]
+}
+
+func (f *function) toPrototype() (*types.Prototype, error) {
+	if f.maxRegs > maxRegisters {
+		return nil, fmt.Errorf("function or expression at line %d needs more than %d registers", f.regsLine, maxRegisters)
+	}
+	if len(f.upValues) > maxUpValues {
+		return nil, fmt.Errorf("function at line %d has more than %d upvalues", f.lineDefined, maxUpValues)
+	}
+	proto := &types.Prototype{
+		Source:          f.source,
+		LineDefined:     uint32(f.lineDefined),
+		LastLineDefined: uint32(f.lastLineDefined),
+		NumParams:       byte(f.numParams),
+		IsVararg:        f.isVararg,
+		MaxStackSize:    byte(f.maxRegs),
+		Code:            f.code,
+		Constants:       f.constants,
+		UpValues:        make([]types.UpValue, len(f.upValues)),
+		Prototypes:      make([]*types.Prototype, len(f.children)),
+		LineInfo:        f.lines,
+		LocalVariables:  make([]*types.LocalVariable, len(f.locals)),
+		UpValueNames:    make([]string, len(f.upValues)),
+	}
+	if proto.MaxStackSize < 2 {
+		proto.MaxStackSize = 2
+	}
+	for i, uv := range f.upValues {
+		if uv.inStack {
+			proto.UpValues[i][0] = 1
+		}
+		proto.UpValues[i][1] = byte(uv.idx)
+		proto.UpValueNames[i] = uv.name
+	}
+	for i, child := range f.children {
+		p, err := child.toPrototype()
+		if err != nil {
+			return nil, err
+		}
+		proto.Prototypes[i] = p
+	}
+	for i, v := range f.locals {
+		proto.LocalVariables[i] = &types.LocalVariable{
+			Name:    v.name,
+			StartPC: uint32(v.startPC),
+			EndPC:   uint32(v.endPC),
+		}
+	}
+	return proto, nil
+}
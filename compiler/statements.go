@@ -0,0 +1,491 @@
+package compiler
+
+import (
+	"fmt"
+
+	"github.com/Salpadding/lua/ast"
+	"github.com/Salpadding/lua/types"
+	"github.com/Salpadding/lua/types/code"
+)
+
+// block 编译语法块中的语句, 调用者负责进入和离开作用域
+func (f *function) block(blk *ast.Block) error {
+	for i, stmt := range blk.Statements {
+		if i < len(blk.Lines) {
+			f.line = blk.Lines[i]
+		}
+		if l, ok := stmt.(ast.Label); ok {
+			if err := f.label(string(l), isBlockEnd(blk, i)); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := f.statement(stmt); err != nil {
+			return err
+		}
+		// 语句结束后只有局部变量占用寄存器
+		f.usedRegs = len(f.active)
+	}
+	if blk.Return != nil {
+		f.line = blk.Return.Line
+		return f.returnStatement(blk.Return)
+	}
+	return nil
+}
+
+// isBlockEnd 判断第 i 条语句之后是否只有标签和空语句
+func isBlockEnd(blk *ast.Block, i int) bool {
+	if blk.Return != nil {
+		return false
+	}
+	for _, stmt := range blk.Statements[i+1:] {
+		switch stmt.(type) {
+		case ast.Label, ast.Empty:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func (f *function) statement(stmt ast.Statement) error {
+	switch s := stmt.(type) {
+	case ast.Empty:
+		return nil
+	case ast.Break:
+		return f.breakStatement()
+	case ast.Goto:
+		return f.gotoStatement(string(s))
+	case *ast.FunctionCall:
+		return f.expression(s, f.allocReg(), 0)
+	case *ast.Block:
+		f.enterScope(false)
+		if err := f.block(s); err != nil {
+			return err
+		}
+		return f.exitScope()
+	case *ast.While:
+		return f.whileStatement(s)
+	case *ast.Repeat:
+		return f.repeatStatement(s)
+	case *ast.If:
+		return f.ifStatement(s)
+	case *ast.For:
+		return f.forNum(s)
+	case *ast.ForIn:
+		return f.forIn(s)
+	case *ast.LocalAssign:
+		return f.localAssign(s)
+	case *ast.LocalFunction:
+		return f.localFunction(s)
+	case *ast.Function:
+		return f.assign(&ast.Assign{
+			Vars:   []ast.Expression{s.Name},
+			Values: []ast.Expression{s},
+		})
+	case *ast.Assign:
+		return f.assign(s)
+	default:
+		return fmt.Errorf("unexpected statement %s at line %d", stmt.String(), f.line)
+	}
+}
+
+func (f *function) breakStatement() error {
+	s := f.loopScope()
+	if s == nil {
+		return fmt.Errorf("break at line %d not inside a loop", f.line)
+	}
+	s.breaks = append(s.breaks, f.emitJmp(0))
+	return nil
+}
+
+func (f *function) gotoStatement(name string) error {
+	s := f.currentScope()
+	s.gotos = append(s.gotos, &label{
+		name:   name,
+		pc:     f.emitJmp(0),
+		active: len(f.active),
+		line:   f.line,
+	})
+	return nil
+}
+
+// label 声明标签, 位于语法块末尾的标签不在块中局部变量的作用域内
+func (f *function) label(name string, atEnd bool) error {
+	for _, s := range f.scopes {
+		if l := s.findLabel(name); l != nil {
+			return fmt.Errorf("label '%s' already defined on line %d", name, l.line)
+		}
+	}
+	s := f.currentScope()
+	active := len(f.active)
+	if atEnd {
+		active = s.active
+	}
+	s.labels = append(s.labels, &label{
+		name:   name,
+		pc:     len(f.code),
+		active: active,
+		line:   f.line,
+	})
+	return nil
+}
+
+// jumpIfFalse 计算条件表达式, 条件为假时跳转, 返回需要回填的跳转指令
+func (f *function) jumpIfFalse(cond ast.Expression) (int, error) {
+	mark := f.usedRegs
+	defer func() { f.usedRegs = mark }()
+	if e, ok := cond.(*ast.InfixExpression); ok {
+		if cmp, ok := comparisonOps[e.Operator.Type()]; ok {
+			b, err := f.rk(e.Left)
+			if err != nil {
+				return 0, err
+			}
+			c, err := f.rk(e.Right)
+			if err != nil {
+				return 0, err
+			}
+			if cmp.swap {
+				b, c = c, b
+			}
+			// 条件成立时跳过之后的 JMP
+			f.emitABC(cmp.op, 1-cmp.a, b, c)
+			return f.emitJmp(0), nil
+		}
+	}
+	r, err := f.register(cond)
+	if err != nil {
+		return 0, err
+	}
+	f.emitABC(code.Test, r, 0, 0)
+	return f.emitJmp(0), nil
+}
+
+func (f *function) whileStatement(s *ast.While) error {
+	f.enterScope(true)
+	start := len(f.code)
+	exit, err := f.jumpIfFalse(s.Condition)
+	if err != nil {
+		return err
+	}
+	f.enterScope(false)
+	if err := f.block(s.Body); err != nil {
+		return err
+	}
+	if err := f.exitScope(); err != nil {
+		return err
+	}
+	f.fixJmp(f.emitJmp(0), start)
+	f.fixJmpHere(exit)
+	return f.exitScope()
+}
+
+// repeat 的条件可以访问循环体中的局部变量
+func (f *function) repeatStatement(s *ast.Repeat) error {
+	f.enterScope(true)
+	start := len(f.code)
+	f.enterScope(false)
+	if err := f.block(s.Body); err != nil {
+		return err
+	}
+	back, err := f.jumpIfFalse(s.Condition)
+	if err != nil {
+		return err
+	}
+	f.fixJmp(back, start)
+	if from := f.capturedFrom(f.currentScope().active); from >= 0 {
+		f.setJmpClose(back, from)
+	}
+	if err := f.exitScope(); err != nil {
+		return err
+	}
+	return f.exitScope()
+}
+
+func (f *function) ifStatement(s *ast.If) error {
+	branches := append([]*ast.Branch{s.Consequence}, s.Alternatives...)
+	var exits []int
+	for i, branch := range branches {
+		next, err := f.jumpIfFalse(branch.Condition)
+		if err != nil {
+			return err
+		}
+		f.enterScope(false)
+		if err := f.block(branch.Body); err != nil {
+			return err
+		}
+		if err := f.exitScope(); err != nil {
+			return err
+		}
+		if i < len(branches)-1 || s.Else != nil {
+			exits = append(exits, f.emitJmp(0))
+		}
+		f.fixJmpHere(next)
+	}
+	if s.Else != nil {
+		f.enterScope(false)
+		if err := f.block(s.Else); err != nil {
+			return err
+		}
+		if err := f.exitScope(); err != nil {
+			return err
+		}
+	}
+	for _, pc := range exits {
+		f.fixJmpHere(pc)
+	}
+	return nil
+}
+
+// for v = e1, e2, e3 do block end
+func (f *function) forNum(s *ast.For) error {
+	line := f.line
+	f.enterScope(true)
+	base := f.usedRegs
+	if err := f.singleValue(s.Start, f.allocReg()); err != nil {
+		return err
+	}
+	if err := f.singleValue(s.Stop, f.allocReg()); err != nil {
+		return err
+	}
+	step := s.Step
+	if step == nil {
+		step = ast.Integer(1)
+	}
+	if err := f.singleValue(step, f.allocReg()); err != nil {
+		return err
+	}
+	f.addLocal("(for index)")
+	f.addLocal("(for limit)")
+	f.addLocal("(for step)")
+	prep := f.emitAsBx(code.ForPrep, base, 0)
+
+	f.enterScope(false)
+	f.allocReg()
+	f.addLocal(string(s.Name))
+	if err := f.block(s.Body); err != nil {
+		return err
+	}
+	if err := f.exitScope(); err != nil {
+		return err
+	}
+	f.fixJmpHere(prep)
+	// 和 luac 一样, 循环指令使用 for 所在的行
+	f.line = line
+	loop := f.emitAsBx(code.ForLoop, base, 0)
+	f.fixJmp(loop, prep+1)
+	return f.exitScope()
+}
+
+// for k, v in explist do block end
+func (f *function) forIn(s *ast.ForIn) error {
+	line := f.line
+	f.enterScope(true)
+	base := f.usedRegs
+	f.allocRegs(3)
+	if err := f.expressions(s.Expressions, base, 3); err != nil {
+		return err
+	}
+	f.addLocal("(for generator)")
+	f.addLocal("(for state)")
+	f.addLocal("(for control)")
+	jmp := f.emitJmp(0)
+
+	f.enterScope(false)
+	f.allocRegs(len(s.NameList))
+	for _, name := range s.NameList {
+		f.addLocal(string(name))
+	}
+	if err := f.block(s.Body); err != nil {
+		return err
+	}
+	if err := f.exitScope(); err != nil {
+		return err
+	}
+	f.fixJmpHere(jmp)
+	// TFORCALL 和 TFORLOOP 也使用 for 所在的行
+	f.line = line
+	f.emitABC(code.TForCall, base, 0, len(s.NameList))
+	loop := f.emitAsBx(code.TForLoop, base+2, 0)
+	f.fixJmp(loop, jmp+1)
+	return f.exitScope()
+}
+
+// expressions 把表达式列表调整为 n 个值, 放到已经分配的寄存器 R(a), ..., R(a+n-1) 中
+func (f *function) expressions(exps []ast.Expression, a, n int) error {
+	mark := f.usedRegs
+	defer func() { f.usedRegs = mark }()
+	f.usedRegs = a
+	for i, exp := range exps {
+		last := i == len(exps)-1
+		switch {
+		case i >= n:
+			// 多余的表达式只求值
+			if err := f.expression(exp, f.allocReg(), 0); err != nil {
+				return err
+			}
+		case last && isMultiValued(exp):
+			r := f.allocRegs(n - i)
+			if err := f.expression(exp, r, n-i); err != nil {
+				return err
+			}
+		default:
+			if err := f.singleValue(exp, f.allocReg()); err != nil {
+				return err
+			}
+		}
+	}
+	if len(exps) < n && (len(exps) == 0 || !isMultiValued(exps[len(exps)-1])) {
+		f.emitLoadNil(a+len(exps), n-len(exps))
+	}
+	return nil
+}
+
+func (f *function) localAssign(s *ast.LocalAssign) error {
+	n := len(s.Identifiers)
+	base := f.usedRegs
+	f.allocRegs(n)
+	if err := f.expressions(s.Values, base, n); err != nil {
+		return err
+	}
+	for _, id := range s.Identifiers {
+		f.addLocal(string(id))
+	}
+	return nil
+}
+
+// local function f 在编译函数体之前声明局部变量, 使函数可以递归调用自身
+func (f *function) localFunction(s *ast.LocalFunction) error {
+	a := f.allocReg()
+	v := f.addLocal(string(s.Name))
+	if err := f.closure(s.Function, a); err != nil {
+		return err
+	}
+	v.startPC = len(f.code)
+	return nil
+}
+
+// assign 先计算所有右值, 再依次赋值给左值
+func (f *function) assign(s *ast.Assign) error {
+	mark := f.usedRegs
+	defer func() { f.usedRegs = mark }()
+
+	// 先计算左值中的表和键
+	type target struct {
+		slot  int // 局部变量
+		up    int // upvalue
+		table int
+		key   int
+		env   bool
+	}
+	targets := make([]target, len(s.Vars))
+	for i, v := range s.Vars {
+		t := target{slot: -1, up: -1}
+		switch x := v.(type) {
+		case ast.Identifier:
+			name := string(x)
+			if t.slot = f.localSlot(name); t.slot >= 0 {
+				break
+			}
+			if t.up = f.upValueIndex(name); t.up >= 0 {
+				break
+			}
+			t.key = f.constantRK(types.String(name))
+			if t.table = f.localSlot(envName); t.table < 0 {
+				t.env = true
+				t.table = f.upValueIndex(envName)
+			}
+		case *ast.TableAccess:
+			var err error
+			if t.table, err = f.register(x.Left); err != nil {
+				return err
+			}
+			if t.key, err = f.rk(x.Index); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("cannot assign to %s at line %d", v.String(), f.line)
+		}
+		targets[i] = t
+	}
+	// 被赋值的局部变量如果同时被用作表或者键, 需要先复制一份
+	for i := range targets {
+		for _, t := range targets {
+			if t.slot < 0 {
+				continue
+			}
+			if targets[i].slot < 0 && targets[i].up < 0 && !targets[i].env && targets[i].table == t.slot {
+				targets[i].table = f.allocReg()
+				f.emitABC(code.Move, targets[i].table, t.slot, 0)
+			}
+			if targets[i].slot < 0 && targets[i].up < 0 && targets[i].key == t.slot {
+				targets[i].key = f.allocReg()
+				f.emitABC(code.Move, targets[i].key, t.slot, 0)
+			}
+		}
+	}
+	n := len(s.Vars)
+	base := f.allocRegs(n)
+	if err := f.expressions(s.Values, base, n); err != nil {
+		return err
+	}
+	for i, t := range targets {
+		r := base + i
+		switch {
+		case t.slot >= 0:
+			f.emitABC(code.Move, t.slot, r, 0)
+		case t.up >= 0:
+			f.emitABC(code.SetUpValue, r, t.up, 0)
+		case t.env:
+			f.emitABC(code.SetTableUpValue, t.table, t.key, r)
+		default:
+			f.emitABC(code.SetTable, t.table, t.key, r)
+		}
+	}
+	return nil
+}
+
+func (f *function) returnStatement(s *ast.Return) error {
+	n := len(s.Values)
+	if n == 0 {
+		f.emitABC(code.Return, 0, 1, 0)
+		return nil
+	}
+	// 尾调用
+	if call, ok := s.Values[0].(*ast.FunctionCall); ok && n == 1 {
+		a := f.allocReg()
+		if err := f.expression(call, a, -1); err != nil {
+			return err
+		}
+		ins := f.code[len(f.code)-1]
+		_, b, _ := ins.ABC()
+		f.code[len(f.code)-1] = code.CreateABC(code.TailCall, a, b, 0)
+		f.emitABC(code.Return, a, 0, 0)
+		f.freeRegs(1)
+		return nil
+	}
+	if id, ok := s.Values[0].(ast.Identifier); ok && n == 1 {
+		if slot := f.localSlot(string(id)); slot >= 0 {
+			f.emitABC(code.Return, slot, 2, 0)
+			return nil
+		}
+	}
+	mark := f.usedRegs
+	defer func() { f.usedRegs = mark }()
+	a := f.usedRegs
+	for i, exp := range s.Values {
+		r := f.allocReg()
+		if i == n-1 && isMultiValued(exp) {
+			if err := f.expression(exp, r, -1); err != nil {
+				return err
+			}
+			f.emitABC(code.Return, a, 0, 0)
+			return nil
+		}
+		if err := f.singleValue(exp, r); err != nil {
+			return err
+		}
+	}
+	f.emitABC(code.Return, a, n+1, 0)
+	return nil
+}
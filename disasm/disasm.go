@@ -0,0 +1,291 @@
+// Package disasm 反汇编函数原型, 输出格式和 luac -l -l 相同
+package disasm
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/Salpadding/lua/types"
+	"github.com/Salpadding/lua/types/code"
+)
+
+// bitRK 表示 B 或者 C 参数是常量索引, 和 lua 的 BITRK 相同
+const bitRK = 1 << 8
+
+// Fprint 把函数原型 p 和内嵌的函数原型反汇编后写入 w,
+// full 为真时输出常量, 局部变量和 upvalue 表, 相当于 luac -l -l
+func Fprint(w io.Writer, p *types.Prototype, full bool) error {
+	if p.Version == types.LuaVersion54 {
+		return errors.New("disasm: Lua 5.4 instructions are not supported")
+	}
+	d := &printer{w: bufio.NewWriter(w), full: full}
+	d.function(p)
+	return d.w.Flush()
+}
+
+// String 返回 luac -l -l 格式的反汇编结果
+func String(p *types.Prototype) string {
+	var buf strings.Builder
+	Fprint(&buf, p, true)
+	return buf.String()
+}
+
+type printer struct {
+	w    *bufio.Writer
+	full bool
+}
+
+func (d *printer) printf(format string, args ...interface{}) {
+	fmt.Fprintf(d.w, format, args...)
+}
+
+func (d *printer) function(p *types.Prototype) {
+	d.header(p)
+	d.code(p)
+	if d.full {
+		d.debug(p)
+	}
+	for _, sub := range p.Prototypes {
+		d.function(sub)
+	}
+}
+
+func (d *printer) header(p *types.Prototype) {
+	source := p.Source
+	switch {
+	case source == "":
+		source = "?"
+	case source[0] == '@' || source[0] == '=':
+		source = source[1:]
+	case source[0] == types.LuaSignature[0]:
+		source = "(bstring)"
+	default:
+		source = "(string)"
+	}
+	kind := "function"
+	if p.LineDefined == 0 {
+		kind = "main"
+	}
+	d.printf("\n%s <%s:%d,%d> (%d instruction%s at %p)\n",
+		kind, source, p.LineDefined, p.LastLineDefined, len(p.Code), plural(len(p.Code)), p)
+	vararg := ""
+	if p.IsVararg {
+		vararg = "+"
+	}
+	d.printf("%d%s param%s, %d slot%s, %d upvalue%s, ",
+		p.NumParams, vararg, plural(int(p.NumParams)), p.MaxStackSize, plural(int(p.MaxStackSize)),
+		len(p.UpValues), plural(len(p.UpValues)))
+	d.printf("%d local%s, %d constant%s, %d function%s\n",
+		len(p.LocalVariables), plural(len(p.LocalVariables)), len(p.Constants), plural(len(p.Constants)),
+		len(p.Prototypes), plural(len(p.Prototypes)))
+}
+
+func (d *printer) code(p *types.Prototype) {
+	for pc := 0; pc < len(p.Code); pc++ {
+		ins := p.Code[pc]
+		op := ins.Opcode()
+		a, b, c := ins.ABC()
+		_, bx := ins.ABx()
+		_, sbx := ins.AsBx()
+		ax := ins.Ax()
+
+		d.printf("\t%d\t", pc+1)
+		if pc < len(p.LineInfo) {
+			d.printf("[%d]\t", p.LineInfo[pc])
+		} else {
+			d.printf("[-]\t")
+		}
+		d.printf("%-9s\t", strings.TrimSpace(op.Name))
+		switch op.OpMode {
+		case code.IABC:
+			d.printf("%d", a)
+			if op.ArgBMode != code.OpArgN {
+				d.printf(" %d", rk(b))
+			}
+			if op.ArgCMode != code.OpArgN {
+				d.printf(" %d", rk(c))
+			}
+		case code.IABx:
+			d.printf("%d", a)
+			switch op.ArgBMode {
+			case code.OpArgK:
+				d.printf(" %d", -1-bx)
+			case code.OpArgU:
+				d.printf(" %d", bx)
+			}
+		case code.IAsBx:
+			d.printf("%d %d", a, sbx)
+		case code.IAx:
+			d.printf("%d", -1-ax)
+		}
+
+		switch op.Type {
+		case code.LoadK:
+			d.printf("\t; %s", constant(p, bx))
+		case code.GetUpValue, code.SetUpValue:
+			d.printf("\t; %s", upValueName(p, b))
+		case code.GetTableUpValue:
+			d.printf("\t; %s", upValueName(p, b))
+			if c&bitRK != 0 {
+				d.printf(" %s", constant(p, c&^bitRK))
+			}
+		case code.SetTableUpValue:
+			d.printf("\t; %s", upValueName(p, a))
+			if b&bitRK != 0 {
+				d.printf(" %s", constant(p, b&^bitRK))
+			}
+			if c&bitRK != 0 {
+				d.printf(" %s", constant(p, c&^bitRK))
+			}
+		case code.GetTable, code.Self:
+			if c&bitRK != 0 {
+				d.printf("\t; %s", constant(p, c&^bitRK))
+			}
+		case code.SetTable, code.Add, code.Sub, code.Mul, code.Mod, code.Pow, code.Div, code.IDiv,
+			code.BitwiseAnd, code.BitwiseOr, code.BitwiseXor, code.ShiftLeft, code.ShiftRight,
+			code.Equal, code.LessThan, code.LessThanOrEqual:
+			if b&bitRK != 0 || c&bitRK != 0 {
+				d.printf("\t; %s %s", rkConstant(p, b), rkConstant(p, c))
+			}
+		case code.Jmp, code.ForLoop, code.ForPrep, code.TForLoop:
+			d.printf("\t; to %d", sbx+pc+2)
+		case code.Closure:
+			if bx < len(p.Prototypes) {
+				d.printf("\t; %p", p.Prototypes[bx])
+			}
+		case code.SetList:
+			// C 为 0 时下一条指令是 EXTRAARG, 和 luac 一样直接打印并跳过
+			if c == 0 && pc+1 < len(p.Code) {
+				pc++
+				d.printf("\t; %d", int(p.Code[pc]))
+			} else {
+				d.printf("\t; %d", c)
+			}
+		case code.ExtraArg:
+			d.printf("\t; %s", constant(p, ax))
+		}
+		d.printf("\n")
+	}
+}
+
+func (d *printer) debug(p *types.Prototype) {
+	d.printf("constants (%d) for %p:\n", len(p.Constants), p)
+	for i := range p.Constants {
+		d.printf("\t%d\t%s\n", i+1, constant(p, i))
+	}
+	d.printf("locals (%d) for %p:\n", len(p.LocalVariables), p)
+	for i, v := range p.LocalVariables {
+		d.printf("\t%d\t%s\t%d\t%d\n", i, v.Name, v.StartPC+1, v.EndPC+1)
+	}
+	d.printf("upvalues (%d) for %p:\n", len(p.UpValues), p)
+	for i, u := range p.UpValues {
+		d.printf("\t%d\t%s\t%d\t%d\n", i, upValueName(p, i), u[0], u[1])
+	}
+}
+
+// rk 把常量索引转换为 luac 显示的负数
+func rk(x int) int {
+	if x&bitRK != 0 {
+		return -1 - x&^bitRK
+	}
+	return x
+}
+
+func rkConstant(p *types.Prototype, x int) string {
+	if x&bitRK == 0 {
+		return "-"
+	}
+	return constant(p, x&^bitRK)
+}
+
+func upValueName(p *types.Prototype, i int) string {
+	if i < len(p.UpValueNames) && p.UpValueNames[i] != "" {
+		return p.UpValueNames[i]
+	}
+	return "-"
+}
+
+// constant 按照 luac 的格式显示第 i 个常量
+func constant(p *types.Prototype, i int) string {
+	if i < 0 || i >= len(p.Constants) {
+		return "?"
+	}
+	switch v := p.Constants[i].(type) {
+	case *types.Nil:
+		return "nil"
+	case types.Boolean:
+		return strconv.FormatBool(bool(v))
+	case types.Integer:
+		return strconv.FormatInt(int64(v), 10)
+	case types.Float:
+		return formatFloat(float64(v))
+	case types.String:
+		return quote(string(v))
+	default:
+		return fmt.Sprintf("? type=%s", v.Type())
+	}
+}
+
+// formatFloat 和 C 的 %.14g 相同, 看起来像整数时加上 .0
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	case math.IsNaN(f):
+		return "nan"
+	}
+	s := strconv.FormatFloat(f, 'g', 14, 64)
+	if strings.Trim(s, "-0123456789") == "" {
+		s += ".0"
+	}
+	return s
+}
+
+func quote(s string) string {
+	var buf strings.Builder
+	buf.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"':
+			buf.WriteString(`\"`)
+		case '\\':
+			buf.WriteString(`\\`)
+		case '\a':
+			buf.WriteString(`\a`)
+		case '\b':
+			buf.WriteString(`\b`)
+		case '\f':
+			buf.WriteString(`\f`)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\r':
+			buf.WriteString(`\r`)
+		case '\t':
+			buf.WriteString(`\t`)
+		case '\v':
+			buf.WriteString(`\v`)
+		default:
+			if c >= 0x20 && c < 0x7f {
+				buf.WriteByte(c)
+			} else {
+				fmt.Fprintf(&buf, `\%03d`, c)
+			}
+		}
+	}
+	buf.WriteByte('"')
+	return buf.String()
+}
+
+func plural(n int) string {
+	if n == 1 {
+		return ""
+	}
+	return "s"
+}
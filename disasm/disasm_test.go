@@ -0,0 +1,111 @@
+package disasm
+
+import (
+	"bytes"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/Salpadding/lua/compiler"
+	"github.com/Salpadding/lua/types"
+	"github.com/stretchr/testify/assert"
+)
+
+var pointer = regexp.MustCompile(`0x[0-9a-f]+`)
+
+func disassemble(t *testing.T, p *types.Prototype, full bool) string {
+	var buf bytes.Buffer
+	assert.NoError(t, Fprint(&buf, p, full))
+	return pointer.ReplaceAllString(buf.String(), "0x0")
+}
+
+func TestLuacOutput(t *testing.T) {
+	f, err := os.Open("../types/testdata/hello_world.o")
+	assert.NoError(t, err)
+	defer f.Close()
+	p, err := types.ReadPrototype(f)
+	assert.NoError(t, err)
+	assert.Equal(t, `
+main <.\test\hello_world.lua:0,0> (4 instructions at 0x0)
+0+ params, 2 slots, 1 upvalue, 0 locals, 2 constants, 0 functions
+	1	[1]	GETTABUP 	0 0 -1	; _ENV "print"
+	2	[1]	LOADK    	1 -2	; "Hello, World!"
+	3	[1]	CALL     	0 2 1
+	4	[1]	RETURN   	0 1
+constants (2) for 0x0:
+	1	"print"
+	2	"Hello, World!"
+locals (0) for 0x0:
+upvalues (1) for 0x0:
+	0	_ENV	1	0
+`, disassemble(t, p, true))
+}
+
+func TestNested(t *testing.T) {
+	p, err := compiler.CompileReader(strings.NewReader(`local function inc(n, ...)
+  local t = {1.5, "a\n", n}
+  for i = 1, 2 do n = n + i end
+  return n >= 10
+end`), "@test.lua")
+	assert.NoError(t, err)
+	assert.Equal(t, `
+main <test.lua:0,0> (2 instructions at 0x0)
+0+ params, 2 slots, 1 upvalue, 1 local, 0 constants, 1 function
+	1	[1]	CLOSURE  	0 0	; 0x0
+	2	[1]	RETURN   	0 1
+
+function <test.lua:1,5> (18 instructions at 0x0)
+1+ param, 7 slots, 0 upvalues, 6 locals, 5 constants, 0 functions
+	1	[2]	NEWTABLE 	1 3 0
+	2	[2]	LOADK    	2 -1	; 1.5
+	3	[2]	LOADK    	3 -2	; "a\n"
+	4	[2]	MOVE     	4 0
+	5	[2]	SETLIST  	1 3 1	; 1
+	6	[3]	LOADK    	2 -3	; 1
+	7	[3]	LOADK    	3 -4	; 2
+	8	[3]	LOADK    	4 -3	; 1
+	9	[3]	FORPREP  	2 2	; to 12
+	10	[3]	ADD      	6 0 5
+	11	[3]	MOVE     	0 6
+	12	[3]	FORLOOP  	2 -3	; to 10
+	13	[4]	LE       	1 -5 0	; 10 -
+	14	[4]	JMP      	0 1	; to 16
+	15	[4]	LOADBOOL 	2 0 1
+	16	[4]	LOADBOOL 	2 1 0
+	17	[4]	RETURN   	2 2
+	18	[5]	RETURN   	0 1
+`, disassemble(t, p, false))
+}
+
+func TestStripped(t *testing.T) {
+	p, err := compiler.CompileReader(strings.NewReader("local t = {1e100, -0.0, 2^53, 'q\"\\\\\\0\\200'}\nx = t"), "=x")
+	assert.NoError(t, err)
+	var buf bytes.Buffer
+	assert.NoError(t, types.WritePrototype(&buf, p, true))
+	p, err = types.ReadPrototype(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, `
+main <?:0,0> (9 instructions at 0x0)
+0+ params, 5 slots, 1 upvalue, 0 locals, 6 constants, 0 functions
+	1	[-]	NEWTABLE 	0 4 0
+	2	[-]	LOADK    	1 -1	; 1e+100
+	3	[-]	LOADK    	2 -2	; -0.0
+	4	[-]	POW      	3 -3 -4	; 2 53
+	5	[-]	LOADK    	4 -5	; "q\"\\\000\200"
+	6	[-]	SETLIST  	0 4 1	; 1
+	7	[-]	MOVE     	1 0
+	8	[-]	SETTABUP 	0 -6 1	; - "x"
+	9	[-]	RETURN   	0 1
+constants (6) for 0x0:
+	1	1e+100
+	2	-0.0
+	3	2
+	4	53
+	5	"q\"\\\000\200"
+	6	"x"
+locals (0) for 0x0:
+upvalues (1) for 0x0:
+	0	-	1	0
+`, disassemble(t, p, true))
+}
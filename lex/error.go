@@ -0,0 +1,19 @@
+package lex
+
+import "fmt"
+
+func errUnfinishedString(line, column int) error {
+	return fmt.Errorf("unfinished string at line %d, column %d", line, column)
+}
+
+func errUnfinishedLongString(line, column int) error {
+	return fmt.Errorf("unfinished long string at line %d, column %d", line, column)
+}
+
+func errInvalidLongString(line, column int) error {
+	return fmt.Errorf("invalid long string delimiter at line %d, column %d", line, column)
+}
+
+func errMalformedNumber(line, column int) error {
+	return fmt.Errorf("malformed number at line %d, column %d", line, column)
+}
@@ -91,35 +91,86 @@ func isWhiteSpace(r rune) bool {
 	return false
 }
 
-func (l *Lexer) skipComment() {
+func (l *Lexer) skipComment() error {
 	// skip comments
 	if l.current.rune() != '-' || l.next.rune() != '-' {
-		return
+		return nil
 	}
 	l.nextChar()
 	l.nextChar()
-	// single-line comment
-	if l.current.rune() != '[' || l.next.rune() != '[' {
-		for !l.current.isEOF() && l.current.rune() != '\n' {
-			l.nextChar()
+	// multi-line comment
+	if l.current.rune() == '[' {
+		if level, ok := l.longBracketLevel(); ok {
+			_, err := l.readLongString(level)
+			return err
 		}
+	}
+	// single-line comment
+	for !l.current.isEOF() && l.current.rune() != '\n' {
 		l.nextChar()
-		return
 	}
 	l.nextChar()
+	return nil
+}
+
+// longBracketLevel 读取 [==[ 形式的左长括号, 返回等号的个数
+func (l *Lexer) longBracketLevel() (int, bool) {
+	if l.current.rune() != '[' {
+		return 0, false
+	}
+	if l.next.rune() == '[' {
+		l.nextChar()
+		l.nextChar()
+		return 0, true
+	}
+	if l.next.rune() != '=' {
+		return 0, false
+	}
+	// [= 之后必须是 = 或者 [
 	l.nextChar()
-	// multi-line comment
-	for !l.current.isEOF() {
-		if l.current.rune() != '-' || l.next.rune() != '-' {
+	level := 0
+	for l.current.rune() == '=' {
+		level++
+		l.nextChar()
+	}
+	if l.current.rune() != '[' {
+		return -1, false
+	}
+	l.nextChar()
+	return level, true
+}
+
+// readLongString 读取长字符串直到匹配的右长括号, 忽略紧跟左长括号的换行符
+func (l *Lexer) readLongString(level int) (string, error) {
+	var buf bytes.Buffer
+	if l.current.rune() == '\r' {
+		l.nextChar()
+	}
+	if l.current.rune() == '\n' {
+		l.nextChar()
+	}
+	for {
+		if l.current.isEOF() {
+			return "", errUnfinishedLongString(l.line, l.column)
+		}
+		if l.current.rune() != ']' {
+			buf.WriteRune(l.current.rune())
 			l.nextChar()
 			continue
 		}
 		l.nextChar()
-		l.nextChar()
-		if l.current.rune() == ']' && l.next.rune() == ']' {
+		n := 0
+		for n < level && l.current.rune() == '=' {
+			n++
 			l.nextChar()
+		}
+		if n == level && l.current.rune() == ']' {
 			l.nextChar()
-			break
+			return buf.String(), nil
+		}
+		buf.WriteRune(']')
+		for i := 0; i < n; i++ {
+			buf.WriteRune('=')
 		}
 	}
 }
@@ -136,7 +187,9 @@ func (l *Lexer) NextToken() (token.Token, error) {
 	l.skipWhiteSpaces()
 	// skip comments
 	if l.current.rune() == '-' && l.next.rune() == '-' {
-		l.skipComment()
+		if err := l.skipComment(); err != nil {
+			return nil, err
+		}
 		return l.NextToken()
 	}
 	if l.current.isEOF() {
@@ -177,6 +230,9 @@ func (l *Lexer) NextToken() (token.Token, error) {
 		return tk, nil
 	case '.':
 		n := l.next.rune()
+		if l.isNumber(n) {
+			return l.readDecimal(l.line, l.column)
+		}
 		if n != '.' {
 			tk := token.NewOperator(string(r), l.line, l.column)
 			l.nextChar()
@@ -195,32 +251,44 @@ func (l *Lexer) NextToken() (token.Token, error) {
 		return tk, nil
 	case '[':
 		n := l.next.rune()
-		if n != '[' {
+		if n != '[' && n != '=' {
 			tk := token.NewDelimiter(string(r), l.line, l.column)
 			l.nextChar()
 			return tk, nil
 		}
 		// here document
 		line, column := l.line, l.column
-		l.nextChar()
-		l.nextChar()
-		var buf bytes.Buffer
-		for !l.current.isEOF() && !(l.current.rune() == ']' && l.next.rune() == ']') {
-			buf.WriteRune(l.current.rune())
-			l.nextChar()
+		level, ok := l.longBracketLevel()
+		if !ok {
+			return nil, errInvalidLongString(line, column)
 		}
-		l.nextChar()
-		l.nextChar()
-		return token.NewStringLiteral(buf.String(), line, column), nil
+		str, err := l.readLongString(level)
+		if err != nil {
+			return nil, err
+		}
+		return token.NewStringLiteral(str, line, column), nil
 	case '"', '\'':
 		line, column := l.line, l.column
 		l.nextChar()
 		var buf bytes.Buffer
-		for !l.current.isEOF() && l.current.rune() != r {
-			if l.current.rune() == '\\' && l.next.rune() == r {
-				buf.WriteRune(r)
-				l.nextChar()
+		for l.current.rune() != r {
+			if l.current.isEOF() || l.current.rune() == '\n' {
+				return nil, errUnfinishedString(line, column)
+			}
+			// 转义序列原样保留, 交给 FromEscaped 处理
+			if l.current.rune() == '\\' {
+				buf.WriteRune(l.current.rune())
 				l.nextChar()
+				if l.current.isEOF() {
+					return nil, errUnfinishedString(line, column)
+				}
+				// \z 跳过之后的空白字符, 包括换行符
+				if l.current.rune() == 'z' {
+					buf.Truncate(buf.Len() - 1)
+					l.nextChar()
+					l.skipWhiteSpaces()
+					continue
+				}
 			}
 			buf.WriteRune(l.current.rune())
 			l.nextChar()
@@ -284,26 +352,38 @@ func (l *Lexer) readLiteralOrKeyword() (token.Token, error) {
 	// peek snd rune
 	snd := l.next.rune()
 	// try to parse as hex number
-	if snd == 'x' || snd == 'X' {
+	if fst == '0' && (snd == 'x' || snd == 'X') {
 		l.nextChar()
 		l.nextChar()
 		var buf bytes.Buffer
-		for !l.current.isEOF() && l.isHex(l.current.rune()) {
-			buf.WriteRune(l.current.rune())
+		for !l.current.isEOF() && l.isHexPart(l.current.rune()) {
+			c := l.current.rune()
+			buf.WriteRune(c)
 			l.nextChar()
+			if (c == 'p' || c == 'P') && (l.current.rune() == '+' || l.current.rune() == '-') {
+				buf.WriteRune(l.current.rune())
+				l.nextChar()
+			}
 		}
-		str := buf.String()
-		_, err := strconv.ParseInt(str, 16, 64)
-		if err != nil {
-			return nil, err
+		if buf.Len() == 0 {
+			return nil, errMalformedNumber(line, column)
 		}
-		return token.NewNumberLiteral(str, 16, line, column), nil
+		return token.NewNumberLiteral(buf.String(), 16, line, column), nil
 	}
-	// try to parse as digital number
+	return l.readDecimal(line, column)
+}
+
+// readDecimal 读取十进制数字, 数字可以以小数点开头
+func (l *Lexer) readDecimal(line, column int) (token.Token, error) {
 	var buf bytes.Buffer
-	for !l.current.isEOF() && (l.isNumber(l.current.rune()) || l.current.rune() == '.' || l.current.rune() == 'e') {
-		buf.WriteRune(l.current.rune())
+	for !l.current.isEOF() && (l.isNumber(l.current.rune()) || l.current.rune() == '.' || l.current.rune() == 'e' || l.current.rune() == 'E') {
+		c := l.current.rune()
+		buf.WriteRune(c)
 		l.nextChar()
+		if (c == 'e' || c == 'E') && (l.current.rune() == '+' || l.current.rune() == '-') {
+			buf.WriteRune(l.current.rune())
+			l.nextChar()
+		}
 	}
 	_, err := strconv.ParseFloat(buf.String(), 64)
 	if err != nil {
@@ -311,3 +391,7 @@ func (l *Lexer) readLiteralOrKeyword() (token.Token, error) {
 	}
 	return token.NewNumberLiteral(buf.String(), 10, line, column), nil
 }
+
+func (l *Lexer) isHexPart(r rune) bool {
+	return l.isHex(r) || r == '.' || r == 'p' || r == 'P'
+}
@@ -6,6 +6,7 @@ import (
 	"testing"
 
 	"github.com/Salpadding/lua/token"
+	"github.com/stretchr/testify/assert"
 )
 
 func Test1(t *testing.T) {
@@ -224,3 +225,39 @@ func TestID(t *testing.T) {
 		fmt.Println(tk.String())
 	}
 }
+
+// tokenStrings 返回 src 中所有 token 的字符串形式
+func tokenStrings(src string) ([]string, error) {
+	l := New(bytes.NewBufferString(src))
+	var res []string
+	for {
+		tk, err := l.NextToken()
+		if err != nil {
+			return res, err
+		}
+		if tk.Type() == token.EndOfFile {
+			return res, nil
+		}
+		res = append(res, tk.String())
+	}
+}
+
+func TestLeadingDotNumber(t *testing.T) {
+	tokens, err := tokenStrings("x = .5 + a.b .. .25e2")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"x", "=", ".5", "+", "a", ".", "b", "..", ".25e2"}, tokens)
+}
+
+func TestSkipWhiteSpaceEscape(t *testing.T) {
+	tokens, err := tokenStrings("'a\\z\n   b' \"c\\z  \"")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{`"ab"`, `"c"`}, tokens)
+}
+
+func TestUnfinishedLongComment(t *testing.T) {
+	_, err := tokenStrings("x = 1\n--[==[ comment\n]]")
+	assert.EqualError(t, err, "unfinished long string at line 3, column 2")
+	tokens, err := tokenStrings("--[==[ comment ]==] x")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"x"}, tokens)
+}
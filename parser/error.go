@@ -9,3 +9,7 @@ import (
 func errUnexpectedError(tk token.Token) error {
 	return fmt.Errorf("unexpected token %s found at line %d, column %d", tk.String(), tk.Line(), tk.Column())
 }
+
+func errMalformedNumber(tk token.Token) error {
+	return fmt.Errorf("malformed number near %s at line %d, column %d", tk.String(), tk.Line(), tk.Column())
+}
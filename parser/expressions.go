@@ -1,10 +1,9 @@
 package parser
 
 import (
-	"strconv"
-
 	"github.com/Salpadding/lua/ast"
 	"github.com/Salpadding/lua/token"
+	"github.com/Salpadding/lua/types"
 )
 
 func (p *Parser) parseExp12() (ast.Expression, error) {
@@ -307,7 +306,7 @@ func (p *Parser) parseExp1() (ast.Expression, error) {
 		if _, err = p.nextToken(1); err != nil {
 			return nil, err
 		}
-		right, err := p.parseExp1()
+		right, err := p.parseExp2()
 		if err != nil {
 			return nil, err
 		}
@@ -323,24 +322,22 @@ func (p *Parser) parseExp0() (ast.Expression, error) {
 	current := p.current
 	switch c := current.(type) {
 	case *token.NumberLiteral:
-		if c.Base() == 10 {
-			f, err := strconv.ParseFloat(c.Literal(), 64)
-			if err != nil {
-				return nil, err
-			}
-			if _, err = p.nextToken(1); err != nil {
-				return nil, err
-			}
-			return ast.Number(f), nil
+		literal := c.Literal()
+		if c.Base() == 16 {
+			literal = "0x" + literal
 		}
-		n, err := strconv.ParseInt(c.Literal(), 16, 64)
-		if err != nil {
-			return nil, err
+		n, ok := types.ParseNumber(literal)
+		if !ok {
+			return nil, errMalformedNumber(c)
 		}
-		if _, err = p.nextToken(1); err != nil {
+		if _, err := p.nextToken(1); err != nil {
 			return nil, err
 		}
-		return ast.Number(n), nil
+		if i, ok := n.(types.Integer); ok {
+			return ast.Integer(i), nil
+		}
+		f, _ := n.ToFloat()
+		return ast.Number(f), nil
 	case *token.StringLiteral:
 		if _, err := p.nextToken(1); err != nil {
 			return nil, err
@@ -475,11 +472,11 @@ func (p *Parser) parsePrefix1() (ast.Expression, error) {
 			if err != nil {
 				return nil, err
 			}
-			return &ast.FunctionCall{
+			left = &ast.FunctionCall{
 				Function: ast.Identifier(id),
 				Args:     args,
 				Self:     left,
-			}, nil
+			}
 		default:
 			return left, nil
 		}
@@ -503,6 +500,11 @@ func (p *Parser) parsePrefix0() (ast.Expression, error) {
 		if _, err := p.nextToken(1); err != nil {
 			return nil, err
 		}
+		// (f()) 和 (...) 只取第一个值
+		switch exp.(type) {
+		case *ast.FunctionCall, ast.Vararg:
+			return &ast.Parenthesized{Expression: exp}, nil
+		}
 		return exp, nil
 	case token.Identifier:
 		if _, err := p.nextToken(1); err != nil {
@@ -520,7 +522,6 @@ func (p *Parser) parseTable() (ast.Table, error) {
 		return nil, err
 	}
 	var pairs ast.Table
-	i := 1
 	for p.current.Type() != token.RightBrace {
 		switch p.current.Type() {
 		case token.LeftBracket:
@@ -546,10 +547,17 @@ func (p *Parser) parseTable() (ast.Table, error) {
 				Value: v,
 			})
 		case token.Identifier:
-			id := p.current.String()
 			if p.next.Type() != token.Assign {
-				return nil, errUnexpectedError(p.next)
+				v, err := p.parseExp12()
+				if err != nil {
+					return nil, err
+				}
+				pairs = append(pairs, &ast.Keypair{
+					Value: v,
+				})
+				break
 			}
+			id := p.current.String()
 			if _, err := p.nextToken(2); err != nil {
 				return nil, err
 			}
@@ -567,10 +575,8 @@ func (p *Parser) parseTable() (ast.Table, error) {
 				return nil, err
 			}
 			pairs = append(pairs, &ast.Keypair{
-				Key:   ast.Number(i),
 				Value: v,
 			})
-			i++
 		}
 		if p.current.Type() != token.Comma && p.current.Type() != token.Semicolon {
 			break
@@ -592,23 +598,10 @@ func (p *Parser) parseTable() (ast.Table, error) {
 }
 
 func (p *Parser) parseLambda() (*ast.Function, error) {
+	line := p.current.Line()
 	// skip function
 	if _, err := p.nextToken(1); err != nil {
 		return nil, err
 	}
-	parameters, err := p.parseParameters()
-	if err != nil {
-		return nil, err
-	}
-	body, err := p.parseBlock()
-	if err != nil {
-		return nil, err
-	}
-	if err := p.assertCurrentAndSkip(token.End); err != nil {
-		return nil, err
-	}
-	return &ast.Function{
-		Body:       body,
-		Parameters: parameters,
-	}, nil
+	return p.parseFunctionBody(line)
 }
@@ -67,29 +67,43 @@ func New(reader io.RuneReader) (*Parser, error) {
 }
 
 func (p *Parser) Parse() (*ast.Block, error) {
-	return p.parseBlock()
+	blk, err := p.parseBlock()
+	if err != nil {
+		return nil, err
+	}
+	// 代码块之后只能是文件结尾, 例如 return 之后不能再有语句
+	if p.current.Type() != token.EndOfFile {
+		return nil, errUnexpectedError(p.current)
+	}
+	return blk, nil
 }
 
-func (p *Parser) parseStatements() ([]ast.Statement, error) {
-	var res []ast.Statement
+func (p *Parser) parseStatements() ([]ast.Statement, []int, error) {
+	var (
+		res   []ast.Statement
+		lines []int
+	)
 	for !p.isReturnOrKeyword(p.current) {
+		line := p.current.Line()
 		s, err := p.parseStatement()
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		res = append(res, s)
+		lines = append(lines, line)
 	}
-	return res, nil
+	return res, lines, nil
 }
 
 func (p *Parser) parseBlock() (*ast.Block, error) {
-	statements, err := p.parseStatements()
+	statements, lines, err := p.parseStatements()
 	if err != nil {
 		return nil, err
 	}
 	if p.current.Type() != token.Return {
 		return &ast.Block{
 			Statements: statements,
+			Lines:      lines,
 		}, nil
 	}
 	re, err := p.parseReturn()
@@ -98,6 +112,7 @@ func (p *Parser) parseBlock() (*ast.Block, error) {
 	}
 	return &ast.Block{
 		Statements: statements,
+		Lines:      lines,
 		Return:     re,
 	}, nil
 }
@@ -152,14 +167,7 @@ func (p *Parser) parseStatement() (ast.Statement, error) {
 		return p.parseFunction()
 	case token.Local:
 		if p.next.Type() == token.Function {
-			if _, err := p.nextToken(1); err != nil {
-				return nil, err
-			}
-			function, err := p.parseFunction()
-			if err != nil {
-				return nil, err
-			}
-			return &ast.LocalFunction{Function: function}, nil
+			return p.parseLocalFunction()
 		}
 		return p.parseLocalAssign()
 	default:
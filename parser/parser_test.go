@@ -42,3 +42,15 @@ func TestParser4(t *testing.T) {
 func TestParser5(t *testing.T) {
 	testParser(t, "testdata/p5.lua")
 }
+
+func TestParseTrailingTokens(t *testing.T) {
+	for _, src := range []string{"return x = 1", "return 1 end", "x = 1 end"} {
+		p, err := New(bytes.NewBufferString(src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := p.Parse(); err == nil {
+			t.Errorf("%q: expected error", src)
+		}
+	}
+}
@@ -48,7 +48,7 @@ func TestParseSimples(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	stmts, err := p.parseStatements()
+	stmts, _, err := p.parseStatements()
 	if err != nil {
 		t.Error(err)
 	}
@@ -128,30 +128,31 @@ func (p *Parser) parseLocalAssign() (*ast.LocalAssign, error) {
 }
 
 func (p *Parser) parseReturn() (*ast.Return, error) {
+	line := p.current.Line()
 	// skip return
 	if _, err := p.nextToken(1); err != nil {
 		return nil, err
 	}
 	switch p.current.Type() {
 	case token.EndOfFile, token.End, token.Else, token.ElseIf, token.Until:
-		return &ast.Return{}, nil
+		return &ast.Return{Line: line}, nil
 	case token.Semicolon:
 		if _, err := p.nextToken(1); err != nil {
 			return nil, err
 		}
-		return &ast.Return{}, nil
+		return &ast.Return{Line: line}, nil
 	default:
 		exps, err := p.parseExpressions()
 		if err != nil {
 			return nil, err
 		}
 		if p.current.Type() != token.Semicolon {
-			return &ast.Return{Values: exps}, nil
+			return &ast.Return{Values: exps, Line: line}, nil
 		}
 		if _, err := p.nextToken(1); err != nil {
 			return nil, err
 		}
-		return &ast.Return{Values: exps}, nil
+		return &ast.Return{Values: exps, Line: line}, nil
 	}
 }
 
@@ -328,7 +329,11 @@ func (p *Parser) parseForIn() (*ast.ForIn, error) {
 	}, nil
 }
 
-func (p *Parser) parseFunction() (*ast.Function, error) {
+// function funcname funcbody
+// funcname ::= Name {'.' Name} [':' Name]
+// 带有 . 或者 : 的函数定义会被转换成赋值语句
+func (p *Parser) parseFunction() (ast.Statement, error) {
+	line := p.current.Line()
 	if err := p.assertCurrentAndSkip(token.Function); err != nil {
 		return nil, err
 	}
@@ -336,6 +341,67 @@ func (p *Parser) parseFunction() (*ast.Function, error) {
 	if err := p.assertCurrentAndSkip(token.Identifier); err != nil {
 		return nil, err
 	}
+	var (
+		target   ast.Expression = name
+		isMethod bool
+	)
+	for p.current.Type() == token.Dot || p.current.Type() == token.Colon {
+		isMethod = p.current.Type() == token.Colon
+		if p.next.Type() != token.Identifier {
+			return nil, errUnexpectedError(p.next)
+		}
+		target = &ast.TableAccess{
+			Left:  target,
+			Index: ast.String(p.next.String()),
+		}
+		if _, err := p.nextToken(2); err != nil {
+			return nil, err
+		}
+		if isMethod {
+			break
+		}
+	}
+	fn, err := p.parseFunctionBody(line)
+	if err != nil {
+		return nil, err
+	}
+	if target == name {
+		fn.Name = name
+		return fn, nil
+	}
+	if isMethod {
+		fn.Parameters = append([]ast.Parameter{ast.Identifier("self")}, fn.Parameters...)
+	}
+	return &ast.Assign{
+		Vars:   []ast.Expression{target},
+		Values: []ast.Expression{fn},
+	}, nil
+}
+
+// local function Name funcbody
+func (p *Parser) parseLocalFunction() (*ast.LocalFunction, error) {
+	// skip local
+	if _, err := p.nextToken(1); err != nil {
+		return nil, err
+	}
+	line := p.current.Line()
+	if err := p.assertCurrentAndSkip(token.Function); err != nil {
+		return nil, err
+	}
+	name := ast.Identifier(p.current.String())
+	if err := p.assertCurrentAndSkip(token.Identifier); err != nil {
+		return nil, err
+	}
+	fn, err := p.parseFunctionBody(line)
+	if err != nil {
+		return nil, err
+	}
+	fn.Name = name
+	return &ast.LocalFunction{Function: fn}, nil
+}
+
+// funcbody ::= '(' [parlist] ')' block end
+func (p *Parser) parseFunctionBody(line int) (*ast.Function, error) {
 	parameters, err := p.parseParameters()
 	if err != nil {
 		return nil, err
@@ -344,13 +410,15 @@ func (p *Parser) parseFunction() (*ast.Function, error) {
 	if err != nil {
 		return nil, err
 	}
+	lastLine := p.current.Line()
 	if err := p.assertCurrentAndSkip(token.End); err != nil {
 		return nil, err
 	}
 	return &ast.Function{
-		Name:       name,
 		Body:       body,
 		Parameters: parameters,
+		Line:       line,
+		LastLine:   lastLine,
 	}, nil
 }
 
@@ -365,8 +433,8 @@ func (p *Parser) parseParameters() ([]ast.Parameter, error) {
 	if _, err := p.nextToken(1); err != nil {
 		return nil, err
 	}
-	if p.next.Type() == token.Varying {
-		if _, err := p.nextToken(2); err != nil {
+	if p.current.Type() == token.Varying {
+		if _, err := p.nextToken(1); err != nil {
 			return nil, err
 		}
 		if err := p.assertCurrentAndSkip(token.RightParenthesis); err != nil {
@@ -63,6 +63,12 @@ func (p *Parser) parseArguments() (ast.Arguments, error) {
 	case token.LeftBrace:
 		return p.parseTable()
 	case token.LeftParenthesis:
+		if p.next.Type() == token.RightParenthesis {
+			if _, err := p.nextToken(2); err != nil {
+				return nil, err
+			}
+			return ast.Expressions{}, nil
+		}
 		if _, err := p.nextToken(1); err != nil {
 			return nil, err
 		}
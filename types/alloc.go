@@ -0,0 +1,39 @@
+package types
+
+import "github.com/Salpadding/lua/types/value"
+
+// 内存统计中使用的大小, 只是近似值
+const (
+	TableSize      = 64 // 空表的大小
+	ArrayEntrySize = 16 // 数组部分每个元素的大小
+	MapEntrySize   = 48 // 哈希部分每个键值对的大小
+	StringSize     = 16 // 字符串除了内容以外的大小
+	ClosureSize    = 32 // 闭包除了 upvalue 以外的大小
+	UpValueSize    = 24 // 每个 upvalue 的大小
+)
+
+// Allocator 记录分配的内存, 超过限制时 Alloc 返回错误并且不记录这次分配
+type Allocator interface {
+	Alloc(size int) error
+	Free(size int)
+}
+
+// Size 返回表占用的内存, 和表增长时记录的大小相同, 没有分配器的表不计入内存统计
+func (t *Table) Size() int {
+	if t.alloc == nil {
+		return 0
+	}
+	return TableSize + t.array.Len()*ArrayEntrySize + len(t.m)*MapEntrySize
+}
+
+// Range 按任意顺序对表中的每个键值对调用 fn
+func (t *Table) Range(fn func(k, v Value)) {
+	for i, v := range *t.array {
+		if v.Type() != value.Nil {
+			fn(Integer(i+1), v)
+		}
+	}
+	for k, v := range t.m {
+		fn(k, v)
+	}
+}
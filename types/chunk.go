@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"math"
 
@@ -25,6 +26,7 @@ type Prototype struct {
 	LineInfo        []uint32         // debug
 	LocalVariables  []*LocalVariable // debug
 	UpValueNames    []string         // debug
+	Version         byte             // 指令集的版本, 0 表示 Lua 5.3, LuaVersion54 表示 Lua 5.4
 }
 
 type Chunk struct {
@@ -32,26 +34,77 @@ type Chunk struct {
 
 type ByteCodeReader struct {
 	io.Reader
+	version byte // 头部中的版本号
+
+	// 以下参数由头部决定, 为零值时使用 64 位小端的默认值
+	order       binary.ByteOrder // 字节序
+	intSize     byte             // C int 的大小
+	sizeTSize   byte             // size_t 的大小
+	integerSize byte             // lua_Integer 的大小
+	numberSize  byte             // lua_Number 的大小
+}
+
+// sizeOf 返回头部中的大小, 没有读取头部时返回默认值 def
+func sizeOf(size, def byte) byte {
+	if size == 0 {
+		return def
+	}
+	return size
+}
+
+func (b *ByteCodeReader) byteOrder() binary.ByteOrder {
+	if b.order == nil {
+		return binary.LittleEndian
+	}
+	return b.order
+}
+
+// maxPrealloc 是按照代码块中的数量预先分配的最大元素个数, 数量来自不可信的输入,
+// 超过的部分随着实际读到的数据增长, 这样数量再大也不会超过输入的大小
+const maxPrealloc = 1 << 12
+
+// preallocate 返回数量为 n 的表预先分配的容量
+func preallocate(n int) int {
+	if n > maxPrealloc {
+		return maxPrealloc
+	}
+	return n
 }
 
 func (b *ByteCodeReader) ReadBytes(n int) ([]byte, error) {
-	res := make([]byte, n)
-	read, err := b.Reader.Read(res)
-	if err != nil {
-		return nil, err
+	if n < 0 {
+		return nil, errors.New("unexpected eof")
 	}
-	if read < n {
+	if n <= maxPrealloc {
+		res := make([]byte, n)
+		if _, err := io.ReadFull(b.Reader, res); err != nil {
+			return nil, errors.New("unexpected eof")
+		}
+		return res, nil
+	}
+	// 长度来自不可信的输入, 按照实际读到的数据分配内存
+	var buf bytes.Buffer
+	if m, err := io.CopyN(&buf, b.Reader, int64(n)); err != nil || m != int64(n) {
 		return nil, errors.New("unexpected eof")
 	}
-	return res, nil
+	return buf.Bytes(), nil
 }
 
+// ReadInt 读取 lua_Integer
 func (b *ByteCodeReader) ReadInt() (int64, error) {
-	i, err := b.ReadUint64()
+	data, err := b.ReadBytes(int(sizeOf(b.integerSize, LuaIntegerSize)))
 	if err != nil {
 		return 0, err
 	}
-	return int64(i), nil
+	return b.decodeInt(data), nil
+}
+
+// decodeInt 按照头部中的字节序解码 4 或者 8 字节的整数, 4 字节的整数按符号扩展
+func (b *ByteCodeReader) decodeInt(data []byte) int64 {
+	if len(data) == 4 {
+		return int64(int32(b.byteOrder().Uint32(data)))
+	}
+	return int64(b.byteOrder().Uint64(data))
 }
 
 func (b *ByteCodeReader) ReadUint32() (uint32, error) {
@@ -59,7 +112,7 @@ func (b *ByteCodeReader) ReadUint32() (uint32, error) {
 	if err != nil {
 		return 0, err
 	}
-	return binary.LittleEndian.Uint32(data), nil
+	return b.byteOrder().Uint32(data), nil
 }
 
 func (b *ByteCodeReader) ReadUint64() (uint64, error) {
@@ -67,7 +120,31 @@ func (b *ByteCodeReader) ReadUint64() (uint64, error) {
 	if err != nil {
 		return 0, err
 	}
-	return binary.LittleEndian.Uint64(data), nil
+	return b.byteOrder().Uint64(data), nil
+}
+
+// readCInt 读取 C int 保存的行号, 数量和指令位置
+func (b *ByteCodeReader) readCInt() (uint32, error) {
+	if sizeOf(b.intSize, CIntSize) == 4 {
+		return b.ReadUint32()
+	}
+	i, err := b.ReadUint64()
+	if err != nil {
+		return 0, err
+	}
+	if i > math.MaxUint32 {
+		return 0, errors.New("integer overflow")
+	}
+	return uint32(i), nil
+}
+
+// readSizeT 读取 size_t 保存的长字符串长度
+func (b *ByteCodeReader) readSizeT() (uint64, error) {
+	if sizeOf(b.sizeTSize, CSizeTSize) == 4 {
+		i, err := b.ReadUint32()
+		return uint64(i), err
+	}
+	return b.ReadUint64()
 }
 
 func (b *ByteCodeReader) ReadByte() (byte, error) {
@@ -78,7 +155,15 @@ func (b *ByteCodeReader) ReadByte() (byte, error) {
 	return data[0], nil
 }
 
+// ReadFloat 读取 lua_Number, 4 字节的 float 转换为 float64
 func (b *ByteCodeReader) ReadFloat() (float64, error) {
+	if sizeOf(b.numberSize, LuaNumberSize) == 4 {
+		u, err := b.ReadUint32()
+		if err != nil {
+			return 0, err
+		}
+		return float64(math.Float32frombits(u)), nil
+	}
 	u, err := b.ReadUint64()
 	if err != nil {
 		return 0, err
@@ -101,13 +186,13 @@ func (b *ByteCodeReader) ReadString() (string, error) {
 		}
 		return string(data), nil
 	}
-	longSize, err := b.ReadUint64()
-	if longSize > math.MaxInt64 || longSize == 0 {
-		return "", errors.New("the string is too large or two small")
-	}
+	longSize, err := b.readSizeT()
 	if err != nil {
 		return "", err
 	}
+	if longSize > math.MaxInt64 || longSize == 0 {
+		return "", errors.New("the string is too large or two small")
+	}
 	str, err := b.ReadBytes(int(longSize - 1))
 	if err != nil {
 		return "", err
@@ -127,6 +212,14 @@ func (b *ByteCodeReader) Load() (*Prototype, error) {
 }
 
 func (b *ByteCodeReader) ReadPrototype() (*Prototype, error) {
+	if b.version == LuaVersion54 {
+		return b.readFunction54("")
+	}
+	return b.readFunction("")
+}
+
+// readFunction 读取函数原型, 没有源文件名时使用外层函数的源文件名 parent
+func (b *ByteCodeReader) readFunction(parent string) (*Prototype, error) {
 	res := &Prototype{}
 	var (
 		err error
@@ -135,10 +228,13 @@ func (b *ByteCodeReader) ReadPrototype() (*Prototype, error) {
 	if res.Source, err = b.ReadString(); err != nil {
 		return nil, err
 	}
-	if res.LineDefined, err = b.ReadUint32(); err != nil {
+	if res.Source == "" {
+		res.Source = parent
+	}
+	if res.LineDefined, err = b.readCInt(); err != nil {
 		return nil, err
 	}
-	if res.LastLineDefined, err = b.ReadUint32(); err != nil {
+	if res.LastLineDefined, err = b.readCInt(); err != nil {
 		return nil, err
 	}
 	if res.NumParams, err = b.ReadByte(); err != nil {
@@ -160,7 +256,7 @@ func (b *ByteCodeReader) ReadPrototype() (*Prototype, error) {
 	if res.UpValues, err = b.readUpValues(); err != nil {
 		return nil, err
 	}
-	if res.Prototypes, err = b.readPrototypes(); err != nil {
+	if res.Prototypes, err = b.readPrototypes(res.Source); err != nil {
 		return nil, err
 	}
 	if res.LineInfo, err = b.readLineInfo(); err != nil {
@@ -176,32 +272,33 @@ func (b *ByteCodeReader) ReadPrototype() (*Prototype, error) {
 }
 
 func (b *ByteCodeReader) readCode() ([]code.Instruction, error) {
-	rawCodes, err := b.ReadUint32()
+	rawCodes, err := b.readCInt()
 	if err != nil {
 		return nil, err
 	}
-	codes := make([]code.Instruction, rawCodes)
-	for i := range codes {
+	codes := make([]code.Instruction, 0, preallocate(int(rawCodes)))
+	for i := uint32(0); i < rawCodes; i++ {
 		c, err := b.ReadUint32()
 		if err != nil {
 			return nil, err
 		}
-		codes[i] = code.Instruction(c)
+		codes = append(codes, code.Instruction(c))
 	}
 	return codes, nil
 }
 
 func (b *ByteCodeReader) readConstants() ([]Value, error) {
-	size, err := b.ReadUint32()
+	size, err := b.readCInt()
 	if err != nil {
 		return nil, err
 	}
-	constants := make([]Value, size)
-	for i := range constants {
-		constants[i], err = b.readConstant()
+	constants := make([]Value, 0, preallocate(int(size)))
+	for i := uint32(0); i < size; i++ {
+		c, err := b.readConstant()
 		if err != nil {
 			return nil, err
 		}
+		constants = append(constants, c)
 	}
 	return constants, nil
 }
@@ -247,32 +344,64 @@ func (b *ByteCodeReader) checkHeader() error {
 	if sig, err := b.ReadBytes(4); err != nil || !bytes.Equal(sig, []byte(LuaSignature)) {
 		return errors.New("signature check fail")
 	}
-	if v, err := b.ReadByte(); err != nil || v != LuaVersion {
+	v, err := b.ReadByte()
+	if err != nil || v != LuaVersion && v != LuaVersion54 {
 		return errors.New("version not match")
 	}
+	b.version = v
+	if v == LuaVersion54 {
+		return b.checkHeader54()
+	}
 	if f, err := b.ReadByte(); err != nil || f != LuaFormat {
 		return errors.New("format mismatch")
 	}
 	if data, err := b.ReadBytes(6); err != nil || !bytes.Equal(data, []byte(LuaData)) {
 		return errors.New("corrupted")
 	}
-	if s, err := b.ReadByte(); err != nil || s != CIntSize {
-		return errors.New("int size mismatch")
+	if b.intSize, err = b.headerSize("int", 4, 8); err != nil {
+		return err
+	}
+	if b.sizeTSize, err = b.headerSize("size_t", 4, 8); err != nil {
+		return err
+	}
+	if _, err = b.headerSize("instruction", InstructionSize); err != nil {
+		return err
 	}
-	if s, err := b.ReadByte(); err != nil || s != CSizeTSize {
-		return errors.New("size_t size mismatch")
+	if b.integerSize, err = b.headerSize("lua_Integer", 4, 8); err != nil {
+		return err
 	}
-	if s, err := b.ReadByte(); err != nil || s != InstructionSize {
-		return errors.New("instruction size mismatch")
+	if b.numberSize, err = b.headerSize("lua_Number", 4, 8); err != nil {
+		return err
+	}
+	return b.checkNumbers()
+}
+
+// headerSize 读取头部中的类型大小, 只接受 allowed 中的值
+func (b *ByteCodeReader) headerSize(name string, allowed ...byte) (byte, error) {
+	s, err := b.ReadByte()
+	if err != nil {
+		return 0, err
 	}
-	if s, err := b.ReadByte(); err != nil || s != LuaIntegerSize {
-		return errors.New("instruction size mismatch")
+	for _, a := range allowed {
+		if s == a {
+			return s, nil
+		}
 	}
-	if s, err := b.ReadByte(); err != nil || s != LuaNumberSize {
-		return errors.New("instruction size mismatch")
+	return 0, fmt.Errorf("%s size mismatch", name)
+}
+
+// checkNumbers 检查头部中的 LUAC_INT 和 LUAC_NUM, 由 LUAC_INT 确定字节序
+func (b *ByteCodeReader) checkNumbers() error {
+	data, err := b.ReadBytes(int(b.integerSize))
+	if err != nil {
+		return err
 	}
-	if i, err := b.ReadInt(); err != nil || i != LuaCInt {
-		return errors.New("endianness mismatch")
+	b.order = binary.LittleEndian
+	if b.decodeInt(data) != LuaCInt {
+		b.order = binary.BigEndian
+		if b.decodeInt(data) != LuaCInt {
+			return errors.New("endianness mismatch")
+		}
 	}
 	if f, err := b.ReadFloat(); err != nil || f != LuaCNumber {
 		return errors.New("float format mismatch")
@@ -280,84 +409,88 @@ func (b *ByteCodeReader) checkHeader() error {
 	return nil
 }
 
-func (b *ByteCodeReader) readPrototypes() ([]*Prototype, error) {
-	size, err := b.ReadUint32()
+func (b *ByteCodeReader) readPrototypes(source string) ([]*Prototype, error) {
+	size, err := b.readCInt()
 	if err != nil {
 		return nil, err
 	}
-	prototypes := make([]*Prototype, size)
-	for i := range prototypes {
-		prototypes[i], err = b.ReadPrototype()
+	prototypes := make([]*Prototype, 0, preallocate(int(size)))
+	for i := uint32(0); i < size; i++ {
+		p, err := b.readFunction(source)
 		if err != nil {
 			return nil, err
 		}
+		prototypes = append(prototypes, p)
 	}
 	return prototypes, nil
 }
 
 func (b *ByteCodeReader) readUpValues() ([]UpValue, error) {
-	size, err := b.ReadUint32()
+	size, err := b.readCInt()
 	if err != nil {
 		return nil, err
 	}
-	upValues := make([]UpValue, size)
-	for i := range upValues {
+	upValues := make([]UpValue, 0, preallocate(int(size)))
+	for i := uint32(0); i < size; i++ {
 		val, err := b.ReadBytes(2)
 		if err != nil {
 			return nil, err
 		}
-		copy(upValues[i][:], val[:])
+		upValues = append(upValues, UpValue{val[0], val[1]})
 	}
 	return upValues, nil
 }
 
 func (b *ByteCodeReader) readLineInfo() ([]uint32, error) {
-	size, err := b.ReadUint32()
+	size, err := b.readCInt()
 	if err != nil {
 		return nil, err
 	}
-	lineInfo := make([]uint32, size)
-	for i := range lineInfo {
-		lineInfo[i], err = b.ReadUint32()
+	lineInfo := make([]uint32, 0, preallocate(int(size)))
+	for i := uint32(0); i < size; i++ {
+		line, err := b.readCInt()
 		if err != nil {
 			return nil, err
 		}
+		lineInfo = append(lineInfo, line)
 	}
 	return lineInfo, nil
 }
 
 func (b *ByteCodeReader) readLocalVariables() ([]*LocalVariable, error) {
-	size, err := b.ReadUint32()
+	size, err := b.readCInt()
 	if err != nil {
 		return nil, err
 	}
-	localVariables := make([]*LocalVariable, size)
-	for i := range localVariables {
-		localVariables[i] = &LocalVariable{}
-		if localVariables[i].Name, err = b.ReadString(); err != nil {
+	localVariables := make([]*LocalVariable, 0, preallocate(int(size)))
+	for i := uint32(0); i < size; i++ {
+		v := &LocalVariable{}
+		if v.Name, err = b.ReadString(); err != nil {
 			return nil, err
 		}
-		if localVariables[i].StartPC, err = b.ReadUint32(); err != nil {
+		if v.StartPC, err = b.readCInt(); err != nil {
 			return nil, err
 		}
-		if localVariables[i].EndPC, err = b.ReadUint32(); err != nil {
+		if v.EndPC, err = b.readCInt(); err != nil {
 			return nil, err
 		}
+		localVariables = append(localVariables, v)
 	}
 	return localVariables, nil
 }
 
 func (b *ByteCodeReader) readUpValueNames() ([]string, error) {
-	size, err := b.ReadUint32()
+	size, err := b.readCInt()
 	if err != nil {
 		return nil, err
 	}
-	names := make([]string, size)
-	for i := range names {
-		names[i], err = b.ReadString()
+	names := make([]string, 0, preallocate(int(size)))
+	for i := uint32(0); i < size; i++ {
+		name, err := b.ReadString()
 		if err != nil {
 			return nil, err
 		}
+		names = append(names, name)
 	}
 	return names, nil
 }
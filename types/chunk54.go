@@ -0,0 +1,275 @@
+package types
+
+import (
+	"bytes"
+	"errors"
+	"math"
+
+	"github.com/Salpadding/lua/types/code"
+	"github.com/Salpadding/lua/types/tag"
+)
+
+// absLineInfo 表示 lineinfo 中的这条指令的行号保存在 abslineinfo 中
+const absLineInfo = -0x80
+
+// checkHeader54 检查 Lua 5.4 头部中版本号之后的部分
+func (b *ByteCodeReader) checkHeader54() error {
+	if f, err := b.ReadByte(); err != nil || f != LuaFormat {
+		return errors.New("format mismatch")
+	}
+	if data, err := b.ReadBytes(6); err != nil || !bytes.Equal(data, []byte(LuaData)) {
+		return errors.New("corrupted")
+	}
+	var err error
+	if _, err = b.headerSize("instruction", InstructionSize); err != nil {
+		return err
+	}
+	if b.integerSize, err = b.headerSize("lua_Integer", 4, 8); err != nil {
+		return err
+	}
+	if b.numberSize, err = b.headerSize("lua_Number", 4, 8); err != nil {
+		return err
+	}
+	return b.checkNumbers()
+}
+
+// readSize 读取变长整数, 高位在前, 每个字节保存 7 位, 最后一个字节的最高位为 1
+func (b *ByteCodeReader) readSize(limit uint64) (uint64, error) {
+	var x uint64
+	limit >>= 7
+	for {
+		c, err := b.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if x >= limit {
+			return 0, errors.New("integer overflow")
+		}
+		x = x<<7 | uint64(c&0x7f)
+		if c&0x80 != 0 {
+			return x, nil
+		}
+	}
+}
+
+func (b *ByteCodeReader) readInt54() (int, error) {
+	x, err := b.readSize(math.MaxInt32)
+	return int(x), err
+}
+
+// readString54 读取字符串, 长度加一保存为变长整数, 0 表示没有字符串
+func (b *ByteCodeReader) readString54() (string, error) {
+	size, err := b.readSize(math.MaxInt64)
+	if err != nil || size == 0 {
+		return "", err
+	}
+	data, err := b.ReadBytes(int(size - 1))
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// readFunction54 读取 Lua 5.4 的函数原型, 没有源文件名时使用外层函数的源文件名 parent
+func (b *ByteCodeReader) readFunction54(parent string) (*Prototype, error) {
+	res := &Prototype{Version: LuaVersion54}
+	var (
+		err      error
+		n        int
+		isVarArg byte
+	)
+	if res.Source, err = b.readString54(); err != nil {
+		return nil, err
+	}
+	if res.Source == "" {
+		res.Source = parent
+	}
+	if n, err = b.readInt54(); err != nil {
+		return nil, err
+	}
+	res.LineDefined = uint32(n)
+	if n, err = b.readInt54(); err != nil {
+		return nil, err
+	}
+	res.LastLineDefined = uint32(n)
+	if res.NumParams, err = b.ReadByte(); err != nil {
+		return nil, err
+	}
+	if isVarArg, err = b.ReadByte(); err != nil {
+		return nil, err
+	}
+	res.IsVararg = isVarArg != 0
+	if res.MaxStackSize, err = b.ReadByte(); err != nil {
+		return nil, err
+	}
+
+	if n, err = b.readInt54(); err != nil {
+		return nil, err
+	}
+	res.Code = make([]code.Instruction, 0, preallocate(n))
+	for i := 0; i < n; i++ {
+		c, err := b.ReadUint32()
+		if err != nil {
+			return nil, err
+		}
+		res.Code = append(res.Code, code.Instruction(c))
+	}
+
+	if n, err = b.readInt54(); err != nil {
+		return nil, err
+	}
+	res.Constants = make([]Value, 0, preallocate(n))
+	for i := 0; i < n; i++ {
+		c, err := b.readConstant54()
+		if err != nil {
+			return nil, err
+		}
+		res.Constants = append(res.Constants, c)
+	}
+
+	if n, err = b.readInt54(); err != nil {
+		return nil, err
+	}
+	res.UpValues = make([]UpValue, 0, preallocate(n))
+	for i := 0; i < n; i++ {
+		// instack, idx, kind, kind 只在编译时使用
+		val, err := b.ReadBytes(3)
+		if err != nil {
+			return nil, err
+		}
+		res.UpValues = append(res.UpValues, UpValue{val[0], val[1]})
+	}
+
+	if n, err = b.readInt54(); err != nil {
+		return nil, err
+	}
+	res.Prototypes = make([]*Prototype, 0, preallocate(n))
+	for i := 0; i < n; i++ {
+		p, err := b.readFunction54(res.Source)
+		if err != nil {
+			return nil, err
+		}
+		res.Prototypes = append(res.Prototypes, p)
+	}
+
+	if err := b.readDebug54(res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (b *ByteCodeReader) readConstant54() (Value, error) {
+	t, err := b.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	switch t {
+	case tag.Nil:
+		return GetNil(), nil
+	case tag.False54:
+		return Boolean(false), nil
+	case tag.True54:
+		return Boolean(true), nil
+	case tag.Number54:
+		f, err := b.ReadFloat()
+		if err != nil {
+			return nil, err
+		}
+		return Float(f), nil
+	case tag.Integer54:
+		i, err := b.ReadInt()
+		if err != nil {
+			return nil, err
+		}
+		return Integer(i), nil
+	case tag.ShortString, tag.LongString:
+		s, err := b.readString54()
+		if err != nil {
+			return nil, err
+		}
+		return String(s), nil
+	default:
+		return nil, errors.New("unsupported constant type")
+	}
+}
+
+// readDebug54 读取调试信息, 行号由相对前一条指令的差值和绝对行号表还原为每条指令的行号
+func (b *ByteCodeReader) readDebug54(p *Prototype) error {
+	n, err := b.readInt54()
+	if err != nil {
+		return err
+	}
+	lineInfo, err := b.ReadBytes(n)
+	if err != nil {
+		return err
+	}
+	if n, err = b.readInt54(); err != nil {
+		return err
+	}
+	abs := make([][2]int, 0, preallocate(n))
+	for i := 0; i < n; i++ {
+		var pc, line int
+		if pc, err = b.readInt54(); err != nil {
+			return err
+		}
+		if line, err = b.readInt54(); err != nil {
+			return err
+		}
+		abs = append(abs, [2]int{pc, line})
+	}
+	if len(lineInfo) > 0 {
+		p.LineInfo = make([]uint32, len(lineInfo))
+		line, j := int(p.LineDefined), 0
+		for pc, d := range lineInfo {
+			if int8(d) != absLineInfo {
+				line += int(int8(d))
+			} else {
+				for j < len(abs) && abs[j][0] < pc {
+					j++
+				}
+				if j == len(abs) || abs[j][0] != pc {
+					return errors.New("bad line info")
+				}
+				line = abs[j][1]
+			}
+			if line < 0 {
+				return errors.New("bad line info")
+			}
+			p.LineInfo[pc] = uint32(line)
+		}
+	}
+
+	if n, err = b.readInt54(); err != nil {
+		return err
+	}
+	count := n
+	p.LocalVariables = make([]*LocalVariable, 0, preallocate(count))
+	for i := 0; i < count; i++ {
+		v := &LocalVariable{}
+		if v.Name, err = b.readString54(); err != nil {
+			return err
+		}
+		if n, err = b.readInt54(); err != nil {
+			return err
+		}
+		v.StartPC = uint32(n)
+		if n, err = b.readInt54(); err != nil {
+			return err
+		}
+		v.EndPC = uint32(n)
+		p.LocalVariables = append(p.LocalVariables, v)
+	}
+
+	if n, err = b.readInt54(); err != nil {
+		return err
+	}
+	p.UpValueNames = make([]string, 0, preallocate(n))
+	for i := 0; i < n; i++ {
+		name, err := b.readString54()
+		if err != nil {
+			return err
+		}
+		p.UpValueNames = append(p.UpValueNames, name)
+	}
+	return nil
+}
@@ -1,9 +1,15 @@
 package types
 
 import (
+	"bytes"
+	"encoding/binary"
+	"math"
 	"os"
+	"runtime"
 	"testing"
 
+	"github.com/Salpadding/lua/types/code"
+	"github.com/Salpadding/lua/types/tag"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -33,3 +39,197 @@ func Test2(t *testing.T) {
 	}
 	assert.NotNil(t, proto)
 }
+
+// header 是代码块头部中的参数
+type header struct {
+	order                                       binary.ByteOrder
+	intSize, sizeTSize, integerSize, numberSize int
+}
+
+func (h header) put(buf *bytes.Buffer, size int, x uint64) {
+	data := make([]byte, 8)
+	h.order.PutUint64(data, x)
+	if h.order == binary.LittleEndian {
+		buf.Write(data[:size])
+	} else {
+		buf.Write(data[8-size:])
+	}
+}
+
+func (h header) putFloat(buf *bytes.Buffer, f float64) {
+	if h.numberSize == 4 {
+		h.put(buf, 4, uint64(math.Float32bits(float32(f))))
+	} else {
+		h.put(buf, 8, math.Float64bits(f))
+	}
+}
+
+// chunk 按照头部参数写入 return 1, -2, 1.5, ("x"):rep(300) 对应的代码块
+func (h header) chunk() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(LuaSignature)
+	buf.Write([]byte{LuaVersion, LuaFormat})
+	buf.WriteString(LuaData)
+	buf.Write([]byte{byte(h.intSize), byte(h.sizeTSize), InstructionSize, byte(h.integerSize), byte(h.numberSize)})
+	h.put(&buf, h.integerSize, LuaCInt)
+	h.putFloat(&buf, LuaCNumber)
+	buf.WriteByte(1) // size_upvalues
+
+	buf.WriteByte(7)
+	buf.WriteString("@t.lua")
+	h.put(&buf, h.intSize, 0)
+	h.put(&buf, h.intSize, 0)
+	buf.Write([]byte{0, 1, 5})
+	instructions := []code.Instruction{
+		code.CreateABx(code.LoadK, 1, 0),
+		code.CreateABx(code.LoadK, 2, 1),
+		code.CreateABx(code.LoadK, 3, 2),
+		code.CreateABx(code.LoadK, 4, 3),
+		code.CreateABC(code.Return, 1, 5, 0),
+	}
+	h.put(&buf, h.intSize, uint64(len(instructions)))
+	for _, i := range instructions {
+		h.put(&buf, 4, uint64(i))
+	}
+	h.put(&buf, h.intSize, 4)
+	buf.WriteByte(tag.Integer)
+	h.put(&buf, h.integerSize, 1)
+	buf.WriteByte(tag.Integer)
+	n := int64(-2)
+	h.put(&buf, h.integerSize, uint64(n))
+	buf.WriteByte(tag.Number)
+	h.putFloat(&buf, 1.5)
+	buf.Write([]byte{tag.LongString, 0xff})
+	h.put(&buf, h.sizeTSize, 301)
+	buf.Write(bytes.Repeat([]byte("x"), 300))
+	h.put(&buf, h.intSize, 1) // upvalues
+	buf.Write([]byte{1, 0})
+	h.put(&buf, h.intSize, 0) // protos
+	h.put(&buf, h.intSize, uint64(len(instructions)))
+	for range instructions {
+		h.put(&buf, h.intSize, 1)
+	}
+	h.put(&buf, h.intSize, 0) // locvars
+	h.put(&buf, h.intSize, 1)
+	buf.WriteByte(5)
+	buf.WriteString("_ENV")
+	return buf.Bytes()
+}
+
+func TestReadHeaderParameters(t *testing.T) {
+	native := header{binary.LittleEndian, 4, 8, 8, 8}.chunk()
+	expect, err := ReadPrototype(bytes.NewReader(native))
+	assert.NoError(t, err)
+	assert.Equal(t, []Value{Integer(1), Integer(-2), Float(1.5), String(bytes.Repeat([]byte("x"), 300))}, expect.Constants)
+	var buf bytes.Buffer
+	assert.NoError(t, WritePrototype(&buf, expect, false))
+	assert.Equal(t, native, buf.Bytes())
+
+	for _, h := range []header{
+		{binary.LittleEndian, 4, 4, 4, 4}, // LUA_32BITS
+		{binary.LittleEndian, 4, 4, 8, 8}, // 32 位平台
+		{binary.BigEndian, 4, 8, 8, 8},
+		{binary.BigEndian, 4, 4, 4, 4},
+		{binary.BigEndian, 8, 8, 4, 8},
+	} {
+		p, err := ReadPrototype(bytes.NewReader(h.chunk()))
+		assert.NoError(t, err, "%+v", h)
+		assert.Equal(t, expect, p, "%+v", h)
+	}
+
+	for _, c := range []struct {
+		offset int
+		value  byte
+		err    string
+	}{
+		{12, 2, "int size mismatch"},
+		{13, 16, "size_t size mismatch"},
+		{14, 8, "instruction size mismatch"},
+		{15, 2, "lua_Integer size mismatch"},
+		{16, 16, "lua_Number size mismatch"},
+		{17, 0x79, "endianness mismatch"},
+		{25, 0xff, "float format mismatch"},
+	} {
+		data := append([]byte(nil), native...)
+		data[c.offset] = c.value
+		_, err := ReadPrototype(bytes.NewReader(data))
+		assert.EqualError(t, err, c.err)
+	}
+}
+
+func TestReadHeaderParameters54(t *testing.T) {
+	// 大端, 4 字节整数和浮点数的 Lua 5.4 代码块
+	data := append([]byte(nil), luac54Empty[:12]...)
+	data = append(data, InstructionSize, 4, 4, 0x00, 0x00, 0x56, 0x78, 0x43, 0xb9, 0x40, 0x00)
+	body := append([]byte(nil), luac54Empty[31:]...)
+	for _, i := range []int{14, 18} {
+		// 指令的字节序
+		body[i], body[i+1], body[i+2], body[i+3] = body[i+3], body[i+2], body[i+1], body[i]
+	}
+	data = append(data, body...)
+
+	p, err := ReadPrototype(bytes.NewReader(data))
+	assert.NoError(t, err)
+	expect, err := ReadPrototype(bytes.NewReader(luac54Empty))
+	assert.NoError(t, err)
+	assert.Equal(t, expect, p)
+}
+
+// countOffset 返回 grow 给 p 的某个表增加一个元素之后, 代码块中第一个不同的字节的位置,
+// 也就是这个表的数量所在的位置
+func countOffset(t *testing.T, p *Prototype, grow func(p *Prototype)) ([]byte, int) {
+	var buf bytes.Buffer
+	assert.NoError(t, WritePrototype(&buf, p, false))
+	data := buf.Bytes()
+	q := *p
+	grow(&q)
+	buf = bytes.Buffer{}
+	assert.NoError(t, WritePrototype(&buf, &q, false))
+	for i := range data {
+		if data[i] != buf.Bytes()[i] {
+			return data, i
+		}
+	}
+	t.Fatal("the chunks are the same")
+	return nil, 0
+}
+
+func TestReadOversizedCount(t *testing.T) {
+	tables := map[string]func(p *Prototype){
+		"code":      func(p *Prototype) { p.Code = append(p.Code[:len(p.Code):len(p.Code)], p.Code[0]) },
+		"constants": func(p *Prototype) { p.Constants = append(p.Constants[:len(p.Constants):len(p.Constants)], GetNil()) },
+		"upvalues":  func(p *Prototype) { p.UpValues = append(p.UpValues[:len(p.UpValues):len(p.UpValues)], UpValue{}) },
+		"protos": func(p *Prototype) {
+			p.Prototypes = []*Prototype{{Source: p.Source, Code: p.Code[3:], Version: p.Version}}
+		},
+		"lineinfo": func(p *Prototype) { p.LineInfo = []uint32{1} },
+		"locvars":  func(p *Prototype) { p.LocalVariables = []*LocalVariable{{Name: "x"}} },
+		"upvalue names": func(p *Prototype) {
+			p.UpValueNames = []string{"_ENV"}
+		},
+	}
+	for _, c := range []struct {
+		p     *Prototype
+		count []byte // 接近 MaxInt32 的数量
+	}{
+		{testPrototype(), []byte{0xff, 0xff, 0xff, 0x7f}},
+		{testPrototype54(), []byte{0x07, 0x7f, 0x7f, 0x7e, 0xff}},
+	} {
+		for name, grow := range tables {
+			data, off := countOffset(t, c.p, grow)
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			for _, chunk := range [][]byte{
+				// 数量之后没有数据
+				append(append([]byte{}, data[:off]...), c.count...),
+				// 数量之后还有原来的数据
+				append(append(append([]byte{}, data[:off]...), c.count...), data[off+1:]...),
+			} {
+				_, err := ReadPrototype(bytes.NewReader(chunk))
+				assert.Error(t, err, name)
+			}
+			runtime.ReadMemStats(&after)
+			assert.True(t, after.TotalAlloc-before.TotalAlloc < 1<<20, "%s allocated %d bytes", name, after.TotalAlloc-before.TotalAlloc)
+		}
+	}
+}
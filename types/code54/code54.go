@@ -0,0 +1,305 @@
+// Package code54 定义 Lua 5.4 的指令格式和指令集
+package code54
+
+const (
+	MaxArgA  = 1<<8 - 1
+	MaxArgB  = 1<<8 - 1
+	MaxArgC  = 1<<8 - 1
+	MaxArgBx = 1<<17 - 1
+	MaxArgAx = 1<<25 - 1
+	MaxArgSJ = 1<<25 - 1
+
+	OffsetSBx = MaxArgBx >> 1 // sBx = Bx - OffsetSBx
+	OffsetSJ  = MaxArgSJ >> 1 // sJ = J - OffsetSJ
+	OffsetSC  = MaxArgC >> 1  // sB 和 sC = B 或者 C - OffsetSC
+)
+
+type OpMode int
+
+/* basic instruction format */
+const (
+	IABC  OpMode = iota // [  C:8  ][  B:8  ][k:1][ A:8  ][OP:7]
+	IABx                // [      Bx:17        ][ A:8  ][OP:7]
+	IAsBx               // [     sBx:17        ][ A:8  ][OP:7]
+	IAx                 // [           Ax:25           ][OP:7]
+	IsJ                 // [           sJ:25           ][OP:7]
+)
+
+type Type int
+
+const (
+	Move Type = iota
+	LoadI
+	LoadF
+	LoadK
+	LoadKX
+	LoadFalse
+	LFalseSkip
+	LoadTrue
+	LoadNil
+	GetUpValue
+	SetUpValue
+	GetTableUpValue
+	GetTable
+	GetI
+	GetField
+	SetTableUpValue
+	SetTable
+	SetI
+	SetField
+	NewTable
+	Self
+	AddI
+	AddK
+	SubK
+	MulK
+	ModK
+	PowK
+	DivK
+	IDivK
+	BitwiseAndK
+	BitwiseOrK
+	BitwiseXorK
+	ShiftRightI
+	ShiftLeftI
+	Add
+	Sub
+	Mul
+	Mod
+	Pow
+	Div
+	IDiv
+	BitwiseAnd
+	BitwiseOr
+	BitwiseXor
+	ShiftLeft
+	ShiftRight
+	MMBin
+	MMBinI
+	MMBinK
+	UnaryMinus
+	BitwiseNot
+	LogicalNot
+	Len
+	Concat
+	Close
+	TBC
+	Jmp
+	Equal
+	LessThan
+	LessThanOrEqual
+	EqualK
+	EqualI
+	LessThanI
+	LessThanOrEqualI
+	GreaterThanI
+	GreaterThanOrEqualI
+	Test
+	TestSet
+	Call
+	TailCall
+	Return
+	Return0
+	Return1
+	ForLoop
+	ForPrep
+	TForPrep
+	TForCall
+	TForLoop
+	SetList
+	Closure
+	VarArg
+	VarArgPrep
+	ExtraArg
+)
+
+func init() {
+	for i := range OpCodes {
+		OpCodes[i].Type = Type(i)
+	}
+}
+
+type OpCode struct {
+	Type     Type
+	MMFlag   byte // 调用元方法的指令
+	TestFlag byte // 下一条指令是跳转
+	SetAFlag byte // 修改寄存器 A
+	OpMode   OpMode
+	Name     string
+}
+
+var OpCodes = []*OpCode{
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 1, OpMode: IABC, Name: "MOVE"},       // R[A] := R[B]
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 1, OpMode: IAsBx, Name: "LOADI"},     // R[A] := sBx
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 1, OpMode: IAsBx, Name: "LOADF"},     // R[A] := (lua_Number)sBx
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 1, OpMode: IABx, Name: "LOADK"},      // R[A] := K[Bx]
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 1, OpMode: IABx, Name: "LOADKX"},     // R[A] := K[extra arg]
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 1, OpMode: IABC, Name: "LOADFALSE"},  // R[A] := false
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 1, OpMode: IABC, Name: "LFALSESKIP"}, // R[A] := false; pc++
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 1, OpMode: IABC, Name: "LOADTRUE"},   // R[A] := true
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 1, OpMode: IABC, Name: "LOADNIL"},    // R[A], R[A+1], ..., R[A+B] := nil
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 1, OpMode: IABC, Name: "GETUPVAL"},   // R[A] := UpValue[B]
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 0, OpMode: IABC, Name: "SETUPVAL"},   // UpValue[B] := R[A]
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 1, OpMode: IABC, Name: "GETTABUP"},   // R[A] := UpValue[B][K[C]:shortstring]
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 1, OpMode: IABC, Name: "GETTABLE"},   // R[A] := R[B][R[C]]
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 1, OpMode: IABC, Name: "GETI"},       // R[A] := R[B][C]
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 1, OpMode: IABC, Name: "GETFIELD"},   // R[A] := R[B][K[C]:shortstring]
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 0, OpMode: IABC, Name: "SETTABUP"},   // UpValue[A][K[B]:shortstring] := RK(C)
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 0, OpMode: IABC, Name: "SETTABLE"},   // R[A][R[B]] := RK(C)
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 0, OpMode: IABC, Name: "SETI"},       // R[A][B] := RK(C)
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 0, OpMode: IABC, Name: "SETFIELD"},   // R[A][K[B]:shortstring] := RK(C)
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 1, OpMode: IABC, Name: "NEWTABLE"},   // R[A] := {}
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 1, OpMode: IABC, Name: "SELF"},       // R[A+1] := R[B]; R[A] := R[B][RK(C):string]
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 1, OpMode: IABC, Name: "ADDI"},       // R[A] := R[B] + sC
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 1, OpMode: IABC, Name: "ADDK"},       // R[A] := R[B] + K[C]:number
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 1, OpMode: IABC, Name: "SUBK"},       // R[A] := R[B] - K[C]:number
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 1, OpMode: IABC, Name: "MULK"},       // R[A] := R[B] * K[C]:number
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 1, OpMode: IABC, Name: "MODK"},       // R[A] := R[B] % K[C]:number
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 1, OpMode: IABC, Name: "POWK"},       // R[A] := R[B] ^ K[C]:number
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 1, OpMode: IABC, Name: "DIVK"},       // R[A] := R[B] / K[C]:number
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 1, OpMode: IABC, Name: "IDIVK"},      // R[A] := R[B] // K[C]:number
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 1, OpMode: IABC, Name: "BANDK"},      // R[A] := R[B] & K[C]:integer
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 1, OpMode: IABC, Name: "BORK"},       // R[A] := R[B] | K[C]:integer
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 1, OpMode: IABC, Name: "BXORK"},      // R[A] := R[B] ~ K[C]:integer
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 1, OpMode: IABC, Name: "SHRI"},       // R[A] := R[B] >> sC
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 1, OpMode: IABC, Name: "SHLI"},       // R[A] := sC << R[B]
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 1, OpMode: IABC, Name: "ADD"},        // R[A] := R[B] + R[C]
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 1, OpMode: IABC, Name: "SUB"},        // R[A] := R[B] - R[C]
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 1, OpMode: IABC, Name: "MUL"},        // R[A] := R[B] * R[C]
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 1, OpMode: IABC, Name: "MOD"},        // R[A] := R[B] % R[C]
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 1, OpMode: IABC, Name: "POW"},        // R[A] := R[B] ^ R[C]
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 1, OpMode: IABC, Name: "DIV"},        // R[A] := R[B] / R[C]
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 1, OpMode: IABC, Name: "IDIV"},       // R[A] := R[B] // R[C]
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 1, OpMode: IABC, Name: "BAND"},       // R[A] := R[B] & R[C]
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 1, OpMode: IABC, Name: "BOR"},        // R[A] := R[B] | R[C]
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 1, OpMode: IABC, Name: "BXOR"},       // R[A] := R[B] ~ R[C]
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 1, OpMode: IABC, Name: "SHL"},        // R[A] := R[B] << R[C]
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 1, OpMode: IABC, Name: "SHR"},        // R[A] := R[B] >> R[C]
+	{MMFlag: 1, TestFlag: 0, SetAFlag: 0, OpMode: IABC, Name: "MMBIN"},      // call C metamethod over R[A] and R[B]
+	{MMFlag: 1, TestFlag: 0, SetAFlag: 0, OpMode: IABC, Name: "MMBINI"},     // call C metamethod over R[A] and sB
+	{MMFlag: 1, TestFlag: 0, SetAFlag: 0, OpMode: IABC, Name: "MMBINK"},     // call C metamethod over R[A] and K[B]
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 1, OpMode: IABC, Name: "UNM"},        // R[A] := -R[B]
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 1, OpMode: IABC, Name: "BNOT"},       // R[A] := ~R[B]
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 1, OpMode: IABC, Name: "NOT"},        // R[A] := not R[B]
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 1, OpMode: IABC, Name: "LEN"},        // R[A] := #R[B] (length operator)
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 1, OpMode: IABC, Name: "CONCAT"},     // R[A] := R[A].. ... ..R[A + B - 1]
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 0, OpMode: IABC, Name: "CLOSE"},      // close all upvalues >= R[A]
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 0, OpMode: IABC, Name: "TBC"},        // mark variable A "to be closed"
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 0, OpMode: IsJ, Name: "JMP"},         // pc += sJ
+	{MMFlag: 0, TestFlag: 1, SetAFlag: 0, OpMode: IABC, Name: "EQ"},         // if ((R[A] == R[B]) ~= k) then pc++
+	{MMFlag: 0, TestFlag: 1, SetAFlag: 0, OpMode: IABC, Name: "LT"},         // if ((R[A] <  R[B]) ~= k) then pc++
+	{MMFlag: 0, TestFlag: 1, SetAFlag: 0, OpMode: IABC, Name: "LE"},         // if ((R[A] <= R[B]) ~= k) then pc++
+	{MMFlag: 0, TestFlag: 1, SetAFlag: 0, OpMode: IABC, Name: "EQK"},        // if ((R[A] == K[B]) ~= k) then pc++
+	{MMFlag: 0, TestFlag: 1, SetAFlag: 0, OpMode: IABC, Name: "EQI"},        // if ((R[A] == sB) ~= k) then pc++
+	{MMFlag: 0, TestFlag: 1, SetAFlag: 0, OpMode: IABC, Name: "LTI"},        // if ((R[A] < sB) ~= k) then pc++
+	{MMFlag: 0, TestFlag: 1, SetAFlag: 0, OpMode: IABC, Name: "LEI"},        // if ((R[A] <= sB) ~= k) then pc++
+	{MMFlag: 0, TestFlag: 1, SetAFlag: 0, OpMode: IABC, Name: "GTI"},        // if ((R[A] > sB) ~= k) then pc++
+	{MMFlag: 0, TestFlag: 1, SetAFlag: 0, OpMode: IABC, Name: "GEI"},        // if ((R[A] >= sB) ~= k) then pc++
+	{MMFlag: 0, TestFlag: 1, SetAFlag: 0, OpMode: IABC, Name: "TEST"},       // if (not R[A] == k) then pc++
+	{MMFlag: 0, TestFlag: 1, SetAFlag: 1, OpMode: IABC, Name: "TESTSET"},    // if (not R[B] == k) then pc++ else R[A] := R[B]
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 1, OpMode: IABC, Name: "CALL"},       // R[A], ... ,R[A+C-2] := R[A](R[A+1], ... ,R[A+B-1])
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 1, OpMode: IABC, Name: "TAILCALL"},   // return R[A](R[A+1], ... ,R[A+B-1])
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 0, OpMode: IABC, Name: "RETURN"},     // return R[A], ... ,R[A+B-2]
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 0, OpMode: IABC, Name: "RETURN0"},    // return
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 0, OpMode: IABC, Name: "RETURN1"},    // return R[A]
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 1, OpMode: IABx, Name: "FORLOOP"},    // update counters; if loop continues then pc-=Bx;
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 1, OpMode: IABx, Name: "FORPREP"},    // <check values and prepare counters>; if not to run then pc+=Bx+1;
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 0, OpMode: IABx, Name: "TFORPREP"},   // create upvalue for R[A + 3]; pc+=Bx
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 0, OpMode: IABC, Name: "TFORCALL"},   // R[A+4], ... ,R[A+3+C] := R[A](R[A+1], R[A+2]);
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 1, OpMode: IABx, Name: "TFORLOOP"},   // if R[A+4] ~= nil then { R[A+2]=R[A+4]; pc -= Bx }
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 0, OpMode: IABC, Name: "SETLIST"},    // R[A][C+i] := R[A+i], 1 <= i <= B
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 1, OpMode: IABx, Name: "CLOSURE"},    // R[A] := closure(KPROTO[Bx])
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 1, OpMode: IABC, Name: "VARARG"},     // R[A], R[A+1], ..., R[A+C-2] = vararg
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 1, OpMode: IABC, Name: "VARARGPREP"}, // (adjust vararg parameters)
+	{MMFlag: 0, TestFlag: 0, SetAFlag: 0, OpMode: IAx, Name: "EXTRAARG"},    // extra (larger) argument for previous opcode
+}
+
+/*
+31     24 23     16  15  14     7 6      0
+[   C   ][   B   ][k][   A    ][  OP  ]
+*/
+type Instruction uint32
+
+// Valid 判断操作码是否存在
+func (ins Instruction) Valid() bool {
+	return int(ins&0x7f) < len(OpCodes)
+}
+
+func (ins Instruction) Opcode() *OpCode {
+	return OpCodes[ins&0x7f]
+}
+
+func (ins Instruction) OpName() string {
+	return ins.Opcode().Name
+}
+
+func (ins Instruction) A() int {
+	return int(ins >> 7 & 0xff)
+}
+
+func (ins Instruction) B() int {
+	return int(ins >> 16 & 0xff)
+}
+
+func (ins Instruction) C() int {
+	return int(ins >> 24 & 0xff)
+}
+
+// SB 返回有符号的 B
+func (ins Instruction) SB() int {
+	return ins.B() - OffsetSC
+}
+
+// SC 返回有符号的 C
+func (ins Instruction) SC() int {
+	return ins.C() - OffsetSC
+}
+
+func (ins Instruction) K() bool {
+	return ins>>15&1 != 0
+}
+
+func (ins Instruction) ABCk() (a, b, c int, k bool) {
+	return ins.A(), ins.B(), ins.C(), ins.K()
+}
+
+func (ins Instruction) ABx() (a, bx int) {
+	return ins.A(), int(ins >> 15)
+}
+
+func (ins Instruction) AsBx() (a, sbx int) {
+	a, bx := ins.ABx()
+	return a, bx - OffsetSBx
+}
+
+func (ins Instruction) Ax() int {
+	return int(ins >> 7)
+}
+
+func (ins Instruction) SJ() int {
+	return int(ins>>7) - OffsetSJ
+}
+
+func CreateABCk(op Type, a, b, c int, k bool) Instruction {
+	var kb int
+	if k {
+		kb = 1
+	}
+	return Instruction(c<<24 | b<<16 | kb<<15 | a<<7 | int(op))
+}
+
+func CreateABx(op Type, a, bx int) Instruction {
+	return Instruction(bx<<15 | a<<7 | int(op))
+}
+
+func CreateAsBx(op Type, a, sbx int) Instruction {
+	return CreateABx(op, a, sbx+OffsetSBx)
+}
+
+func CreateAx(op Type, ax int) Instruction {
+	return Instruction(ax<<7 | int(op))
+}
+
+func CreateSJ(op Type, sj int) Instruction {
+	return Instruction((sj+OffsetSJ)<<7 | int(op))
+}
@@ -12,4 +12,7 @@ const (
 	LuaNumberSize   = 8
 	LuaCInt         = 0x5678
 	LuaCNumber      = 370.5
+
+	// Lua 5.4 的代码块, 头部没有 int 和 size_t 的大小
+	LuaVersion54 = 0x54
 )
@@ -7,10 +7,12 @@ import (
 	"github.com/Salpadding/lua/types/value"
 )
 
+// FloatToInteger 把没有小数部分并且在整数范围内的浮点数转换为整数
 func FloatToInteger(f Float) (Integer, bool) {
-	// todo: correct?
-	i := Integer(f)
-	return i, Float(i) == f
+	if f >= -(1<<63) && f < 1<<63 && math.Floor(float64(f)) == float64(f) {
+		return Integer(f), true
+	}
+	return 0, false
 }
 
 // a % b == a - ((a // b) * b)
@@ -72,12 +74,12 @@ func Sub(a, b Value) (Value, bool) {
 
 func Mul(a, b Value) (Value, bool) {
 	ai, ok := a.(Integer)
-	bi, ok2 := a.(Integer)
+	bi, ok2 := b.(Integer)
 	if ok && ok2 {
 		return ai * bi, true
 	}
 	af, ok := a.ToFloat()
-	bf, ok2 := a.ToFloat()
+	bf, ok2 := b.ToFloat()
 	if !ok || !ok2 {
 		return nil, false
 	}
@@ -124,24 +126,17 @@ func Negative(a Value) (Value, bool) {
 	return nil, false
 }
 
-func sigMod(f Float) int {
-	if f < 0 {
-		return -1
-	}
-	if f > 0 {
-		return 1
-	}
-	return 0
-}
-
-func toComparison(i int) value.Comparison {
-	if i < 0 {
+// compareFloat 比较两个浮点数, 有 NaN 时返回 0
+func compareFloat(a, b Float) value.Comparison {
+	switch {
+	case a < b:
 		return value.LessThan
-	}
-	if i > 0 {
+	case a > b:
 		return value.GreaterThan
+	case a == b:
+		return value.Equal
 	}
-	return value.Equal
+	return 0
 }
 
 func Compare(a, b Value) (value.Comparison, bool) {
@@ -149,22 +144,33 @@ func Compare(a, b Value) (value.Comparison, bool) {
 	case String:
 		bs, ok := b.(String)
 		if ok {
-			return toComparison(strings.Compare(string(x), string(bs))), true
+			switch strings.Compare(string(x), string(bs)) {
+			case -1:
+				return value.LessThan, true
+			case 1:
+				return value.GreaterThan, true
+			}
+			return value.Equal, true
 		}
 	case Integer:
 		switch y := b.(type) {
 		case Integer:
-			return toComparison(int(x - y)), true
+			switch {
+			case x < y:
+				return value.LessThan, true
+			case x > y:
+				return value.GreaterThan, true
+			}
+			return value.Equal, true
 		case Float:
-			return toComparison(sigMod(Float(x) - y)), true
+			return compareFloat(Float(x), y), true
 		}
 	case Float:
 		switch y := b.(type) {
 		case Integer:
-			res, ok := Compare(b, a)
-			return -res, ok
+			return compareFloat(x, Float(y)), true
 		case Float:
-			return toComparison(sigMod(x - y)), true
+			return compareFloat(x, y), true
 		}
 	}
 	return 0, false
@@ -252,6 +258,9 @@ func equal(a, b Value) bool {
 	case Integer, Float:
 		cmp, _ := Compare(a, b)
 		return cmp == value.Equal
+	case Native:
+		bn, ok := b.(Native)
+		return ok && x.pointer() == bn.pointer()
 	default:
 		return a == b
 	}
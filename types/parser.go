@@ -11,12 +11,12 @@ var reInteger = regexp.MustCompile(`^[+-]?[0-9]+$|^-?0x[0-9a-f]+$`)
 var reHexFloat = regexp.MustCompile(`^([0-9a-f]+(\.[0-9a-f]*)?|([0-9a-f]*\.[0-9a-f]+))(p[+\-]?[0-9]+)?$`)
 
 func ParseNumber(str string) (Number, bool) {
+	str = strings.ToLower(strings.TrimSpace(str))
 	if reInteger.MatchString(str) {
-		i, ok := ParseInteger(str)
-		if !ok {
-			return nil, ok
+		if i, ok := ParseInteger(str); ok {
+			return Integer(i), ok
 		}
-		return Integer(i), ok
+		// 超出范围的十进制整数转换成浮点数
 	}
 	f, ok := ParseFloat(str)
 	if !ok {
@@ -8,3 +8,11 @@ const (
 	ShortString = 0x04
 	LongString  = 0x14
 )
+
+// Lua 5.4 的常量类型, 布尔值分为 false 和 true, 整数和浮点数的标记和 5.3 相反
+const (
+	False54   = 0x01
+	True54    = 0x11
+	Integer54 = 0x03
+	Number54  = 0x13
+)
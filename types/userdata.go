@@ -0,0 +1,85 @@
+package types
+
+import "github.com/Salpadding/lua/types/value"
+
+// Userdata 保存宿主程序的数据, 和表一样可以设置自己的元表
+type Userdata struct {
+	Data interface{}
+	meta *Table
+}
+
+// NewUserdata 创建保存 data 的 userdata
+func NewUserdata(data interface{}, meta *Table) *Userdata {
+	return &Userdata{Data: data, meta: meta}
+}
+
+// Metatable 返回元表, 没有元表时返回 nil
+func (u *Userdata) Metatable() *Table {
+	return u.meta
+}
+
+// SetMetatable 设置元表, meta 为 nil 时清除元表
+func (u *Userdata) SetMetatable(meta *Table) {
+	u.meta = meta
+}
+
+func (u *Userdata) value() {}
+
+func (u *Userdata) String() string { return "userdata" }
+
+func (u *Userdata) Type() value.Type {
+	return value.UserData
+}
+
+func (u *Userdata) ToNumber() (Number, bool) {
+	return nil, false
+}
+
+func (u *Userdata) ToInteger() (Integer, bool) {
+	return 0, false
+}
+
+func (u *Userdata) ToFloat() (Float, bool) {
+	return 0, false
+}
+
+func (u *Userdata) ToString() (string, bool) {
+	return "", false
+}
+
+func (u *Userdata) ToBoolean() Boolean {
+	return true
+}
+
+// LightUserdata 是只保存指针的 userdata, 指针相同的 light userdata 相等
+type LightUserdata struct {
+	Pointer interface{}
+}
+
+func (u LightUserdata) value() {}
+
+func (u LightUserdata) String() string { return "userdata" }
+
+func (u LightUserdata) Type() value.Type {
+	return value.UserData
+}
+
+func (u LightUserdata) ToNumber() (Number, bool) {
+	return nil, false
+}
+
+func (u LightUserdata) ToInteger() (Integer, bool) {
+	return 0, false
+}
+
+func (u LightUserdata) ToFloat() (Float, bool) {
+	return 0, false
+}
+
+func (u LightUserdata) ToString() (string, bool) {
+	return "", false
+}
+
+func (u LightUserdata) ToBoolean() Boolean {
+	return true
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"math"
 	"strconv"
+	"unsafe"
 
 	"github.com/Salpadding/lua/common"
 	"github.com/Salpadding/lua/types/value"
@@ -163,9 +164,7 @@ func (f Float) ToNumber() (Number, bool) {
 }
 
 func (f Float) ToInteger() (Integer, bool) {
-	// todo: correct?
-	i := int64(f)
-	return Integer(i), Float(i) == f
+	return FloatToInteger(f)
 }
 
 func (f Float) ToBoolean() Boolean {
@@ -235,7 +234,7 @@ func (s String) ToInteger() (Integer, bool) {
 		return Integer(i), ok
 	}
 	if f, ok := ParseFloat(string(s)); ok {
-		return Integer(f), float64(Integer(f)) == f
+		return FloatToInteger(Float(f))
 	}
 	return 0, false
 }
@@ -255,6 +254,11 @@ func (s String) ToFloat() (Float, bool) {
 type Table struct {
 	array *array
 	m     map[Value]Value
+	meta  *Table // 元表
+	alloc Allocator // 记录表增长使用的内存, 为 nil 时不记录
+
+	keys   []Value       // 遍历时哈希部分的键的顺序, 插入新的键时失效
+	keyIdx map[Value]int // 键在 keys 中的位置
 }
 
 func NewTable() *Table {
@@ -311,13 +315,10 @@ func (t *Table) Set(k Value, v Value) error {
 	case *Nil, *None:
 		return nil
 	case Integer:
-		if int(x) <= t.array.Len()+1 {
-			t.array.Set(int(x), v)
-			t.expand()
-			return nil
+		if x >= 1 && int(x) <= t.array.Len()+1 {
+			return t.setArray(int(x), v)
 		}
-		t.m[k] = v
-		return nil
+		return t.setMap(k, v)
 	case Float:
 		if math.IsNaN(float64(x)) {
 			return errors.New("NaN index")
@@ -326,15 +327,126 @@ func (t *Table) Set(k Value, v Value) error {
 		if ok {
 			return t.Set(i, v)
 		}
-		t.m[k] = v
-		return nil
+		return t.setMap(k, v)
 	default:
-		if v == nil || v.Type() == value.Nil {
-			return nil
+		return t.setMap(k, v)
+	}
+}
+
+// setArray 设置数组部分, 数组变长或者变短时记录内存的变化
+func (t *Table) setArray(idx int, v Value) error {
+	n := t.array.Len()
+	if idx == n+1 && v.Type() != value.Nil {
+		if err := t.allocate(ArrayEntrySize); err != nil {
+			return err
+		}
+	}
+	t.array.Set(idx, v)
+	if m := t.array.Len(); m < n {
+		t.free((n - m) * ArrayEntrySize)
+	}
+	t.expand()
+	return nil
+}
+
+// setMap 赋值为 nil 时删除键
+func (t *Table) setMap(k Value, v Value) error {
+	_, exists := t.m[k]
+	if v == nil || v.Type() == value.Nil {
+		if exists {
+			delete(t.m, k)
+			t.free(MapEntrySize)
 		}
-		t.m[k] = v
 		return nil
 	}
+	if !exists {
+		if err := t.allocate(MapEntrySize); err != nil {
+			return err
+		}
+		t.keys = nil
+	}
+	t.m[k] = v
+	return nil
+}
+
+// SetAllocator 设置记录表增长使用的内存的分配器
+func (t *Table) SetAllocator(alloc Allocator) {
+	t.alloc = alloc
+}
+
+func (t *Table) allocate(size int) error {
+	if t.alloc == nil {
+		return nil
+	}
+	return t.alloc.Alloc(size)
+}
+
+func (t *Table) free(size int) {
+	if t.alloc != nil {
+		t.alloc.Free(size)
+	}
+}
+
+// Next 返回 k 之后的下一个键值对, k 为 nil 时返回第一个, 遍历结束时返回两个 nil
+func (t *Table) Next(k Value) (Value, Value, error) {
+	i := 0 // 数组部分的下一个位置
+	j := 0 // 哈希部分的下一个位置
+	switch x := k.(type) {
+	case *Nil, *None:
+	case Integer:
+		if x >= 1 && int(x) <= t.array.Len() {
+			i = int(x)
+			break
+		}
+		i = t.array.Len()
+		if idx, ok := t.keyIndex()[k]; ok {
+			j = idx + 1
+		} else if x < 1 {
+			return nil, nil, errors.New("invalid key to 'next'")
+		}
+	default:
+		i = t.array.Len()
+		if f, ok := k.(Float); ok {
+			if n, ok := f.ToInteger(); ok {
+				return t.Next(n)
+			}
+		}
+		idx, ok := t.keyIndex()[k]
+		if !ok {
+			return nil, nil, errors.New("invalid key to 'next'")
+		}
+		j = idx + 1
+	}
+	for ; i < t.array.Len(); i++ {
+		if v := (*t.array)[i]; v.Type() != value.Nil {
+			return Integer(i + 1), v, nil
+		}
+	}
+	keys := t.keys
+	if keys == nil {
+		t.keyIndex()
+		keys = t.keys
+	}
+	for ; j < len(keys); j++ {
+		if v, ok := t.m[keys[j]]; ok {
+			return keys[j], v, nil
+		}
+	}
+	return GetNil(), GetNil(), nil
+}
+
+// keyIndex 返回哈希部分的键的位置, 需要时重新生成遍历顺序
+func (t *Table) keyIndex() map[Value]int {
+	if t.keys != nil {
+		return t.keyIdx
+	}
+	t.keys = make([]Value, 0, len(t.m))
+	t.keyIdx = make(map[Value]int, len(t.m))
+	for k := range t.m {
+		t.keyIdx[k] = len(t.keys)
+		t.keys = append(t.keys, k)
+	}
+	return t.keyIdx
 }
 
 func (t *Table) expand() {
@@ -344,8 +456,9 @@ func (t *Table) expand() {
 		if !ok || val.Type() == value.Nil {
 			break
 		}
-		delete(t.m, val)
+		delete(t.m, Integer(idx))
 		t.array.Set(idx, val)
+		t.free(MapEntrySize - ArrayEntrySize)
 		idx++
 	}
 }
@@ -353,13 +466,23 @@ func (t *Table) expand() {
 func (t *Table) Len() int {
 	return t.array.Len()
 }
+
+// Metatable 返回元表, 没有元表时返回 nil
+func (t *Table) Metatable() *Table {
+	return t.meta
+}
+
+// SetMetatable 设置元表, meta 为 nil 时清除元表
+func (t *Table) SetMetatable(meta *Table) {
+	t.meta = meta
+}
 func (t *Table) Get(k Value) (Value, error) {
 	v, ok := t.m[k]
 	switch x := k.(type) {
 	case *Nil, *None:
 		return GetNil(), nil
 	case Integer:
-		if int(x-1) < t.array.Len() {
+		if x >= 1 && int(x-1) < t.array.Len() {
 			return t.array.Get(int(x))
 		}
 	case Float:
@@ -380,6 +503,11 @@ func (t *Table) Get(k Value) (Value, error) {
 
 type Native func(args ...Value) ([]Value, error)
 
+// pointer 返回闭包对象的地址, 函数类型不能直接比较, 用地址区分不同的本地函数
+func (n Native) pointer() uintptr {
+	return uintptr(*(*unsafe.Pointer)(unsafe.Pointer(&n)))
+}
+
 func (n Native) value() {
 }
 
@@ -444,29 +572,36 @@ func (f *Function) ToBoolean() Boolean {
 	return true
 }
 
-type Thread func()
+// Thread 是协程, 协程的运行状态由虚拟机保存
+type Thread struct {
+	Coroutine interface{}
+}
 
-func (t Thread) ToString() (string, bool) {
+func (t *Thread) ToString() (string, bool) {
 	return "", false
 }
 
-func (t Thread) ToNumber() (Number, bool) {
+func (t *Thread) ToNumber() (Number, bool) {
 	return nil, false
 }
 
-func (t Thread) ToInteger() (Integer, bool) {
+func (t *Thread) ToInteger() (Integer, bool) {
+	return 0, false
+}
+
+func (t *Thread) ToFloat() (Float, bool) {
 	return 0, false
 }
 
-func (t Thread) value() {}
+func (t *Thread) value() {}
 
-func (t Thread) String() string { return "thread" }
+func (t *Thread) String() string { return "thread" }
 
-func (t Thread) Type() value.Type {
+func (t *Thread) Type() value.Type {
 	return value.Thread
 }
 
-func (t Thread) ToBoolean() Boolean {
+func (t *Thread) ToBoolean() Boolean {
 	return true
 }
 
@@ -499,13 +634,62 @@ func (l *array) shrink() {
 	if len(*l) == 0 {
 		return
 	}
-	for (*l)[len(*l)-1].Type() == value.Nil {
+	for len(*l) > 0 && (*l)[len(*l)-1].Type() == value.Nil {
 		*l = (*l)[:len(*l)-1]
 	}
 }
 
+// ValuePointer 是 upvalue 的存储单元, 同一个变量的闭包共享同一个单元
+// 打开时指向调用帧的寄存器, 关闭后保存变量自己的值
 type ValuePointer struct{
 	Value
+	stack *[]Value
+	index int
+}
+
+// NewOpenUpValue 创建指向寄存器 stack[index] 的 upvalue
+func NewOpenUpValue(stack *[]Value, index int) *ValuePointer {
+	return &ValuePointer{stack: stack, index: index}
+}
+
+// IsOpen 判断 upvalue 是否仍然指向寄存器
+func (v *ValuePointer) IsOpen() bool {
+	return v.stack != nil
+}
+
+// Get 返回 upvalue 的值
+func (v *ValuePointer) Get() Value {
+	if v.stack == nil {
+		if v.Value == nil {
+			return GetNil()
+		}
+		return v.Value
+	}
+	if v.index < len(*v.stack) {
+		return (*v.stack)[v.index]
+	}
+	return GetNil()
+}
+
+// Set 修改 upvalue 的值, 打开的 upvalue 直接写入寄存器
+func (v *ValuePointer) Set(x Value) {
+	if v.stack == nil {
+		v.Value = x
+		return
+	}
+	for v.index >= len(*v.stack) {
+		*v.stack = append(*v.stack, GetNil())
+	}
+	(*v.stack)[v.index] = x
+}
+
+// Close 把寄存器的值复制到 upvalue 中, 之后不再引用寄存器
+func (v *ValuePointer) Close() {
+	if v.stack == nil {
+		return
+	}
+	v.Value = v.Get()
+	v.stack = nil
 }
 
 func(v *ValuePointer) value() error{
@@ -18,6 +18,7 @@ var m = map[Type]string{
 	None:     "none",
 	Nil:      "nil",
 	Boolean:  "boolean",
+	Number:   "number",
 	String:   "string",
 	Table:    "table",
 	Function: "function",
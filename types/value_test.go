@@ -2,8 +2,10 @@ package types
 
 import (
 	"fmt"
+	"math"
 	"testing"
 
+	"github.com/Salpadding/lua/types/value"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -44,3 +46,51 @@ func TestLuaTable(t *testing.T){
 	assert.NoError(t, err)
 	assert.Equal(t, Integer(444), v)
 }
+
+func TestTableNext(t *testing.T) {
+	tb := NewTable()
+	assert.NoError(t, tb.Set(Integer(1), String("a")))
+	assert.NoError(t, tb.Set(Integer(2), String("b")))
+	assert.NoError(t, tb.Set(String("x"), Integer(1)))
+	assert.NoError(t, tb.Set(String("y"), Integer(2)))
+
+	seen := map[Value]Value{}
+	var k Value = GetNil()
+	for {
+		next, v, err := tb.Next(k)
+		assert.NoError(t, err)
+		if next.Type() == value.Nil {
+			break
+		}
+		seen[next] = v
+		// 遍历时删除当前键
+		if next == String("x") {
+			assert.NoError(t, tb.Set(next, GetNil()))
+		}
+		k = next
+	}
+	assert.Equal(t, map[Value]Value{
+		Integer(1): String("a"), Integer(2): String("b"), String("x"): Integer(1), String("y"): Integer(2),
+	}, seen)
+
+	_, _, err := tb.Next(String("missing"))
+	assert.Error(t, err)
+}
+
+func TestCompare(t *testing.T) {
+	cmp, ok := Compare(Float(1.5), Integer(2))
+	assert.True(t, ok)
+	assert.Equal(t, value.LessThan, cmp)
+	cmp, _ = Compare(Integer(math.MinInt64), Integer(math.MaxInt64))
+	assert.Equal(t, value.LessThan, cmp)
+	cmp, _ = Compare(Float(math.NaN()), Float(1))
+	assert.Equal(t, value.Comparison(0), cmp)
+	_, ok = Compare(String("a"), Integer(1))
+	assert.False(t, ok)
+
+	_, ok = Float(1e100).ToInteger()
+	assert.False(t, ok)
+	i, ok := Float(-3).ToInteger()
+	assert.True(t, ok)
+	assert.Equal(t, Integer(-3), i)
+}
@@ -0,0 +1,433 @@
+package types
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Salpadding/lua/types/code"
+	"github.com/Salpadding/lua/types/code54"
+)
+
+// maxRegisters 是函数能够使用的最大寄存器数量, 和 lua 的 MAXREGS 相同
+const maxRegisters = 255
+
+// bitRK 表示 B 或者 C 参数是常量索引
+const bitRK = 1 << 8
+
+// Verify 检查函数原型和内嵌的函数原型, 保证虚拟机执行时不会访问越界,
+// 从不可信的来源加载二进制代码块时应该在执行前调用
+func Verify(p *Prototype) error {
+	return verifyFunction(p, nil)
+}
+
+// verifier 检查一个函数原型, parent 是外层函数, 主函数为 nil
+type verifier struct {
+	p      *Prototype
+	parent *Prototype
+	pc     int
+	op     string // 当前指令的名字
+}
+
+func verifyFunction(p *Prototype, parent *Prototype) error {
+	v := &verifier{p: p, parent: parent, pc: -1}
+	if err := v.verify(); err != nil {
+		return err
+	}
+	v.pc, v.op = -1, ""
+	for _, sub := range p.Prototypes {
+		if sub == nil {
+			return v.errorf("nil function prototype")
+		}
+		if sub.Version != p.Version {
+			return v.errorf("nested function has a different version")
+		}
+		if err := verifyFunction(sub, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (v *verifier) errorf(format string, args ...interface{}) error {
+	source := v.p.Source
+	if source != "" && (source[0] == '@' || source[0] == '=') {
+		source = source[1:]
+	}
+	where := fmt.Sprintf("function <%s:%d,%d>", source, v.p.LineDefined, v.p.LastLineDefined)
+	if v.pc >= 0 {
+		where += fmt.Sprintf(" instruction %d", v.pc+1)
+		if v.op != "" {
+			where += fmt.Sprintf(" (%s)", strings.TrimSpace(v.op))
+		}
+	}
+	return fmt.Errorf("bad binary chunk: %s: %s", where, fmt.Sprintf(format, args...))
+}
+
+func (v *verifier) verify() error {
+	p := v.p
+	if p.MaxStackSize > maxRegisters {
+		return v.errorf("max stack size %d too large", p.MaxStackSize)
+	}
+	if p.NumParams > p.MaxStackSize {
+		return v.errorf("%d parameters exceed max stack size %d", p.NumParams, p.MaxStackSize)
+	}
+	if len(p.LineInfo) != 0 && len(p.LineInfo) != len(p.Code) {
+		return v.errorf("%d line info entries for %d instructions", len(p.LineInfo), len(p.Code))
+	}
+	if len(p.UpValueNames) > len(p.UpValues) {
+		return v.errorf("%d upvalue names for %d upvalues", len(p.UpValueNames), len(p.UpValues))
+	}
+	for _, l := range p.LocalVariables {
+		if l == nil || l.StartPC > l.EndPC || int(l.EndPC) > len(p.Code) {
+			return v.errorf("invalid local variable range")
+		}
+	}
+	if v.parent != nil {
+		for i, uv := range p.UpValues {
+			if uv[0] != 0 && int(uv[1]) >= int(v.parent.MaxStackSize) {
+				return v.errorf("upvalue %d refers to register %d out of range (max stack size %d)", i, uv[1], v.parent.MaxStackSize)
+			}
+			if uv[0] == 0 && int(uv[1]) >= len(v.parent.UpValues) {
+				return v.errorf("upvalue %d refers to upvalue %d out of range (%d upvalues)", i, uv[1], len(v.parent.UpValues))
+			}
+		}
+	}
+	for _, c := range p.Constants {
+		switch c.(type) {
+		case *Nil, Boolean, Integer, Float, String:
+		default:
+			return v.errorf("invalid constant %v", c)
+		}
+	}
+	if len(p.Code) == 0 {
+		return v.errorf("empty code")
+	}
+	if p.Version == LuaVersion54 {
+		return v.verify54()
+	}
+	// 最后一条指令必须是 RETURN, 保证 pc 不会超出代码的范围
+	if last := p.Code[len(p.Code)-1]; int(last&0x3f) >= len(code.OpCodes) || last.Opcode().Type != code.Return {
+		v.pc = len(p.Code) - 1
+		return v.errorf("last instruction is not RETURN")
+	}
+	for v.pc = 0; v.pc < len(p.Code); v.pc++ {
+		if err := v.instruction(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// instruction 检查 pc 处的指令
+func (v *verifier) instruction() error {
+	ins := v.p.Code[v.pc]
+	v.op = ""
+	if int(ins&0x3f) >= len(code.OpCodes) {
+		return v.errorf("invalid opcode %d", ins&0x3f)
+	}
+	op := ins.Opcode()
+	v.op = op.Name
+	if err := v.top(); err != nil {
+		return err
+	}
+	a, b, c := ins.ABC()
+	_, bx := ins.ABx()
+	_, sbx := ins.AsBx()
+
+	switch op.Type {
+	case code.Move, code.UnaryMinus, code.BitwiseNot, code.LogicalNot, code.Len:
+		return v.registers(a, b)
+	case code.TestSet:
+		if err := v.registers(a, b); err != nil {
+			return err
+		}
+		return v.jump(v.pc + 2)
+	case code.LoadK:
+		if err := v.registers(a); err != nil {
+			return err
+		}
+		return v.constant(bx)
+	case code.LoadKX:
+		if err := v.registers(a); err != nil {
+			return err
+		}
+		return v.extraArg(true)
+	case code.LoadBool:
+		if err := v.registers(a); err != nil {
+			return err
+		}
+		if c != 0 {
+			return v.jump(v.pc + 2)
+		}
+	case code.LoadNil:
+		return v.registers(a, a+b)
+	case code.GetUpValue:
+		if err := v.registers(a); err != nil {
+			return err
+		}
+		return v.upValue(b)
+	case code.SetUpValue:
+		if err := v.registers(a); err != nil {
+			return err
+		}
+		return v.upValue(b)
+	case code.GetTableUpValue:
+		if err := v.registers(a); err != nil {
+			return err
+		}
+		if err := v.upValue(b); err != nil {
+			return err
+		}
+		return v.rk(c)
+	case code.SetTableUpValue:
+		if err := v.upValue(a); err != nil {
+			return err
+		}
+		return v.rk(b, c)
+	case code.GetTable:
+		if err := v.registers(a, b); err != nil {
+			return err
+		}
+		return v.rk(c)
+	case code.SetTable:
+		if err := v.registers(a); err != nil {
+			return err
+		}
+		return v.rk(b, c)
+	case code.NewTable:
+		return v.registers(a)
+	case code.Test:
+		if err := v.registers(a); err != nil {
+			return err
+		}
+		return v.jump(v.pc + 2)
+	case code.Self:
+		if err := v.registers(a, a+1, b); err != nil {
+			return err
+		}
+		return v.rk(c)
+	case code.Add, code.Sub, code.Mul, code.Mod, code.Pow, code.Div, code.IDiv,
+		code.BitwiseAnd, code.BitwiseOr, code.BitwiseXor, code.ShiftLeft, code.ShiftRight:
+		if err := v.registers(a); err != nil {
+			return err
+		}
+		return v.rk(b, c)
+	case code.Concat:
+		if b > c {
+			return v.errorf("invalid register range %d..%d", b, c)
+		}
+		return v.registers(a, b, c)
+	case code.Jmp:
+		if a > 0 {
+			if err := v.registers(a - 1); err != nil {
+				return err
+			}
+		}
+		return v.jump(v.pc + 1 + sbx)
+	case code.Equal, code.LessThan, code.LessThanOrEqual:
+		if err := v.rk(b, c); err != nil {
+			return err
+		}
+		return v.jump(v.pc + 2)
+	case code.Call:
+		if err := v.registers(a); err != nil {
+			return err
+		}
+		if b > 0 {
+			if err := v.registers(a + b - 1); err != nil {
+				return err
+			}
+		}
+		if c > 1 {
+			return v.registers(a + c - 2)
+		}
+	case code.TailCall:
+		if err := v.registers(a); err != nil {
+			return err
+		}
+		if b > 0 {
+			return v.registers(a + b - 1)
+		}
+	case code.Return, code.VarArg:
+		if b != 1 {
+			if err := v.registers(a); err != nil {
+				return err
+			}
+		}
+		if b > 1 {
+			return v.registers(a + b - 2)
+		}
+	case code.ForLoop, code.ForPrep:
+		if err := v.registers(a, a+3); err != nil {
+			return err
+		}
+		return v.jump(v.pc + 1 + sbx)
+	case code.TForCall:
+		if err := v.registers(a, a+2+c); err != nil {
+			return err
+		}
+		return v.jump(v.pc + 1)
+	case code.TForLoop:
+		if err := v.registers(a, a+1); err != nil {
+			return err
+		}
+		return v.jump(v.pc + 1 + sbx)
+	case code.SetList:
+		if err := v.registers(a, a+b); err != nil {
+			return err
+		}
+		if c == 0 {
+			return v.extraArg(false)
+		}
+	case code.Closure:
+		if err := v.registers(a); err != nil {
+			return err
+		}
+		if bx >= len(v.p.Prototypes) {
+			return v.errorf("function index %d out of range (%d functions)", bx, len(v.p.Prototypes))
+		}
+	case code.ExtraArg:
+		return v.errorf("EXTRAARG must follow LOADKX or SETLIST")
+	}
+	return nil
+}
+
+// registers 检查寄存器索引
+func (v *verifier) registers(regs ...int) error {
+	for _, r := range regs {
+		if r < 0 || r >= int(v.p.MaxStackSize) {
+			return v.errorf("register %d out of range (max stack size %d)", r, v.p.MaxStackSize)
+		}
+	}
+	return nil
+}
+
+// rk 检查寄存器或者常量索引
+func (v *verifier) rk(args ...int) error {
+	for _, x := range args {
+		var err error
+		if x&bitRK != 0 {
+			err = v.constant(x &^ bitRK)
+		} else {
+			err = v.registers(x)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (v *verifier) constant(i int) error {
+	if i >= len(v.p.Constants) {
+		return v.errorf("constant index %d out of range (%d constants)", i, len(v.p.Constants))
+	}
+	return nil
+}
+
+func (v *verifier) upValue(i int) error {
+	if i >= len(v.p.UpValues) {
+		return v.errorf("upvalue index %d out of range (%d upvalues)", i, len(v.p.UpValues))
+	}
+	return nil
+}
+
+// jump 检查跳转目标, 目标不能是 EXTRAARG 的参数, 也不能是使用栈顶的指令
+func (v *verifier) jump(target int) error {
+	if target < 0 || target >= len(v.p.Code) {
+		return v.errorf("jump target %d out of range (%d instructions)", target+1, len(v.p.Code))
+	}
+	if v.isExtraArg(target) {
+		return v.errorf("jump target %d is an EXTRAARG argument", target+1)
+	}
+	if v.usesTop(target) {
+		return v.errorf("jump target %d uses the top of the stack", target+1)
+	}
+	return nil
+}
+
+// top 检查 pc 处的指令使用栈顶时, 前一条指令是否设置了栈顶
+func (v *verifier) top() error {
+	if v.usesTop(v.pc) && (v.pc == 0 || !v.setsTop(v.pc-1)) {
+		return v.errorf("the top of the stack is not set by the previous instruction")
+	}
+	return nil
+}
+
+// usesTop 判断 pc 处的指令是否使用前一条指令设置的栈顶,
+// 也就是 B 为 0 的 CALL, TAILCALL, RETURN 和 SETLIST
+func (v *verifier) usesTop(pc int) bool {
+	if v.p.Version == LuaVersion54 {
+		return usesTop54(code54.Instruction(v.p.Code[pc]))
+	}
+	ins := v.p.Code[pc]
+	if int(ins&0x3f) >= len(code.OpCodes) {
+		return false
+	}
+	switch ins.Opcode().Type {
+	case code.Call, code.TailCall, code.Return, code.SetList:
+		_, b, _ := ins.ABC()
+		return b == 0
+	}
+	return false
+}
+
+// setsTop 判断 pc 处的指令是否把结果放到栈顶, 也就是 C 为 0 的 CALL,
+// B 为 0 的 VARARG 和 TAILCALL
+func (v *verifier) setsTop(pc int) bool {
+	if v.p.Version == LuaVersion54 {
+		return setsTop54(code54.Instruction(v.p.Code[pc]))
+	}
+	ins := v.p.Code[pc]
+	if int(ins&0x3f) >= len(code.OpCodes) {
+		return false
+	}
+	_, b, c := ins.ABC()
+	switch ins.Opcode().Type {
+	case code.Call:
+		return c == 0
+	case code.VarArg:
+		return b == 0
+	case code.TailCall:
+		return true
+	}
+	return false
+}
+
+// extraArg 检查下一条指令是否是 EXTRAARG, 检查后跳过这条指令,
+// constant 为真时参数是常量索引
+func (v *verifier) extraArg(constant bool) error {
+	next := v.pc + 1
+	if next >= len(v.p.Code) || v.p.Code[next]&0x3f != code.Instruction(code.ExtraArg) {
+		return v.errorf("missing EXTRAARG")
+	}
+	ax := v.p.Code[next].Ax()
+	if constant {
+		if err := v.constant(ax); err != nil {
+			return err
+		}
+	} else if ax == 0 {
+		return v.errorf("invalid SETLIST block 0")
+	}
+	v.pc = next
+	return nil
+}
+
+// isExtraArg 判断 pc 处的指令是否是 LOADKX 或者 SETLIST 使用的 EXTRAARG
+func (v *verifier) isExtraArg(pc int) bool {
+	if v.p.Version == LuaVersion54 {
+		return v.isExtraArg54(pc)
+	}
+	if pc == 0 || v.p.Code[pc]&0x3f != code.Instruction(code.ExtraArg) {
+		return false
+	}
+	prev := v.p.Code[pc-1]
+	switch prev & 0x3f {
+	case code.Instruction(code.LoadKX):
+		return true
+	case code.Instruction(code.SetList):
+		_, _, c := prev.ABC()
+		return c == 0
+	}
+	return false
+}
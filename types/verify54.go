@@ -0,0 +1,303 @@
+package types
+
+import (
+	"github.com/Salpadding/lua/types/code54"
+)
+
+// verify54 检查 Lua 5.4 的指令
+func (v *verifier) verify54() error {
+	p := v.p
+	// 最后一条指令必须是 RETURN, RETURN0 或者 RETURN1
+	last := code54.Instruction(p.Code[len(p.Code)-1])
+	if !last.Valid() {
+		v.pc = len(p.Code) - 1
+		return v.errorf("last instruction is not RETURN")
+	}
+	switch last.Opcode().Type {
+	case code54.Return, code54.Return0, code54.Return1:
+	default:
+		v.pc = len(p.Code) - 1
+		return v.errorf("last instruction is not RETURN")
+	}
+	for v.pc = 0; v.pc < len(p.Code); v.pc++ {
+		if err := v.instruction54(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// instruction54 检查 pc 处的 Lua 5.4 指令
+func (v *verifier) instruction54() error {
+	ins := code54.Instruction(v.p.Code[v.pc])
+	v.op = ""
+	if !ins.Valid() {
+		return v.errorf("invalid opcode %d", ins&0x7f)
+	}
+	op := ins.Opcode()
+	v.op = op.Name
+	if err := v.top(); err != nil {
+		return err
+	}
+	a, b, c, k := ins.ABCk()
+	_, bx := ins.ABx()
+
+	switch op.Type {
+	case code54.Move, code54.GetI, code54.AddI, code54.ShiftRightI, code54.ShiftLeftI,
+		code54.UnaryMinus, code54.BitwiseNot, code54.LogicalNot, code54.Len, code54.MMBin:
+		return v.registers(a, b)
+	case code54.LoadI, code54.LoadF, code54.LoadFalse, code54.LoadTrue, code54.Close, code54.TBC,
+		code54.MMBinI, code54.Return1:
+		return v.registers(a)
+	case code54.LoadK:
+		if err := v.registers(a); err != nil {
+			return err
+		}
+		return v.constant(bx)
+	case code54.LoadKX:
+		if err := v.registers(a); err != nil {
+			return err
+		}
+		return v.extraArg54(true)
+	case code54.LFalseSkip:
+		if err := v.registers(a); err != nil {
+			return err
+		}
+		return v.jump(v.pc + 2)
+	case code54.LoadNil:
+		return v.registers(a, a+b)
+	case code54.GetUpValue, code54.SetUpValue:
+		if err := v.registers(a); err != nil {
+			return err
+		}
+		return v.upValue(b)
+	case code54.GetTableUpValue:
+		if err := v.registers(a); err != nil {
+			return err
+		}
+		if err := v.upValue(b); err != nil {
+			return err
+		}
+		return v.constant(c)
+	case code54.GetField, code54.AddK, code54.SubK, code54.MulK, code54.ModK, code54.PowK, code54.DivK,
+		code54.IDivK, code54.BitwiseAndK, code54.BitwiseOrK, code54.BitwiseXorK:
+		if err := v.registers(a, b); err != nil {
+			return err
+		}
+		return v.constant(c)
+	case code54.SetTableUpValue:
+		if err := v.upValue(a); err != nil {
+			return err
+		}
+		if err := v.constant(b); err != nil {
+			return err
+		}
+		return v.rkc(c, k)
+	case code54.SetTable:
+		if err := v.registers(a, b); err != nil {
+			return err
+		}
+		return v.rkc(c, k)
+	case code54.SetI:
+		if err := v.registers(a); err != nil {
+			return err
+		}
+		return v.rkc(c, k)
+	case code54.SetField:
+		if err := v.registers(a); err != nil {
+			return err
+		}
+		if err := v.constant(b); err != nil {
+			return err
+		}
+		return v.rkc(c, k)
+	case code54.NewTable:
+		if err := v.registers(a); err != nil {
+			return err
+		}
+		return v.extraArg54(false)
+	case code54.Self:
+		if err := v.registers(a, a+1, b); err != nil {
+			return err
+		}
+		return v.rkc(c, k)
+	case code54.GetTable, code54.Add, code54.Sub, code54.Mul, code54.Mod, code54.Pow, code54.Div, code54.IDiv,
+		code54.BitwiseAnd, code54.BitwiseOr, code54.BitwiseXor, code54.ShiftLeft, code54.ShiftRight:
+		return v.registers(a, b, c)
+	case code54.MMBinK:
+		if err := v.registers(a); err != nil {
+			return err
+		}
+		return v.constant(b)
+	case code54.Concat:
+		if b == 0 {
+			return v.errorf("invalid register range %d..%d", a, a+b-1)
+		}
+		return v.registers(a, a+b-1)
+	case code54.Jmp:
+		return v.jump(v.pc + 1 + ins.SJ())
+	case code54.Equal, code54.LessThan, code54.LessThanOrEqual, code54.TestSet:
+		if err := v.registers(a, b); err != nil {
+			return err
+		}
+		return v.jump(v.pc + 2)
+	case code54.EqualK:
+		if err := v.registers(a); err != nil {
+			return err
+		}
+		if err := v.constant(b); err != nil {
+			return err
+		}
+		return v.jump(v.pc + 2)
+	case code54.EqualI, code54.LessThanI, code54.LessThanOrEqualI, code54.GreaterThanI, code54.GreaterThanOrEqualI,
+		code54.Test:
+		if err := v.registers(a); err != nil {
+			return err
+		}
+		return v.jump(v.pc + 2)
+	case code54.Call:
+		if err := v.registers(a); err != nil {
+			return err
+		}
+		if b > 0 {
+			if err := v.registers(a + b - 1); err != nil {
+				return err
+			}
+		}
+		if c > 1 {
+			return v.registers(a + c - 2)
+		}
+	case code54.TailCall:
+		if err := v.registers(a); err != nil {
+			return err
+		}
+		if b > 0 {
+			return v.registers(a + b - 1)
+		}
+	case code54.Return:
+		if b != 1 {
+			if err := v.registers(a); err != nil {
+				return err
+			}
+		}
+		if b > 1 {
+			return v.registers(a + b - 2)
+		}
+	case code54.VarArg:
+		if c != 1 {
+			if err := v.registers(a); err != nil {
+				return err
+			}
+		}
+		if c > 1 {
+			return v.registers(a + c - 2)
+		}
+	case code54.ForLoop:
+		if err := v.registers(a, a+3); err != nil {
+			return err
+		}
+		return v.jump(v.pc + 1 - bx)
+	case code54.ForPrep:
+		if err := v.registers(a, a+3); err != nil {
+			return err
+		}
+		return v.jump(v.pc + 2 + bx)
+	case code54.TForPrep:
+		if err := v.registers(a, a+3); err != nil {
+			return err
+		}
+		return v.jump(v.pc + 1 + bx)
+	case code54.TForCall:
+		if err := v.registers(a, a+3+c); err != nil {
+			return err
+		}
+		return v.jump(v.pc + 1)
+	case code54.TForLoop:
+		if err := v.registers(a, a+4); err != nil {
+			return err
+		}
+		return v.jump(v.pc + 1 - bx)
+	case code54.SetList:
+		if err := v.registers(a, a+b); err != nil {
+			return err
+		}
+		if k {
+			return v.extraArg54(false)
+		}
+	case code54.Closure:
+		if err := v.registers(a); err != nil {
+			return err
+		}
+		if bx >= len(v.p.Prototypes) {
+			return v.errorf("function index %d out of range (%d functions)", bx, len(v.p.Prototypes))
+		}
+	case code54.ExtraArg:
+		return v.errorf("EXTRAARG must follow LOADKX, NEWTABLE or SETLIST")
+	}
+	return nil
+}
+
+// rkc 检查 k 标志决定的寄存器或者常量索引
+func (v *verifier) rkc(c int, k bool) error {
+	if k {
+		return v.constant(c)
+	}
+	return v.registers(c)
+}
+
+// extraArg54 检查下一条指令是否是 EXTRAARG, 检查后跳过这条指令,
+// constant 为真时参数是常量索引
+func (v *verifier) extraArg54(constant bool) error {
+	next := v.pc + 1
+	if next >= len(v.p.Code) || code54.Instruction(v.p.Code[next])&0x7f != code54.Instruction(code54.ExtraArg) {
+		return v.errorf("missing EXTRAARG")
+	}
+	if constant {
+		if err := v.constant(code54.Instruction(v.p.Code[next]).Ax()); err != nil {
+			return err
+		}
+	}
+	v.pc = next
+	return nil
+}
+
+// isExtraArg54 判断 pc 处的指令是否是 LOADKX, NEWTABLE 或者 SETLIST 使用的 EXTRAARG
+func (v *verifier) isExtraArg54(pc int) bool {
+	if pc == 0 || code54.Instruction(v.p.Code[pc])&0x7f != code54.Instruction(code54.ExtraArg) {
+		return false
+	}
+	prev := code54.Instruction(v.p.Code[pc-1])
+	switch prev & 0x7f {
+	case code54.Instruction(code54.LoadKX), code54.Instruction(code54.NewTable):
+		return true
+	case code54.Instruction(code54.SetList):
+		return prev.K()
+	}
+	return false
+}
+
+// usesTop54 判断 Lua 5.4 的指令是否使用前一条指令设置的栈顶
+func usesTop54(ins code54.Instruction) bool {
+	if !ins.Valid() {
+		return false
+	}
+	switch ins.Opcode().Type {
+	case code54.Call, code54.TailCall, code54.Return, code54.SetList:
+		return ins.B() == 0
+	}
+	return false
+}
+
+// setsTop54 判断 Lua 5.4 的指令是否把结果放到栈顶
+func setsTop54(ins code54.Instruction) bool {
+	if !ins.Valid() {
+		return false
+	}
+	switch ins.Opcode().Type {
+	case code54.Call, code54.VarArg:
+		return ins.C() == 0
+	case code54.TailCall:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,181 @@
+package types
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/Salpadding/lua/types/code"
+	"github.com/Salpadding/lua/types/code54"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyLuac(t *testing.T) {
+	files, err := filepath.Glob("../vm/testdata/*.o")
+	assert.NoError(t, err)
+	files = append(files, "../vm/testdata/luac.out", "testdata/hello_world.o")
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		assert.NoError(t, err)
+		proto, err := ReadPrototype(bytes.NewReader(data))
+		assert.NoError(t, err)
+		assert.NoError(t, Verify(proto), file)
+	}
+}
+
+// testPrototype 返回 print("hi") 对应的函数原型
+func testPrototype() *Prototype {
+	return &Prototype{
+		Source:       "@test.lua",
+		IsVararg:     true,
+		MaxStackSize: 2,
+		Code: []code.Instruction{
+			code.CreateABC(code.GetTableUpValue, 0, 0, bitRK|0),
+			code.CreateABx(code.LoadK, 1, 1),
+			code.CreateABC(code.Call, 0, 2, 1),
+			code.CreateABC(code.Return, 0, 1, 0),
+		},
+		Constants: []Value{String("print"), String("hi")},
+		UpValues:  []UpValue{{1, 0}},
+	}
+}
+
+func TestVerify(t *testing.T) {
+	assert.NoError(t, Verify(testPrototype()))
+
+	for _, c := range []struct {
+		pc  int
+		ins code.Instruction
+		err string
+	}{
+		{0, code.CreateABC(code.GetTableUpValue, 0, 1, bitRK|0), "instruction 1 (GETTABUP): upvalue index 1 out of range (1 upvalues)"},
+		{0, code.CreateABC(code.GetTableUpValue, 2, 0, bitRK|0), "instruction 1 (GETTABUP): register 2 out of range (max stack size 2)"},
+		{0, code.CreateABC(code.GetTableUpValue, 0, 0, bitRK|5), "instruction 1 (GETTABUP): constant index 5 out of range (2 constants)"},
+		{1, code.CreateABx(code.LoadK, 1, 2), "instruction 2 (LOADK): constant index 2 out of range (2 constants)"},
+		{1, code.CreateAsBx(code.Jmp, 0, 5), "instruction 2 (JMP): jump target 8 out of range (4 instructions)"},
+		{1, code.CreateAsBx(code.Jmp, 0, -3), "instruction 2 (JMP): jump target 0 out of range (4 instructions)"},
+		{1, code.CreateABx(code.Closure, 1, 0), "instruction 2 (CLOSURE): function index 0 out of range (0 functions)"},
+		{1, code.CreateABx(code.LoadKX, 1, 0), "instruction 2 (LOADKX): missing EXTRAARG"},
+		{1, code.CreateAx(code.ExtraArg, 0), "instruction 2 (EXTRAARG): EXTRAARG must follow LOADKX or SETLIST"},
+		{1, code.CreateABC(code.Call, 0, 3, 1), "instruction 2 (CALL): register 2 out of range (max stack size 2)"},
+		{2, code.CreateABC(code.Equal, 0, 0, 1), "instruction 3 (EQ): jump target 5 out of range (4 instructions)"},
+		{3, code.CreateABC(code.Call, 0, 1, 1), "instruction 4: last instruction is not RETURN"},
+		{1, code.Instruction(60), "instruction 2: invalid opcode 60"},
+	} {
+		p := testPrototype()
+		p.Code[c.pc] = c.ins
+		assert.EqualError(t, Verify(p), "bad binary chunk: function <test.lua:0,0> "+c.err)
+	}
+
+	p := testPrototype()
+	p.Code[1] = code.CreateABx(code.LoadKX, 1, 0)
+	p.Code[2] = code.CreateAx(code.ExtraArg, 1)
+	assert.NoError(t, Verify(p))
+	p.Code[2] = code.CreateAx(code.ExtraArg, 3)
+	assert.EqualError(t, Verify(p), "bad binary chunk: function <test.lua:0,0> instruction 2 (LOADKX): constant index 3 out of range (2 constants)")
+	p.Code[2] = code.CreateAx(code.ExtraArg, 1)
+	p.Code[0] = code.CreateAsBx(code.Jmp, 0, 1)
+	assert.EqualError(t, Verify(p), "bad binary chunk: function <test.lua:0,0> instruction 1 (JMP): jump target 3 is an EXTRAARG argument")
+
+	// TEST 和 TESTSET 可能跳过下一条指令
+	p = testPrototype()
+	p.Code = []code.Instruction{code.CreateABC(code.Test, 0, 0, 1), code.CreateABC(code.Return, 0, 1, 0)}
+	assert.EqualError(t, Verify(p), "bad binary chunk: function <test.lua:0,0> instruction 1 (TEST): jump target 3 out of range (2 instructions)")
+	p.Code[0] = code.CreateABC(code.TestSet, 0, 1, 1)
+	assert.EqualError(t, Verify(p), "bad binary chunk: function <test.lua:0,0> instruction 1 (TESTSET): jump target 3 out of range (2 instructions)")
+
+	// B 为 0 时前一条指令必须设置栈顶
+	p = testPrototype()
+	p.Code = []code.Instruction{code.CreateABC(code.Return, 0, 0, 0)}
+	assert.EqualError(t, Verify(p), "bad binary chunk: function <test.lua:0,0> instruction 1 (RETURN): the top of the stack is not set by the previous instruction")
+	p.Code = []code.Instruction{code.CreateABC(code.Call, 0, 0, 1), code.CreateABC(code.Return, 0, 1, 0)}
+	assert.EqualError(t, Verify(p), "bad binary chunk: function <test.lua:0,0> instruction 1 (CALL): the top of the stack is not set by the previous instruction")
+	p.Code = []code.Instruction{code.CreateABC(code.VarArg, 1, 0, 0), code.CreateABC(code.Call, 0, 0, 0), code.CreateABC(code.Return, 0, 0, 0)}
+	assert.NoError(t, Verify(p))
+	p.Code = []code.Instruction{code.CreateAsBx(code.Jmp, 0, 1), code.CreateABC(code.Call, 0, 2, 0), code.CreateABC(code.Return, 0, 0, 0)}
+	assert.EqualError(t, Verify(p), "bad binary chunk: function <test.lua:0,0> instruction 1 (JMP): jump target 3 uses the top of the stack")
+
+	p = testPrototype()
+	p.LineInfo = []uint32{1}
+	assert.EqualError(t, Verify(p), "bad binary chunk: function <test.lua:0,0>: 1 line info entries for 4 instructions")
+
+	// 内嵌函数的 upvalue 必须指向外层函数的寄存器或者 upvalue
+	sub := testPrototype()
+	sub.LineDefined, sub.LastLineDefined = 1, 3
+	sub.UpValues = []UpValue{{0, 1}}
+	p = testPrototype()
+	p.Prototypes = []*Prototype{sub}
+	assert.EqualError(t, Verify(p), "bad binary chunk: function <test.lua:1,3>: upvalue 0 refers to upvalue 1 out of range (1 upvalues)")
+	sub.UpValues = []UpValue{{1, 2}}
+	assert.EqualError(t, Verify(p), "bad binary chunk: function <test.lua:1,3>: upvalue 0 refers to register 2 out of range (max stack size 2)")
+}
+
+// testPrototype54 返回 Lua 5.4 的 print("hi") 对应的函数原型
+func testPrototype54() *Prototype {
+	return &Prototype{
+		Source:       "@test.lua",
+		IsVararg:     true,
+		MaxStackSize: 2,
+		Code: []code.Instruction{
+			code.Instruction(code54.CreateABCk(code54.GetTableUpValue, 0, 0, 0, false)),
+			code.Instruction(code54.CreateABx(code54.LoadK, 1, 1)),
+			code.Instruction(code54.CreateABCk(code54.Call, 0, 2, 1, false)),
+			code.Instruction(code54.CreateABCk(code54.Return, 0, 1, 1, false)),
+		},
+		Constants: []Value{String("print"), String("hi")},
+		UpValues:  []UpValue{{1, 0}},
+		Version:   LuaVersion54,
+	}
+}
+
+func TestVerify54(t *testing.T) {
+	assert.NoError(t, Verify(testPrototype54()))
+
+	for _, c := range []struct {
+		pc  int
+		ins code54.Instruction
+		err string
+	}{
+		{0, code54.CreateABCk(code54.GetTableUpValue, 0, 1, 0, false), "instruction 1 (GETTABUP): upvalue index 1 out of range (1 upvalues)"},
+		{0, code54.CreateABCk(code54.GetTableUpValue, 0, 0, 5, false), "instruction 1 (GETTABUP): constant index 5 out of range (2 constants)"},
+		{1, code54.CreateABCk(code54.SetField, 0, 0, 3, true), "instruction 2 (SETFIELD): constant index 3 out of range (2 constants)"},
+		{1, code54.CreateABCk(code54.SetField, 0, 0, 3, false), "instruction 2 (SETFIELD): register 3 out of range (max stack size 2)"},
+		{1, code54.CreateABCk(code54.Add, 0, 1, 2, false), "instruction 2 (ADD): register 2 out of range (max stack size 2)"},
+		{1, code54.CreateSJ(code54.Jmp, 5), "instruction 2 (JMP): jump target 8 out of range (4 instructions)"},
+		{1, code54.CreateABx(code54.ForLoop, 0, 3), "instruction 2 (FORLOOP): register 3 out of range (max stack size 2)"},
+		{1, code54.CreateABCk(code54.NewTable, 0, 0, 0, false), "instruction 2 (NEWTABLE): missing EXTRAARG"},
+		{1, code54.CreateAx(code54.ExtraArg, 0), "instruction 2 (EXTRAARG): EXTRAARG must follow LOADKX, NEWTABLE or SETLIST"},
+		{2, code54.CreateABCk(code54.EqualI, 0, 0, 0, false), "instruction 3 (EQI): jump target 5 out of range (4 instructions)"},
+		{3, code54.CreateABCk(code54.Call, 0, 1, 1, false), "instruction 4: last instruction is not RETURN"},
+		{1, code54.Instruction(90), "instruction 2: invalid opcode 90"},
+	} {
+		p := testPrototype54()
+		p.Code[c.pc] = code.Instruction(c.ins)
+		assert.EqualError(t, Verify(p), "bad binary chunk: function <test.lua:0,0> "+c.err)
+	}
+
+	p := testPrototype54()
+	p.Code[1] = code.Instruction(code54.CreateABCk(code54.NewTable, 1, 0, 0, false))
+	p.Code[2] = code.Instruction(code54.CreateAx(code54.ExtraArg, 0))
+	assert.NoError(t, Verify(p))
+	p.Code[0] = code.Instruction(code54.CreateSJ(code54.Jmp, 1))
+	assert.EqualError(t, Verify(p), "bad binary chunk: function <test.lua:0,0> instruction 1 (JMP): jump target 3 is an EXTRAARG argument")
+
+	p = testPrototype54()
+	p.Code = []code.Instruction{code.Instruction(code54.CreateABCk(code54.Return, 0, 0, 1, false))}
+	assert.EqualError(t, Verify(p), "bad binary chunk: function <test.lua:0,0> instruction 1 (RETURN): the top of the stack is not set by the previous instruction")
+	p.Code = []code.Instruction{
+		code.Instruction(code54.CreateABCk(code54.VarArg, 1, 0, 0, false)),
+		code.Instruction(code54.CreateABCk(code54.Call, 0, 0, 0, false)),
+		code.Instruction(code54.CreateABCk(code54.Return, 0, 0, 1, false)),
+	}
+	assert.NoError(t, Verify(p))
+	p.Code[0] = code.Instruction(code54.CreateABCk(code54.VarArg, 1, 0, 2, false))
+	assert.EqualError(t, Verify(p), "bad binary chunk: function <test.lua:0,0> instruction 2 (CALL): the top of the stack is not set by the previous instruction")
+
+	// 内嵌函数和外层函数的版本必须相同
+	p = testPrototype54()
+	p.Prototypes = []*Prototype{testPrototype()}
+	assert.EqualError(t, Verify(p), "bad binary chunk: function <test.lua:0,0>: nested function has a different version")
+}
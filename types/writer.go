@@ -0,0 +1,200 @@
+package types
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+
+	"github.com/Salpadding/lua/types/tag"
+)
+
+// maxShortLen 是短字符串的最大长度, 和 lua 的 LUAI_MAXSHORTLEN 相同
+const maxShortLen = 40
+
+var errUnsupportedConstant = errors.New("unsupported constant type")
+
+// ByteCodeWriter 把函数原型写成二进制代码块, 输出和 luac 完全相同
+type ByteCodeWriter struct {
+	io.Writer
+	Strip bool // 去掉调试信息, 相当于 luac -s
+
+	buf bytes.Buffer
+}
+
+func (b *ByteCodeWriter) WriteByte(c byte) error {
+	return b.buf.WriteByte(c)
+}
+
+func (b *ByteCodeWriter) WriteUint32(i uint32) {
+	var data [4]byte
+	binary.LittleEndian.PutUint32(data[:], i)
+	b.buf.Write(data[:])
+}
+
+func (b *ByteCodeWriter) WriteUint64(i uint64) {
+	var data [8]byte
+	binary.LittleEndian.PutUint64(data[:], i)
+	b.buf.Write(data[:])
+}
+
+func (b *ByteCodeWriter) WriteInt(i int64) {
+	b.WriteUint64(uint64(i))
+}
+
+func (b *ByteCodeWriter) WriteFloat(f float64) {
+	b.WriteUint64(math.Float64bits(f))
+}
+
+// WriteString 写入字符串, 长度加一后小于 0xff 时用一个字节表示, 否则写入 0xff 和 size_t
+func (b *ByteCodeWriter) WriteString(s string) {
+	size := uint64(len(s)) + 1
+	if size < 0xff {
+		b.buf.WriteByte(byte(size))
+	} else {
+		b.buf.WriteByte(0xff)
+		b.WriteUint64(size)
+	}
+	b.buf.WriteString(s)
+}
+
+// Dump 写入头部和主函数原型
+func (b *ByteCodeWriter) Dump(p *Prototype) error {
+	if p == nil {
+		return errors.New("nil prototype")
+	}
+	b.buf.Reset()
+	if p.Version == LuaVersion54 {
+		b.writeHeader54()
+		b.buf.WriteByte(byte(len(p.UpValues))) // size_upvalues
+		if err := b.writePrototype54(p, nil); err != nil {
+			return err
+		}
+	} else {
+		b.writeHeader()
+		b.buf.WriteByte(byte(len(p.UpValues))) // size_upvalues
+		if err := b.writePrototype(p, nil); err != nil {
+			return err
+		}
+	}
+	_, err := b.Writer.Write(b.buf.Bytes())
+	return err
+}
+
+func (b *ByteCodeWriter) writeHeader() {
+	b.buf.WriteString(LuaSignature)
+	b.buf.WriteByte(LuaVersion)
+	b.buf.WriteByte(LuaFormat)
+	b.buf.WriteString(LuaData)
+	b.buf.WriteByte(CIntSize)
+	b.buf.WriteByte(CSizeTSize)
+	b.buf.WriteByte(InstructionSize)
+	b.buf.WriteByte(LuaIntegerSize)
+	b.buf.WriteByte(LuaNumberSize)
+	b.WriteInt(LuaCInt)
+	b.WriteFloat(LuaCNumber)
+}
+
+// writePrototype 写入函数原型, 和外层函数相同的源文件名不重复写入
+func (b *ByteCodeWriter) writePrototype(p *Prototype, parentSource *string) error {
+	if b.Strip || parentSource != nil && p.Source == *parentSource {
+		b.buf.WriteByte(0)
+	} else {
+		b.WriteString(p.Source)
+	}
+	b.WriteUint32(p.LineDefined)
+	b.WriteUint32(p.LastLineDefined)
+	b.buf.WriteByte(p.NumParams)
+	if p.IsVararg {
+		b.buf.WriteByte(1)
+	} else {
+		b.buf.WriteByte(0)
+	}
+	b.buf.WriteByte(p.MaxStackSize)
+
+	b.WriteUint32(uint32(len(p.Code)))
+	for _, c := range p.Code {
+		b.WriteUint32(uint32(c))
+	}
+	b.WriteUint32(uint32(len(p.Constants)))
+	for _, c := range p.Constants {
+		if err := b.writeConstant(c); err != nil {
+			return err
+		}
+	}
+	b.WriteUint32(uint32(len(p.UpValues)))
+	for _, u := range p.UpValues {
+		b.buf.Write(u[:])
+	}
+	b.WriteUint32(uint32(len(p.Prototypes)))
+	for _, sub := range p.Prototypes {
+		if err := b.writePrototype(sub, &p.Source); err != nil {
+			return err
+		}
+	}
+	b.writeDebug(p)
+	return nil
+}
+
+func (b *ByteCodeWriter) writeConstant(c Value) error {
+	switch c := c.(type) {
+	case *Nil:
+		b.buf.WriteByte(tag.Nil)
+	case Boolean:
+		b.buf.WriteByte(tag.Boolean)
+		if c {
+			b.buf.WriteByte(1)
+		} else {
+			b.buf.WriteByte(0)
+		}
+	case Float:
+		b.buf.WriteByte(tag.Number)
+		b.WriteFloat(float64(c))
+	case Integer:
+		b.buf.WriteByte(tag.Integer)
+		b.WriteInt(int64(c))
+	case String:
+		if len(c) <= maxShortLen {
+			b.buf.WriteByte(tag.ShortString)
+		} else {
+			b.buf.WriteByte(tag.LongString)
+		}
+		b.WriteString(string(c))
+	default:
+		return errUnsupportedConstant
+	}
+	return nil
+}
+
+// writeDebug 写入调试信息, Strip 时只写入三个 0
+func (b *ByteCodeWriter) writeDebug(p *Prototype) {
+	if b.Strip {
+		b.WriteUint32(0)
+		b.WriteUint32(0)
+		b.WriteUint32(0)
+		return
+	}
+	b.WriteUint32(uint32(len(p.LineInfo)))
+	for _, line := range p.LineInfo {
+		b.WriteUint32(line)
+	}
+	b.WriteUint32(uint32(len(p.LocalVariables)))
+	for _, v := range p.LocalVariables {
+		b.WriteString(v.Name)
+		b.WriteUint32(v.StartPC)
+		b.WriteUint32(v.EndPC)
+	}
+	b.WriteUint32(uint32(len(p.UpValueNames)))
+	for _, name := range p.UpValueNames {
+		b.WriteString(name)
+	}
+}
+
+// WritePrototype 把函数原型写成二进制代码块, strip 为真时不写入调试信息
+func WritePrototype(w io.Writer, p *Prototype, strip bool) error {
+	return (&ByteCodeWriter{
+		Writer: w,
+		Strip:  strip,
+	}).Dump(p)
+}
@@ -0,0 +1,160 @@
+package types
+
+import (
+	"github.com/Salpadding/lua/types/tag"
+)
+
+const (
+	limLineDiff = 0x80 // lineinfo 中能保存的行号差的上限
+	maxIWthAbs  = 128  // 两个绝对行号之间最多的指令数量
+)
+
+func (b *ByteCodeWriter) writeHeader54() {
+	b.buf.WriteString(LuaSignature)
+	b.buf.WriteByte(LuaVersion54)
+	b.buf.WriteByte(LuaFormat)
+	b.buf.WriteString(LuaData)
+	b.buf.WriteByte(InstructionSize)
+	b.buf.WriteByte(LuaIntegerSize)
+	b.buf.WriteByte(LuaNumberSize)
+	b.WriteInt(LuaCInt)
+	b.WriteFloat(LuaCNumber)
+}
+
+// writeSize 写入变长整数, 高位在前, 最后一个字节的最高位为 1
+func (b *ByteCodeWriter) writeSize(x uint64) {
+	var buf [10]byte
+	n := len(buf)
+	for {
+		n--
+		buf[n] = byte(x & 0x7f)
+		x >>= 7
+		if x == 0 {
+			break
+		}
+	}
+	buf[len(buf)-1] |= 0x80
+	b.buf.Write(buf[n:])
+}
+
+func (b *ByteCodeWriter) writeString54(s string) {
+	b.writeSize(uint64(len(s)) + 1)
+	b.buf.WriteString(s)
+}
+
+// writePrototype54 按照 Lua 5.4 的格式写入函数原型
+func (b *ByteCodeWriter) writePrototype54(p *Prototype, parentSource *string) error {
+	if b.Strip || parentSource != nil && p.Source == *parentSource {
+		b.writeSize(0)
+	} else {
+		b.writeString54(p.Source)
+	}
+	b.writeSize(uint64(p.LineDefined))
+	b.writeSize(uint64(p.LastLineDefined))
+	b.buf.WriteByte(p.NumParams)
+	if p.IsVararg {
+		b.buf.WriteByte(1)
+	} else {
+		b.buf.WriteByte(0)
+	}
+	b.buf.WriteByte(p.MaxStackSize)
+
+	b.writeSize(uint64(len(p.Code)))
+	for _, c := range p.Code {
+		b.WriteUint32(uint32(c))
+	}
+	b.writeSize(uint64(len(p.Constants)))
+	for _, c := range p.Constants {
+		if err := b.writeConstant54(c); err != nil {
+			return err
+		}
+	}
+	b.writeSize(uint64(len(p.UpValues)))
+	for _, u := range p.UpValues {
+		b.buf.Write(u[:])
+		b.buf.WriteByte(0) // kind
+	}
+	b.writeSize(uint64(len(p.Prototypes)))
+	for _, sub := range p.Prototypes {
+		if err := b.writePrototype54(sub, &p.Source); err != nil {
+			return err
+		}
+	}
+	b.writeDebug54(p)
+	return nil
+}
+
+func (b *ByteCodeWriter) writeConstant54(c Value) error {
+	switch c := c.(type) {
+	case *Nil:
+		b.buf.WriteByte(tag.Nil)
+	case Boolean:
+		if c {
+			b.buf.WriteByte(tag.True54)
+		} else {
+			b.buf.WriteByte(tag.False54)
+		}
+	case Float:
+		b.buf.WriteByte(tag.Number54)
+		b.WriteFloat(float64(c))
+	case Integer:
+		b.buf.WriteByte(tag.Integer54)
+		b.WriteInt(int64(c))
+	case String:
+		if len(c) <= maxShortLen {
+			b.buf.WriteByte(tag.ShortString)
+		} else {
+			b.buf.WriteByte(tag.LongString)
+		}
+		b.writeString54(string(c))
+	default:
+		return errUnsupportedConstant
+	}
+	return nil
+}
+
+// writeDebug54 把每条指令的行号转换为和前一条指令的差值, 差值太大或者间隔太远时写入绝对行号
+func (b *ByteCodeWriter) writeDebug54(p *Prototype) {
+	if b.Strip || len(p.LineInfo) == 0 {
+		b.writeSize(0)
+		b.writeSize(0)
+	} else {
+		lineInfo := make([]byte, len(p.LineInfo))
+		var abs [][2]int
+		prev, count := int(p.LineDefined), 0
+		for pc, l := range p.LineInfo {
+			line := int(l)
+			diff := line - prev
+			if diff <= -limLineDiff || diff >= limLineDiff || count >= maxIWthAbs {
+				abs = append(abs, [2]int{pc, line})
+				diff = absLineInfo
+				count = 0
+			}
+			count++
+			lineInfo[pc] = byte(int8(diff))
+			prev = line
+		}
+		b.writeSize(uint64(len(lineInfo)))
+		b.buf.Write(lineInfo)
+		b.writeSize(uint64(len(abs)))
+		for _, a := range abs {
+			b.writeSize(uint64(a[0]))
+			b.writeSize(uint64(a[1]))
+		}
+	}
+	if b.Strip {
+		b.writeSize(0)
+		b.writeSize(0)
+		return
+	}
+	b.writeSize(uint64(len(p.LocalVariables)))
+	for _, v := range p.LocalVariables {
+		b.writeString54(v.Name)
+		b.writeSize(uint64(v.StartPC))
+		b.writeSize(uint64(v.EndPC))
+	}
+	b.writeSize(uint64(len(p.UpValueNames)))
+	for _, name := range p.UpValueNames {
+		b.writeString54(name)
+	}
+}
@@ -0,0 +1,159 @@
+package types
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/Salpadding/lua/types/code"
+	"github.com/Salpadding/lua/types/code54"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriterRoundTrip(t *testing.T) {
+	files, err := filepath.Glob("../vm/testdata/*.o")
+	assert.NoError(t, err)
+	files = append(files, "../vm/testdata/luac.out", "testdata/hello_world.o")
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		assert.NoError(t, err)
+		proto, err := ReadPrototype(bytes.NewReader(data))
+		assert.NoError(t, err, file)
+
+		var buf bytes.Buffer
+		assert.NoError(t, WritePrototype(&buf, proto, false))
+		assert.Equal(t, data, buf.Bytes(), file)
+
+		got, err := ReadPrototype(&buf)
+		assert.NoError(t, err, file)
+		assert.Equal(t, proto, got, file)
+	}
+}
+
+func TestWriterStrip(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/hello_world.o")
+	assert.NoError(t, err)
+	proto, err := ReadPrototype(bytes.NewReader(data))
+	assert.NoError(t, err)
+
+	var buf bytes.Buffer
+	assert.NoError(t, WritePrototype(&buf, proto, true))
+	stripped, err := ReadPrototype(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "", stripped.Source)
+	assert.Empty(t, stripped.LineInfo)
+	assert.Empty(t, stripped.LocalVariables)
+	assert.Empty(t, stripped.UpValueNames)
+	assert.Equal(t, proto.Code, stripped.Code)
+	assert.Equal(t, proto.Constants, stripped.Constants)
+}
+
+func TestWriteString(t *testing.T) {
+	long := string(bytes.Repeat([]byte("x"), 300))
+	for _, s := range []string{"", "short", long} {
+		w := &ByteCodeWriter{}
+		w.WriteString(s)
+		got, err := (&ByteCodeReader{Reader: &w.buf}).ReadString()
+		assert.NoError(t, err)
+		assert.Equal(t, s, got)
+	}
+	w := &ByteCodeWriter{}
+	w.WriteString(long)
+	assert.Equal(t, byte(0xff), w.buf.Bytes()[0])
+}
+
+// luac54Empty 是 Lua 5.4 的 luac 编译空文件的结果
+var luac54Empty = []byte{
+	0x1b, 'L', 'u', 'a', 0x54, 0x00, 0x19, 0x93, '\r', '\n', 0x1a, '\n', 0x04, 0x08, 0x08,
+	0x78, 0x56, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x28, 0x77, 0x40,
+	0x01,                               // size_upvalues
+	0x87, '=', 's', 't', 'd', 'i', 'n', // source
+	0x80, 0x80, 0x00, 0x01, 0x02, // linedefined, lastlinedefined, numparams, is_vararg, maxstacksize
+	0x82, 0x51, 0x00, 0x00, 0x00, 0x46, 0x00, 0x01, 0x01, // VARARGPREP 0, RETURN 0 1 1
+	0x80,                   // constants
+	0x81, 0x01, 0x00, 0x00, // upvalues
+	0x80,             // protos
+	0x82, 0x01, 0x00, // lineinfo
+	0x80,                           // abslineinfo
+	0x80,                           // locvars
+	0x81, 0x85, '_', 'E', 'N', 'V', // upvalue names
+}
+
+func TestReadLua54(t *testing.T) {
+	proto, err := ReadPrototype(bytes.NewReader(luac54Empty))
+	assert.NoError(t, err)
+	assert.Equal(t, byte(LuaVersion54), proto.Version)
+	assert.Equal(t, "=stdin", proto.Source)
+	assert.True(t, proto.IsVararg)
+	assert.Equal(t, []code.Instruction{
+		code.Instruction(code54.CreateABCk(code54.VarArgPrep, 0, 0, 0, false)),
+		code.Instruction(code54.CreateABCk(code54.Return, 0, 1, 1, false)),
+	}, proto.Code)
+	assert.Equal(t, []UpValue{{1, 0}}, proto.UpValues)
+	assert.Equal(t, []uint32{1, 1}, proto.LineInfo)
+	assert.Equal(t, []string{"_ENV"}, proto.UpValueNames)
+	assert.NoError(t, Verify(proto))
+
+	var buf bytes.Buffer
+	assert.NoError(t, WritePrototype(&buf, proto, false))
+	assert.Equal(t, luac54Empty, buf.Bytes())
+}
+
+func TestWriter54RoundTrip(t *testing.T) {
+	sub := &Prototype{
+		Source:          "@test.lua",
+		LineDefined:     2,
+		LastLineDefined: 300,
+		MaxStackSize:    2,
+		Code:            make([]code.Instruction, 200),
+		Constants:       []Value{},
+		UpValues:        []UpValue{{1, 0}},
+		Prototypes:      []*Prototype{},
+		LineInfo:        make([]uint32, 200),
+		LocalVariables:  []*LocalVariable{},
+		UpValueNames:    []string{"x"},
+		Version:         LuaVersion54,
+	}
+	for i := range sub.Code {
+		sub.Code[i] = code.Instruction(code54.CreateABCk(code54.Return0, 0, 0, 0, false))
+		// 行号差超过 127 或者连续 128 条指令没有绝对行号时写入绝对行号
+		sub.LineInfo[i] = uint32(3 + i/2)
+	}
+	sub.LineInfo[10] = 290
+	proto := &Prototype{
+		Source:         "@test.lua",
+		IsVararg:       true,
+		MaxStackSize:   2,
+		Code:           []code.Instruction{code.Instruction(code54.CreateABx(code54.Closure, 0, 0)), code.Instruction(code54.CreateABCk(code54.Return, 0, 1, 1, false))},
+		Constants:      []Value{GetNil(), Boolean(true), Boolean(false), Integer(-1), Float(1.5), String("s"), String(bytes.Repeat([]byte("x"), 300))},
+		UpValues:       []UpValue{{1, 0}},
+		Prototypes:     []*Prototype{sub},
+		LineInfo:       []uint32{300, 1},
+		LocalVariables: []*LocalVariable{{Name: "x", StartPC: 1, EndPC: 2}},
+		UpValueNames:   []string{"_ENV"},
+		Version:        LuaVersion54,
+	}
+	assert.NoError(t, Verify(proto))
+
+	var buf bytes.Buffer
+	assert.NoError(t, WritePrototype(&buf, proto, false))
+	data := append([]byte(nil), buf.Bytes()...)
+	got, err := ReadPrototype(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, proto, got)
+
+	buf.Reset()
+	assert.NoError(t, WritePrototype(&buf, got, false))
+	assert.Equal(t, data, buf.Bytes())
+
+	buf.Reset()
+	assert.NoError(t, WritePrototype(&buf, proto, true))
+	stripped, err := ReadPrototype(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "", stripped.Source)
+	assert.Empty(t, stripped.LineInfo)
+	assert.Equal(t, proto.Code, stripped.Code)
+	assert.Equal(t, proto.Constants, stripped.Constants)
+}
@@ -0,0 +1,668 @@
+package vm
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Salpadding/lua/types"
+	"github.com/Salpadding/lua/types/value"
+)
+
+// nativeFunction 是需要访问虚拟机的本地函数, 加载时绑定到虚拟机
+type nativeFunction func(vm *LuaVM, args ...types.Value) ([]types.Value, error)
+
+// baseFunctions 是基础库函数
+var baseFunctions = map[string]nativeFunction{
+	"print":          basePrint,
+	"setmetatable":   baseSetMetatable,
+	"getmetatable":   baseGetMetatable,
+	"next":           baseNext,
+	"pairs":          basePairs,
+	"ipairs":         baseIPairs,
+	"error":          baseError,
+	"pcall":          basePCall,
+	"xpcall":         baseXPCall,
+	"assert":         baseAssert,
+	"type":           baseType,
+	"tostring":       baseToString,
+	"tonumber":       baseToNumber,
+	"select":         baseSelect,
+	"rawget":         baseRawGet,
+	"rawset":         baseRawSet,
+	"rawequal":       baseRawEqual,
+	"rawlen":         baseRawLen,
+	"load":           baseLoad,
+	"collectgarbage": baseCollectGarbage,
+}
+
+// baseFileFunctions 是访问文件的基础函数, 安全模式下不注册
+var baseFileFunctions = map[string]nativeFunction{
+	"loadfile": baseLoadFile,
+	"dofile":   baseDoFile,
+}
+
+// openBase 注册基础函数, 以及全局变量 _G 和 _VERSION
+func (vm *LuaVM) openBase() error {
+	if err := vm.register(baseFunctions); err != nil {
+		return err
+	}
+	if err := vm.global.Set(types.String("_G"), vm.global); err != nil {
+		return err
+	}
+	if err := vm.global.Set(types.String("_VERSION"), types.String(LuaVersion)); err != nil {
+		return err
+	}
+	if vm.safe {
+		return nil
+	}
+	// natives 中是测试代码使用的 fail, 安全模式下不注册
+	for k, v := range natives {
+		if err := vm.global.Set(k, v); err != nil {
+			return err
+		}
+	}
+	return vm.register(baseFileFunctions)
+}
+
+// register 把本地函数绑定到虚拟机并注册为全局变量
+func (vm *LuaVM) register(functions map[string]nativeFunction) error {
+	return vm.setFunctions(vm.global, functions)
+}
+
+// openLib 创建一个库并注册为全局变量
+func (vm *LuaVM) openLib(name string, functions map[string]nativeFunction) (*types.Table, error) {
+	lib := types.NewTable()
+	if err := vm.setFunctions(lib, functions); err != nil {
+		return nil, err
+	}
+	return lib, vm.global.Set(types.String(name), lib)
+}
+
+// setFunctions 把本地函数绑定到虚拟机并保存到表中
+func (vm *LuaVM) setFunctions(tb *types.Table, functions map[string]nativeFunction) error {
+	for name, fn := range functions {
+		if err := tb.Set(types.String(name), vm.bind(fn)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (vm *LuaVM) bind(fn nativeFunction) types.Native {
+	return func(args ...types.Value) ([]types.Value, error) {
+		return fn(vm, args...)
+	}
+}
+
+// arg 返回第 i 个参数, 不存在时返回 nil
+func arg(args []types.Value, i int) types.Value {
+	if i < len(args) {
+		return args[i]
+	}
+	return types.GetNil()
+}
+
+// checkTable 检查第 i 个参数是否是表
+func checkTable(args []types.Value, i int, fname string) (*types.Table, error) {
+	tb, ok := arg(args, i).(*types.Table)
+	if !ok {
+		return nil, errArgument(i+1, fname, fmt.Sprintf("table expected, got %s", typeNameOf(args, i)))
+	}
+	return tb, nil
+}
+
+// checkString 检查第 i 个参数是否是字符串, 数字会被转换为字符串
+func checkString(args []types.Value, i int, fname string) (string, error) {
+	s, ok := toConcatString(arg(args, i))
+	if !ok {
+		return "", errArgument(i+1, fname, fmt.Sprintf("string expected, got %s", typeNameOf(args, i)))
+	}
+	return s, nil
+}
+
+// optString 返回第 i 个字符串参数, 参数为 nil 时返回默认值
+func optString(args []types.Value, i int, fname, def string) (string, error) {
+	if isNil(arg(args, i)) {
+		return def, nil
+	}
+	return checkString(args, i, fname)
+}
+
+// checkInteger 检查第 i 个参数是否可以转换为整数
+func checkInteger(args []types.Value, i int, fname string) (int64, error) {
+	v := arg(args, i)
+	if _, ok := v.ToNumber(); !ok {
+		return 0, errArgument(i+1, fname, fmt.Sprintf("number expected, got %s", typeNameOf(args, i)))
+	}
+	n, ok := v.ToInteger()
+	if !ok {
+		return 0, errArgument(i+1, fname, errNoIntegerRepresentation.Error())
+	}
+	return int64(n), nil
+}
+
+// checkNumber 检查第 i 个参数是否可以转换为数字
+func checkNumber(args []types.Value, i int, fname string) (types.Number, error) {
+	n, ok := arg(args, i).ToNumber()
+	if !ok {
+		return nil, errArgument(i+1, fname, fmt.Sprintf("number expected, got %s", typeNameOf(args, i)))
+	}
+	return n, nil
+}
+
+// checkFloat 检查第 i 个参数是否可以转换为数字, 返回浮点数
+func checkFloat(args []types.Value, i int, fname string) (float64, error) {
+	n, err := checkNumber(args, i, fname)
+	if err != nil {
+		return 0, err
+	}
+	f, _ := n.ToFloat()
+	return float64(f), nil
+}
+
+// optInteger 返回第 i 个整数参数, 参数为 nil 时返回默认值
+func optInteger(args []types.Value, i int, fname string, def int64) (int64, error) {
+	if isNil(arg(args, i)) {
+		return def, nil
+	}
+	return checkInteger(args, i, fname)
+}
+
+// typeNameOf 返回参数的类型名, 缺少的参数为 no value
+func typeNameOf(args []types.Value, i int) string {
+	if i >= len(args) {
+		return "no value"
+	}
+	return args[i].Type().String()
+}
+
+func basePrint(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	strs := make([]string, len(args))
+	for i, v := range args {
+		s, err := vm.toString(v)
+		if err != nil {
+			return nil, err
+		}
+		strs[i] = s
+	}
+	fmt.Fprintln(vm.output(), strings.Join(strs, "\t"))
+	return nil, nil
+}
+
+func baseSetMetatable(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	tb, err := checkTable(args, 0, "setmetatable")
+	if err != nil {
+		return nil, err
+	}
+	var mt *types.Table
+	switch x := arg(args, 1).(type) {
+	case *types.Nil:
+	case *types.Table:
+		mt = x
+	default:
+		return nil, errArgument(2, "setmetatable", "nil or table expected")
+	}
+	if !isNil(vm.metaField(tb, "__metatable")) {
+		return nil, errProtectedMetatable
+	}
+	tb.SetMetatable(mt)
+	return []types.Value{tb}, nil
+}
+
+func baseGetMetatable(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	if len(args) == 0 {
+		return nil, errArgument(1, "getmetatable", "value expected")
+	}
+	mt := vm.getMetatable(args[0])
+	if mt == nil {
+		return []types.Value{types.GetNil()}, nil
+	}
+	if protected := vm.metaField(args[0], "__metatable"); !isNil(protected) {
+		return []types.Value{protected}, nil
+	}
+	return []types.Value{mt}, nil
+}
+
+func baseNext(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	tb, err := checkTable(args, 0, "next")
+	if err != nil {
+		return nil, err
+	}
+	k, v, err := tb.Next(arg(args, 1))
+	if err != nil {
+		return nil, err
+	}
+	if isNil(k) {
+		return []types.Value{types.GetNil()}, nil
+	}
+	return []types.Value{k, v}, nil
+}
+
+// pairs(t) 返回 next, t, nil, 元表中有 __pairs 时调用 __pairs
+func basePairs(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	if len(args) == 0 {
+		return nil, errArgument(1, "pairs", "table expected, got no value")
+	}
+	if h := vm.metaField(args[0], "__pairs"); !isNil(h) {
+		values, err := vm.Call(h, args[0])
+		if err != nil {
+			return nil, err
+		}
+		return []types.Value{arg(values, 0), arg(values, 1), arg(values, 2)}, nil
+	}
+	if _, err := checkTable(args, 0, "pairs"); err != nil {
+		return nil, err
+	}
+	return []types.Value{vm.bind(baseNext), args[0], types.GetNil()}, nil
+}
+
+// ipairs(t) 返回的迭代器从 1 开始遍历, 直到遇到 nil
+func baseIPairs(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	if len(args) == 0 {
+		return nil, errArgument(1, "ipairs", "table expected, got no value")
+	}
+	return []types.Value{vm.bind(ipairsIterator), args[0], types.Integer(0)}, nil
+}
+
+func ipairsIterator(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	i, _ := arg(args, 1).ToInteger()
+	i++
+	v, err := vm.index(arg(args, 0), i)
+	if err != nil {
+		return nil, err
+	}
+	if isNil(v) {
+		return []types.Value{types.GetNil()}, nil
+	}
+	return []types.Value{i, v}, nil
+}
+
+// error(v [, level]) 抛出错误, level 为 0 时不添加位置信息
+func baseError(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	level := types.Integer(1)
+	if lv := arg(args, 1); !isNil(lv) {
+		i, ok := lv.ToInteger()
+		if !ok {
+			return nil, errArgument(2, "error", fmt.Sprintf("number expected, got %s", typeNameOf(args, 1)))
+		}
+		level = i
+	}
+	return nil, vm.newError(arg(args, 0), int(level))
+}
+
+// protectedCall 在保护模式下调用函数, handler 为 nil 时表示 pcall
+func (vm *LuaVM) protectedCall(handler, fn types.Value, args ...types.Value) ([]types.Value, error) {
+	st := vm.state()
+	st.handlers = append(st.handlers, handler)
+	defer func() { st.handlers = st.handlers[:len(st.handlers)-1] }()
+	return vm.callYieldable(fn, args...)
+}
+
+// callYieldable 调用函数, 允许被调用的函数跨越当前本地函数让出
+func (vm *LuaVM) callYieldable(fn types.Value, args ...types.Value) ([]types.Value, error) {
+	if co := vm.current; co != nil {
+		co.nCcalls--
+		defer func() { co.nCcalls++ }()
+	}
+	return vm.Call(fn, args...)
+}
+
+// pcall(f, ...) 成功时返回 true 和函数的返回值, 失败时返回 false 和错误值
+func basePCall(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	if len(args) == 0 {
+		return nil, errArgument(1, "pcall", "value expected")
+	}
+	values, err := vm.protectedCall(types.GetNil(), args[0], args[1:]...)
+	if vm.aborted(err) {
+		return nil, err
+	}
+	if err != nil {
+		return []types.Value{types.Boolean(false), errorValue(err)}, nil
+	}
+	return append([]types.Value{types.Boolean(true)}, values...), nil
+}
+
+// xpcall(f, msgh, ...) 出错时返回 false 和消息处理函数的返回值
+func baseXPCall(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	if len(args) < 2 {
+		return nil, errArgument(2, "xpcall", "value expected")
+	}
+	msgh := args[1]
+	values, err := vm.protectedCall(msgh, args[0], args[2:]...)
+	if err == nil {
+		return append([]types.Value{types.Boolean(true)}, values...), nil
+	}
+	if vm.aborted(err) {
+		return nil, err
+	}
+	if e, ok := err.(*LuaError); ok && e.handled != nil {
+		return []types.Value{types.Boolean(false), e.handled}, nil
+	}
+	// 没有经过 throw 的错误, 例如本地函数直接返回的错误
+	v, err := vm.callMeta(msgh, errorValue(err))
+	if err != nil {
+		v = errorValue(err)
+	}
+	return []types.Value{types.Boolean(false), v}, nil
+}
+
+// assert(v [, message]) v 为假时抛出错误, 否则返回所有参数
+func baseAssert(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	if len(args) == 0 {
+		return nil, errArgument(1, "assert", "value expected")
+	}
+	if args[0].ToBoolean() {
+		return args, nil
+	}
+	if len(args) > 1 {
+		return nil, vm.throw(&LuaError{Value: args[1], Line: -1})
+	}
+	return nil, vm.newError(types.String("assertion failed!"), 1)
+}
+
+// checkAny 检查第 i 个参数是否存在
+func checkAny(args []types.Value, i int, fname string) (types.Value, error) {
+	if i >= len(args) {
+		return nil, errArgument(i+1, fname, "value expected")
+	}
+	return args[i], nil
+}
+
+func baseType(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	v, err := checkAny(args, 0, "type")
+	if err != nil {
+		return nil, err
+	}
+	return []types.Value{types.String(v.Type().String())}, nil
+}
+
+// tostring(v) 把值转换为字符串, 支持 __tostring 和 __name
+func baseToString(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	v, err := checkAny(args, 0, "tostring")
+	if err != nil {
+		return nil, err
+	}
+	s, err := vm.toString(v)
+	if err != nil {
+		return nil, err
+	}
+	return []types.Value{types.String(s)}, nil
+}
+
+// tonumber(v [, base]) 把值转换为数字, 不能转换时返回 nil, 指定 base 时按照 base 进制解析整数
+func baseToNumber(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	if isNil(arg(args, 1)) {
+		v, err := checkAny(args, 0, "tonumber")
+		if err != nil {
+			return nil, err
+		}
+		switch x := v.(type) {
+		case types.Integer, types.Float:
+			return []types.Value{x}, nil
+		case types.String:
+			if n, ok := types.ParseNumber(string(x)); ok {
+				return []types.Value{n}, nil
+			}
+		}
+		return []types.Value{types.GetNil()}, nil
+	}
+	base, err := checkInteger(args, 1, "tonumber")
+	if err != nil {
+		return nil, err
+	}
+	s, ok := arg(args, 0).(types.String)
+	if !ok {
+		return nil, errArgument(1, "tonumber", fmt.Sprintf("string expected, got %s", typeNameOf(args, 0)))
+	}
+	if base < 2 || base > 36 {
+		return nil, errArgument(2, "tonumber", "base out of range")
+	}
+	if n, ok := parseIntegerBase(string(s), base); ok {
+		return []types.Value{n}, nil
+	}
+	return []types.Value{types.GetNil()}, nil
+}
+
+// parseIntegerBase 按照 base 进制解析整数, 允许前后的空白和符号, 溢出时回绕
+func parseIntegerBase(s string, base int64) (types.Integer, bool) {
+	s = strings.TrimSpace(s)
+	neg := false
+	if len(s) > 0 && (s[0] == '-' || s[0] == '+') {
+		neg = s[0] == '-'
+		s = s[1:]
+	}
+	if len(s) == 0 {
+		return 0, false
+	}
+	var n uint64
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		var digit int64
+		switch {
+		case isDigit(c):
+			digit = int64(c - '0')
+		case isAlpha(c):
+			digit = int64(c|0x20-'a') + 10
+		default:
+			return 0, false
+		}
+		if digit >= base {
+			return 0, false
+		}
+		n = n*uint64(base) + uint64(digit)
+	}
+	if neg {
+		n = -n
+	}
+	return types.Integer(n), true
+}
+
+// select(n, ...) 返回第 n 个之后的参数, n 为 '#' 时返回参数的数量
+func baseSelect(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	rest := len(args) - 1
+	if s, ok := arg(args, 0).(types.String); ok && s == "#" {
+		return []types.Value{types.Integer(rest)}, nil
+	}
+	n, err := checkInteger(args, 0, "select")
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 {
+		n += int64(rest) + 1
+	}
+	if n < 1 {
+		return nil, errArgument(1, "select", "index out of range")
+	}
+	if n > int64(rest) {
+		return nil, nil
+	}
+	return args[n:], nil
+}
+
+func baseRawGet(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	tb, err := checkTable(args, 0, "rawget")
+	if err != nil {
+		return nil, err
+	}
+	k, err := checkAny(args, 1, "rawget")
+	if err != nil {
+		return nil, err
+	}
+	v, err := tb.Get(k)
+	if err != nil {
+		return nil, err
+	}
+	return []types.Value{v}, nil
+}
+
+func baseRawSet(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	tb, err := checkTable(args, 0, "rawset")
+	if err != nil {
+		return nil, err
+	}
+	k, err := checkAny(args, 1, "rawset")
+	if err != nil {
+		return nil, err
+	}
+	v, err := checkAny(args, 2, "rawset")
+	if err != nil {
+		return nil, err
+	}
+	if isNil(k) {
+		return nil, errNilIndex
+	}
+	if err := tb.Set(k, v); err != nil {
+		return nil, err
+	}
+	return []types.Value{tb}, nil
+}
+
+func baseRawEqual(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	a, err := checkAny(args, 0, "rawequal")
+	if err != nil {
+		return nil, err
+	}
+	b, err := checkAny(args, 1, "rawequal")
+	if err != nil {
+		return nil, err
+	}
+	cmp, _ := types.Equal(a, b)
+	return []types.Value{types.Boolean(cmp == value.Equal)}, nil
+}
+
+func baseRawLen(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	switch x := arg(args, 0).(type) {
+	case *types.Table:
+		return []types.Value{types.Integer(x.Len())}, nil
+	case types.String:
+		return []types.Value{types.Integer(len(x))}, nil
+	}
+	return nil, errArgument(1, "rawlen", "table or string expected")
+}
+
+// collectgarbage([opt]) 回收不可达的对象, count 返回脚本使用的内存, 单位是 KB
+// 内存由 Go 的垃圾回收器管理, 其他选项只是为了兼容
+func baseCollectGarbage(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	opt, err := optString(args, 0, "collectgarbage", "collect")
+	if err != nil {
+		return nil, err
+	}
+	switch opt {
+	case "collect":
+		vm.CollectGarbage()
+		return []types.Value{types.Integer(0)}, nil
+	case "count":
+		return []types.Value{types.Float(float64(vm.MemoryUsed()) / 1024)}, nil
+	case "step", "isrunning":
+		return []types.Value{types.Boolean(true)}, nil
+	case "stop", "restart", "setpause", "setstepmul":
+		return []types.Value{types.Integer(0)}, nil
+	}
+	return nil, errArgument(1, "collectgarbage", fmt.Sprintf("invalid option '%s'", opt))
+}
+
+// load(chunk [, chunkname [, mode [, env]]]) 加载代码块, chunk 可以是字符串或者返回字符串片段的函数
+func baseLoad(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	var (
+		src       string
+		chunkName string
+	)
+	switch x := arg(args, 0).(type) {
+	case types.String:
+		src, chunkName = string(x), string(x)
+	case *types.Function, types.Native:
+		var buf strings.Builder
+		for {
+			values, err := vm.Call(x)
+			if vm.aborted(err) {
+				return nil, err
+			}
+			if err != nil {
+				return []types.Value{types.GetNil(), errorValue(err)}, nil
+			}
+			piece := arg(values, 0)
+			if isNil(piece) {
+				break
+			}
+			s, ok := piece.(types.String)
+			if !ok {
+				return []types.Value{types.GetNil(), types.String("reader function must return a string")}, nil
+			}
+			if s == "" {
+				break
+			}
+			buf.WriteString(string(s))
+		}
+		src, chunkName = buf.String(), "=(load)"
+	default:
+		return nil, errArgument(1, "load", fmt.Sprintf("string expected, got %s", typeNameOf(args, 0)))
+	}
+	chunkName, err := optString(args, 1, "load", chunkName)
+	if err != nil {
+		return nil, err
+	}
+	mode, err := optString(args, 2, "load", "bt")
+	if err != nil {
+		return nil, err
+	}
+	var env types.Value
+	if len(args) > 3 {
+		env = args[3]
+	}
+	fn, err := vm.loadChunk(strings.NewReader(src), chunkName, mode, env)
+	if err != nil {
+		return []types.Value{types.GetNil(), types.String(err.Error())}, nil
+	}
+	return []types.Value{fn}, nil
+}
+
+// loadFile 加载文件, filename 为 nil 时读取标准输入
+func (vm *LuaVM) loadFile(filename types.Value, mode string, env types.Value) (*types.Function, error) {
+	name, ok := filename.(types.String)
+	if !ok {
+		return vm.loadChunk(vm.input(), "=stdin", mode, env)
+	}
+	f, err := os.Open(string(name))
+	if err != nil {
+		return nil, fmt.Errorf("cannot open %s", string(name))
+	}
+	defer f.Close()
+	return vm.loadChunk(f, "@"+string(name), mode, env)
+}
+
+// loadfile([filename [, mode [, env]]]) 和 load 相同, 但是从文件中读取代码块
+func baseLoadFile(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	if !isNil(arg(args, 0)) {
+		if _, err := checkString(args, 0, "loadfile"); err != nil {
+			return nil, err
+		}
+	}
+	mode, err := optString(args, 1, "loadfile", "bt")
+	if err != nil {
+		return nil, err
+	}
+	var env types.Value
+	if len(args) > 2 {
+		env = args[2]
+	}
+	fn, err := vm.loadFile(arg(args, 0), mode, env)
+	if err != nil {
+		return []types.Value{types.GetNil(), types.String(err.Error())}, nil
+	}
+	return []types.Value{fn}, nil
+}
+
+// dofile([filename]) 执行文件并返回所有返回值, 出错时抛出错误
+func baseDoFile(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	if !isNil(arg(args, 0)) {
+		if _, err := checkString(args, 0, "dofile"); err != nil {
+			return nil, err
+		}
+	}
+	fn, err := vm.loadFile(arg(args, 0), "bt", nil)
+	if err != nil {
+		return nil, err
+	}
+	return vm.Call(fn)
+}
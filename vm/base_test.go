@@ -0,0 +1,170 @@
+package vm
+
+import (
+	"math"
+	"testing"
+
+	"github.com/Salpadding/lua/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPairs(t *testing.T) {
+	var vm LuaVM
+	values, err := vm.DoString(`
+local t = {10, 20, 30, x = 1, y = 2}
+local n, sum = 0, 0
+for k, v in pairs(t) do
+  n = n + 1
+  sum = sum + v
+end
+local keys = 0
+for k in next, t do keys = keys + 1 end
+return n, sum, keys
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{types.Integer(5), types.Integer(63), types.Integer(5)}, values)
+}
+
+func TestIPairs(t *testing.T) {
+	var vm LuaVM
+	values, err := vm.DoString(`
+local t = {1, 2, 3, nil, 5}
+local s = 0
+for i, v in ipairs(t) do s = s + i * v end
+local proxy = setmetatable({}, {__index = function(_, i) if i <= 4 then return i end end})
+local n = 0
+for _, v in ipairs(proxy) do n = n + v end
+return s, n
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{types.Integer(14), types.Integer(10)}, values)
+}
+
+func TestPairsMeta(t *testing.T) {
+	var vm LuaVM
+	values, err := vm.DoString(`
+local t = setmetatable({}, {__pairs = function(t)
+  return function(_, k)
+    if k == nil then return 1, "one" end
+  end, t, nil
+end})
+local res = {}
+for k, v in pairs(t) do res[k] = v end
+return res[1], next({})
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{types.String("one"), types.GetNil()}, values)
+}
+
+func TestClosureInGenericFor(t *testing.T) {
+	var vm LuaVM
+	values, err := vm.DoString(`
+local fns = {}
+for i, v in ipairs({"a", "b"}) do
+  fns[i] = function() return v end
+end
+return fns[1](), fns[2]()
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{types.String("a"), types.String("b")}, values)
+}
+
+func TestTypeAndToString(t *testing.T) {
+	var vm LuaVM
+	values, err := vm.DoString(`
+local mt = {__tostring = function(p) return "P(" .. p.x .. ")" end}
+return type(nil), type(true), type(1), type("s"), type({}), type(print), type(coroutine.create(print)),
+  tostring(nil), tostring(false), tostring(12), tostring(1.5), tostring(1e100), tostring(-0.0),
+  tostring(setmetatable({x = 3}, mt))
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{
+		types.String("nil"), types.String("boolean"), types.String("number"), types.String("string"),
+		types.String("table"), types.String("function"), types.String("thread"),
+		types.String("nil"), types.String("false"), types.String("12"), types.String("1.5"),
+		types.String("1e+100"), types.String("-0.0"), types.String("P(3)"),
+	}, values)
+
+	_, err = vm.DoString("type()")
+	assert.Contains(t, err.Error(), "bad argument #1 to 'type' (value expected)")
+	_, err = vm.DoString("tostring(setmetatable({}, {__tostring = function() return 1 end}))")
+	assert.Contains(t, err.Error(), "'__tostring' must return a string")
+}
+
+func TestToNumber(t *testing.T) {
+	var vm LuaVM
+	values, err := vm.DoString(`
+return tonumber("10"), tonumber("  0x1F  "), tonumber("1e2"), tonumber("3.5"), tonumber(7), tonumber("abc"),
+  tonumber({}), tonumber("ff", 16), tonumber("  -101 ", 2), tonumber("zz", 36), tonumber("8", 8),
+  tonumber("7fffffffffffffff", 16), tonumber("", 10), tonumber("1.5", 10)
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{
+		types.Integer(10), types.Integer(31), types.Float(100), types.Float(3.5), types.Integer(7), types.GetNil(),
+		types.GetNil(), types.Integer(255), types.Integer(-5), types.Integer(1295), types.GetNil(),
+		types.Integer(math.MaxInt64), types.GetNil(), types.GetNil(),
+	}, values)
+
+	_, err = vm.DoString("tonumber('1', 37)")
+	assert.Contains(t, err.Error(), "bad argument #2 to 'tonumber' (base out of range)")
+	_, err = vm.DoString("tonumber(10, 16)")
+	assert.Contains(t, err.Error(), "bad argument #1 to 'tonumber' (string expected, got number)")
+}
+
+func TestSelectAndRaw(t *testing.T) {
+	var vm LuaVM
+	values, err := vm.DoString(`
+local mt = {__index = function() return "meta" end, __newindex = function() error("blocked") end,
+  __len = function() return 99 end, __eq = function() return true end}
+local t = setmetatable({}, mt)
+rawset(t, "k", "v")
+local a, b = setmetatable({}, mt), setmetatable({}, mt)
+return select("#", 1, nil, 3), select(2, "a", "b", "c"), select(-1, "a", "b", "c"),
+  t.missing, rawget(t, "missing"), rawget(t, "k"), #t, rawlen(t), rawlen("abc"),
+  a == b, rawequal(a, b), rawequal(a, a)
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{
+		types.Integer(3), types.String("b"), types.String("c"),
+		types.String("meta"), types.GetNil(), types.String("v"), types.Integer(99), types.Integer(0), types.Integer(3),
+		types.Boolean(true), types.Boolean(false), types.Boolean(true),
+	}, values)
+
+	_, err = vm.DoString("select(0, 1)")
+	assert.Contains(t, err.Error(), "bad argument #1 to 'select' (index out of range)")
+	_, err = vm.DoString("rawlen(1)")
+	assert.Contains(t, err.Error(), "bad argument #1 to 'rawlen' (table or string expected)")
+	_, err = vm.DoString("rawset({}, nil, 1)")
+	assert.Contains(t, err.Error(), "index is nil")
+}
+
+func TestGlobalVariables(t *testing.T) {
+	var vm LuaVM
+	values, err := vm.DoString(`
+local proxy = setmetatable({}, {__index = _G})
+return _G == _ENV, _G._G == _G, proxy.print == print, _VERSION
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{types.Boolean(true), types.Boolean(true), types.Boolean(true), types.String("Lua 5.3")}, values)
+}
+
+func TestCollectGarbage(t *testing.T) {
+	vm := New(WithMemoryLimit(1 << 20))
+	values, err := vm.DoString(`
+local before = collectgarbage("count")
+local t = {}
+for i = 1, 1000 do t[i] = {} end
+local grown = collectgarbage("count")
+t = nil
+local collected = collectgarbage()
+local after = collectgarbage("count")
+return grown > before, collected, after < grown, collectgarbage("step"), collectgarbage("isrunning")
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{
+		types.Boolean(true), types.Integer(0), types.Boolean(true), types.Boolean(true), types.Boolean(true),
+	}, values)
+
+	_, err = vm.DoString(`collectgarbage("bad")`)
+	assert.EqualError(t, err, `[string "collectgarbage("bad")"]:1: bad argument #1 to 'collectgarbage' (invalid option 'bad')`)
+}
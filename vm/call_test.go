@@ -0,0 +1,65 @@
+package vm
+
+import (
+	"testing"
+
+	"github.com/Salpadding/lua/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeepRecursion(t *testing.T) {
+	var vm LuaVM
+	values, err := vm.DoString(`
+function sum(n)
+  if n == 0 then return 0 end
+  return n + sum(n - 1)
+end
+return sum(50000)
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{types.Integer(1250025000)}, values)
+}
+
+func TestStackOverflow(t *testing.T) {
+	var vm LuaVM
+	vm.SetMaxCallDepth(1000)
+	values, err := vm.DoString(`
+function f(n) return 1 + f(n + 1) end
+local ok, msg = pcall(f, 1)
+return ok, msg
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, types.Boolean(false), values[0])
+	assert.Contains(t, string(values[1].(types.String)), "stack overflow")
+
+	_, err = vm.DoString("function f() return 1 + f() end return f()")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "stack overflow")
+
+	_, err = vm.DoString("function f() return pcall(f) end return f()")
+	assert.NoError(t, err)
+}
+
+func TestTailCall(t *testing.T) {
+	var vm LuaVM
+	vm.SetMaxCallDepth(100)
+	values, err := vm.DoString(`
+function loop(n, acc)
+  if n == 0 then return acc end
+  return loop(n - 1, acc + 1)
+end
+local t = setmetatable({}, {__call = function(self, n) return n * 2 end})
+local function viaMeta(n) return t(n) end
+local function native(s) return select("#", s, s) end
+return loop(1000000, 0), viaMeta(21), native("x")
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{types.Integer(1000000), types.Integer(42), types.Integer(2)}, values)
+
+	_, err = vm.DoString(`
+function g() error("boom") end
+function f() return g() end
+f()
+`)
+	assert.Contains(t, err.(*LuaError).Traceback, "(...tail calls...)")
+}
@@ -0,0 +1,336 @@
+package vm
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/Salpadding/lua/types"
+	"github.com/Salpadding/lua/types/value"
+)
+
+const (
+	coroutineSuspended = "suspended"
+	coroutineRunning   = "running"
+	coroutineNormal    = "normal"
+	coroutineDead      = "dead"
+)
+
+// transfer 是协程让出或者结束时传回的值
+type transfer struct {
+	values []types.Value
+	err    error
+	done   bool
+}
+
+// coroutine 是协程的运行状态, 每个协程在自己的 goroutine 中执行, 拥有独立的帧栈
+// 同一时刻只有一个协程在运行, 通过 channel 交接控制权
+type coroutine struct {
+	threadState
+
+	thread    *types.Thread // 协程没有挂起时的 Thread, 挂起时为 nil, 这样 Thread 不可达时可以被回收
+	fn        types.Value
+	status    string
+	started   bool
+	killed    bool
+	collected bool // Thread 不可达, 结束协程时不调用 __close 元方法
+	nCcalls   int  // 正在执行的本地函数数量, 让出时只允许调用 Yield 的本地函数在栈上
+
+	err      error // 协程因为错误结束时的错误
+	closeErr error // 协程被关闭时 __close 元方法的错误
+
+	resume   chan []types.Value
+	transfer chan transfer
+}
+
+var coroutineFunctions = map[string]nativeFunction{
+	"create":      coCreate,
+	"resume":      coResume,
+	"yield":       coYield,
+	"status":      coStatus,
+	"wrap":        coWrap,
+	"isyieldable": coIsYieldable,
+	"running":     coRunning,
+	"close":       coClose,
+}
+
+// NewThread 创建一个执行 fn 的协程
+// Thread 不可达时挂起的协程会在之后调用 NewThread, CollectGarbage 或者 Close 时结束,
+// 协程自己的调用栈引用它的 Thread 时无法回收
+func (vm *LuaVM) NewThread(fn types.Value) *types.Thread {
+	vm.releaseCollected()
+	co := &coroutine{
+		fn:       fn,
+		status:   coroutineSuspended,
+		resume:   make(chan []types.Value),
+		transfer: make(chan transfer),
+	}
+	th := &types.Thread{Coroutine: co}
+	runtime.SetFinalizer(th, func(*types.Thread) {
+		vm.collectMu.Lock()
+		vm.collected = append(vm.collected, co)
+		vm.collectMu.Unlock()
+	})
+	return th
+}
+
+// releaseCollected 结束 Thread 已经不可达的挂起协程, 释放它们的 goroutine
+func (vm *LuaVM) releaseCollected() {
+	vm.collectMu.Lock()
+	collected := vm.collected
+	vm.collected = nil
+	vm.collectMu.Unlock()
+	for _, co := range collected {
+		if co.status != coroutineSuspended || !co.started {
+			continue
+		}
+		co.collected = true
+		vm.kill(co)
+	}
+}
+
+// Resume 启动或者恢复协程, 返回协程让出或者返回的值
+func (vm *LuaVM) Resume(th *types.Thread, args ...types.Value) ([]types.Value, error) {
+	co, ok := th.Coroutine.(*coroutine)
+	if !ok {
+		return nil, errInvalidOperand
+	}
+	switch co.status {
+	case coroutineDead:
+		return nil, errResumeDead
+	case coroutineSuspended:
+	default:
+		return nil, errResumeNonSuspended
+	}
+	prev := vm.current
+	if prev != nil {
+		prev.status = coroutineNormal
+	}
+	co.status = coroutineRunning
+	co.thread = th
+	vm.current = co
+	if vm.coroutines == nil {
+		vm.coroutines = map[*coroutine]struct{}{}
+	}
+	vm.coroutines[co] = struct{}{}
+	if co.started {
+		co.resume <- args
+	} else {
+		co.started = true
+		go vm.run(co, args)
+	}
+	res := <-co.transfer
+	vm.current = prev
+	if prev != nil {
+		prev.status = coroutineRunning
+	}
+	co.thread = nil
+	if res.done {
+		co.status = coroutineDead
+		co.err = res.err
+		delete(vm.coroutines, co)
+	} else {
+		co.status = coroutineSuspended
+	}
+	return res.values, res.err
+}
+
+func (vm *LuaVM) run(co *coroutine, args []types.Value) {
+	var res transfer
+	defer func() {
+		if r := recover(); r != nil {
+			res = transfer{err: fmt.Errorf("%v", r)}
+		}
+		res.done = true
+		co.transfer <- res
+	}()
+	res.values, res.err = vm.Call(co.fn, args...)
+}
+
+// Yield 让出当前协程, 返回下一次 Resume 传入的值
+// 本地函数可以调用 Yield 让出协程, 但是不能跨越其他本地函数让出
+func (vm *LuaVM) Yield(values ...types.Value) ([]types.Value, error) {
+	co := vm.current
+	if co == nil {
+		return nil, errYieldOutside
+	}
+	if co.killed {
+		// 关闭协程时 __close 元方法不能让出
+		return nil, errCoroutineClosed
+	}
+	if co.nCcalls > 1 {
+		return nil, errYieldAcrossC
+	}
+	co.transfer <- transfer{values: values}
+	args := <-co.resume
+	if co.killed {
+		return nil, errCoroutineClosed
+	}
+	return args, nil
+}
+
+// Close 结束所有挂起的协程
+func (vm *LuaVM) Close() {
+	vm.releaseCollected()
+	for co := range vm.coroutines {
+		if co.status != coroutineSuspended || !co.started {
+			continue
+		}
+		vm.kill(co)
+	}
+}
+
+// kill 结束挂起的协程, 协程的调用栈展开时用 nil 调用待关闭变量的 __close 元方法,
+// 返回 __close 元方法的错误
+func (vm *LuaVM) kill(co *coroutine) error {
+	prev := vm.current
+	if prev != nil {
+		prev.status = coroutineNormal
+	}
+	co.killed = true
+	co.status = coroutineRunning
+	if co.thread == nil {
+		// 挂起的协程不保存 Thread, __close 元方法调用 coroutine.running 时使用新的 Thread
+		co.thread = &types.Thread{Coroutine: co}
+	}
+	vm.current = co
+	co.resume <- nil
+	res := <-co.transfer
+	vm.current = prev
+	if prev != nil {
+		prev.status = coroutineRunning
+	}
+	co.thread = nil
+	co.status = coroutineDead
+	delete(vm.coroutines, co)
+	if res.err != nil && res.err == vm.abort {
+		return res.err
+	}
+	return co.closeErr
+}
+
+// isYieldable 判断当前是否可以让出, 调用方自身是一个本地函数
+func (vm *LuaVM) isYieldable() bool {
+	return vm.current != nil && vm.current.nCcalls <= 1
+}
+
+func checkThread(args []types.Value, i int, fname string) (*types.Thread, error) {
+	th, ok := arg(args, i).(*types.Thread)
+	if !ok {
+		return nil, errArgument(i+1, fname, fmt.Sprintf("coroutine expected, got %s", typeNameOf(args, i)))
+	}
+	return th, nil
+}
+
+func checkFunction(args []types.Value, i int, fname string) (types.Value, error) {
+	fn := arg(args, i)
+	if fn.Type() != value.Function {
+		return nil, errArgument(i+1, fname, fmt.Sprintf("function expected, got %s", typeNameOf(args, i)))
+	}
+	return fn, nil
+}
+
+func coCreate(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	fn, err := checkFunction(args, 0, "create")
+	if err != nil {
+		return nil, err
+	}
+	return []types.Value{vm.NewThread(fn)}, nil
+}
+
+// resume 出错时返回 false 和错误信息, 不会向外传播错误
+func coResume(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	th, err := checkThread(args, 0, "resume")
+	if err != nil {
+		return nil, err
+	}
+	values, err := vm.Resume(th, args[1:]...)
+	if vm.aborted(err) {
+		return nil, err
+	}
+	if err != nil {
+		return []types.Value{types.Boolean(false), errorValue(err)}, nil
+	}
+	return append([]types.Value{types.Boolean(true)}, values...), nil
+}
+
+func coYield(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	return vm.Yield(args...)
+}
+
+func coStatus(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	th, err := checkThread(args, 0, "status")
+	if err != nil {
+		return nil, err
+	}
+	if co, ok := th.Coroutine.(*coroutine); ok {
+		return []types.Value{types.String(co.status)}, nil
+	}
+	// 主线程
+	if vm.current == nil {
+		return []types.Value{types.String(coroutineRunning)}, nil
+	}
+	return []types.Value{types.String(coroutineNormal)}, nil
+}
+
+// wrap 返回的函数恢复协程, 出错时向外传播错误
+func coWrap(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	fn, err := checkFunction(args, 0, "wrap")
+	if err != nil {
+		return nil, err
+	}
+	th := vm.NewThread(fn)
+	wrapper := types.Native(func(args ...types.Value) ([]types.Value, error) {
+		return vm.Resume(th, args...)
+	})
+	return []types.Value{wrapper}, nil
+}
+
+// close(co) 关闭挂起或者结束的协程, 成功时返回 true, 否则返回 false 和错误值
+func coClose(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	th, err := checkThread(args, 0, "close")
+	if err != nil {
+		return nil, err
+	}
+	co, ok := th.Coroutine.(*coroutine)
+	if !ok || co.status != coroutineSuspended && co.status != coroutineDead {
+		status := coroutineRunning
+		if ok {
+			status = co.status
+		} else if vm.current != nil {
+			status = coroutineNormal
+		}
+		return nil, fmt.Errorf("cannot close a %s coroutine", status)
+	}
+	if co.status == coroutineSuspended {
+		if co.started {
+			co.thread = th
+			err = vm.kill(co)
+		} else {
+			co.status = coroutineDead
+		}
+	} else {
+		err, co.err = co.err, nil
+	}
+	if vm.aborted(err) {
+		return nil, err
+	}
+	if err != nil {
+		return []types.Value{types.Boolean(false), errorValue(err)}, nil
+	}
+	return []types.Value{types.Boolean(true)}, nil
+}
+
+func coIsYieldable(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	return []types.Value{types.Boolean(vm.isYieldable())}, nil
+}
+
+// running 返回当前协程, 以及是否是主线程
+func coRunning(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	if vm.current == nil {
+		if vm.mainThread == nil {
+			vm.mainThread = &types.Thread{}
+		}
+		return []types.Value{vm.mainThread, types.Boolean(true)}, nil
+	}
+	return []types.Value{vm.current.thread, types.Boolean(false)}, nil
+}
@@ -0,0 +1,139 @@
+package vm
+
+import (
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/Salpadding/lua/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCoroutine(t *testing.T) {
+	var vm LuaVM
+	defer vm.Close()
+	values, err := vm.DoString(`
+local function inner(x)
+  local y = coroutine.yield(x + 1)
+  return y * 2
+end
+local co = coroutine.create(function(a)
+  local b = inner(a)
+  local c = coroutine.yield(b)
+  return "done", c
+end)
+local r = {}
+local ok, v = coroutine.resume(co, 1)
+r[#r + 1] = v
+ok, v = coroutine.resume(co, 10)
+r[#r + 1] = v
+r[#r + 1] = coroutine.status(co)
+local ok2, s, c = coroutine.resume(co, "last")
+r[#r + 1] = s
+r[#r + 1] = c
+r[#r + 1] = coroutine.status(co)
+local ok3, msg = coroutine.resume(co)
+return r[1], r[2], r[3], r[4], r[5], r[6], ok3, msg
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{
+		types.Integer(2), types.Integer(20), types.String("suspended"), types.String("done"), types.String("last"),
+		types.String("dead"), types.Boolean(false), types.String("cannot resume dead coroutine"),
+	}, values)
+}
+
+func TestCoroutineWrap(t *testing.T) {
+	var vm LuaVM
+	defer vm.Close()
+	values, err := vm.DoString(`
+local gen = coroutine.wrap(function()
+  for i = 1, 3 do coroutine.yield(i) end
+end)
+local sum = 0
+for i = 1, 3 do sum = sum + gen() end
+local co = coroutine.create(function()
+  local self, main = coroutine.running()
+  return coroutine.status(self), coroutine.isyieldable(), main
+end)
+local _, st, y, main = coroutine.resume(co)
+local _, ismain = coroutine.running()
+return sum, st, y, main, ismain, coroutine.isyieldable()
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{
+		types.Integer(6), types.String("running"), types.Boolean(true), types.Boolean(false),
+		types.Boolean(true), types.Boolean(false),
+	}, values)
+
+	_, err = vm.DoString("coroutine.yield(1)")
+	assert.EqualError(t, err, `[string "coroutine.yield(1)"]:1: attempt to yield from outside a coroutine`)
+}
+
+func TestNativeYield(t *testing.T) {
+	var vm LuaVM
+	defer vm.Close()
+	_, err := vm.DoString("x = 1")
+	assert.NoError(t, err)
+	// 本地函数主动让出
+	var waits []types.Value
+	assert.NoError(t, vm.global.Set(types.String("wait"), types.Native(func(args ...types.Value) ([]types.Value, error) {
+		waits = append(waits, args[0])
+		return vm.Yield(args...)
+	})))
+	// 本地函数回调 lua 函数时不能让出
+	assert.NoError(t, vm.global.Set(types.String("callback"), types.Native(func(args ...types.Value) ([]types.Value, error) {
+		return vm.Call(args[0])
+	})))
+	fn, err := vm.LoadString(`
+local n = wait(1)
+n = n + wait(2)
+callback(function() coroutine.yield() end)
+return n
+`)
+	assert.NoError(t, err)
+	th := vm.NewThread(fn)
+	values, err := vm.Resume(th)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{types.Integer(1)}, values)
+	_, err = vm.Resume(th, types.Integer(10))
+	assert.NoError(t, err)
+	_, err = vm.Resume(th, types.Integer(20))
+	assert.EqualError(t, err, `[string "..."]:4: attempt to yield across a C-call boundary`)
+	assert.Equal(t, []types.Value{types.Integer(1), types.Integer(2)}, waits)
+}
+
+func TestCloseSuspended(t *testing.T) {
+	var vm LuaVM
+	fn, err := vm.LoadString("coroutine.yield(1)\nreturn 2")
+	assert.NoError(t, err)
+	th := vm.NewThread(fn)
+	_, err = vm.Resume(th)
+	assert.NoError(t, err)
+	vm.Close()
+	_, err = vm.Resume(th)
+	assert.Error(t, err)
+}
+
+func TestReleaseAbandoned(t *testing.T) {
+	var vm LuaVM
+	defer vm.Close()
+	base := runtime.NumGoroutine()
+	_, err := vm.DoString(`
+local function gen()
+  for i = 1, 10 do coroutine.yield(i) end
+end
+for i = 1, 100 do
+  for v in coroutine.wrap(gen) do break end
+end
+`)
+	assert.NoError(t, err)
+	assert.True(t, runtime.NumGoroutine() >= base+100)
+	// 不可达的挂起协程被回收, 终结器在 GC 之后异步执行
+	for i := 0; i < 100 && runtime.NumGoroutine() > base+1; i++ {
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+		vm.CollectGarbage()
+	}
+	assert.True(t, runtime.NumGoroutine() <= base+1, "%d goroutines, %d before", runtime.NumGoroutine(), base)
+	assert.True(t, len(vm.coroutines) <= 1)
+}
@@ -0,0 +1,393 @@
+package vm
+
+import (
+	"github.com/Salpadding/lua/types"
+	"github.com/Salpadding/lua/types/code"
+	"github.com/Salpadding/lua/types/code54"
+)
+
+var debugFunctions = map[string]nativeFunction{
+	"traceback":    debugTraceback,
+	"sethook":      debugSetHook,
+	"gethook":      debugGetHook,
+	"getinfo":      debugGetInfo,
+	"getlocal":     debugGetLocal,
+	"setlocal":     debugSetLocal,
+	"getupvalue":   debugGetUpValue,
+	"setupvalue":   debugSetUpValue,
+	"upvalueid":    debugUpValueID,
+	"upvaluejoin":  debugUpValueJoin,
+	"getmetatable": debugGetMetatable,
+}
+
+func (vm *LuaVM) openDebug() error {
+	_, err := vm.openLib("debug", debugFunctions)
+	return err
+}
+
+// threadStateOf 返回协程的调用状态, 主线程对应 vm.mainState
+func (vm *LuaVM) threadStateOf(th *types.Thread) *threadState {
+	if co, ok := th.Coroutine.(*coroutine); ok {
+		return &co.threadState
+	}
+	return &vm.mainState
+}
+
+// threadArg 处理调试函数可选的第一个协程参数, 返回协程的调用状态和剩下的参数
+func (vm *LuaVM) threadArg(args []types.Value) (*threadState, []types.Value) {
+	if th, ok := arg(args, 0).(*types.Thread); ok {
+		return vm.threadStateOf(th), args[1:]
+	}
+	return vm.state(), args
+}
+
+// traceback([thread,] [message [, level]]) 在消息后面加上调用栈, 消息不是字符串时原样返回
+func debugTraceback(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	st, rest := vm.threadArg(args)
+	msg := arg(rest, 0)
+	if _, ok := toConcatString(msg); !ok && !isNil(msg) {
+		return []types.Value{msg}, nil
+	}
+	level, err := optInteger(rest, 1, "traceback", 1)
+	if err != nil {
+		return nil, err
+	}
+	tb := stackTraceback(st.frames, int(level))
+	if s, ok := toConcatString(msg); ok {
+		tb = s + "\n" + tb
+	}
+	return []types.Value{types.String(tb)}, nil
+}
+
+// frameAt 返回第 i 个参数指定的调用帧, 第 1 层是调用调试函数的 lua 函数
+func frameAt(st *threadState, args []types.Value, i int, fname string) (*Frame, error) {
+	level, err := checkInteger(args, i, fname)
+	if err != nil {
+		return nil, err
+	}
+	if level < 1 || level > int64(len(st.frames)) {
+		return nil, errArgument(i+1, fname, "level out of range")
+	}
+	return st.frames[len(st.frames)-int(level)], nil
+}
+
+// calledValue 返回调用帧正在执行的 CALL 指令调用的函数
+func calledValue(f *Frame) types.Value {
+	pc := f.pc - 1
+	if pc < 0 || pc >= len(f.fn.Code) {
+		return types.GetNil()
+	}
+	if f.fn.Version == types.LuaVersion54 {
+		ins := code54.Instruction(f.fn.Code[pc])
+		switch ins.Opcode().Type {
+		case code54.Call, code54.TailCall:
+			return f.Get(ins.A())
+		}
+		return types.GetNil()
+	}
+	ins := f.fn.Code[pc]
+	switch ins.Opcode().Type {
+	case code.Call, code.TailCall:
+		a, _, _ := ins.ABC()
+		return f.Get(a)
+	}
+	return types.GetNil()
+}
+
+// getinfo([thread,] f [, what]) 返回函数或者第 f 层调用的信息, 第 0 层是 getinfo 自己
+func debugGetInfo(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	st, rest := vm.threadArg(args)
+	a := len(args) - len(rest)
+	what, err := optString(args, a+1, "getinfo", "flnStuL")
+	if err != nil {
+		return nil, err
+	}
+	var (
+		fn     types.Value
+		frame  *Frame // 调用帧, 参数是函数时为 nil
+		caller *Frame // 用于推测函数名字的调用者
+	)
+	switch x := arg(args, a).(type) {
+	case *types.Function, types.Native:
+		fn = x
+	default:
+		level, err := checkInteger(args, a, "getinfo")
+		if err != nil {
+			return nil, err
+		}
+		n := len(st.frames)
+		switch {
+		case level < 0 || level > int64(n):
+			return []types.Value{types.GetNil()}, nil
+		case level == 0:
+			fn = types.GetNil()
+			if n > 0 {
+				caller = st.frames[n-1]
+				fn = calledValue(caller)
+			}
+		default:
+			i := n - int(level)
+			frame = st.frames[i]
+			fn = frame.fn
+			if i > 0 && !frame.tailCall {
+				caller = st.frames[i-1]
+			}
+		}
+	}
+	lf, _ := fn.(*types.Function)
+
+	t, err := vm.newTable()
+	if err != nil {
+		return nil, err
+	}
+	// 第一次出错之后不再设置字段
+	set := func(k string, v types.Value) {
+		if err == nil {
+			err = t.Set(types.String(k), v)
+		}
+	}
+	for i := 0; i < len(what); i++ {
+		switch what[i] {
+		case 'S':
+			if lf == nil {
+				set("source", types.String("=[C]"))
+				set("short_src", types.String("[C]"))
+				set("what", types.String("C"))
+				set("linedefined", types.Integer(-1))
+				set("lastlinedefined", types.Integer(-1))
+				continue
+			}
+			kind := "Lua"
+			if lf.LineDefined == 0 {
+				kind = "main"
+			}
+			set("source", types.String(lf.Source))
+			set("short_src", types.String(chunkID(lf.Source)))
+			set("what", types.String(kind))
+			set("linedefined", types.Integer(lf.LineDefined))
+			set("lastlinedefined", types.Integer(lf.LastLineDefined))
+		case 'l':
+			line := -1
+			if frame != nil {
+				line = frame.currentLine()
+			}
+			set("currentline", types.Integer(line))
+		case 'u':
+			if lf == nil {
+				set("nups", types.Integer(0))
+				set("nparams", types.Integer(0))
+				set("isvararg", types.Boolean(true))
+				continue
+			}
+			set("nups", types.Integer(len(lf.UpValues)))
+			set("nparams", types.Integer(lf.NumParams))
+			set("isvararg", types.Boolean(lf.IsVararg))
+		case 'n':
+			var kind, name string
+			if caller != nil {
+				kind, name = funcName(caller)
+			}
+			set("namewhat", types.String(kind))
+			if kind != "" {
+				set("name", types.String(name))
+			}
+		case 't':
+			set("istailcall", types.Boolean(frame != nil && frame.tailCall))
+		case 'f':
+			set("func", fn)
+		case 'L':
+			if lf == nil {
+				continue
+			}
+			lines, err := vm.newTable()
+			if err != nil {
+				return nil, err
+			}
+			for _, line := range lf.LineInfo {
+				if err := lines.Set(types.Integer(line), types.Boolean(true)); err != nil {
+					return nil, err
+				}
+			}
+			set("activelines", lines)
+		default:
+			return nil, errArgument(a+2, "getinfo", "invalid option")
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []types.Value{t}, nil
+}
+
+// local 返回调用帧中第 n 个局部变量的名字和存储位置, n 为负数时表示第 -n 个可变参数
+func (f *Frame) local(n int) (string, *types.Value) {
+	if n < 0 {
+		if -n > len(f.varArgs) {
+			return "", nil
+		}
+		return "(*vararg)", &f.varArgs[-n-1]
+	}
+	if n == 0 || n > len(*f.Register) {
+		return "", nil
+	}
+	name := localName(f.fn.Prototype, n-1, f.pc-1)
+	if name == "" {
+		name = "(*temporary)"
+	}
+	return name, &(*f.Register)[n-1]
+}
+
+// getlocal([thread,] f, local) 返回局部变量的名字和值, f 是函数时只返回参数的名字
+func debugGetLocal(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	st, rest := vm.threadArg(args)
+	a := len(args) - len(rest)
+	n, err := checkInteger(args, a+1, "getlocal")
+	if err != nil {
+		return nil, err
+	}
+	switch x := arg(args, a).(type) {
+	case *types.Function:
+		if name := localName(x.Prototype, int(n)-1, 0); n > 0 && name != "" {
+			return []types.Value{types.String(name)}, nil
+		}
+		return []types.Value{types.GetNil()}, nil
+	case types.Native:
+		return []types.Value{types.GetNil()}, nil
+	}
+	f, err := frameAt(st, args, a, "getlocal")
+	if err != nil {
+		return nil, err
+	}
+	name, v := f.local(int(n))
+	if v == nil {
+		return []types.Value{types.GetNil()}, nil
+	}
+	return []types.Value{types.String(name), *v}, nil
+}
+
+// setlocal([thread,] level, local, value) 修改局部变量, 返回变量的名字
+func debugSetLocal(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	st, rest := vm.threadArg(args)
+	a := len(args) - len(rest)
+	f, err := frameAt(st, args, a, "setlocal")
+	if err != nil {
+		return nil, err
+	}
+	n, err := checkInteger(args, a+1, "setlocal")
+	if err != nil {
+		return nil, err
+	}
+	v, err := checkAny(args, a+2, "setlocal")
+	if err != nil {
+		return nil, err
+	}
+	name, p := f.local(int(n))
+	if p == nil {
+		return []types.Value{types.GetNil()}, nil
+	}
+	*p = v
+	return []types.Value{types.String(name)}, nil
+}
+
+// upValue 返回 lua 函数的第 n 个 upvalue 和名字, 不存在时返回 nil
+func upValue(fn types.Value, n int64) (*types.ValuePointer, string) {
+	f, ok := fn.(*types.Function)
+	if !ok || n < 1 || n > int64(len(f.UpValues)) {
+		return nil, ""
+	}
+	name := "(*no name)"
+	if int(n) <= len(f.UpValueNames) && f.UpValueNames[n-1] != "" {
+		name = f.UpValueNames[n-1]
+	}
+	return f.UpValues[n-1], name
+}
+
+// getupvalue(f, up) 返回函数的第 up 个 upvalue 的名字和值
+func debugGetUpValue(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	fn, err := checkFunction(args, 0, "getupvalue")
+	if err != nil {
+		return nil, err
+	}
+	n, err := checkInteger(args, 1, "getupvalue")
+	if err != nil {
+		return nil, err
+	}
+	uv, name := upValue(fn, n)
+	if uv == nil {
+		return nil, nil
+	}
+	return []types.Value{types.String(name), uv.Get()}, nil
+}
+
+// setupvalue(f, up, value) 修改函数的第 up 个 upvalue, 返回 upvalue 的名字
+func debugSetUpValue(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	fn, err := checkFunction(args, 0, "setupvalue")
+	if err != nil {
+		return nil, err
+	}
+	n, err := checkInteger(args, 1, "setupvalue")
+	if err != nil {
+		return nil, err
+	}
+	v, err := checkAny(args, 2, "setupvalue")
+	if err != nil {
+		return nil, err
+	}
+	uv, name := upValue(fn, n)
+	if uv == nil {
+		return nil, nil
+	}
+	uv.Set(v)
+	return []types.Value{types.String(name)}, nil
+}
+
+// checkUpValue 检查第 i 个参数是函数, 第 i+1 个参数是有效的 upvalue 序号
+func checkUpValue(args []types.Value, i int, fname string) (*types.Function, int, error) {
+	fn, err := checkFunction(args, i, fname)
+	if err != nil {
+		return nil, 0, err
+	}
+	n, err := checkInteger(args, i+1, fname)
+	if err != nil {
+		return nil, 0, err
+	}
+	if uv, _ := upValue(fn, n); uv == nil {
+		return nil, 0, errArgument(i+2, fname, "invalid upvalue index")
+	}
+	return fn.(*types.Function), int(n) - 1, nil
+}
+
+// upvalueid(f, n) 返回 upvalue 的唯一标识, 共享同一个变量的闭包返回相同的标识
+func debugUpValueID(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	fn, n, err := checkUpValue(args, 0, "upvalueid")
+	if err != nil {
+		return nil, err
+	}
+	return []types.Value{types.LightUserdata{Pointer: fn.UpValues[n]}}, nil
+}
+
+// upvaluejoin(f1, n1, f2, n2) 让 f1 的第 n1 个 upvalue 指向 f2 的第 n2 个 upvalue
+func debugUpValueJoin(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	f1, n1, err := checkUpValue(args, 0, "upvaluejoin")
+	if err != nil {
+		return nil, err
+	}
+	f2, n2, err := checkUpValue(args, 2, "upvaluejoin")
+	if err != nil {
+		return nil, err
+	}
+	f1.UpValues[n1] = f2.UpValues[n2]
+	return nil, nil
+}
+
+// getmetatable(value) 返回值的元表, 不检查 __metatable 字段
+func debugGetMetatable(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	v, err := checkAny(args, 0, "getmetatable")
+	if err != nil {
+		return nil, err
+	}
+	if mt := vm.getMetatable(v); mt != nil {
+		return []types.Value{mt}, nil
+	}
+	return []types.Value{types.GetNil()}, nil
+}
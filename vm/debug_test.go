@@ -0,0 +1,114 @@
+package vm
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Salpadding/lua/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDebugGetInfo(t *testing.T) {
+	var vm LuaVM
+	values, err := vm.DoString(`
+local function f(a, b, ...)
+  local info = debug.getinfo(1, "nSlu")
+  return info
+end
+local info = f()
+local main = debug.getinfo(1, "S")
+local c = debug.getinfo(print)
+local self = debug.getinfo(0, "nf")
+return info.name, info.namewhat, info.what, info.currentline, info.linedefined, info.lastlinedefined,
+  info.nups, info.nparams, info.isvararg, main.what, c.what, c.short_src, self.name, self.func == debug.getinfo,
+  debug.getinfo(100)`)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{
+		types.String("f"), types.String("local"), types.String("Lua"), types.Integer(3),
+		types.Integer(2), types.Integer(5), types.Integer(1), types.Integer(2), types.Boolean(true),
+		types.String("main"), types.String("C"), types.String("[C]"), types.String("getinfo"), types.Boolean(true),
+		types.GetNil(),
+	}, values)
+
+	values, err = vm.DoString(`
+local function g() return 1 end
+local lines = debug.getinfo(g, "L").activelines
+return lines[2], lines[3], debug.getinfo(g, "t").istailcall`)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{types.Boolean(true), types.GetNil(), types.Boolean(false)}, values)
+
+	_, err = vm.DoString("debug.getinfo(1, 'X')")
+	assert.Error(t, err)
+	assert.True(t, strings.Contains(err.Error(), "bad argument #2 to 'getinfo' (invalid option)"))
+}
+
+func TestDebugLocal(t *testing.T) {
+	var vm LuaVM
+	values, err := vm.DoString(`
+local function f(a, ...)
+  local b = a + 1
+  local n1, v1 = debug.getlocal(1, 1)
+  local n2, v2 = debug.getlocal(1, 2)
+  local n3, v3 = debug.getlocal(1, -1)
+  debug.setlocal(1, 2, 100)
+  return n1, v1, n2, v2, n3, v3, b
+end
+return f(1, 'x')`)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{
+		types.String("a"), types.Integer(1), types.String("b"), types.Integer(2),
+		types.String("(*vararg)"), types.String("x"), types.Integer(100),
+	}, values)
+
+	values, err = vm.DoString(`
+local function f(x, y) end
+return debug.getlocal(f, 2), debug.getlocal(f, 3)`)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{types.String("y"), types.GetNil()}, values)
+
+	_, err = vm.DoString("debug.getlocal(50, 1)")
+	assert.Error(t, err)
+	assert.True(t, strings.Contains(err.Error(), "bad argument #1 to 'getlocal' (level out of range)"))
+}
+
+func TestDebugUpValue(t *testing.T) {
+	var vm LuaVM
+	values, err := vm.DoString(`
+local x, y = 1, 2
+local function f() return x end
+local function g() return x + y end
+local n1, v1 = debug.getupvalue(f, 1)
+local n2 = debug.setupvalue(g, 1, 10)
+local none = debug.getupvalue(f, 2)
+return n1, v1, n2, x, f(), none,
+  debug.upvalueid(f, 1) == debug.upvalueid(g, 1), debug.upvalueid(g, 1) == debug.upvalueid(g, 2)`)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{
+		types.String("x"), types.Integer(1), types.String("x"), types.Integer(10), types.Integer(10),
+		types.GetNil(), types.Boolean(true), types.Boolean(false),
+	}, values)
+
+	values, err = vm.DoString(`
+local a, b = 1, 2
+local function f() return a end
+local function g() return b end
+debug.upvaluejoin(f, 1, g, 1)
+b = 3
+return f(), debug.upvalueid(f, 1) == debug.upvalueid(g, 1)`)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{types.Integer(3), types.Boolean(true)}, values)
+
+	_, err = vm.DoString("debug.upvalueid(print, 1)")
+	assert.Error(t, err)
+	assert.True(t, strings.Contains(err.Error(), "bad argument #2 to 'upvalueid' (invalid upvalue index)"))
+}
+
+func TestDebugGetMetatable(t *testing.T) {
+	var vm LuaVM
+	values, err := vm.DoString(`
+local mt = {__metatable = "locked"}
+local t = setmetatable({}, mt)
+return getmetatable(t), debug.getmetatable(t) == mt, debug.getmetatable({})`)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{types.String("locked"), types.Boolean(true), types.GetNil()}, values)
+}
@@ -0,0 +1,497 @@
+package dap
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/Salpadding/lua/types"
+	"github.com/Salpadding/lua/types/value"
+	"github.com/Salpadding/lua/vm"
+	"github.com/Salpadding/lua/vm/debugger"
+)
+
+// threadID 是唯一的线程的编号, 协程和主线程共用同一个调用栈
+const threadID = 1
+
+var (
+	errNotLaunched = errors.New("no program launched")
+	errNotPaused   = errors.New("program is not paused")
+)
+
+// Server 是一个调试会话, 通过一个连接和编辑器通信
+type Server struct {
+	r   *bufio.Reader
+	w   io.Writer
+	wmu sync.Mutex // 保护 w 和 seq, 事件和响应可能在不同的 goroutine 中发送
+	seq int
+
+	vm      *vm.LuaVM
+	d       *debugger.Debugger
+	fn      *types.Function
+	program string       // 代码块名字中的路径
+	lines   map[int]bool // 代码块中有指令的行
+	maxLine int
+	entry   bool // 下一次暂停是 stopOnEntry 导致的
+	started bool
+
+	handles map[int]interface{} // 暂停期间有效的变量引用
+	exited  chan struct{}       // 脚本结束并发送 terminated 事件之后关闭
+}
+
+// 变量引用指向的对象, 表直接使用 *types.Table
+type (
+	localsRef   struct{ frame *debugger.Frame }
+	upValuesRef struct{ frame *debugger.Frame }
+)
+
+// NewServer 创建从 r 读取请求, 向 w 写入响应和事件的调试会话
+func NewServer(r io.Reader, w io.Writer) *Server {
+	return &Server{
+		r:       bufio.NewReader(r),
+		w:       w,
+		handles: map[int]interface{}{},
+		exited:  make(chan struct{}),
+	}
+}
+
+// ServeStdio 通过标准输入输出和编辑器通信
+func ServeStdio() error {
+	return NewServer(os.Stdin, os.Stdout).Serve()
+}
+
+// ListenAndServe 监听 TCP 地址, 每个连接是一个独立的调试会话
+func ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			NewServer(conn, conn).Serve()
+		}()
+	}
+}
+
+// Serve 处理请求直到收到 disconnect 请求或者连接关闭
+func (s *Server) Serve() error {
+	defer s.shutdown()
+	for {
+		req, err := readMessage(s.r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if req.Type != "request" {
+			continue
+		}
+		if req.Command == "disconnect" {
+			s.shutdown()
+			return s.respond(req, nil, nil)
+		}
+		h, ok := handlers[req.Command]
+		if !ok {
+			if err := s.respond(req, nil, fmt.Errorf("unsupported command '%s'", req.Command)); err != nil {
+				return err
+			}
+			continue
+		}
+		body, then, err := h(s, req.Arguments)
+		if err := s.respond(req, body, err); err != nil {
+			return err
+		}
+		// 继续执行等操作在响应之后进行, 保证客户端先收到响应再收到事件
+		if err == nil && then != nil {
+			then()
+		}
+	}
+}
+
+// shutdown 停止正在执行的脚本, 并等待结束事件发送完成
+func (s *Server) shutdown() {
+	if !s.started {
+		return
+	}
+	if s.d.Running() {
+		s.d.Terminate()
+	}
+	<-s.exited
+}
+
+func (s *Server) respond(req *message, body interface{}, err error) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	s.seq++
+	res := &response{Seq: s.seq, Type: "response", RequestSeq: req.Seq, Success: err == nil, Command: req.Command, Body: body}
+	if err != nil {
+		res.Message = err.Error()
+	}
+	return writeMessage(s.w, res)
+}
+
+func (s *Server) sendEvent(name string, body interface{}) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	s.seq++
+	return writeMessage(s.w, &event{Seq: s.seq, Type: "event", Event: name, Body: body})
+}
+
+// outputWriter 把脚本的输出作为 output 事件发送给编辑器
+type outputWriter struct{ s *Server }
+
+func (o outputWriter) Write(p []byte) (int, error) {
+	if err := o.s.sendEvent("output", outputEvent{Category: "stdout", Output: string(p)}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// handler 处理一种请求, 返回响应的内容和发送响应之后执行的操作
+type handler func(s *Server, args json.RawMessage) (interface{}, func(), error)
+
+var handlers = map[string]handler{
+	"initialize":        (*Server).initialize,
+	"launch":            (*Server).launch,
+	"setBreakpoints":    (*Server).setBreakpoints,
+	"configurationDone": (*Server).configurationDone,
+	"threads":           (*Server).threads,
+	"stackTrace":        (*Server).stackTrace,
+	"scopes":            (*Server).scopes,
+	"variables":         (*Server).variables,
+	"evaluate":          (*Server).evaluate,
+	"continue":          resume((*debugger.Debugger).Continue),
+	"next":              resume((*debugger.Debugger).StepOver),
+	"stepIn":            resume((*debugger.Debugger).StepInto),
+	"stepOut":           resume((*debugger.Debugger).StepOut),
+	"pause":             (*Server).pause,
+	"terminate":         (*Server).terminate,
+}
+
+func (s *Server) initialize(args json.RawMessage) (interface{}, func(), error) {
+	return capabilities{
+		SupportsConfigurationDoneRequest: true,
+		SupportsEvaluateForHovers:        true,
+		SupportsTerminateRequest:         true,
+	}, nil, nil
+}
+
+// launch 加载程序, 程序在 configurationDone 之后才开始执行
+func (s *Server) launch(raw json.RawMessage) (interface{}, func(), error) {
+	var args launchArguments
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, nil, err
+	}
+	if s.fn != nil {
+		return nil, nil, errors.New("program already launched")
+	}
+	path, err := filepath.Abs(args.Program)
+	if err != nil {
+		return nil, nil, err
+	}
+	l := vm.New(vm.WithStdout(outputWriter{s}))
+	fn, err := l.LoadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	s.vm, s.fn, s.program = l, fn, path
+	s.d = debugger.New(l)
+	s.lines = map[int]bool{}
+	s.addLines(fn.Prototype)
+	s.entry = args.StopOnEntry
+	// 加载之后才能根据行号信息设置断点
+	return nil, func() { s.sendEvent("initialized", nil) }, nil
+}
+
+// addLines 记录函数和嵌套的函数中有指令的行
+func (s *Server) addLines(p *types.Prototype) {
+	for _, line := range p.LineInfo {
+		s.lines[int(line)] = true
+		if int(line) > s.maxLine {
+			s.maxLine = int(line)
+		}
+	}
+	for _, sub := range p.Prototypes {
+		s.addLines(sub)
+	}
+}
+
+// resolveLine 把断点移动到 line 或者之后第一个有指令的行
+func (s *Server) resolveLine(line int) (int, bool) {
+	for ; line <= s.maxLine; line++ {
+		if s.lines[line] {
+			return line, true
+		}
+	}
+	return 0, false
+}
+
+func (s *Server) setBreakpoints(raw json.RawMessage) (interface{}, func(), error) {
+	var args setBreakpointsArguments
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, nil, err
+	}
+	requested := args.Lines
+	if args.Breakpoints != nil {
+		requested = nil
+		for _, bp := range args.Breakpoints {
+			requested = append(requested, bp.Line)
+		}
+	}
+	path, err := filepath.Abs(args.Source.Path)
+	if err != nil {
+		return nil, nil, err
+	}
+	bps := make([]breakpoint, len(requested))
+	if s.fn == nil || path != s.program {
+		for i, line := range requested {
+			bps[i] = breakpoint{Line: line, Message: "source is not loaded"}
+		}
+		return map[string]interface{}{"breakpoints": bps}, nil, nil
+	}
+	var lines []int
+	for i, line := range requested {
+		actual, ok := s.resolveLine(line)
+		if !ok {
+			bps[i] = breakpoint{Line: line, Message: "no code at or after this line"}
+			continue
+		}
+		bps[i] = breakpoint{Verified: true, Line: actual}
+		lines = append(lines, actual)
+	}
+	s.d.SetBreakpoints(debugger.SourceName(s.fn.Source), lines)
+	return map[string]interface{}{"breakpoints": bps}, nil, nil
+}
+
+func (s *Server) configurationDone(args json.RawMessage) (interface{}, func(), error) {
+	if s.fn == nil {
+		return nil, nil, errNotLaunched
+	}
+	if s.started {
+		return nil, nil, errors.New("program already started")
+	}
+	return nil, s.start, nil
+}
+
+// start 开始执行程序, 并在新的 goroutine 中把暂停和结束转换为事件
+func (s *Server) start() {
+	if s.entry {
+		s.d.Pause()
+	}
+	if err := s.d.Start(s.fn); err != nil {
+		s.sendEvent("output", outputEvent{Category: "stderr", Output: err.Error() + "\n"})
+		return
+	}
+	s.started = true
+	go s.watch()
+}
+
+func (s *Server) watch() {
+	defer close(s.exited)
+	for {
+		e := s.d.Wait()
+		if e.Reason != debugger.Exited {
+			reason := e.Reason.String()
+			if s.entry {
+				reason, s.entry = "entry", false
+			}
+			s.sendEvent("stopped", stoppedEvent{Reason: reason, ThreadID: threadID, AllThreadsStopped: true})
+			continue
+		}
+		code := 0
+		if e.Err != nil && e.Err != context.Canceled {
+			code = 1
+			s.sendEvent("output", outputEvent{Category: "stderr", Output: e.Err.Error() + "\n"})
+		}
+		s.sendEvent("exited", exitedEvent{ExitCode: code})
+		s.sendEvent("terminated", nil)
+		return
+	}
+}
+
+func (s *Server) threads(args json.RawMessage) (interface{}, func(), error) {
+	return map[string]interface{}{"threads": []thread{{ID: threadID, Name: "main"}}}, nil, nil
+}
+
+// frame 返回暂停时的调用帧, 帧的编号是层数加 1
+func (s *Server) frame(id int) (*debugger.Frame, error) {
+	if s.d == nil || !s.d.Paused() {
+		return nil, errNotPaused
+	}
+	if id == 0 {
+		id = 1
+	}
+	return s.d.Frame(id - 1)
+}
+
+func (s *Server) stackTrace(raw json.RawMessage) (interface{}, func(), error) {
+	var args stackTraceArguments
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, nil, err
+	}
+	if s.d == nil || !s.d.Paused() {
+		return nil, nil, errNotPaused
+	}
+	frames := s.d.Frames()
+	total := len(frames)
+	if args.StartFrame < len(frames) {
+		frames = frames[args.StartFrame:]
+	} else {
+		frames = nil
+	}
+	if args.Levels > 0 && args.Levels < len(frames) {
+		frames = frames[:args.Levels]
+	}
+	res := make([]stackFrame, len(frames))
+	for i, f := range frames {
+		res[i] = stackFrame{
+			ID:     f.Level + 1,
+			Name:   f.Name,
+			Source: &source{Name: filepath.Base(f.Source), Path: f.Source},
+			Line:   f.Line,
+			Column: 1,
+		}
+	}
+	return map[string]interface{}{"stackFrames": res, "totalFrames": total}, nil, nil
+}
+
+// handle 为暂停期间可以展开的对象分配变量引用
+func (s *Server) handle(v interface{}) int {
+	id := len(s.handles) + 1
+	s.handles[id] = v
+	return id
+}
+
+func (s *Server) scopes(raw json.RawMessage) (interface{}, func(), error) {
+	var args frameArguments
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, nil, err
+	}
+	f, err := s.frame(args.FrameID)
+	if err != nil {
+		return nil, nil, err
+	}
+	scopes := []scope{
+		{Name: "Locals", VariablesReference: s.handle(localsRef{f})},
+		{Name: "Upvalues", VariablesReference: s.handle(upValuesRef{f})},
+	}
+	return map[string]interface{}{"scopes": scopes}, nil, nil
+}
+
+// variable 把值转换为 DAP 的变量, 表可以继续展开
+func (s *Server) variable(name string, v types.Value) variable {
+	res := variable{Name: name, Value: debugger.FormatValue(v), Type: v.Type().String()}
+	if t, ok := v.(*types.Table); ok {
+		res.VariablesReference = s.handle(t)
+	}
+	return res
+}
+
+func (s *Server) variables(raw json.RawMessage) (interface{}, func(), error) {
+	var args variablesArguments
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, nil, err
+	}
+	if s.d == nil || !s.d.Paused() {
+		return nil, nil, errNotPaused
+	}
+	vars := []variable{}
+	switch x := s.handles[args.VariablesReference].(type) {
+	case localsRef:
+		for _, v := range x.frame.Locals() {
+			vars = append(vars, s.variable(v.Name, v.Value))
+		}
+		for i, v := range x.frame.VarArgs() {
+			vars = append(vars, s.variable(fmt.Sprintf("(*vararg %d)", i+1), v))
+		}
+	case upValuesRef:
+		for _, v := range x.frame.UpValues() {
+			vars = append(vars, s.variable(v.Name, v.Value))
+		}
+	case *types.Table:
+		k, v, err := x.Next(types.GetNil())
+		for ; err == nil && k.Type() != value.Nil; k, v, err = x.Next(k) {
+			name := debugger.FormatValue(k)
+			if str, ok := k.(types.String); ok {
+				name = string(str)
+			} else {
+				name = "[" + name + "]"
+			}
+			vars = append(vars, s.variable(name, v))
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	default:
+		return nil, nil, fmt.Errorf("invalid variables reference %d", args.VariablesReference)
+	}
+	return map[string]interface{}{"variables": vars}, nil, nil
+}
+
+func (s *Server) evaluate(raw json.RawMessage) (interface{}, func(), error) {
+	var args evaluateArguments
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, nil, err
+	}
+	f, err := s.frame(args.FrameID)
+	if err != nil {
+		return nil, nil, err
+	}
+	values, err := f.Eval(args.Expression)
+	if err != nil {
+		return nil, nil, err
+	}
+	res := evaluateResponse{}
+	if len(values) == 1 {
+		v := s.variable("", values[0])
+		res.Result, res.Type, res.VariablesReference = v.Value, v.Type, v.VariablesReference
+		return res, nil, nil
+	}
+	results := make([]string, len(values))
+	for i, v := range values {
+		results[i] = debugger.FormatValue(v)
+	}
+	res.Result = strings.Join(results, ", ")
+	return res, nil, nil
+}
+
+// resume 返回继续执行的请求的处理函数, 继续执行之后变量引用失效
+func resume(fn func(d *debugger.Debugger) error) handler {
+	return func(s *Server, args json.RawMessage) (interface{}, func(), error) {
+		if s.d == nil || !s.d.Paused() {
+			return nil, nil, errNotPaused
+		}
+		s.handles = map[int]interface{}{}
+		return map[string]interface{}{"allThreadsContinued": true}, func() { fn(s.d) }, nil
+	}
+}
+
+func (s *Server) pause(args json.RawMessage) (interface{}, func(), error) {
+	if !s.started {
+		return nil, nil, errNotLaunched
+	}
+	s.d.Pause()
+	return nil, nil, nil
+}
+
+func (s *Server) terminate(args json.RawMessage) (interface{}, func(), error) {
+	if !s.started {
+		return nil, nil, errNotLaunched
+	}
+	return nil, func() { s.d.Terminate() }, nil
+}
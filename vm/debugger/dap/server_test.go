@@ -0,0 +1,278 @@
+package dap
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// client 是测试中使用的 DAP 客户端, 按照脚本发送请求并检查响应和事件
+type client struct {
+	t       *testing.T
+	conn    net.Conn
+	seq     int
+	msgs    chan *message
+	pending []*message // 等待响应时收到的事件
+	done    chan error
+}
+
+func newClient(t *testing.T) *client {
+	c1, c2 := net.Pipe()
+	c := &client{t: t, conn: c2, msgs: make(chan *message, 100), done: make(chan error, 1)}
+	go func() {
+		c.done <- NewServer(c1, c1).Serve()
+		c1.Close()
+	}()
+	go func() {
+		r := bufio.NewReader(c2)
+		for {
+			msg, err := readMessage(r)
+			if err != nil {
+				close(c.msgs)
+				return
+			}
+			c.msgs <- msg
+		}
+	}()
+	return c
+}
+
+func (c *client) send(command string, args interface{}) {
+	c.seq++
+	req := map[string]interface{}{"seq": c.seq, "type": "request", "command": command}
+	if args != nil {
+		req["arguments"] = args
+	}
+	assert.NoError(c.t, writeMessage(c.conn, req))
+}
+
+func (c *client) next() *message {
+	c.t.Helper()
+	select {
+	case msg, ok := <-c.msgs:
+		if !ok {
+			c.t.Fatal("connection closed")
+		}
+		return msg
+	case <-time.After(5 * time.Second):
+		c.t.Fatal("timeout")
+	}
+	return nil
+}
+
+// request 发送请求并等待响应, 把响应的内容解码到 body
+func (c *client) request(command string, args interface{}, body interface{}) *message {
+	c.t.Helper()
+	c.send(command, args)
+	for {
+		msg := c.next()
+		if msg.Type == "event" {
+			c.pending = append(c.pending, msg)
+			continue
+		}
+		assert.Equal(c.t, c.seq, msg.RequestSeq)
+		assert.Equal(c.t, command, msg.Command)
+		if body != nil {
+			assert.True(c.t, msg.Success, msg.Message)
+			assert.NoError(c.t, json.Unmarshal(msg.Body, body))
+		}
+		return msg
+	}
+}
+
+// event 等待名字为 name 的事件, 跳过 output 事件
+func (c *client) event(name string, body interface{}) {
+	c.t.Helper()
+	for {
+		var msg *message
+		if len(c.pending) > 0 {
+			msg, c.pending = c.pending[0], c.pending[1:]
+		} else {
+			msg = c.next()
+		}
+		if msg.Type != "event" || msg.Event == "output" && name != "output" {
+			continue
+		}
+		assert.Equal(c.t, name, msg.Event)
+		if body != nil {
+			assert.NoError(c.t, json.Unmarshal(msg.Body, body))
+		}
+		return
+	}
+}
+
+func (c *client) launch(program string, stopOnEntry bool) string {
+	c.t.Helper()
+	var caps capabilities
+	c.request("initialize", map[string]interface{}{"adapterID": "lua"}, &caps)
+	assert.True(c.t, caps.SupportsConfigurationDoneRequest)
+	path, _ := filepath.Abs(program)
+	res := c.request("launch", launchArguments{Program: program, StopOnEntry: stopOnEntry}, nil)
+	assert.True(c.t, res.Success, res.Message)
+	c.event("initialized", nil)
+	return path
+}
+
+func (c *client) stopped(reason string) {
+	c.t.Helper()
+	var e stoppedEvent
+	c.event("stopped", &e)
+	assert.Equal(c.t, reason, e.Reason)
+	assert.Equal(c.t, threadID, e.ThreadID)
+}
+
+type stackTraceBody struct {
+	StackFrames []stackFrame `json:"stackFrames"`
+	TotalFrames int          `json:"totalFrames"`
+}
+
+func (c *client) stack() []stackFrame {
+	c.t.Helper()
+	var body stackTraceBody
+	c.request("stackTrace", map[string]interface{}{"threadId": threadID}, &body)
+	return body.StackFrames
+}
+
+func (c *client) variables(ref int) map[string]variable {
+	c.t.Helper()
+	var body struct {
+		Variables []variable `json:"variables"`
+	}
+	c.request("variables", variablesArguments{VariablesReference: ref}, &body)
+	vars := map[string]variable{}
+	for _, v := range body.Variables {
+		vars[v.Name] = v
+	}
+	return vars
+}
+
+func TestSession(t *testing.T) {
+	c := newClient(t)
+	path := c.launch("testdata/sum.lua", false)
+
+	var bps struct {
+		Breakpoints []breakpoint `json:"breakpoints"`
+	}
+	c.request("setBreakpoints", setBreakpointsArguments{
+		Source:      source{Path: path},
+		Breakpoints: []sourceBreakpoint{{Line: 4}, {Line: 8}, {Line: 100}},
+	}, &bps)
+	assert.Equal(t, []breakpoint{
+		{Verified: true, Line: 4},
+		{Verified: true, Line: 9},
+		{Line: 100, Message: "no code at or after this line"},
+	}, bps.Breakpoints)
+	c.request("configurationDone", nil, nil)
+
+	// 空行上的断点移动到下一行
+	c.stopped("breakpoint")
+	frames := c.stack()
+	assert.Equal(t, 1, len(frames))
+	assert.Equal(t, 9, frames[0].Line)
+	assert.Equal(t, path, frames[0].Source.Path)
+
+	c.request("continue", map[string]interface{}{"threadId": threadID}, nil)
+	c.stopped("breakpoint")
+	frames = c.stack()
+	assert.Equal(t, 2, len(frames))
+	assert.Equal(t, "sum", frames[0].Name)
+	assert.Equal(t, 4, frames[0].Line)
+	assert.Equal(t, "main chunk", frames[1].Name)
+	assert.Equal(t, 10, frames[1].Line)
+
+	var scopes struct {
+		Scopes []scope `json:"scopes"`
+	}
+	c.request("scopes", frameArguments{FrameID: frames[0].ID}, &scopes)
+	assert.Equal(t, "Locals", scopes.Scopes[0].Name)
+	locals := c.variables(scopes.Scopes[0].VariablesReference)
+	assert.Equal(t, "0", locals["s"].Value)
+	assert.Equal(t, "1", locals["v"].Value, locals)
+	assert.Equal(t, "table", locals["t"].Type)
+
+	// 展开表
+	fields := c.variables(locals["t"].VariablesReference)
+	assert.Equal(t, 4, len(fields))
+	assert.Equal(t, "3", fields["[3]"].Value)
+	assert.Equal(t, `"list"`, fields["name"].Value)
+
+	var eval evaluateResponse
+	c.request("evaluate", evaluateArguments{Expression: "s + v * 10", FrameID: frames[0].ID}, &eval)
+	assert.Equal(t, "10", eval.Result)
+	c.request("evaluate", evaluateArguments{Expression: "data", FrameID: frames[1].ID}, &eval)
+	assert.Equal(t, "table", eval.Type)
+	assert.NotZero(t, eval.VariablesReference)
+	res := c.request("evaluate", evaluateArguments{Expression: "error('boom')", FrameID: frames[0].ID}, nil)
+	assert.False(t, res.Success)
+
+	c.request("setBreakpoints", setBreakpointsArguments{Source: source{Path: path}}, &bps)
+	assert.Empty(t, bps.Breakpoints)
+	c.request("next", map[string]interface{}{"threadId": threadID}, nil)
+	c.stopped("step")
+	assert.Equal(t, 3, c.stack()[0].Line)
+	c.request("stepOut", map[string]interface{}{"threadId": threadID}, nil)
+	c.stopped("step")
+	assert.Equal(t, 11, c.stack()[0].Line)
+
+	c.request("continue", map[string]interface{}{"threadId": threadID}, nil)
+	var out outputEvent
+	c.event("output", &out)
+	assert.Equal(t, outputEvent{Category: "stdout", Output: "total\t6\n"}, out)
+	var exited exitedEvent
+	c.event("exited", &exited)
+	assert.Equal(t, 0, exited.ExitCode)
+	c.event("terminated", nil)
+
+	res = c.request("continue", map[string]interface{}{"threadId": threadID}, nil)
+	assert.False(t, res.Success)
+	c.request("disconnect", nil, nil)
+	assert.NoError(t, <-c.done)
+}
+
+func TestPauseAndStepIn(t *testing.T) {
+	c := newClient(t)
+	c.launch("testdata/loop.lua", true)
+	c.request("configurationDone", nil, nil)
+	c.stopped("entry")
+	assert.Equal(t, 1, c.stack()[0].Line)
+
+	c.request("stepIn", map[string]interface{}{"threadId": threadID}, nil)
+	c.stopped("step")
+	assert.Equal(t, 2, c.stack()[0].Line)
+
+	c.request("continue", map[string]interface{}{"threadId": threadID}, nil)
+	c.request("pause", map[string]interface{}{"threadId": threadID}, nil)
+	c.stopped("pause")
+	var scopes struct {
+		Scopes []scope `json:"scopes"`
+	}
+	c.request("scopes", frameArguments{FrameID: 1}, &scopes)
+	locals := c.variables(scopes.Scopes[0].VariablesReference)
+	assert.Equal(t, "number", locals["n"].Type)
+
+	// 断开连接时停止脚本
+	c.request("disconnect", nil, nil)
+	var exited exitedEvent
+	c.event("exited", &exited)
+	assert.Equal(t, 0, exited.ExitCode)
+	c.event("terminated", nil)
+	assert.NoError(t, <-c.done)
+}
+
+func TestUnsupported(t *testing.T) {
+	c := newClient(t)
+	res := c.request("restartFrame", nil, nil)
+	assert.False(t, res.Success)
+	assert.Equal(t, "unsupported command 'restartFrame'", res.Message)
+	res = c.request("launch", launchArguments{Program: "testdata/missing.lua"}, nil)
+	assert.False(t, res.Success)
+	res = c.request("configurationDone", nil, nil)
+	assert.Equal(t, errNotLaunched.Error(), res.Message)
+	c.request("disconnect", nil, nil)
+	assert.NoError(t, <-c.done)
+}
@@ -0,0 +1,12 @@
+local function sum(t)
+  local s = 0
+  for _, v in ipairs(t) do
+    s = s + v
+  end
+  return s
+end
+
+local data = {1, 2, 3, name = "list"}
+local total = sum(data)
+print("total", total)
+return total
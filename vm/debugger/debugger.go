@@ -0,0 +1,322 @@
+// Package debugger 在虚拟机的调试钩子上实现断点, 单步执行和查看变量
+//
+// 脚本在单独的 goroutine 中执行, 暂停时阻塞在钩子中, 直到调用 Continue 或者单步执行的方法
+package debugger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Salpadding/lua/types"
+	"github.com/Salpadding/lua/vm"
+)
+
+var (
+	errRunning    = errors.New("debugger: script is already running")
+	errNotRunning = errors.New("debugger: script is not running")
+	errNotPaused  = errors.New("debugger: script is not paused")
+)
+
+// Reason 是脚本暂停或者结束的原因
+type Reason int
+
+const (
+	Breakpoint Reason = iota // 遇到断点
+	Step                     // 单步执行完成
+	Pause                    // 调用了 Pause
+	Exited                   // 脚本执行结束
+)
+
+var reasonNames = [...]string{"breakpoint", "step", "pause", "exited"}
+
+func (r Reason) String() string {
+	return reasonNames[r]
+}
+
+// Event 是脚本暂停或者结束的事件
+type Event struct {
+	Reason Reason
+	Source string // 暂停位置的代码块名字, 去掉了开头的 @ 或者 =
+	Line   int    // 暂停位置的行号
+
+	Values []types.Value // 脚本结束时的返回值
+	Err    error         // 脚本结束时的错误, 调用 Terminate 时是 context.Canceled
+}
+
+// command 是暂停之后继续执行的方式
+type command int
+
+const (
+	cmdContinue command = iota
+	cmdStepOver
+	cmdStepInto
+	cmdStepOut
+	cmdTerminate
+)
+
+// Debugger 调试在虚拟机中执行的脚本, 同一时间只能执行一个脚本
+type Debugger struct {
+	vm *vm.LuaVM
+
+	mu          sync.Mutex
+	breakpoints map[string]map[int]bool // 代码块名字到断点行号
+	running     bool
+	paused      bool
+	frames      []*Frame // 暂停时的调用栈, 第一个元素是栈顶
+	cancel      context.CancelFunc
+
+	pause    int32 // 不为 0 时在下一行暂停
+	events   chan *Event
+	commands chan command
+
+	// 以下字段只在脚本的 goroutine 中访问
+	ctx       context.Context
+	step      command // 正在进行的单步操作, cmdContinue 表示没有
+	stepDepth int     // 开始单步操作时调用栈的深度
+}
+
+// New 创建调试器, 开始执行脚本时才会设置虚拟机的调试钩子
+func New(l *vm.LuaVM) *Debugger {
+	return &Debugger{
+		vm:          l,
+		breakpoints: map[string]map[int]bool{},
+		events:      make(chan *Event, 1),
+		commands:    make(chan command),
+	}
+}
+
+// SourceName 返回断点中使用的代码块名字, 去掉了代码块名字开头的 @ 或者 =
+func SourceName(source string) string {
+	if strings.HasPrefix(source, "@") || strings.HasPrefix(source, "=") {
+		return source[1:]
+	}
+	return source
+}
+
+// SetBreakpoint 在代码块 source 的第 line 行设置断点
+func (d *Debugger) SetBreakpoint(source string, line int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	lines := d.breakpoints[source]
+	if lines == nil {
+		lines = map[int]bool{}
+		d.breakpoints[source] = lines
+	}
+	lines[line] = true
+}
+
+// ClearBreakpoint 删除代码块 source 第 line 行的断点
+func (d *Debugger) ClearBreakpoint(source string, line int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.breakpoints[source], line)
+}
+
+// SetBreakpoints 把代码块 source 的断点替换为 lines
+func (d *Debugger) SetBreakpoints(source string, lines []int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	m := map[int]bool{}
+	for _, line := range lines {
+		m[line] = true
+	}
+	d.breakpoints[source] = m
+}
+
+// Breakpoints 返回代码块 source 中按照行号排序的断点
+func (d *Debugger) Breakpoints(source string) []int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var lines []int
+	for line := range d.breakpoints[source] {
+		lines = append(lines, line)
+	}
+	sort.Ints(lines)
+	return lines
+}
+
+func (d *Debugger) hasBreakpoint(source string, line int) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.breakpoints[source][line]
+}
+
+// Start 在新的 goroutine 中调用函数, 之后通过 Wait 得到暂停或者结束的事件
+func (d *Debugger) Start(fn types.Value, args ...types.Value) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.running {
+		return errRunning
+	}
+	d.running = true
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+	d.step = cmdContinue
+	d.vm.SetHook(d.hook, vm.MaskLine, 0)
+	go func() {
+		values, err := d.vm.CallContext(d.ctx, 0, fn, args...)
+		d.vm.SetHook(nil, 0, 0)
+		d.mu.Lock()
+		d.running = false
+		d.cancel()
+		d.mu.Unlock()
+		d.events <- &Event{Reason: Exited, Values: values, Err: err}
+	}()
+	return nil
+}
+
+// Wait 等待脚本暂停或者结束
+func (d *Debugger) Wait() *Event {
+	return <-d.events
+}
+
+// Running 判断脚本是否正在执行, 暂停时也是正在执行
+func (d *Debugger) Running() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.running
+}
+
+// Paused 判断脚本是否暂停
+func (d *Debugger) Paused() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.paused
+}
+
+// Pause 让脚本在执行下一行之前暂停, 在 Start 之前调用时在第一行暂停
+func (d *Debugger) Pause() {
+	atomic.StoreInt32(&d.pause, 1)
+}
+
+// Continue 继续执行到下一个断点
+func (d *Debugger) Continue() error {
+	return d.resume(cmdContinue)
+}
+
+// StepOver 执行到当前函数的下一行, 不进入调用的函数
+func (d *Debugger) StepOver() error {
+	return d.resume(cmdStepOver)
+}
+
+// StepInto 执行到下一行, 调用 lua 函数时在函数的第一行暂停
+func (d *Debugger) StepInto() error {
+	return d.resume(cmdStepInto)
+}
+
+// StepOut 执行到当前函数返回之后调用者的下一行
+func (d *Debugger) StepOut() error {
+	return d.resume(cmdStepOut)
+}
+
+// Terminate 停止执行脚本, 之后 Wait 返回的结束事件中的错误是 context.Canceled
+func (d *Debugger) Terminate() error {
+	d.mu.Lock()
+	if !d.running {
+		d.mu.Unlock()
+		return errNotRunning
+	}
+	d.cancel()
+	paused := d.paused
+	d.paused = false
+	d.mu.Unlock()
+	if paused {
+		d.commands <- cmdTerminate
+	}
+	return nil
+}
+
+func (d *Debugger) resume(cmd command) error {
+	d.mu.Lock()
+	if !d.paused {
+		d.mu.Unlock()
+		return errNotPaused
+	}
+	d.paused = false
+	d.mu.Unlock()
+	d.commands <- cmd
+	return nil
+}
+
+// Frames 返回暂停时的调用栈, 第一个元素是栈顶的函数, 没有暂停时返回 nil
+func (d *Debugger) Frames() []*Frame {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.frames
+}
+
+// Frame 返回暂停时调用栈的第 level 层, 第 0 层是栈顶的函数
+func (d *Debugger) Frame(level int) (*Frame, error) {
+	frames := d.Frames()
+	if frames == nil {
+		return nil, errNotPaused
+	}
+	if level < 0 || level >= len(frames) {
+		return nil, fmt.Errorf("debugger: frame %d out of range", level)
+	}
+	return frames[level], nil
+}
+
+// hook 是每一行开始执行之前调用的钩子, 需要暂停时阻塞直到收到继续执行的命令
+func (d *Debugger) hook(l *vm.LuaVM, info *vm.HookInfo) error {
+	if err := d.ctx.Err(); err != nil {
+		return err
+	}
+	depth := len(l.Frames())
+	reason, ok := d.stopReason(info, depth)
+	if !ok {
+		return nil
+	}
+	d.step = cmdContinue
+
+	d.mu.Lock()
+	d.frames = d.stack(l)
+	d.paused = true
+	d.mu.Unlock()
+	d.events <- &Event{Reason: reason, Source: SourceName(info.Function.Source), Line: info.Line}
+
+	cmd := <-d.commands
+	d.mu.Lock()
+	d.frames = nil
+	d.mu.Unlock()
+	switch cmd {
+	case cmdTerminate:
+		return d.ctx.Err()
+	case cmdStepOver, cmdStepInto, cmdStepOut:
+		d.step, d.stepDepth = cmd, depth
+	}
+	return nil
+}
+
+// stopReason 判断是否需要在将要执行的一行之前暂停
+func (d *Debugger) stopReason(info *vm.HookInfo, depth int) (Reason, bool) {
+	if atomic.CompareAndSwapInt32(&d.pause, 1, 0) {
+		return Pause, true
+	}
+	if d.hasBreakpoint(SourceName(info.Function.Source), info.Line) {
+		return Breakpoint, true
+	}
+	switch d.step {
+	case cmdStepInto:
+		return Step, true
+	case cmdStepOver:
+		return Step, depth <= d.stepDepth
+	case cmdStepOut:
+		return Step, depth < d.stepDepth
+	}
+	return 0, false
+}
+
+// stack 记录当前线程的调用栈
+func (d *Debugger) stack(l *vm.LuaVM) []*Frame {
+	vmFrames := l.Frames()
+	frames := make([]*Frame, len(vmFrames))
+	for i, f := range vmFrames {
+		frames[i] = newFrame(d, i, f)
+	}
+	return frames
+}
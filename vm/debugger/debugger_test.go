@@ -0,0 +1,160 @@
+package debugger
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/Salpadding/lua/types"
+	"github.com/Salpadding/lua/vm"
+	"github.com/stretchr/testify/assert"
+)
+
+const script = `local function add(a, b)
+  local s = a + b
+  return s
+end
+local x = 1
+local y = add(x, 2)
+x = add(y, 3)
+return x`
+
+func load(t *testing.T) (*Debugger, types.Value) {
+	var l vm.LuaVM
+	fn, err := l.LoadEnv(strings.NewReader(script), "@test.lua", nil)
+	assert.NoError(t, err)
+	return New(&l), fn
+}
+
+func assertStop(t *testing.T, e *Event, reason Reason, line int) {
+	assert.Equal(t, reason, e.Reason)
+	assert.Equal(t, "test.lua", e.Source)
+	assert.Equal(t, line, e.Line)
+}
+
+func TestBreakpoint(t *testing.T) {
+	d, fn := load(t)
+	d.SetBreakpoint("test.lua", 2)
+	assert.Equal(t, []int{2}, d.Breakpoints("test.lua"))
+	assert.NoError(t, d.Start(fn))
+
+	assertStop(t, d.Wait(), Breakpoint, 2)
+	frames := d.Frames()
+	assert.Equal(t, 2, len(frames))
+	assert.Equal(t, "add", frames[0].Name)
+	assert.Equal(t, "main chunk", frames[1].Name)
+	assert.Equal(t, 6, frames[1].Line)
+	assert.Equal(t, []vm.Variable{{Name: "a", Value: types.Integer(1)}, {Name: "b", Value: types.Integer(2)}}, frames[0].Locals())
+
+	assert.NoError(t, d.Continue())
+	assertStop(t, d.Wait(), Breakpoint, 2)
+	assert.Equal(t, 7, d.Frames()[1].Line)
+
+	d.ClearBreakpoint("test.lua", 2)
+	assert.NoError(t, d.Continue())
+	e := d.Wait()
+	assert.Equal(t, Exited, e.Reason)
+	assert.NoError(t, e.Err)
+	assert.Equal(t, []types.Value{types.Integer(6)}, e.Values)
+	assert.Nil(t, d.Frames())
+	assert.Equal(t, errNotPaused, d.Continue())
+}
+
+func TestStep(t *testing.T) {
+	d, fn := load(t)
+	d.Pause()
+	assert.NoError(t, d.Start(fn))
+	assertStop(t, d.Wait(), Pause, 1)
+
+	for _, line := range []int{5, 6} {
+		assert.NoError(t, d.StepOver())
+		assertStop(t, d.Wait(), Step, line)
+	}
+	assert.NoError(t, d.StepInto())
+	assertStop(t, d.Wait(), Step, 2)
+	assert.NoError(t, d.StepOver())
+	assertStop(t, d.Wait(), Step, 3)
+	assert.NoError(t, d.StepOut())
+	assertStop(t, d.Wait(), Step, 7)
+	assert.NoError(t, d.StepOver())
+	assertStop(t, d.Wait(), Step, 8)
+
+	assert.NoError(t, d.Continue())
+	assert.Equal(t, Exited, d.Wait().Reason)
+}
+
+func TestEval(t *testing.T) {
+	d, fn := load(t)
+	d.SetBreakpoint("test.lua", 3)
+	assert.NoError(t, d.Start(fn))
+	assertStop(t, d.Wait(), Breakpoint, 3)
+
+	f, err := d.Frame(0)
+	assert.NoError(t, err)
+	values, err := f.Eval("s * 10, a, type(print)")
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{types.Integer(30), types.Integer(1), types.String("function")}, values)
+
+	// 修改局部变量会影响函数的返回值
+	_, err = f.Eval("s = 100")
+	assert.NoError(t, err)
+	caller, err := d.Frame(1)
+	assert.NoError(t, err)
+	values, err = caller.Eval("x")
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{types.Integer(1)}, values)
+
+	_, err = f.Eval("error('boom')")
+	assert.Error(t, err)
+	_, err = d.Frame(2)
+	assert.Error(t, err)
+
+	d.ClearBreakpoint("test.lua", 3)
+	assert.NoError(t, d.Continue())
+	e := d.Wait()
+	assert.NoError(t, e.Err)
+	assert.Equal(t, []types.Value{types.Integer(103)}, e.Values)
+}
+
+func TestTerminate(t *testing.T) {
+	var l vm.LuaVM
+	fn, err := l.LoadEnv(strings.NewReader("while true do pcall(function() end) end"), "=loop", nil)
+	assert.NoError(t, err)
+	d := New(&l)
+	assert.NoError(t, d.Start(fn))
+	assert.Equal(t, errRunning, d.Start(fn))
+	d.Pause()
+	e := d.Wait()
+	assert.Equal(t, Pause, e.Reason)
+	assert.Equal(t, "loop", e.Source)
+
+	assert.NoError(t, d.Terminate())
+	e = d.Wait()
+	assert.Equal(t, Exited, e.Reason)
+	assert.Equal(t, context.Canceled, e.Err)
+	assert.False(t, d.Running())
+	assert.Equal(t, errNotRunning, d.Terminate())
+}
+
+func TestREPL(t *testing.T) {
+	d, fn := load(t)
+	in := strings.NewReader(strings.Join([]string{
+		"b test.lua:3", "run", "bt", "locals", "p s + 1", "frame 1", "p y", "finish", "delete test.lua:3", "c",
+	}, "\n"))
+	var out bytes.Buffer
+	assert.NoError(t, d.REPL(fn, in, &out))
+	assert.Equal(t, `(ldb) breakpoint at test.lua:3
+(ldb) stopped (breakpoint) at test.lua:3
+(ldb) *#0 add at test.lua:3
+ #1 main chunk at test.lua:6
+(ldb) a = 1
+b = 2
+s = 3
+(ldb) 4
+(ldb) #1 main chunk at test.lua:6
+(ldb) nil
+(ldb) stopped (step) at test.lua:7
+(ldb) (ldb) exited: 6
+`, out.String())
+}
@@ -0,0 +1,153 @@
+package debugger
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Salpadding/lua/types"
+	"github.com/Salpadding/lua/vm"
+)
+
+// Frame 是暂停时调用栈中的一层, 只在暂停期间有效
+type Frame struct {
+	d     *Debugger
+	frame *vm.Frame
+
+	Level  int    // 第 0 层是栈顶的函数
+	Name   string // 函数的名字, 不知道名字时是 main chunk 或者 function <source:line>
+	Source string // 代码块名字, 去掉了开头的 @ 或者 =
+	Line   int    // 正在执行的行号
+}
+
+func newFrame(d *Debugger, level int, f *vm.Frame) *Frame {
+	fn := f.Function()
+	name := ""
+	if _, n := d.vm.FuncName(f); n != "" {
+		name = n
+	} else if fn.LineDefined == 0 {
+		name = "main chunk"
+	} else {
+		name = fmt.Sprintf("function <%s:%d>", SourceName(fn.Source), fn.LineDefined)
+	}
+	return &Frame{
+		d:      d,
+		frame:  f,
+		Level:  level,
+		Name:   name,
+		Source: SourceName(fn.Source),
+		Line:   f.CurrentLine(),
+	}
+}
+
+// Locals 返回正在执行的行中活跃的局部变量, 按照声明的顺序排列
+func (f *Frame) Locals() []vm.Variable {
+	return f.frame.Locals()
+}
+
+// UpValues 返回函数的 upvalue
+func (f *Frame) UpValues() []vm.Variable {
+	return f.frame.UpValues()
+}
+
+// VarArgs 返回函数的可变参数
+func (f *Frame) VarArgs() []types.Value {
+	return f.frame.VarArgs()
+}
+
+// Eval 在调用帧中执行表达式或者语句, 可以读写局部变量, upvalue 和全局变量
+// 表达式中的 ... 是调用帧的可变参数
+func (f *Frame) Eval(src string) ([]types.Value, error) {
+	env := types.NewTable()
+	meta := types.NewTable()
+	if err := meta.Set(types.String("__index"), types.Native(f.index)); err != nil {
+		return nil, err
+	}
+	if err := meta.Set(types.String("__newindex"), types.Native(f.newIndex)); err != nil {
+		return nil, err
+	}
+	env.SetMetatable(meta)
+
+	// 先作为表达式编译, 失败时再作为语句编译
+	fn, err := f.d.vm.LoadEnv(strings.NewReader("return "+src), "=eval", env)
+	if err != nil {
+		if fn, err = f.d.vm.LoadEnv(strings.NewReader(src), "=eval", env); err != nil {
+			return nil, err
+		}
+	}
+	return f.d.vm.Call(fn, f.VarArgs()...)
+}
+
+// index 依次在局部变量, upvalue 和全局变量中查找名字
+func (f *Frame) index(args ...types.Value) ([]types.Value, error) {
+	name, ok := args[1].(types.String)
+	if !ok {
+		return []types.Value{types.GetNil()}, nil
+	}
+	locals := f.Locals()
+	for i := len(locals) - 1; i >= 0; i-- {
+		if locals[i].Name == string(name) {
+			return []types.Value{locals[i].Value}, nil
+		}
+	}
+	for _, uv := range f.UpValues() {
+		if uv.Name == string(name) {
+			return []types.Value{uv.Value}, nil
+		}
+	}
+	g := f.globals()
+	if g == nil {
+		return []types.Value{types.GetNil()}, nil
+	}
+	v, err := g.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	return []types.Value{v}, nil
+}
+
+// newIndex 依次修改局部变量, upvalue 和全局变量
+func (f *Frame) newIndex(args ...types.Value) ([]types.Value, error) {
+	name, ok := args[1].(types.String)
+	if ok && (f.frame.SetLocal(string(name), args[2]) || f.frame.SetUpValue(string(name), args[2])) {
+		return nil, nil
+	}
+	g := f.globals()
+	if g == nil {
+		return nil, fmt.Errorf("cannot assign to %s", FormatValue(args[1]))
+	}
+	return nil, g.Set(args[1], args[2])
+}
+
+// globals 返回函数的 _ENV, 没有 _ENV 时使用虚拟机的全局变量
+func (f *Frame) globals() *types.Table {
+	for _, uv := range f.UpValues() {
+		if uv.Name == "_ENV" {
+			t, _ := uv.Value.(*types.Table)
+			return t
+		}
+	}
+	return f.d.vm.Globals()
+}
+
+// FormatValue 把值转换为调试器中显示的形式, 字符串带引号, 表和函数显示地址
+func FormatValue(v types.Value) string {
+	switch x := v.(type) {
+	case nil:
+		return "nil"
+	case *types.Nil, *types.None, types.Boolean, types.Integer, types.Float, types.String:
+		return x.String()
+	case *types.Table:
+		return fmt.Sprintf("table: %p", x)
+	case *types.Function:
+		return fmt.Sprintf("function: %p", x)
+	case types.Native:
+		return "function: builtin"
+	case *types.Userdata:
+		return fmt.Sprintf("userdata: %p", x)
+	case types.LightUserdata:
+		return fmt.Sprintf("userdata: %p", x.Pointer)
+	case *types.Thread:
+		return fmt.Sprintf("thread: %p", x)
+	}
+	return v.Type().String()
+}
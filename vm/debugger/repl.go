@@ -0,0 +1,186 @@
+package debugger
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/Salpadding/lua/types"
+)
+
+const replHelp = `commands:
+  break <source>:<line>   set a breakpoint (alias b)
+  delete <source>:<line>  delete a breakpoint
+  run                     start the script (alias r)
+  continue                continue to the next breakpoint (alias c)
+  next                    step over (alias n)
+  step                    step into (alias s)
+  finish                  step out
+  backtrace               print the call stack (alias bt)
+  frame <n>               select a frame (alias f)
+  locals                  print local variables and upvalues
+  print <expr>            evaluate an expression in the selected frame (alias p)
+  quit                    terminate the script and exit (alias q)`
+
+// REPL 从 in 读取命令调试函数 fn, 输出写入 out, 脚本结束或者输入 quit 时返回
+func (d *Debugger) REPL(fn types.Value, in io.Reader, out io.Writer) error {
+	r := &repl{d: d, fn: fn, out: out}
+	scanner := bufio.NewScanner(in)
+	for !r.done {
+		fmt.Fprint(out, "(ldb) ")
+		if !scanner.Scan() {
+			break
+		}
+		if err := r.exec(strings.TrimSpace(scanner.Text())); err != nil {
+			fmt.Fprintln(out, "error:", err)
+		}
+	}
+	if d.Running() {
+		if err := d.Terminate(); err != nil {
+			return err
+		}
+		d.Wait()
+	}
+	return scanner.Err()
+}
+
+type repl struct {
+	d     *Debugger
+	fn    types.Value
+	out   io.Writer
+	level int // 选择的调用帧
+	done  bool
+}
+
+func (r *repl) exec(line string) error {
+	cmd, arg := line, ""
+	if i := strings.IndexByte(line, ' '); i >= 0 {
+		cmd, arg = line[:i], strings.TrimSpace(line[i+1:])
+	}
+	switch cmd {
+	case "":
+		return nil
+	case "help", "h":
+		fmt.Fprintln(r.out, replHelp)
+	case "break", "b", "delete":
+		source, n, err := parseLocation(arg)
+		if err != nil {
+			return err
+		}
+		if cmd == "delete" {
+			r.d.ClearBreakpoint(source, n)
+			return nil
+		}
+		r.d.SetBreakpoint(source, n)
+		fmt.Fprintf(r.out, "breakpoint at %s:%d\n", source, n)
+	case "run", "r":
+		if err := r.d.Start(r.fn); err != nil {
+			return err
+		}
+		r.wait()
+	case "continue", "c":
+		return r.resume(r.d.Continue)
+	case "next", "n":
+		return r.resume(r.d.StepOver)
+	case "step", "s":
+		return r.resume(r.d.StepInto)
+	case "finish":
+		return r.resume(r.d.StepOut)
+	case "backtrace", "bt":
+		frames := r.d.Frames()
+		if frames == nil {
+			return errNotPaused
+		}
+		for _, f := range frames {
+			mark := " "
+			if f.Level == r.level {
+				mark = "*"
+			}
+			fmt.Fprintf(r.out, "%s#%d %s at %s:%d\n", mark, f.Level, f.Name, f.Source, f.Line)
+		}
+	case "frame", "f":
+		level, err := strconv.Atoi(arg)
+		if err != nil {
+			return fmt.Errorf("invalid frame number %q", arg)
+		}
+		f, err := r.d.Frame(level)
+		if err != nil {
+			return err
+		}
+		r.level = level
+		fmt.Fprintf(r.out, "#%d %s at %s:%d\n", f.Level, f.Name, f.Source, f.Line)
+	case "locals":
+		f, err := r.d.Frame(r.level)
+		if err != nil {
+			return err
+		}
+		for _, v := range f.Locals() {
+			fmt.Fprintf(r.out, "%s = %s\n", v.Name, FormatValue(v.Value))
+		}
+		for _, v := range f.UpValues() {
+			fmt.Fprintf(r.out, "%s = %s (upvalue)\n", v.Name, FormatValue(v.Value))
+		}
+	case "print", "p":
+		f, err := r.d.Frame(r.level)
+		if err != nil {
+			return err
+		}
+		values, err := f.Eval(arg)
+		if err != nil {
+			return err
+		}
+		s := make([]string, len(values))
+		for i, v := range values {
+			s[i] = FormatValue(v)
+		}
+		fmt.Fprintln(r.out, strings.Join(s, ", "))
+	case "quit", "q":
+		r.done = true
+	default:
+		return fmt.Errorf("unknown command %q, type help for a list of commands", cmd)
+	}
+	return nil
+}
+
+func (r *repl) resume(fn func() error) error {
+	if err := fn(); err != nil {
+		return err
+	}
+	r.wait()
+	return nil
+}
+
+// wait 等待脚本暂停或者结束并输出位置
+func (r *repl) wait() {
+	e := r.d.Wait()
+	r.level = 0
+	if e.Reason != Exited {
+		fmt.Fprintf(r.out, "stopped (%s) at %s:%d\n", e.Reason, e.Source, e.Line)
+		return
+	}
+	r.done = true
+	if e.Err != nil {
+		fmt.Fprintln(r.out, "script error:", e.Err)
+		return
+	}
+	s := make([]string, len(e.Values))
+	for i, v := range e.Values {
+		s[i] = FormatValue(v)
+	}
+	fmt.Fprintf(r.out, "exited: %s\n", strings.Join(s, ", "))
+}
+
+// parseLocation 解析 source:line 形式的位置
+func parseLocation(s string) (string, int, error) {
+	i := strings.LastIndexByte(s, ':')
+	if i < 0 {
+		return "", 0, fmt.Errorf("invalid location %q, expected <source>:<line>", s)
+	}
+	line, err := strconv.Atoi(s[i+1:])
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid line number in %q", s)
+	}
+	return s[:i], line, nil
+}
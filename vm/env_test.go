@@ -0,0 +1,63 @@
+package vm
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Salpadding/lua/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocalEnv(t *testing.T) {
+	var vm LuaVM
+	values, err := vm.DoString(`
+x = "global"
+local function sandbox()
+  local _ENV = {y = 1}
+  x = "inner"
+  local function f() z = y + 1 end
+  f()
+  return _ENV
+end
+local env = sandbox()
+return x, env.x, env.z
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{types.String("global"), types.String("inner"), types.Integer(2)}, values)
+
+	values, err = vm.DoString(`
+local _ENV = {tostring = tostring}
+v = 1
+return tostring(v)
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{types.String("1")}, values)
+	values, err = vm.DoString("return v")
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{types.GetNil()}, values)
+
+	_, err = vm.DoString("local _ENV = {}; print(1)")
+	assert.Contains(t, err.Error(), "attempt to call a nil value (global 'print')")
+}
+
+func TestLoadEnv(t *testing.T) {
+	var vm LuaVM
+	env := types.NewTable()
+	assert.NoError(t, env.Set(types.String("n"), types.Integer(41)))
+	fn, err := vm.LoadEnv(strings.NewReader("n = n + 1; result = n; return n"), "=sandbox", env)
+	assert.NoError(t, err)
+	values, err := vm.Call(fn)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{types.Integer(42)}, values)
+	result, _ := env.Get(types.String("result"))
+	assert.Equal(t, types.Integer(42), result)
+
+	values, err = vm.DoString("return n, result")
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{types.GetNil(), types.GetNil()}, values)
+
+	fn, err = vm.LoadEnv(strings.NewReader("return x"), "=nilenv", nil)
+	assert.NoError(t, err)
+	_, err = vm.Call(fn)
+	assert.Contains(t, err.Error(), "attempt to index a nil value")
+}
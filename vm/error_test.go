@@ -0,0 +1,146 @@
+package vm
+
+import (
+	"math"
+	"testing"
+
+	"github.com/Salpadding/lua/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRuntimeErrorInfo(t *testing.T) {
+	var vm LuaVM
+	cases := map[string]string{
+		"return x + 1":                              `[string "return x + 1"]:1: attempt to perform arithmetic on a nil value (global 'x')`,
+		"local t = {}\nreturn t.a.b":                `[string "local t = {}..."]:2: attempt to index a nil value (field 'a')`,
+		"local s = 'a'\nreturn -{}":                 `[string "local s = 'a'..."]:2: attempt to perform arithmetic on a table value`,
+		"local u\nreturn function() return u() end": "",
+		"return ('x') .. {}":                        `[string "return ('x') .. {}"]:1: attempt to concatenate a table value`,
+		"local a = 1\nreturn a & 1.5":               `[string "local a = 1..."]:2: number has no integer representation`,
+		"return #nil":                               `[string "return #nil"]:1: attempt to get length of a nil value`,
+		"string = nil\nreturn string.len('a')":      `[string "string = nil..."]:2: attempt to index a nil value (global 'string')`,
+	}
+	for src, msg := range cases {
+		values, err := vm.DoString(src)
+		if msg == "" {
+			assert.NoError(t, err)
+			_, err = vm.Call(values[0])
+			assert.EqualError(t, err, `[string "local u..."]:2: attempt to call a nil value (upvalue 'u')`)
+			continue
+		}
+		assert.EqualError(t, err, msg, src)
+	}
+}
+
+func TestPCall(t *testing.T) {
+	var vm LuaVM
+	values, err := vm.DoString(`
+local function f(a, b) return a + b, a * b end
+local r = {pcall(f, 2, 3)}
+local ok, msg = pcall(f, 1, nil)
+local ok2, e = pcall(error, {code = 1})
+local ok3, m3 = pcall(error, "plain", 0)
+local function lvl() error("deep", 2) end
+local ok4, m4 = pcall(function()
+  lvl()
+end)
+return r[1], r[2], r[3], ok, msg, ok2, e.code, m3, m4
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{
+		types.Boolean(true), types.Integer(5), types.Integer(6),
+		types.Boolean(false), types.String(`[string "..."]:2: attempt to perform arithmetic on a nil value (local 'b')`),
+		types.Boolean(false), types.Integer(1),
+		types.String("plain"), types.String(`[string "..."]:9: deep`),
+	}, values)
+}
+
+func TestXPCall(t *testing.T) {
+	var vm LuaVM
+	values, err := vm.DoString(`
+local function handler(m) return "handled: " .. m end
+local function f() local t = nil; return t.x end
+local ok, msg = xpcall(f, handler)
+local ok2, tb = xpcall(f, debugTraceback)
+local ok3, v = xpcall(function(a) return a end, handler, 7)
+return ok, msg, ok2, tb, ok3, v
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, types.Boolean(false), values[0])
+	assert.Equal(t, types.String(`handled: [string "..."]:3: attempt to index a nil value (local 't')`), values[1])
+	assert.Equal(t, types.Boolean(false), values[2])
+	// 消息处理函数自身出错时返回它的错误
+	assert.Contains(t, string(values[3].(types.String)), "attempt to call a nil value")
+	assert.Equal(t, []types.Value{types.Boolean(true), types.Integer(7)}, values[4:])
+}
+
+func TestAssert(t *testing.T) {
+	var vm LuaVM
+	values, err := vm.DoString("return assert(1, 2, 3)")
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{types.Integer(1), types.Integer(2), types.Integer(3)}, values)
+
+	_, err = vm.DoString("assert(false)")
+	assert.EqualError(t, err, `[string "assert(false)"]:1: assertion failed!`)
+	_, err = vm.DoString("assert(nil, 'custom')")
+	assert.EqualError(t, err, "custom")
+	_, err = vm.DoString("assert(false, {})")
+	assert.EqualError(t, err, "(error object is a table value)")
+	e, ok := err.(*LuaError)
+	assert.True(t, ok)
+	assert.IsType(t, &types.Table{}, e.Value)
+}
+
+func TestTraceback(t *testing.T) {
+	var vm LuaVM
+	_, err := vm.DoString(`
+local function inner() error("boom") end
+function outer() inner() end
+outer()
+`)
+	e, ok := err.(*LuaError)
+	assert.True(t, ok)
+	assert.Equal(t, `[string "..."]:2: boom`, e.Error())
+	assert.Equal(t, `[string "..."]`, e.Source)
+	assert.Equal(t, 2, e.Line)
+	assert.Equal(t, "stack traceback:\n"+
+		"\t[string \"...\"]:2: in upvalue 'inner'\n"+
+		"\t[string \"...\"]:3: in function 'outer'\n"+
+		"\t[string \"...\"]:4: in main chunk", e.Traceback)
+}
+
+func TestCoroutineError(t *testing.T) {
+	var vm LuaVM
+	defer vm.Close()
+	values, err := vm.DoString(`
+local co = coroutine.create(function() error({1, 2}) end)
+local ok, e = coroutine.resume(co)
+local co2 = coroutine.create(function() local x; return x.y end)
+local ok2, e2 = coroutine.resume(co2)
+return ok, #e, ok2, e2
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{
+		types.Boolean(false), types.Integer(2),
+		types.Boolean(false), types.String(`[string "..."]:4: attempt to index a nil value (local 'x')`),
+	}, values)
+}
+
+func TestIntegerDivideByZero(t *testing.T) {
+	var vm LuaVM
+	values, err := vm.DoString(`
+local a, b = 1, 0
+local ok, msg = pcall(function() return a // b end)
+local ok2, msg2 = pcall(function() return a % b end)
+local co = coroutine.create(function() return "1" // b end)
+local ok3, msg3 = coroutine.resume(co)
+return ok, msg, ok2, msg2, ok3, msg3, a // 0.0, a % 0.0 ~= a % 0.0
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{
+		types.Boolean(false), types.String(`[string "..."]:3: attempt to perform 'n//0'`),
+		types.Boolean(false), types.String(`[string "..."]:4: attempt to perform 'n%0'`),
+		types.Boolean(false), types.String(`[string "..."]:5: attempt to perform 'n//0'`),
+		types.Float(math.Inf(1)), types.Boolean(true),
+	}, values)
+}
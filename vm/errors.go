@@ -1,8 +1,101 @@
 package vm
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Salpadding/lua/types"
+)
 
 var (
-	errInvalidOperand = errors.New("invalid operand found")
-	errIndexOverFlow  = errors.New("index overflow")
+	errInvalidOperand          = errors.New("invalid operand found")
+	errIndexOverFlow           = errors.New("index overflow")
+	errNoIntegerRepresentation = errors.New("number has no integer representation")
+	errNilIndex                = errors.New("index is nil")
+	errToStringResult          = errors.New("'__tostring' must return a string")
+	errProtectedMetatable      = errors.New("cannot change a protected metatable")
+	errResumeDead              = errors.New("cannot resume dead coroutine")
+	errResumeNonSuspended      = errors.New("cannot resume non-suspended coroutine")
+	errYieldOutside            = errors.New("attempt to yield from outside a coroutine")
+	errYieldAcrossC            = errors.New("attempt to yield across a C-call boundary")
+	errCoroutineClosed         = errors.New("coroutine closed")
+	errStackOverflow           = errors.New("stack overflow")
+	errCStackOverflow          = errors.New("C stack overflow")
+	errUpValueIndex            = errors.New("upvalue index out of range")
+	errNotEnoughMemory         = errors.New("not enough memory")
+	errIntegerDivideByZero     = errors.New("attempt to perform 'n//0'")
+	errIntegerModByZero        = errors.New("attempt to perform 'n%0'")
 )
+
+
+// typeError 是操作数类型错误, operand 是出错的操作数的位置, 用于补充变量信息
+type typeError struct {
+	action   string
+	typeName string
+	operand  int
+}
+
+func (e *typeError) Error() string {
+	return fmt.Sprintf("attempt to %s a %s value", e.action, e.typeName)
+}
+
+func errArithmetic(typeName string, operand int) error {
+	return &typeError{action: "perform arithmetic on", typeName: typeName, operand: operand}
+}
+
+func errBitwise(typeName string, operand int) error {
+	return &typeError{action: "perform bitwise operation on", typeName: typeName, operand: operand}
+}
+
+func errIndex(typeName string) error {
+	return &typeError{action: "index", typeName: typeName}
+}
+
+func errCall(typeName string) error {
+	return &typeError{action: "call", typeName: typeName}
+}
+
+func errConcat(typeName string, operand int) error {
+	return &typeError{action: "concatenate", typeName: typeName, operand: operand}
+}
+
+func errLength(typeName string) error {
+	return &typeError{action: "get length of", typeName: typeName}
+}
+
+func errLoop(event string) error {
+	return fmt.Errorf("'%s' chain too long; possibly a loop", event)
+}
+
+// errArgument 是本地函数参数错误
+func errArgument(n int, fname, msg string) error {
+	return fmt.Errorf("bad argument #%d to '%s' (%s)", n, fname, msg)
+}
+
+// LuaError 是 lua 运行时错误, Value 可以是任意 lua 值
+type LuaError struct {
+	Value     types.Value
+	Traceback string // 出错时的调用栈
+	Source    string // 出错的代码块, 没有位置信息时为空
+	Line      int    // 出错的行号, 没有位置信息时为 -1
+
+	handled types.Value // xpcall 的消息处理函数的返回值
+}
+
+func (e *LuaError) Error() string {
+	switch x := e.Value.(type) {
+	case types.String:
+		return string(x)
+	case types.Integer, types.Float:
+		return numberToString(x)
+	}
+	return fmt.Sprintf("(error object is a %s value)", e.Value.Type())
+}
+
+// errorValue 把错误转换为 lua 值
+func errorValue(err error) types.Value {
+	if e, ok := err.(*LuaError); ok {
+		return e.Value
+	}
+	return types.String(err.Error())
+}
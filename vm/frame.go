@@ -5,6 +5,7 @@ import (
 
 	"github.com/Salpadding/lua/types"
 	"github.com/Salpadding/lua/types/code"
+	"github.com/Salpadding/lua/types/code54"
 	"github.com/Salpadding/lua/types/value"
 )
 
@@ -20,6 +21,11 @@ const (
 	// 伪索引支持
 	LuaMaxStack      = 1000000
 	LuaRegistryIndex = -LuaMaxStack - 1000
+
+	// lua 函数调用栈的默认最大深度
+	defaultMaxCallDepth = 200000
+	// Call 的最大嵌套层数, 每一层都会占用 Go 的栈
+	maxCCalls = 200
 )
 
 type BinaryOperator func(a, b types.Value) (types.Value, bool)
@@ -56,10 +62,39 @@ type Frame struct {
 	pc           int
 	varArgs      []types.Value
 	returned     []types.Value
+	toBeClosed   []int // 待关闭变量的寄存器, 只用于 Lua 5.4
+
+	ret      int  // 返回值在调用者寄存器中的位置
+	results  int  // 调用者需要的返回值数量, -1 表示全部
+	tailCall bool // 是否通过尾调用进入
+	hookPC   int  // 上一次检查 line 事件时的指令位置
 }
 
 func (f *Frame) Close() {}
 
+// openUpValue 返回指向寄存器 idx 的 upvalue, 同一个寄存器只创建一次
+func (f *Frame) openUpValue(idx int) *types.ValuePointer {
+	if uv, ok := f.openUpValues[idx]; ok {
+		return uv
+	}
+	if f.openUpValues == nil {
+		f.openUpValues = map[int]*types.ValuePointer{}
+	}
+	uv := types.NewOpenUpValue((*[]types.Value)(f.Register), idx)
+	f.openUpValues[idx] = uv
+	return uv
+}
+
+// closeUpValues 关闭所有指向寄存器 from 及以上的 upvalue
+func (f *Frame) closeUpValues(from int) {
+	for idx, uv := range f.openUpValues {
+		if idx >= from {
+			uv.Close()
+			delete(f.openUpValues, idx)
+		}
+	}
+}
+
 func (f *Frame) Copy(dst, src int) error {
 	return f.Set(dst, f.Get(src))
 }
@@ -169,16 +204,46 @@ func (f *Frame) GetRK(rk int) (types.Value, error) {
 	return f.Get(rk), nil
 }
 
-func (f *Frame) execute() ([]types.Value, error) {
+// execute 执行调用栈顶部的函数, 直到调用栈回到 base 层
+// lua 函数之间的调用不会在 Go 的栈上递归, 而是压入新的调用帧
+func (vm *LuaVM) execute(st *threadState, base int) ([]types.Value, error) {
 	for {
-		ins := &Instruction{Instruction: f.Fetch(), vm:f.vm}
-		//name := ins.Opcode().Name
-		if err := ins.execute(f); err != nil {
+		if err := vm.step(); err != nil {
 			return nil, err
 		}
-		if ins.Opcode().Type == code.Return {
+		f := st.frames[len(st.frames)-1]
+		if vm.hookMask != 0 {
+			if err := vm.traceExec(f); err != nil {
+				return nil, vm.runtimeError(f, f.fn.Code[f.pc], err)
+			}
+		}
+		var (
+			ins      = f.Fetch()
+			err      error
+			returned bool
+		)
+		if f.fn.Version == types.LuaVersion54 {
+			ins54 := &instruction54{Instruction: code54.Instruction(ins), vm: vm}
+			returned, err = ins54.isReturn(), ins54.execute(f)
+		} else {
+			returned, err = ins.Opcode().Type == code.Return, (&Instruction{Instruction: ins, vm: vm}).execute(f)
+		}
+		if err != nil {
+			return nil, vm.runtimeError(f, ins, err)
+		}
+		if !returned {
+			continue
+		}
+		if err := vm.returnHook(f); err != nil {
+			return nil, vm.runtimeError(f, ins, err)
+		}
+		st.frames = st.frames[:len(st.frames)-1]
+		if len(st.frames) == base {
 			return f.returned, nil
 		}
-		//fmt.Printf("%s %s\n", name, f)
+		caller := st.frames[len(st.frames)-1]
+		if err := caller.setResults(f.ret, f.results, f.returned); err != nil {
+			return nil, err
+		}
 	}
 }
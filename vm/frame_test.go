@@ -86,11 +86,9 @@ func TestBin(t *testing.T) {
 	f, err := os.Open("testdata/luac.out")
 	assert.NoError(t, err)
 	var vm LuaVM
-	var counter gasCounter
-	vm.hooks = []Hook{counter.hook}
 	assert.NoError(t, vm.Load(f))
 	assert.NoError(t, vm.Execute())
-	fmt.Print(counter.gas)
+	fmt.Print(vm.GasUsed())
 }
 
 func TestBin2(t *testing.T) {
@@ -0,0 +1,200 @@
+package vm
+
+import (
+	"strings"
+
+	"github.com/Salpadding/lua/types"
+)
+
+// HookEvent 是调试钩子的事件
+type HookEvent int
+
+const (
+	HookCall HookEvent = iota
+	HookReturn
+	HookLine
+	HookCount
+	HookTailCall
+)
+
+var hookEventNames = [...]string{"call", "return", "line", "count", "tail call"}
+
+func (e HookEvent) String() string {
+	return hookEventNames[e]
+}
+
+// HookMask 选择触发钩子的事件
+type HookMask uint
+
+const (
+	MaskCall   HookMask = 1 << iota // 调用 lua 函数, 包括尾调用
+	MaskReturn                      // lua 函数返回
+	MaskLine                        // 开始执行新的一行, 或者跳转回前面的指令
+	MaskCount                       // 每执行 count 条指令
+)
+
+// HookInfo 是传给调试钩子的信息
+type HookInfo struct {
+	Event    HookEvent
+	Frame    *Frame          // 触发事件的调用帧
+	Function *types.Function // 调用帧正在执行的函数
+	PC       int             // 将要执行或者刚刚执行的指令的位置
+	Line     int             // 指令的行号, 没有行号信息时为 -1
+}
+
+// Hook 是调试钩子, 返回错误时停止执行, 错误可以被 pcall 捕获
+type Hook func(vm *LuaVM, info *HookInfo) error
+
+// SetHook 设置调试钩子, count 大于 0 时每执行 count 条指令触发一次 count 事件
+// hook 为 nil 或者没有选择任何事件时关闭钩子
+func (vm *LuaVM) SetHook(hook Hook, mask HookMask, count int) {
+	if count > 0 {
+		mask |= MaskCount
+	} else {
+		mask &^= MaskCount
+	}
+	if hook == nil || mask == 0 {
+		hook, mask, count = nil, 0, 0
+	}
+	vm.hook, vm.hookMask, vm.hookCount, vm.hookCounter = hook, mask, count, count
+	vm.hookFn = nil
+}
+
+// GetHook 返回当前的调试钩子, 事件和 count
+func (vm *LuaVM) GetHook() (Hook, HookMask, int) {
+	return vm.hook, vm.hookMask, vm.hookCount
+}
+
+// Function 返回调用帧正在执行的函数
+func (f *Frame) Function() *types.Function {
+	return f.fn
+}
+
+// PC 返回下一条将要执行的指令的位置
+func (f *Frame) PC() int {
+	return f.pc
+}
+
+// lineAt 返回第 pc 条指令的行号, 没有行号信息时返回 -1
+func (f *Frame) lineAt(pc int) int {
+	if pc < 0 || pc >= len(f.fn.LineInfo) {
+		return -1
+	}
+	return int(f.fn.LineInfo[pc])
+}
+
+// runHook 调用调试钩子, 钩子执行期间不会再触发钩子
+func (vm *LuaVM) runHook(event HookEvent, f *Frame, pc int) error {
+	if vm.hook == nil || vm.inHook {
+		return nil
+	}
+	vm.inHook = true
+	defer func() { vm.inHook = false }()
+	err := vm.hook(vm, &HookInfo{Event: event, Frame: f, Function: f.fn, PC: pc, Line: f.lineAt(pc)})
+	if err != nil && vm.ctx != nil && err == vm.ctx.Err() {
+		// 钩子在 context 取消后返回 ctx.Err() 时中止执行, 不能被 pcall 捕获
+		vm.abort = err
+	}
+	return err
+}
+
+// callHook 在 lua 函数开始执行之前触发 call 事件
+func (vm *LuaVM) callHook(f *Frame) error {
+	if vm.hookMask&MaskCall == 0 {
+		return nil
+	}
+	event := HookCall
+	if f.tailCall {
+		event = HookTailCall
+	}
+	return vm.runHook(event, f, 0)
+}
+
+// returnHook 在 lua 函数返回之前触发 return 事件
+func (vm *LuaVM) returnHook(f *Frame) error {
+	if vm.hookMask&MaskReturn == 0 {
+		return nil
+	}
+	return vm.runHook(HookReturn, f, f.pc-1)
+}
+
+// traceExec 在执行指令之前触发 count 和 line 事件
+func (vm *LuaVM) traceExec(f *Frame) error {
+	// 和 lua 一样, 钩子执行期间 pc 指向下一条指令, 这样当前行和活跃的局部变量都是将要执行的指令的
+	f.pc++
+	defer func() { f.pc-- }()
+	if vm.hookMask&MaskCount != 0 {
+		if vm.hookCounter--; vm.hookCounter <= 0 {
+			vm.hookCounter = vm.hookCount
+			if err := vm.runHook(HookCount, f, f.pc); err != nil {
+				return err
+			}
+		}
+	}
+	if vm.hookMask&MaskLine != 0 {
+		pc, last := f.pc-1, f.hookPC
+		f.hookPC = pc
+		// 函数开始, 向前跳转或者进入新的一行时触发
+		if pc == 0 || pc <= last || f.lineAt(pc) != f.lineAt(last) {
+			if err := vm.runHook(HookLine, f, pc); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+var debugHookMasks = map[byte]HookMask{'c': MaskCall, 'r': MaskReturn, 'l': MaskLine}
+
+// sethook([thread,] hook, mask [, count]) 设置 lua 函数作为调试钩子, 没有参数时关闭钩子
+func debugSetHook(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	_, args = vm.threadArg(args)
+	if isNil(arg(args, 0)) {
+		vm.SetHook(nil, 0, 0)
+		return nil, nil
+	}
+	fn, err := checkFunction(args, 0, "sethook")
+	if err != nil {
+		return nil, err
+	}
+	smask, err := checkString(args, 1, "sethook")
+	if err != nil {
+		return nil, err
+	}
+	count, err := optInteger(args, 2, "sethook", 0)
+	if err != nil {
+		return nil, err
+	}
+	var mask HookMask
+	for i := 0; i < len(smask); i++ {
+		mask |= debugHookMasks[smask[i]]
+	}
+	vm.SetHook(func(vm *LuaVM, info *HookInfo) error {
+		args := []types.Value{types.String(info.Event.String())}
+		if info.Event == HookLine {
+			args = append(args, types.Integer(info.Line))
+		}
+		_, err := vm.Call(fn, args...)
+		return err
+	}, mask, int(count))
+	vm.hookFn = fn
+	return nil, nil
+}
+
+// gethook([thread]) 返回钩子函数, 事件和 count, 钩子不是 lua 函数时返回 external hook
+func debugGetHook(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	if vm.hook == nil {
+		return []types.Value{types.GetNil()}, nil
+	}
+	var fn types.Value = types.String("external hook")
+	if vm.hookFn != nil {
+		fn = vm.hookFn
+	}
+	var mask strings.Builder
+	for _, c := range []byte("crl") {
+		if vm.hookMask&debugHookMasks[c] != 0 {
+			mask.WriteByte(c)
+		}
+	}
+	return []types.Value{fn, types.String(mask.String()), types.Integer(vm.hookCount)}, nil
+}
@@ -0,0 +1,103 @@
+package vm
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Salpadding/lua/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHookLine(t *testing.T) {
+	var vm LuaVM
+	var lines []int
+	vm.SetHook(func(vm *LuaVM, info *HookInfo) error {
+		assert.Equal(t, HookLine, info.Event)
+		assert.Equal(t, info.Function, info.Frame.Function())
+		lines = append(lines, info.Line)
+		return nil
+	}, MaskLine, 0)
+	// 和 luac 一样, 每次循环回到 for 所在的行
+	_, err := vm.DoString("local a = 1\nlocal b = 2\nfor i = 1, 2 do\na = a + i\nend\nreturn a")
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1, 2, 3, 4, 3, 4, 3, 6}, lines)
+
+	lines = nil
+	_, err = vm.DoString("local t = {1, 2}\nfor _, v in ipairs(t) do\nlocal x = v\nend\nreturn t")
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1, 2, 3, 2, 3, 2, 5}, lines)
+}
+
+func TestHookCallReturn(t *testing.T) {
+	var vm LuaVM
+	events := map[HookEvent]int{}
+	vm.SetHook(func(vm *LuaVM, info *HookInfo) error {
+		events[info.Event]++
+		return nil
+	}, MaskCall|MaskReturn, 0)
+	_, err := vm.DoString("local function f(n) if n > 0 then return f(n - 1) end return 0 end\nf(3)\nlocal function g() return 1 end\ng()")
+	assert.NoError(t, err)
+	assert.Equal(t, map[HookEvent]int{HookCall: 3, HookTailCall: 3, HookReturn: 3}, events)
+}
+
+func TestHookCount(t *testing.T) {
+	var vm LuaVM
+	n := 0
+	vm.SetHook(func(vm *LuaVM, info *HookInfo) error {
+		assert.Equal(t, HookCount, info.Event)
+		n++
+		return nil
+	}, 0, 1)
+	_, mask, count := vm.GetHook()
+	assert.Equal(t, MaskCount, mask)
+	assert.Equal(t, 1, count)
+
+	// 算术指令也会触发钩子
+	_, err := vm.DoString("local a, b = 1, 2 local c = a + b * a - b return c")
+	assert.NoError(t, err)
+	assert.Equal(t, 6, n)
+
+	vm.SetHook(nil, 0, 0)
+	n = 0
+	_, err = vm.DoString("return 1")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+}
+
+func TestHookError(t *testing.T) {
+	var vm LuaVM
+	_, err := vm.DoString("function f() return 1 end")
+	assert.NoError(t, err)
+	vm.SetHook(func(vm *LuaVM, info *HookInfo) error {
+		if info.Event == HookCall && len(vm.state().frames) > 1 {
+			return errors.New("interrupted")
+		}
+		return nil
+	}, MaskCall, 0)
+	values, err := vm.DoString("local ok, msg = pcall(f) return ok")
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{types.Boolean(false)}, values)
+}
+
+func TestDebugSetHook(t *testing.T) {
+	var vm LuaVM
+	values, err := vm.DoString(`
+local lines = {}
+debug.sethook(function(event, line) lines[#lines + 1] = line end, "l")
+local a = 1
+local b = 2
+debug.sethook()
+local f, mask, count = debug.gethook()
+return #lines, f`)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{types.Integer(3), types.GetNil()}, values)
+
+	values, err = vm.DoString(`
+local f = function() end
+debug.sethook(f, "cr", 10)
+local g, mask, count = debug.gethook()
+debug.sethook()
+return g == f, mask, count`)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{types.Boolean(true), types.String("cr"), types.Integer(10)}, values)
+}
@@ -0,0 +1,95 @@
+package vm
+
+import "github.com/Salpadding/lua/types"
+
+// Variable 是调试器看到的局部变量或者 upvalue
+type Variable struct {
+	Name  string
+	Value types.Value
+}
+
+// Globals 返回全局变量表, 虚拟机还没有加载代码时返回 nil
+func (vm *LuaVM) Globals() *types.Table {
+	return vm.global
+}
+
+// Frames 返回当前线程的调用栈, 第一个元素是栈顶的 lua 函数
+func (vm *LuaVM) Frames() []*Frame {
+	frames := vm.state().frames
+	res := make([]*Frame, len(frames))
+	for i, f := range frames {
+		res[len(frames)-1-i] = f
+	}
+	return res
+}
+
+// FuncName 根据调用者的指令推测调用帧中的函数名字, 返回种类和名字, 例如 global 和 f
+func (vm *LuaVM) FuncName(f *Frame) (kind, name string) {
+	frames := vm.state().frames
+	for i := len(frames) - 1; i > 0; i-- {
+		if frames[i] == f {
+			if f.tailCall {
+				return "", ""
+			}
+			return funcName(frames[i-1])
+		}
+	}
+	return "", ""
+}
+
+// CurrentLine 返回正在执行的指令的行号, 没有行号信息时返回 -1
+func (f *Frame) CurrentLine() int {
+	return f.currentLine()
+}
+
+// IsTailCall 判断调用帧是否通过尾调用进入
+func (f *Frame) IsTailCall() bool {
+	return f.tailCall
+}
+
+// Locals 返回正在执行的指令处活跃的局部变量, 按照声明的顺序排列
+func (f *Frame) Locals() []Variable {
+	var vars []Variable
+	for n := 1; ; n++ {
+		name := localName(f.fn.Prototype, n-1, f.pc-1)
+		if name == "" {
+			return vars
+		}
+		vars = append(vars, Variable{Name: name, Value: f.Get(n - 1)})
+	}
+}
+
+// SetLocal 修改名字为 name 的局部变量, 同名时修改最后声明的变量, 不存在时返回 false
+func (f *Frame) SetLocal(name string, v types.Value) bool {
+	for n := len(f.Locals()); n > 0; n-- {
+		if localName(f.fn.Prototype, n-1, f.pc-1) == name {
+			return f.Set(n-1, v) == nil
+		}
+	}
+	return false
+}
+
+// VarArgs 返回调用帧的可变参数
+func (f *Frame) VarArgs() []types.Value {
+	return f.varArgs
+}
+
+// UpValues 返回函数的 upvalue
+func (f *Frame) UpValues() []Variable {
+	vars := make([]Variable, len(f.fn.UpValues))
+	for i, uv := range f.fn.UpValues {
+		vars[i] = Variable{Name: upValueName(f.fn.Prototype, i), Value: uv.Get()}
+	}
+	return vars
+}
+
+// SetUpValue 修改名字为 name 的 upvalue, 不存在时返回 false
+func (f *Frame) SetUpValue(name string, v types.Value) bool {
+	for i, uv := range f.fn.UpValues {
+		if upValueName(f.fn.Prototype, i) == name {
+			uv.Set(v)
+			return true
+		}
+	}
+	return false
+}
@@ -1,8 +1,6 @@
 package vm
 
 import (
-	"bytes"
-
 	"github.com/Salpadding/lua/types"
 	"github.com/Salpadding/lua/types/code"
 	"github.com/Salpadding/lua/types/value"
@@ -55,12 +53,7 @@ func (ins *Instruction) jmp(f *Frame) error {
 	if a == 0 {
 		return nil
 	}
-	for i := range f.openUpValues{
-		if i < a - 1{
-			continue
-		}
-		delete(f.openUpValues, i)
-	}
+	f.closeUpValues(a - 1)
 	return nil
 }
 
@@ -69,9 +62,6 @@ func (ins *Instruction) execute(f *Frame) error {
 	if ok {
 		return ins.arithmetic(f)
 	}
-	for _, hk := range ins.vm.hooks{
-		hk(ins.Opcode())
-	}
 	switch ins.Opcode().Type {
 	case code.Move:
 		return ins.move(f)
@@ -102,6 +92,10 @@ func (ins *Instruction) execute(f *Frame) error {
 		return ins.forLoop(f)
 	case code.ForPrep:
 		return ins.forPrep(f)
+	case code.TForCall:
+		return ins.tForCall(f)
+	case code.TForLoop:
+		return ins.tForLoop(f)
 	case code.NewTable:
 		return ins.newTable(f)
 	case code.GetTable:
@@ -119,7 +113,7 @@ func (ins *Instruction) execute(f *Frame) error {
 	case code.VarArg:
 		return ins.varArgs(f)
 	case code.TailCall:
-		return ins.call(f)
+		return ins.tailCall(f)
 	case code.Self:
 		return ins.self(f)
 	case code.GetUpValue:
@@ -192,7 +186,6 @@ func (ins *Instruction) arithmetic(vm *Frame) error {
 func (ins *Instruction) binaryArithmetic(vm *Frame) error {
 	a, b, c := ins.ABC()
 	op, _ := opMapping[ins.Opcode().Type]
-	fn, _ := binaryOperators[op]
 	v1, err := vm.GetRK(b)
 	if err != nil {
 		return err
@@ -201,9 +194,9 @@ func (ins *Instruction) binaryArithmetic(vm *Frame) error {
 	if err != nil {
 		return err
 	}
-	v, ok := fn(v1, v2)
-	if !ok {
-		return errInvalidOperand
+	v, err := vm.vm.arith(op, v1, v2)
+	if err != nil {
+		return err
 	}
 	return vm.Set(a, v)
 }
@@ -212,14 +205,13 @@ func (ins *Instruction) binaryArithmetic(vm *Frame) error {
 func (ins *Instruction) unaryArithmetic(vm *Frame) error {
 	a, b, _ := ins.ABC()
 	op, _ := opMapping[ins.Opcode().Type]
-	fn, _ := unaryOperators[op]
 	v1, err := vm.GetRK(b)
 	if err != nil {
 		return err
 	}
-	v, ok := fn(v1)
-	if !ok {
-		return errInvalidOperand
+	v, err := vm.vm.arith(op, v1, v1)
+	if err != nil {
+		return err
 	}
 	return vm.Set(a, v)
 }
@@ -227,9 +219,9 @@ func (ins *Instruction) unaryArithmetic(vm *Frame) error {
 // R(A) := length of R(B)
 func (ins *Instruction) len(vm *Frame) error {
 	a, b, _ := ins.ABC()
-	length, ok := types.Len(vm.Get(b))
-	if !ok {
-		return errInvalidOperand
+	length, err := vm.vm.length(vm.Get(b))
+	if err != nil {
+		return err
 	}
 	return vm.Set(a, length)
 }
@@ -237,23 +229,16 @@ func (ins *Instruction) len(vm *Frame) error {
 // R(A) := R(B).. ... ..R(C)
 func (ins *Instruction) concat(vm *Frame) error {
 	a, b, c := ins.ABC()
-	var str bytes.Buffer
-	for i := b; i <= c; i++ {
-		s, ok := vm.Get(i).ToString()
-		if !ok {
-			return errInvalidOperand
-		}
-		str.WriteString(s)
+	v, err := vm.vm.concat(vm.Slice(b, c+1))
+	if err != nil {
+		return err
 	}
-	return vm.Set(a, types.String(str.String()))
+	return vm.Set(a, v)
 }
 
 // if ((RK(B) op RK(C)) ~= A) then pc++
 func (ins *Instruction) compare(vm *Frame, comparison value.Comparison) error {
-	var (
-		cmp value.Comparison
-		ok  bool
-	)
+	var ok bool
 	a, b, c := ins.ABC()
 	v1, err := vm.GetRK(b)
 	if err != nil {
@@ -263,15 +248,17 @@ func (ins *Instruction) compare(vm *Frame, comparison value.Comparison) error {
 	if err != nil {
 		return err
 	}
-	if comparison == value.Equal {
-		cmp, ok = types.Equal(v1, v2)
-	} else {
-		cmp, ok = types.Compare(v1, v2)
+	switch comparison {
+	case value.Equal:
+		ok, err = vm.vm.equal(v1, v2)
+	case value.LessThan:
+		ok, err = vm.vm.lessThan(v1, v2)
+	default:
+		ok, err = vm.vm.lessEqual(v1, v2)
 	}
-	if !ok {
-		return errInvalidOperand
+	if err != nil {
+		return err
 	}
-	ok = cmp&comparison != 0
 	if ok != (a != 0) {
 		vm.AddPC(1)
 	}
@@ -346,10 +333,36 @@ func (ins *Instruction) forLoop(vm *Frame) error {
 	return nil
 }
 
+// R(A+3), ... ,R(A+2+C) := R(A)(R(A+1), R(A+2));
+func (ins *Instruction) tForCall(f *Frame) error {
+	a, _, c := ins.ABC()
+	values, err := f.vm.Call(f.Get(a), f.Get(a+1), f.Get(a+2))
+	if err != nil {
+		return err
+	}
+	return f.setResults(a+3, c, values)
+}
+
+// if R(A+1) ~= nil then {
+//   R(A)=R(A+1); pc += sBx
+// }
+func (ins *Instruction) tForLoop(f *Frame) error {
+	a, sBx := ins.AsBx()
+	if isNil(f.Get(a + 1)) {
+		return nil
+	}
+	f.AddPC(sBx)
+	return f.Copy(a, a+1)
+}
+
 // R(A) := {} (size = B, C)
 func (ins *Instruction) newTable(vm *Frame) error {
 	a, _, _ := ins.ABC()
-	return vm.Set(a, types.NewTable())
+	t, err := vm.vm.newTable()
+	if err != nil {
+		return err
+	}
+	return vm.Set(a, t)
 }
 
 // R(A) [RK(B)] := RK(C)
@@ -363,21 +376,20 @@ func (ins *Instruction) setTable(vm *Frame) error {
 	if err != nil {
 		return err
 	}
-	tb, ok := vm.Get(a).(*types.Table)
-	if !ok {
-		return errInvalidOperand
-	}
-	return tb.Set(v1, v2)
+	return vm.vm.setIndex(vm.Get(a), v1, v2)
 }
 
 // R(A)[(C-1)*FPF+i] := R(A+i), 1 <= i <= B
 func (ins *Instruction) setList(f *Frame) error {
 	a, b, c := ins.ABC()
-	if c > 0 {
-		c--
-	} else {
+	if c == 0 {
 		c = f.Fetch().Ax()
 	}
+	return f.setList(a, b, (c-1)*fieldsPerFlush)
+}
+
+// R(A)[idx+i] := R(A+i), 1 <= i <= B, B 为 0 时设置到栈顶
+func (f *Frame) setList(a, b, idx int) error {
 	if b == 0 {
 		b = f.GetTop() - a
 	}
@@ -386,7 +398,6 @@ func (ins *Instruction) setList(f *Frame) error {
 	if !ok {
 		return errInvalidOperand
 	}
-	idx := c * fieldsPerFlush
 	for j := 1; j <= b; j++ {
 		idx++
 		if err := tb.Set(types.Integer(idx), f.Get(a+j)); err != nil {
@@ -403,11 +414,7 @@ func (ins *Instruction) getTable(vm *Frame) error {
 	if err != nil {
 		return err
 	}
-	tb, ok := vm.Get(b).(*types.Table)
-	if !ok {
-		return errInvalidOperand
-	}
-	v, err = tb.Get(v)
+	v, err = vm.vm.index(vm.Get(b), v)
 	if err != nil {
 		return err
 	}
@@ -417,7 +424,15 @@ func (ins *Instruction) getTable(vm *Frame) error {
 // R(A) := closure(KPROTO[Bx])
 func (ins *Instruction) closure(f *Frame) error {
 	a, bx := ins.ABx()
+	return f.closure(a, bx)
+}
+
+// closure 创建第 bx 个内嵌函数原型的闭包并放到 R(A)
+func (f *Frame) closure(a, bx int) error {
 	proto := f.fn.Prototypes[bx]
+	if err := f.vm.memory.Alloc(types.ClosureSize + types.UpValueSize*len(proto.UpValues)); err != nil {
+		return err
+	}
 	fn := &types.Function{Prototype: proto, UpValues: make([]*types.ValuePointer, len(proto.UpValues))}
 	for i, uvInfo := range proto.UpValues {
 		uvIdx := int(uvInfo[1])
@@ -426,15 +441,7 @@ func (ins *Instruction) closure(f *Frame) error {
 			fn.UpValues[i] = f.fn.UpValues[uvIdx]
 			continue
 		}
-		if f.openUpValues == nil{
-			f.openUpValues = map[int]*types.ValuePointer{}
-		}
-		if v, ok := f.openUpValues[uvIdx]; ok{
-			fn.UpValues[i] = v
-			continue
-		}
-		fn.UpValues[i] = &types.ValuePointer{Value: f.Get(uvIdx)}
-		f.openUpValues[uvIdx] = fn.UpValues[i]
+		fn.UpValues[i] = f.openUpValue(uvIdx)
 	}
 	return f.Set(a, fn)
 }
@@ -442,53 +449,102 @@ func (ins *Instruction) closure(f *Frame) error {
 // return R(A), ... ,R(A+B-2)
 func (ins *Instruction) iReturn(f *Frame) error {
 	a, b, _ := ins.ABC()
-	if b == 1 {
-		return nil
+	return f.iReturn(a, b)
+}
+
+// iReturn 设置返回值 R(A), ... ,R(A+B-2), B 为 0 时返回到栈顶
+func (f *Frame) iReturn(a, b int) error {
+	defer f.closeUpValues(0)
+	switch b {
+	case 0:
+		f.returned = f.Slice(a, f.GetTop()+1)
+	case 1:
+		f.returned = nil
+	default:
+		f.returned = f.Slice(a, a+b-1)
 	}
-	f.returned = f.Slice(a, a+b-1)
 	return nil
 }
 
 // R(A), ... ,R(A+C-2) := R(A)(R(A+1), ... ,R(A+B-1))
 func (ins *Instruction) call(f *Frame) error {
 	a, b, c := ins.ABC()
+	return f.call(a, b, c)
+}
+
+// call 调用 R(A), B 和 C 的含义和 CALL 指令相同
+func (f *Frame) call(a, b, c int) error {
 	if b == 0 {
 		b = f.GetTop() - a + 1
 	}
-	args := f.Slice(a+1, a+b)
-	var (
-		values []types.Value
-		err    error
-	)
-	switch fn := f.Get(a).(type) {
-	case *types.Function:
-		newFrame := f.vm.NewFrame(fn)
-		// 参数传递
-		err = newFrame.PushN(int(fn.NumParams), args...)
+	fn, args, err := f.vm.callable(f.Get(a), f.Slice(a+1, a+b))
+	if err != nil {
+		return err
+	}
+	if x, ok := fn.(*types.Function); ok {
+		// lua 函数压入新的调用帧, 返回时由 execute 设置结果
+		frame, err := f.vm.newCallFrame(x, args)
 		if err != nil {
 			return err
 		}
-		if len(args) > int(fn.NumParams) && f.fn.IsVararg {
-			newFrame.varArgs = args[fn.NumParams:]
-		}
-		values, err = newFrame.execute()
-		if err != nil{
-			return err
-		}
-	case types.Native:
-		values, err = fn(args...)
+		frame.ret, frame.results = a, c-1
+		return f.vm.pushFrame(f.vm.state(), frame)
+	}
+	values, err := f.vm.Call(fn, args...)
+	if err != nil {
+		return err
+	}
+	return f.setResults(a, c-1, values)
+}
+
+// return R(A)(R(A+1), ... ,R(A+B-1))
+// 被调用的 lua 函数替换当前的调用帧, 调用栈的深度不变
+func (ins *Instruction) tailCall(f *Frame) error {
+	a, b, _ := ins.ABC()
+	return f.callTail(a, b)
+}
+
+// callTail 尾调用 R(A), B 的含义和 TAILCALL 指令相同
+func (f *Frame) callTail(a, b int) error {
+	if b == 0 {
+		b = f.GetTop() - a + 1
+	}
+	fn, args, err := f.vm.callable(f.Get(a), f.Slice(a+1, a+b))
+	if err != nil {
+		return err
+	}
+	x, ok := fn.(*types.Function)
+	if !ok {
+		// 本地函数直接调用, 接下来的 RETURN A 0 返回全部结果
+		values, err := f.vm.Call(fn, args...)
 		if err != nil {
 			return err
 		}
-	default:
-		return errInvalidOperand
+		return f.setResults(a, -1, values)
+	}
+	frame, err := f.vm.newCallFrame(x, args)
+	if err != nil {
+		return err
+	}
+	frame.ret, frame.results, frame.tailCall = f.ret, f.results, true
+	f.closeUpValues(0)
+	st := f.vm.state()
+	st.frames[len(st.frames)-1] = frame
+	return f.vm.callHook(frame)
+}
+
+// setResults 把 values 放到 R(A) 开始的 n 个寄存器中, n 小于 0 时保留全部并设置栈顶
+func (f *Frame) setResults(a, n int, values []types.Value) error {
+	if n < 0 {
+		f.Resize(a)
+		return f.PushN(-1, values...)
 	}
-	for i := range values {
-		if a+i == a+c-1 {
-			break
+	for i := 0; i < n; i++ {
+		v := types.Value(types.GetNil())
+		if i < len(values) {
+			v = values[i]
 		}
-		err = f.Set(a+i, values[i])
-		if err != nil {
+		if err := f.Set(a+i, v); err != nil {
 			return err
 		}
 	}
@@ -498,29 +554,7 @@ func (ins *Instruction) call(f *Frame) error {
 // R(A), R(A+1), ..., R(A+B-2) = vararg
 func (ins *Instruction) varArgs(f *Frame) error {
 	a, b, _ := ins.ABC()
-	if b == 1 {
-		return nil
-	}
-	varArgsSize := b - 1
-	if varArgsSize < 0 {
-		varArgsSize = len(f.varArgs)
-	}
-	args := f.varArgs
-	if varArgsSize < len(f.varArgs) {
-		args = f.varArgs[:varArgsSize]
-	}
-	for i := 0; i < varArgsSize; i++ {
-		if i >= len(args) {
-			if err := f.Set(a+i, types.GetNil()); err != nil {
-				return err
-			}
-			continue
-		}
-		if err := f.Set(a+i, args[i]); err != nil {
-			return err
-		}
-	}
-	return nil
+	return f.setResults(a, b-1, f.varArgs)
 }
 
 // R(A+1) := R(B); R(A) := R(B)[RK(C)]
@@ -531,15 +565,11 @@ func (ins *Instruction) self(f *Frame) error {
 		return err
 	}
 
-	tb, ok := f.Get(b).(*types.Table)
-	if !ok {
-		return errInvalidOperand
-	}
 	k, err := f.GetRK(c)
 	if err != nil {
 		return err
 	}
-	v, err := tb.Get(k)
+	v, err := f.vm.index(f.Get(b), k)
 	if err != nil {
 		return err
 	}
@@ -552,44 +582,30 @@ func (ins *Instruction) getUpValue(f *Frame) error {
 	if b < 0 || b >= len(f.fn.UpValues) {
 		return f.Set(a, types.GetNil())
 	}
-	return f.Set(a, f.fn.UpValues[b].Value)
+	return f.Set(a, f.fn.UpValues[b].Get())
 }
 
 // UpValue[B] := R(A)
 func (ins *Instruction) setUpValue(f *Frame) error {
 	a, b, _ := ins.ABC()
-	if b < 0 {
-		b += len(f.fn.UpValues)
-	}
-	if b >= len(f.fn.UpValues) {
-		tmp := f.fn.UpValues
-		f.fn.UpValues = make([]*types.ValuePointer, b+1)
-		copy(f.fn.UpValues, tmp)
+	if b < 0 || b >= len(f.fn.UpValues) {
+		return nil
 	}
-	f.fn.UpValues[b] = &types.ValuePointer{Value: f.Get(a)}
+	f.fn.UpValues[b].Set(f.Get(a))
 	return nil
 }
 
 // R(A) := UpValue[B][RK(C)]
 func (ins *Instruction) getTableUpValue(f *Frame) error {
 	a, b, c := ins.ABC()
-	var (
-		tb *types.Table
-		ok = true
-	)
+	if b >= len(f.fn.UpValues) {
+		return errUpValueIndex
+	}
 	k, err := f.GetRK(c)
 	if err != nil {
 		return err
 	}
-	if b == 0 {
-		tb = f.vm.global
-	} else {
-		tb, ok = f.fn.UpValues[b].Value.(*types.Table)
-	}
-	if !ok {
-		return errInvalidOperand
-	}
-	v, err := tb.Get(k)
+	v, err := f.vm.index(f.fn.UpValues[b].Get(), k)
 	if err != nil {
 		return err
 	}
@@ -599,19 +615,10 @@ func (ins *Instruction) getTableUpValue(f *Frame) error {
 // UpValue[A][RK(B)] := RK(C)
 func (ins *Instruction) setTableUpValue(f *Frame) error {
 	a, b, c := ins.ABC()
-	var (
-		tb *types.Table
-		ok = true
-	)
-	if a == 0 {
-		tb = f.vm.global
-	} else {
-		tb, ok = f.fn.UpValues[a].Value.(*types.Table)
-	}
-	if !ok {
-		return errInvalidOperand
+	if a >= len(f.fn.UpValues) {
+		return errUpValueIndex
 	}
-	//vm.CheckStack(2)
+	tb := f.fn.UpValues[a].Get()
 	k, err := f.GetRK(b) // ~/rk[b]
 	if err != nil {
 		return err
@@ -620,5 +627,5 @@ func (ins *Instruction) setTableUpValue(f *Frame) error {
 	if err != nil {
 		return err
 	}
-	return tb.Set(k, v)
+	return f.vm.setIndex(tb, k, v)
 }
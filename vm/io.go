@@ -0,0 +1,637 @@
+package vm
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/Salpadding/lua/types"
+)
+
+var ioFunctions = map[string]nativeFunction{
+	"close":   ioClose,
+	"flush":   ioFlush,
+	"input":   ioInput,
+	"output":  ioOutput,
+	"lines":   ioLines,
+	"open":    ioOpen,
+	"read":    ioRead,
+	"write":   ioWrite,
+	"type":    ioType,
+	"tmpfile": ioTmpFile,
+	"popen":   ioPOpen,
+}
+
+var fileMethods = map[string]nativeFunction{
+	"close":   fileClose,
+	"flush":   fileFlush,
+	"lines":   fileLines,
+	"read":    fileRead,
+	"seek":    fileSeek,
+	"setvbuf": fileSetVBuf,
+	"write":   fileWrite,
+}
+
+// 注册表中保存默认输入输出文件和文件元表的键
+const (
+	ioInputKey  = types.String("_IO_input")
+	ioOutputKey = types.String("_IO_output")
+	fileMetaKey = types.String("FILE*")
+)
+
+var (
+	errClosedFile   = errors.New("attempt to use a closed file")
+	errStandardFile = errors.New("cannot close standard file")
+	errFileClosed   = errors.New("file is already closed")
+	errPOpen        = errors.New("'popen' not supported")
+)
+
+// luaFile 是 io 库中的文件句柄
+type luaFile struct {
+	src    io.Reader     // 读取的数据源, 用于移动读写位置后重置 r
+	r      *bufio.Reader // 为 nil 时不能读取
+	w      io.Writer     // 为 nil 时不能写入
+	closer io.Closer
+	seeker io.Seeker
+	std    bool // 标准文件不能关闭
+	closed bool
+}
+
+// newFile 把 Go 的读写对象包装为 lua 的文件, 没有实现的接口对应的操作会失败
+func (vm *LuaVM) newFile(rw interface{}, std bool) (*types.Userdata, error) {
+	lf := &luaFile{std: std}
+	if r, ok := rw.(io.Reader); ok {
+		lf.src, lf.r = r, bufio.NewReader(r)
+	}
+	lf.w, _ = rw.(io.Writer)
+	lf.closer, _ = rw.(io.Closer)
+	lf.seeker, _ = rw.(io.Seeker)
+	mt, err := vm.registry.Get(fileMetaKey)
+	if err != nil {
+		return nil, err
+	}
+	meta, _ := mt.(*types.Table)
+	return types.NewUserdata(lf, meta), nil
+}
+
+// openIO 打开 io 库, 设置文件的元表和标准文件
+func (vm *LuaVM) openIO() error {
+	lib, err := vm.openLib("io", ioFunctions)
+	if err != nil {
+		return err
+	}
+	methods := types.NewTable()
+	if err := vm.setFunctions(methods, fileMethods); err != nil {
+		return err
+	}
+	meta := types.NewTable()
+	fields := map[string]types.Value{
+		"__name":     fileMetaKey,
+		"__index":    methods,
+		"__tostring": vm.bind(fileToString),
+	}
+	for k, v := range fields {
+		if err := meta.Set(types.String(k), v); err != nil {
+			return err
+		}
+	}
+	if err := vm.registry.Set(fileMetaKey, meta); err != nil {
+		return err
+	}
+	std := []struct {
+		name string
+		key  types.String
+		rw   interface{}
+	}{
+		{"stdin", ioInputKey, vm.input()},
+		{"stdout", ioOutputKey, vm.output()},
+		{"stderr", "", os.Stderr},
+	}
+	for _, s := range std {
+		f, err := vm.newFile(s.rw, true)
+		if err != nil {
+			return err
+		}
+		if err := lib.Set(types.String(s.name), f); err != nil {
+			return err
+		}
+		if s.key == "" {
+			continue
+		}
+		if err := vm.registry.Set(s.key, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// toFile 返回 v 中的文件, v 不是文件时返回 nil
+func toFile(v types.Value) *luaFile {
+	if u, ok := v.(*types.Userdata); ok {
+		if lf, ok := u.Data.(*luaFile); ok {
+			return lf
+		}
+	}
+	return nil
+}
+
+// checkFile 检查第 i 个参数是否是没有关闭的文件
+func checkFile(args []types.Value, i int, fname string) (*luaFile, error) {
+	lf := toFile(arg(args, i))
+	if lf == nil {
+		return nil, errArgument(i+1, fname, fmt.Sprintf("FILE* expected, got %s", typeNameOf(args, i)))
+	}
+	if lf.closed {
+		return nil, errClosedFile
+	}
+	return lf, nil
+}
+
+// defaultFile 返回默认输入或者输出文件
+func (vm *LuaVM) defaultFile(key types.String) (types.Value, *luaFile, error) {
+	v, err := vm.registry.Get(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	lf := toFile(v)
+	if lf == nil || lf.closed {
+		kind := strings.TrimPrefix(string(key), "_IO_")
+		return nil, nil, fmt.Errorf("standard %s file is closed", kind)
+	}
+	return v, lf, nil
+}
+
+// openFile 按照 C 语言 fopen 的模式打开文件
+func (vm *LuaVM) openFile(name, mode string) (*types.Userdata, error) {
+	flags := map[string]int{
+		"r":  os.O_RDONLY,
+		"w":  os.O_WRONLY | os.O_CREATE | os.O_TRUNC,
+		"a":  os.O_WRONLY | os.O_CREATE | os.O_APPEND,
+		"r+": os.O_RDWR,
+		"w+": os.O_RDWR | os.O_CREATE | os.O_TRUNC,
+		"a+": os.O_RDWR | os.O_CREATE | os.O_APPEND,
+	}
+	f, err := os.OpenFile(name, flags[strings.TrimRight(mode, "b")], 0666)
+	if err != nil {
+		return nil, err
+	}
+	var rw interface{} = f
+	switch mode[0] {
+	case 'r':
+		if !strings.Contains(mode, "+") {
+			rw = struct {
+				io.ReadCloser
+				io.Seeker
+			}{f, f}
+		}
+	default:
+		if !strings.Contains(mode, "+") {
+			rw = struct {
+				io.WriteCloser
+				io.Seeker
+			}{f, f}
+		}
+	}
+	return vm.newFile(rw, false)
+}
+
+// validMode 检查 io.open 的模式是否合法
+func validMode(mode string) bool {
+	mode = strings.TrimRight(mode, "b")
+	switch mode {
+	case "r", "w", "a", "r+", "w+", "a+":
+		return true
+	}
+	return false
+}
+
+// close 关闭文件, 标准文件不能关闭
+func (lf *luaFile) close() []types.Value {
+	if lf.std {
+		return []types.Value{types.GetNil(), types.String(errStandardFile.Error())}
+	}
+	lf.closed = true
+	var err error
+	if lf.closer != nil {
+		err = lf.closer.Close()
+	}
+	return fileResult(err, "")
+}
+
+// flush 把缓冲的数据写入文件
+func (lf *luaFile) flush() error {
+	if f, ok := lf.w.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// sync 丢弃读取缓冲区中的数据, 并把读写位置移动到实际读取到的位置
+func (lf *luaFile) sync() error {
+	if lf.r == nil || lf.r.Buffered() == 0 || lf.seeker == nil {
+		return nil
+	}
+	if _, err := lf.seeker.Seek(int64(-lf.r.Buffered()), io.SeekCurrent); err != nil {
+		return err
+	}
+	lf.r.Reset(lf.src)
+	return nil
+}
+
+// write 把字符串和数字写入文件, 成功时返回文件自己
+func (lf *luaFile) write(self types.Value, args []types.Value, start int, fname string) ([]types.Value, error) {
+	if lf.w == nil {
+		return fileResult(errors.New("file not opened for writing"), ""), nil
+	}
+	if err := lf.sync(); err != nil {
+		return fileResult(err, ""), nil
+	}
+	for i := start; i < len(args); i++ {
+		s, err := checkString(args, i, fname)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.WriteString(lf.w, s); err != nil {
+			return fileResult(err, ""), nil
+		}
+	}
+	return []types.Value{self}, nil
+}
+
+// readNumber 读取一个数字, 不是合法的数字时返回 nil
+func (lf *luaFile) readNumber() types.Value {
+	for {
+		b, err := lf.r.ReadByte()
+		if err != nil {
+			return types.GetNil()
+		}
+		if !strings.ContainsRune(" \t\n\r\f\v", rune(b)) {
+			_ = lf.r.UnreadByte()
+			break
+		}
+	}
+	var buf []byte
+	for len(buf) < 200 {
+		b, err := lf.r.ReadByte()
+		if err != nil {
+			break
+		}
+		sign := b == '+' || b == '-'
+		if sign && len(buf) > 0 && !strings.ContainsRune("eEpP", rune(buf[len(buf)-1])) ||
+			!sign && !strings.ContainsRune("0123456789abcdefABCDEFxX.pP", rune(b)) {
+			_ = lf.r.UnreadByte()
+			break
+		}
+		buf = append(buf, b)
+	}
+	if n, ok := types.ParseNumber(string(buf)); ok {
+		return n
+	}
+	return types.GetNil()
+}
+
+// readLine 读取一行, keep 为 true 时保留换行符, 文件结束时返回 nil
+func (lf *luaFile) readLine(keep bool) types.Value {
+	s, err := lf.r.ReadString('\n')
+	if err != nil && s == "" {
+		return types.GetNil()
+	}
+	if !keep {
+		s = strings.TrimSuffix(s, "\n")
+	}
+	return types.String(s)
+}
+
+// readN 读取最多 n 个字节, n 为 0 时用于判断文件是否结束
+func (lf *luaFile) readN(n int64) types.Value {
+	if n == 0 {
+		if _, err := lf.r.Peek(1); err != nil {
+			return types.GetNil()
+		}
+		return types.String("")
+	}
+	buf := make([]byte, n)
+	m, _ := io.ReadFull(lf.r, buf)
+	if m == 0 {
+		return types.GetNil()
+	}
+	return types.String(buf[:m])
+}
+
+// read 按照格式读取文件, 某一个格式读取失败时后面的格式不再读取
+func (lf *luaFile) read(args []types.Value, start int, fname string) ([]types.Value, error) {
+	if lf.r == nil {
+		return fileResult(errors.New("file not opened for reading"), ""), nil
+	}
+	formats := args[start:]
+	if len(formats) == 0 {
+		formats = []types.Value{types.String("l")}
+	}
+	var res []types.Value
+	for i, f := range formats {
+		var v types.Value
+		if n, ok := f.(types.Integer); ok {
+			v = lf.readN(int64(n))
+		} else {
+			s, err := checkString(formats, i, fname)
+			if err != nil {
+				return nil, errArgument(i+1, fname, "invalid format")
+			}
+			switch strings.TrimPrefix(s, "*")[:1] {
+			case "n":
+				v = lf.readNumber()
+			case "l":
+				v = lf.readLine(false)
+			case "L":
+				v = lf.readLine(true)
+			case "a":
+				data, _ := ioutil.ReadAll(lf.r)
+				v = types.String(data)
+			default:
+				return nil, errArgument(i+1, fname, "invalid format")
+			}
+		}
+		res = append(res, v)
+		if isNil(v) {
+			break
+		}
+	}
+	return res, nil
+}
+
+// lines 返回按照格式读取文件的迭代函数, toClose 为 true 时读到文件结尾后关闭文件
+func (vm *LuaVM) lines(lf *luaFile, formats []types.Value, toClose bool) types.Native {
+	formats = append([]types.Value{}, formats...)
+	return vm.bind(func(vm *LuaVM, _ ...types.Value) ([]types.Value, error) {
+		if lf.closed {
+			return nil, errFileClosed
+		}
+		values, err := lf.read(formats, 0, "lines")
+		if err != nil {
+			return nil, err
+		}
+		if len(values) > 0 && isNil(values[0]) && toClose {
+			lf.close()
+		}
+		return values, nil
+	})
+}
+
+func fileToString(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	lf := toFile(arg(args, 0))
+	if lf == nil {
+		return nil, errArgument(1, "tostring", fmt.Sprintf("FILE* expected, got %s", typeNameOf(args, 0)))
+	}
+	if lf.closed {
+		return []types.Value{types.String("file (closed)")}, nil
+	}
+	return []types.Value{types.String(fmt.Sprintf("file (%p)", lf))}, nil
+}
+
+func fileClose(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	lf, err := checkFile(args, 0, "close")
+	if err != nil {
+		return nil, err
+	}
+	return lf.close(), nil
+}
+
+func fileFlush(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	lf, err := checkFile(args, 0, "flush")
+	if err != nil {
+		return nil, err
+	}
+	if err := lf.flush(); err != nil {
+		return fileResult(err, ""), nil
+	}
+	return []types.Value{args[0]}, nil
+}
+
+func fileLines(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	lf, err := checkFile(args, 0, "lines")
+	if err != nil {
+		return nil, err
+	}
+	return []types.Value{vm.lines(lf, args[1:], false)}, nil
+}
+
+func fileRead(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	lf, err := checkFile(args, 0, "read")
+	if err != nil {
+		return nil, err
+	}
+	return lf.read(args, 1, "read")
+}
+
+func fileWrite(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	lf, err := checkFile(args, 0, "write")
+	if err != nil {
+		return nil, err
+	}
+	return lf.write(args[0], args, 1, "write")
+}
+
+// file:seek([whence [, offset]]) 移动读写位置并返回新的位置
+func fileSeek(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	lf, err := checkFile(args, 0, "seek")
+	if err != nil {
+		return nil, err
+	}
+	whenceName, err := optString(args, 1, "seek", "cur")
+	if err != nil {
+		return nil, err
+	}
+	whence, ok := map[string]int{"set": io.SeekStart, "cur": io.SeekCurrent, "end": io.SeekEnd}[whenceName]
+	if !ok {
+		return nil, errArgument(2, "seek", fmt.Sprintf("invalid option '%s'", whenceName))
+	}
+	offset, err := optInteger(args, 2, "seek", 0)
+	if err != nil {
+		return nil, err
+	}
+	if lf.seeker == nil {
+		return fileResult(errors.New("file is not seekable"), ""), nil
+	}
+	if lf.r != nil && whence == io.SeekCurrent {
+		offset -= int64(lf.r.Buffered())
+	}
+	pos, err := lf.seeker.Seek(offset, whence)
+	if err != nil {
+		return fileResult(err, ""), nil
+	}
+	if lf.r != nil {
+		lf.r.Reset(lf.src)
+	}
+	return []types.Value{types.Integer(pos)}, nil
+}
+
+// file:setvbuf(mode [, size]) 写入没有缓冲, 只检查参数
+func fileSetVBuf(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	if _, err := checkFile(args, 0, "setvbuf"); err != nil {
+		return nil, err
+	}
+	mode, err := checkString(args, 1, "setvbuf")
+	if err != nil {
+		return nil, err
+	}
+	switch mode {
+	case "no", "full", "line":
+		return []types.Value{types.Boolean(true)}, nil
+	}
+	return nil, errArgument(2, "setvbuf", fmt.Sprintf("invalid option '%s'", mode))
+}
+
+// close([file]) 关闭文件, 省略时关闭默认输出文件
+func ioClose(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	if isNil(arg(args, 0)) {
+		_, lf, err := vm.defaultFile(ioOutputKey)
+		if err != nil {
+			return nil, err
+		}
+		return lf.close(), nil
+	}
+	return fileClose(vm, args...)
+}
+
+func ioFlush(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	f, _, err := vm.defaultFile(ioOutputKey)
+	if err != nil {
+		return nil, err
+	}
+	return fileFlush(vm, f)
+}
+
+// setDefaultFile 实现 io.input 和 io.output, 参数是文件名时按照 mode 打开文件
+func (vm *LuaVM) setDefaultFile(args []types.Value, key types.String, mode, fname string) ([]types.Value, error) {
+	switch x := arg(args, 0).(type) {
+	case *types.Nil, *types.None:
+	case types.String:
+		f, err := vm.openFile(string(x), mode)
+		if err != nil {
+			msg, _ := fileError(err)
+			return nil, fmt.Errorf("cannot open file '%s' (%s)", string(x), msg)
+		}
+		if err := vm.registry.Set(key, f); err != nil {
+			return nil, err
+		}
+	default:
+		if _, err := checkFile(args, 0, fname); err != nil {
+			return nil, err
+		}
+		if err := vm.registry.Set(key, x); err != nil {
+			return nil, err
+		}
+	}
+	f, err := vm.registry.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return []types.Value{f}, nil
+}
+
+// input([file]) 设置或者返回默认输入文件
+func ioInput(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	return vm.setDefaultFile(args, ioInputKey, "r", "input")
+}
+
+// output([file]) 设置或者返回默认输出文件
+func ioOutput(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	return vm.setDefaultFile(args, ioOutputKey, "w", "output")
+}
+
+// lines([filename, ...]) 返回按行读取文件的迭代函数, 省略文件名时读取默认输入文件
+func ioLines(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	if isNil(arg(args, 0)) {
+		_, lf, err := vm.defaultFile(ioInputKey)
+		if err != nil {
+			return nil, err
+		}
+		var formats []types.Value
+		if len(args) > 1 {
+			formats = args[1:]
+		}
+		return []types.Value{vm.lines(lf, formats, false)}, nil
+	}
+	name, err := checkString(args, 0, "lines")
+	if err != nil {
+		return nil, err
+	}
+	f, err := vm.openFile(name, "r")
+	if err != nil {
+		msg, _ := fileError(err)
+		return nil, fmt.Errorf("%s: %s", name, msg)
+	}
+	return []types.Value{vm.lines(toFile(f), args[1:], true)}, nil
+}
+
+// open(filename [, mode]) 打开文件, 失败时返回 nil 和错误信息
+func ioOpen(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	name, err := checkString(args, 0, "open")
+	if err != nil {
+		return nil, err
+	}
+	mode, err := optString(args, 1, "open", "r")
+	if err != nil {
+		return nil, err
+	}
+	if !validMode(mode) {
+		return nil, errArgument(2, "open", "invalid mode")
+	}
+	f, err := vm.openFile(name, mode)
+	if err != nil {
+		return fileResult(err, name), nil
+	}
+	return []types.Value{f}, nil
+}
+
+func ioRead(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	_, lf, err := vm.defaultFile(ioInputKey)
+	if err != nil {
+		return nil, err
+	}
+	return lf.read(args, 0, "read")
+}
+
+func ioWrite(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	f, lf, err := vm.defaultFile(ioOutputKey)
+	if err != nil {
+		return nil, err
+	}
+	return lf.write(f, args, 0, "write")
+}
+
+// type(obj) 返回 file, closed file 或者 nil
+func ioType(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	if _, err := checkAny(args, 0, "type"); err != nil {
+		return nil, err
+	}
+	lf := toFile(args[0])
+	switch {
+	case lf == nil:
+		return []types.Value{types.GetNil()}, nil
+	case lf.closed:
+		return []types.Value{types.String("closed file")}, nil
+	}
+	return []types.Value{types.String("file")}, nil
+}
+
+// tmpfile() 创建以读写模式打开的临时文件
+func ioTmpFile(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	f, err := ioutil.TempFile("", "lua_")
+	if err != nil {
+		return fileResult(err, ""), nil
+	}
+	u, err := vm.newFile(f, false)
+	if err != nil {
+		return nil, err
+	}
+	return []types.Value{u}, nil
+}
+
+func ioPOpen(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	return nil, errPOpen
+}
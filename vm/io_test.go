@@ -0,0 +1,78 @@
+package vm
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Salpadding/lua/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIOFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "luaio")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := types.String(filepath.Join(dir, "data.txt"))
+
+	var vm LuaVM
+	fn, err := vm.LoadString(`
+local path = ...
+local f = assert(io.open(path, "w"))
+assert(f:write("line1\n", 42, " 3.5\n") == f)
+f:write("last")
+f:close()
+local closed = io.type(f)
+
+f = assert(io.open(path))
+local l1 = f:read("l")
+local n1, n2 = f:read("n", "n")
+local rest = f:read("a")
+local eof = f:read("l")
+local pos = f:seek("set", 2)
+local two = f:read(2)
+f:close()
+
+local lines = {}
+for l in io.lines(path) do lines[#lines + 1] = l end
+local missing, msg = io.open(path .. ".none")
+return l1, n1, n2, rest, eof, pos, two, closed, io.type(f), io.type(1), #lines, lines[3], missing, type(msg)
+`)
+	assert.NoError(t, err)
+	values, err := vm.Call(fn, path)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{
+		types.String("line1"), types.Integer(42), types.Float(3.5), types.String("\nlast"), types.GetNil(),
+		types.Integer(2), types.String("ne"), types.String("closed file"), types.String("closed file"), types.GetNil(),
+		types.Integer(3), types.String("last"), types.GetNil(), types.String("string"),
+	}, values)
+
+	_, err = vm.DoString(`local f = io.tmpfile(); f:close(); f:read()`)
+	assert.Contains(t, err.Error(), "attempt to use a closed file")
+	_, err = vm.DoString(`io.open("x", "rw")`)
+	assert.Contains(t, err.Error(), "bad argument #2 to 'open' (invalid mode)")
+	_, err = vm.DoString(`io.tmpfile():read("x")`)
+	assert.Contains(t, err.Error(), "bad argument #1 to 'read' (invalid format)")
+}
+
+func TestIOStd(t *testing.T) {
+	var out bytes.Buffer
+	vm := New(WithStdout(&out), WithStdin(strings.NewReader("first\n12 rest\n")))
+	values, err := vm.DoString(`
+io.write("a", 1, "\n")
+io.stdout:write("b\n")
+local l = io.read()
+local n = io.read("n")
+local ok, msg = io.stdout:close()
+return l, n, io.read("L"), ok, msg, tostring(io.stdout):sub(1, 6)
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{
+		types.String("first"), types.Integer(12), types.String(" rest\n"),
+		types.GetNil(), types.String("cannot close standard file"), types.String("file ("),
+	}, values)
+	assert.Equal(t, "a1\nb\n", out.String())
+}
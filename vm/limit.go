@@ -0,0 +1,85 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/Salpadding/lua/types"
+)
+
+// ErrOutOfGas 表示执行的指令数量超过了限制
+var ErrOutOfGas = errors.New("out of gas")
+
+// ctxCheckInterval 是检查 context 是否取消的指令间隔
+const ctxCheckInterval = 1024
+
+// CallContext 调用函数, 最多执行 gas 条指令, gas 为 0 时不限制指令数量
+// 指令用完时返回 ErrOutOfGas, ctx 取消或者超时时返回 ctx.Err(), 这两种错误不能被 pcall 捕获
+// 标准库中可能长时间运行的函数也消耗 gas 并检查 ctx: string.rep, string.gsub 和 table.concat
+// 每生成一个字节消耗一个单位, 模式匹配和 table.sort 每一步消耗一个单位.
+// 宿主注册的本地函数不消耗 gas, 也不检查 ctx
+func (vm *LuaVM) CallContext(ctx context.Context, gas uint64, fn types.Value, args ...types.Value) ([]types.Value, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	vm.ctx, vm.gasLimit, vm.gasUsed, vm.abort = ctx, gas, 0, nil
+	defer func() {
+		vm.ctx, vm.gasLimit, vm.abort = nil, 0, nil
+	}()
+	values, err := vm.Call(fn, args...)
+	if vm.abort != nil {
+		// 中止的错误可能被协程或者消息处理函数吞掉, 这里总是返回它
+		return nil, vm.abort
+	}
+	return values, err
+}
+
+// DoStringContext 加载并执行字符串, 资源限制和 CallContext 相同
+func (vm *LuaVM) DoStringContext(ctx context.Context, gas uint64, src string) ([]types.Value, error) {
+	fn, err := vm.load(strings.NewReader(src), src, "bt", nil)
+	if err != nil {
+		return nil, err
+	}
+	return vm.CallContext(ctx, gas, fn)
+}
+
+// GasUsed 返回最近一次 CallContext 开始后执行的指令数量
+func (vm *LuaVM) GasUsed() uint64 {
+	return vm.gasUsed
+}
+
+// step 在执行每条指令之前消耗 gas, 并定期检查 context 是否取消
+func (vm *LuaVM) step() error {
+	return vm.charge(1)
+}
+
+// charge 消耗 n 个单位的 gas, 每消耗 ctxCheckInterval 个单位检查一次 context 是否取消,
+// 长时间运行的本地函数在每一步调用
+func (vm *LuaVM) charge(n uint64) error {
+	if vm.abort != nil {
+		return vm.abort
+	}
+	before := vm.gasUsed
+	vm.gasUsed += n
+	if vm.gasLimit > 0 && vm.gasUsed > vm.gasLimit {
+		vm.abort = ErrOutOfGas
+		return vm.abort
+	}
+	if vm.ctx != nil && vm.gasUsed/ctxCheckInterval != before/ctxCheckInterval {
+		if err := vm.ctx.Err(); err != nil {
+			vm.abort = err
+			return err
+		}
+	}
+	return nil
+}
+
+// aborted 判断错误是否是资源用完, os.exit 或者协程被关闭导致的中止, pcall 不会捕获中止的错误,
+// 资源用完和 os.exit 的错误直接返回给宿主程序
+func (vm *LuaVM) aborted(err error) bool {
+	if _, ok := err.(*ExitError); ok {
+		return true
+	}
+	return err != nil && (err == vm.abort || err == errCoroutineClosed)
+}
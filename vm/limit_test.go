@@ -0,0 +1,88 @@
+package vm
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Salpadding/lua/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGasLimit(t *testing.T) {
+	var vm LuaVM
+	ctx := context.Background()
+	values, err := vm.DoStringContext(ctx, 1000, "local s = 0 for i = 1, 10 do s = s + i end return s")
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{types.Integer(55)}, values)
+	assert.True(t, vm.GasUsed() > 0 && vm.GasUsed() <= 1000)
+
+	for _, src := range []string{
+		"while true do end",
+		"while true do pcall(function() while true do end end) end",
+		"xpcall(function() while true do end end, function(m) return m end) return 1",
+		"local ok = coroutine.resume(coroutine.create(function() while true do end end)) return ok",
+		"coroutine.wrap(function() while true do end end)()",
+		"local f = load(function() while true do end end) return 1",
+	} {
+		_, err = vm.DoStringContext(ctx, 10000, src)
+		assert.Equal(t, ErrOutOfGas, err, src)
+		assert.Equal(t, uint64(10001), vm.GasUsed(), src)
+	}
+
+	values, err = vm.DoString("while true do return 'still usable' end")
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{types.String("still usable")}, values)
+}
+
+func TestContextCancel(t *testing.T) {
+	var vm LuaVM
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := vm.DoStringContext(ctx, 0, "while true do pcall(function() end) end")
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	fn, err := vm.LoadString("return 1")
+	assert.NoError(t, err)
+	_, err = vm.CallContext(ctx, 0, fn)
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestNativeLimits(t *testing.T) {
+	var vm LuaVM
+	ctx := context.Background()
+	for _, src := range []string{
+		"return #string.rep('x', 100000)",
+		"return pcall(string.find, string.rep('a', 30), '.-.-.-.-.-b')",
+		"return string.gsub(string.rep('a', 30), '.-.-.-.-.-b', '')",
+		"local t = {} for i = 1, 2000 do t[i] = -i end table.sort(t) return t[1]",
+	} {
+		_, err := vm.DoStringContext(ctx, 10000, src)
+		assert.Equal(t, ErrOutOfGas, err, src)
+	}
+
+	// 按照生成的字节数消耗 gas, 停止时退还 string.rep 预先记录的内存
+	vm.SetMemoryLimit(1 << 30)
+	used := vm.MemoryUsed()
+	for _, src := range []string{
+		"return #string.rep(string.rep('x', 1e4), 1e4)",
+		"return #string.gsub(string.rep('x', 1e4), '.', string.rep('y', 1e4))",
+		"local t = {} for i = 1, 100 do t[i] = 'x' end return #table.concat(t, string.rep('-', 1e4))",
+	} {
+		_, err := vm.DoStringContext(ctx, 1e6, src)
+		assert.Equal(t, ErrOutOfGas, err, src)
+		assert.True(t, vm.MemoryUsed()-used < 1e5, "%s used %d bytes", src, vm.MemoryUsed()-used)
+	}
+	vm.SetMemoryLimit(0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := vm.DoStringContext(ctx, 0, "return string.find(string.rep('a', 300), '.-.-.-.-.-.-b')")
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	values, err := vm.DoString("return #string.rep('', 1e12), #string.rep('ab', 3, ',')")
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{types.Integer(0), types.Integer(8)}, values)
+}
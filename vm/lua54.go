@@ -0,0 +1,569 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/Salpadding/lua/types"
+	"github.com/Salpadding/lua/types/code54"
+	"github.com/Salpadding/lua/types/value"
+)
+
+var opMapping54 = map[code54.Type]value.ArithmeticOperator{
+	// 立即数和常量
+	code54.AddI:        value.Add,
+	code54.AddK:        value.Add,
+	code54.SubK:        value.Sub,
+	code54.MulK:        value.Mul,
+	code54.ModK:        value.Mod,
+	code54.PowK:        value.Pow,
+	code54.DivK:        value.Div,
+	code54.IDivK:       value.IDiv,
+	code54.BitwiseAndK: value.BitwiseAnd,
+	code54.BitwiseOrK:  value.BitwiseOr,
+	code54.BitwiseXorK: value.BitwiseXor,
+	code54.ShiftRightI: value.ShiftRight,
+	code54.ShiftLeftI:  value.ShiftLeft,
+
+	// binary operators
+	code54.Add:        value.Add,
+	code54.Sub:        value.Sub,
+	code54.Mul:        value.Mul,
+	code54.Mod:        value.Mod,
+	code54.Pow:        value.Pow,
+	code54.Div:        value.Div,
+	code54.IDiv:       value.IDiv,
+	code54.BitwiseAnd: value.BitwiseAnd,
+	code54.BitwiseOr:  value.BitwiseOr,
+	code54.BitwiseXor: value.BitwiseXor,
+	code54.ShiftLeft:  value.ShiftLeft,
+	code54.ShiftRight: value.ShiftRight,
+
+	// unary operators
+	code54.UnaryMinus: value.UnaryMinus,
+	code54.BitwiseNot: value.BitwiseNot,
+}
+
+var errForStepZero = errors.New("'for' step is zero")
+
+// instruction54 是 Lua 5.4 的指令, 和 Lua 5.3 的指令共用调用帧
+type instruction54 struct {
+	code54.Instruction
+	vm *LuaVM
+}
+
+// isReturn 判断指令是否结束当前函数
+func (ins *instruction54) isReturn() bool {
+	switch ins.Opcode().Type {
+	case code54.Return, code54.Return0, code54.Return1:
+		return true
+	}
+	return false
+}
+
+func (ins *instruction54) execute(f *Frame) error {
+	if _, ok := opMapping54[ins.Opcode().Type]; ok {
+		return ins.arithmetic(f)
+	}
+	a, b, c, k := ins.ABCk()
+	switch ins.Opcode().Type {
+	case code54.Move:
+		return f.Copy(a, b)
+	case code54.LoadI:
+		_, sbx := ins.AsBx()
+		return f.Set(a, types.Integer(sbx))
+	case code54.LoadF:
+		_, sbx := ins.AsBx()
+		return f.Set(a, types.Float(sbx))
+	case code54.LoadK:
+		_, bx := ins.ABx()
+		v, err := f.GetConst(bx)
+		if err != nil {
+			return err
+		}
+		return f.Set(a, v)
+	case code54.LoadKX:
+		v, err := f.GetConst(code54.Instruction(f.Fetch()).Ax())
+		if err != nil {
+			return err
+		}
+		return f.Set(a, v)
+	case code54.LoadFalse:
+		return f.Set(a, types.Boolean(false))
+	case code54.LFalseSkip:
+		f.AddPC(1)
+		return f.Set(a, types.Boolean(false))
+	case code54.LoadTrue:
+		return f.Set(a, types.Boolean(true))
+	case code54.LoadNil:
+		for i := a; i <= a+b; i++ {
+			if err := f.Set(i, types.GetNil()); err != nil {
+				return err
+			}
+		}
+		return nil
+	case code54.GetUpValue:
+		if b >= len(f.fn.UpValues) {
+			return f.Set(a, types.GetNil())
+		}
+		return f.Set(a, f.fn.UpValues[b].Get())
+	case code54.SetUpValue:
+		if b < len(f.fn.UpValues) {
+			f.fn.UpValues[b].Set(f.Get(a))
+		}
+		return nil
+	case code54.GetTableUpValue:
+		if b >= len(f.fn.UpValues) {
+			return errUpValueIndex
+		}
+		key, err := f.GetConst(c)
+		if err != nil {
+			return err
+		}
+		return ins.getIndex(f, a, f.fn.UpValues[b].Get(), key)
+	case code54.GetTable:
+		return ins.getIndex(f, a, f.Get(b), f.Get(c))
+	case code54.GetI:
+		return ins.getIndex(f, a, f.Get(b), types.Integer(c))
+	case code54.GetField:
+		key, err := f.GetConst(c)
+		if err != nil {
+			return err
+		}
+		return ins.getIndex(f, a, f.Get(b), key)
+	case code54.SetTableUpValue:
+		if a >= len(f.fn.UpValues) {
+			return errUpValueIndex
+		}
+		key, err := f.GetConst(b)
+		if err != nil {
+			return err
+		}
+		return ins.setIndex(f, f.fn.UpValues[a].Get(), key)
+	case code54.SetTable:
+		return ins.setIndex(f, f.Get(a), f.Get(b))
+	case code54.SetI:
+		return ins.setIndex(f, f.Get(a), types.Integer(b))
+	case code54.SetField:
+		key, err := f.GetConst(b)
+		if err != nil {
+			return err
+		}
+		return ins.setIndex(f, f.Get(a), key)
+	case code54.NewTable:
+		// 下一条指令是保存表大小的 EXTRAARG
+		f.AddPC(1)
+		t, err := f.vm.newTable()
+		if err != nil {
+			return err
+		}
+		return f.Set(a, t)
+	case code54.Self:
+		obj := f.Get(b)
+		if err := f.Set(a+1, obj); err != nil {
+			return err
+		}
+		key, err := ins.rkc(f)
+		if err != nil {
+			return err
+		}
+		return ins.getIndex(f, a, obj, key)
+	case code54.MMBin, code54.MMBinI, code54.MMBinK:
+		// 算术指令已经调用了元方法
+		return nil
+	case code54.LogicalNot:
+		return f.Set(a, !f.Get(b).ToBoolean())
+	case code54.Len:
+		v, err := f.vm.length(f.Get(b))
+		if err != nil {
+			return err
+		}
+		return f.Set(a, v)
+	case code54.Concat:
+		v, err := f.vm.concat(f.Slice(a, a+b))
+		if err != nil {
+			return err
+		}
+		return f.Set(a, v)
+	case code54.Close:
+		f.closeUpValues(a)
+		return f.closeToBeClosed(a)
+	case code54.TBC:
+		return f.markToBeClosed(a)
+	case code54.Jmp:
+		f.AddPC(ins.SJ())
+		return nil
+	case code54.Equal, code54.LessThan, code54.LessThanOrEqual, code54.EqualK, code54.EqualI,
+		code54.LessThanI, code54.LessThanOrEqualI, code54.GreaterThanI, code54.GreaterThanOrEqualI:
+		return ins.compare(f)
+	case code54.Test:
+		if bool(f.Get(a).ToBoolean()) != k {
+			f.AddPC(1)
+		}
+		return nil
+	case code54.TestSet:
+		if bool(f.Get(b).ToBoolean()) != k {
+			f.AddPC(1)
+			return nil
+		}
+		return f.Copy(a, b)
+	case code54.Call:
+		return f.call(a, b, c)
+	case code54.TailCall:
+		if err := f.closeToBeClosed(0); err != nil {
+			return err
+		}
+		return f.callTail(a, b)
+	case code54.Return:
+		if err := f.closeToBeClosed(0); err != nil {
+			return err
+		}
+		return f.iReturn(a, b)
+	case code54.Return0:
+		return f.iReturn(a, 1)
+	case code54.Return1:
+		return f.iReturn(a, 2)
+	case code54.ForLoop:
+		return ins.forLoop(f)
+	case code54.ForPrep:
+		return ins.forPrep(f)
+	case code54.TForPrep:
+		_, bx := ins.ABx()
+		if err := f.markToBeClosed(a + 3); err != nil {
+			return err
+		}
+		f.AddPC(bx)
+		return nil
+	case code54.TForCall:
+		values, err := f.vm.Call(f.Get(a), f.Get(a+1), f.Get(a+2))
+		if err != nil {
+			return err
+		}
+		return f.setResults(a+4, c, values)
+	case code54.TForLoop:
+		_, bx := ins.ABx()
+		if isNil(f.Get(a + 4)) {
+			return nil
+		}
+		f.AddPC(-bx)
+		return f.Copy(a+2, a+4)
+	case code54.SetList:
+		if k {
+			c += code54.Instruction(f.Fetch()).Ax() * (code54.MaxArgC + 1)
+		}
+		return f.setList(a, b, c)
+	case code54.Closure:
+		_, bx := ins.ABx()
+		return f.closure(a, bx)
+	case code54.VarArg:
+		return f.setResults(a, c-1, f.varArgs)
+	default:
+		// VARARGPREP: 调用帧创建时已经保存了可变参数
+		return nil
+	}
+}
+
+// rkc 返回 k 为真时的常量 K[C], 否则返回 R[C]
+func (ins *instruction54) rkc(f *Frame) (types.Value, error) {
+	if ins.K() {
+		return f.GetConst(ins.C())
+	}
+	return f.Get(ins.C()), nil
+}
+
+// R[A] := t[key]
+func (ins *instruction54) getIndex(f *Frame, a int, t, key types.Value) error {
+	v, err := f.vm.index(t, key)
+	if err != nil {
+		return err
+	}
+	return f.Set(a, v)
+}
+
+// t[key] := RK(C)
+func (ins *instruction54) setIndex(f *Frame, t, key types.Value) error {
+	v, err := ins.rkc(f)
+	if err != nil {
+		return err
+	}
+	return f.vm.setIndex(t, key, v)
+}
+
+// R[A] := R[B] op R[C], K[C] 或者 sC, 成功后跳过下一条 MMBIN 指令
+func (ins *instruction54) arithmetic(f *Frame) error {
+	a, b, c, _ := ins.ABCk()
+	t := ins.Opcode().Type
+	x, y := f.Get(b), types.Value(nil)
+	switch t {
+	case code54.UnaryMinus, code54.BitwiseNot:
+		y = x
+	case code54.AddI, code54.ShiftRightI:
+		y = types.Integer(ins.SC())
+	case code54.ShiftLeftI:
+		x, y = types.Integer(ins.SC()), x
+	case code54.AddK, code54.SubK, code54.MulK, code54.ModK, code54.PowK, code54.DivK, code54.IDivK,
+		code54.BitwiseAndK, code54.BitwiseOrK, code54.BitwiseXorK:
+		k, err := f.GetConst(c)
+		if err != nil {
+			return err
+		}
+		y = k
+	default:
+		y = f.Get(c)
+	}
+	v, err := f.vm.arith(opMapping54[t], x, y)
+	if err != nil {
+		return err
+	}
+	if f.pc < len(f.fn.Code) {
+		switch code54.Instruction(f.fn.Code[f.pc]).Opcode().Type {
+		case code54.MMBin, code54.MMBinI, code54.MMBinK:
+			f.AddPC(1)
+		}
+	}
+	return f.Set(a, v)
+}
+
+// if ((R[A] op R[B], K[B] 或者 sB) ~= k) then pc++
+func (ins *instruction54) compare(f *Frame) error {
+	a, b, c, k := ins.ABCk()
+	t := ins.Opcode().Type
+	x, y := f.Get(a), types.Value(nil)
+	switch t {
+	case code54.Equal, code54.LessThan, code54.LessThanOrEqual:
+		y = f.Get(b)
+	case code54.EqualK:
+		v, err := f.GetConst(b)
+		if err != nil {
+			return err
+		}
+		y = v
+	default:
+		// C 不为 0 时立即数原本是浮点数
+		if c != 0 {
+			y = types.Float(ins.SB())
+		} else {
+			y = types.Integer(ins.SB())
+		}
+	}
+	var (
+		ok  bool
+		err error
+	)
+	switch t {
+	case code54.Equal, code54.EqualK, code54.EqualI:
+		ok, err = f.vm.equal(x, y)
+	case code54.LessThan, code54.LessThanI:
+		ok, err = f.vm.lessThan(x, y)
+	case code54.LessThanOrEqual, code54.LessThanOrEqualI:
+		ok, err = f.vm.lessEqual(x, y)
+	case code54.GreaterThanI:
+		ok, err = f.vm.lessThan(y, x)
+	default:
+		ok, err = f.vm.lessEqual(y, x)
+	}
+	if err != nil {
+		return err
+	}
+	if ok != k {
+		f.AddPC(1)
+	}
+	return nil
+}
+
+// 检查循环的参数; 整数循环在 R[A+1] 中保存剩余的次数
+// 不执行循环时 pc += Bx + 1
+func (ins *instruction54) forPrep(f *Frame) error {
+	a, bx := ins.ABx()
+	init, limit, step := numberOperand(f.Get(a)), numberOperand(f.Get(a+1)), numberOperand(f.Get(a+2))
+	i, ok1 := init.(types.Integer)
+	s, ok2 := step.(types.Integer)
+	if ok1 && ok2 {
+		if s == 0 {
+			return errForStepZero
+		}
+		l, skip, err := forLimit(i, limit, s)
+		if err != nil {
+			return err
+		}
+		if skip {
+			f.AddPC(bx + 1)
+			return nil
+		}
+		var count uint64
+		if s > 0 {
+			count = (uint64(l) - uint64(i)) / uint64(s)
+		} else {
+			count = (uint64(i) - uint64(l)) / (uint64(-(s + 1)) + 1)
+		}
+		if err := f.Set(a+1, types.Integer(count)); err != nil {
+			return err
+		}
+		return f.Copy(a+3, a)
+	}
+
+	fi, ok := init.ToFloat()
+	if !ok {
+		return forError("initial value")
+	}
+	fl, ok := limit.ToFloat()
+	if !ok {
+		return forError("limit")
+	}
+	fs, ok := step.ToFloat()
+	if !ok {
+		return forError("step")
+	}
+	if fs == 0 {
+		return errForStepZero
+	}
+	if fs > 0 && fl < fi || fs < 0 && fi < fl {
+		f.AddPC(bx + 1)
+		return nil
+	}
+	for i, v := range []types.Float{fi, fl, fs, fi} {
+		if err := f.Set(a+i, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 更新循环变量; if 循环继续 then pc -= Bx
+func (ins *instruction54) forLoop(f *Frame) error {
+	a, bx := ins.ABx()
+	if step, ok := f.Get(a + 2).(types.Integer); ok {
+		count, _ := f.Get(a + 1).(types.Integer)
+		if uint64(count) == 0 {
+			return nil
+		}
+		idx, _ := f.Get(a).(types.Integer)
+		idx += step
+		if err := f.Set(a+1, count-1); err != nil {
+			return err
+		}
+		if err := f.Set(a, idx); err != nil {
+			return err
+		}
+		f.AddPC(-bx)
+		return f.Set(a+3, idx)
+	}
+	idx, _ := f.Get(a).ToFloat()
+	limit, _ := f.Get(a + 1).ToFloat()
+	step, _ := f.Get(a + 2).ToFloat()
+	idx += step
+	if step > 0 && idx <= limit || step <= 0 && limit <= idx {
+		if err := f.Set(a, idx); err != nil {
+			return err
+		}
+		f.AddPC(-bx)
+		return f.Set(a+3, idx)
+	}
+	return nil
+}
+
+// forLimit 把整数循环的上限转换为整数, skip 为真时循环一次也不执行
+func forLimit(init types.Integer, limit types.Value, step types.Integer) (types.Integer, bool, error) {
+	var l types.Integer
+	switch x := limit.(type) {
+	case types.Integer:
+		l = x
+	case types.Float:
+		fl := float64(x)
+		if step < 0 {
+			fl = math.Ceil(fl)
+		} else {
+			fl = math.Floor(fl)
+		}
+		switch {
+		case fl >= -(1<<63) && fl < 1<<63:
+			l = types.Integer(fl)
+		case fl > 0:
+			// 上限太大, 步长为负数时不执行
+			if step < 0 {
+				return 0, true, nil
+			}
+			l = math.MaxInt64
+		default:
+			// 上限太小或者是 NaN, 步长为正数时不执行
+			if step > 0 {
+				return 0, true, nil
+			}
+			l = math.MinInt64
+		}
+	default:
+		return 0, false, forError("limit")
+	}
+	if step > 0 {
+		return l, init > l, nil
+	}
+	return l, init < l, nil
+}
+
+func forError(what string) error {
+	return fmt.Errorf("'for' %s must be a number", what)
+}
+
+// markToBeClosed 把寄存器 reg 标记为待关闭变量, nil 和 false 不需要关闭
+func (f *Frame) markToBeClosed(reg int) error {
+	v := f.Get(reg)
+	if !v.ToBoolean() {
+		return nil
+	}
+	if isNil(f.vm.metaField(v, "__close")) {
+		name := localName(f.fn.Prototype, reg, f.pc-1)
+		if name == "" {
+			name = "?"
+		}
+		return fmt.Errorf("variable '%s' got a non-closable value", name)
+	}
+	f.toBeClosed = append(f.toBeClosed, reg)
+	return nil
+}
+
+// closeToBeClosed 按照和标记相反的顺序调用寄存器 from 及以上的待关闭变量的 __close 元方法
+func (f *Frame) closeToBeClosed(from int) error {
+	for n := len(f.toBeClosed); n > 0 && f.toBeClosed[n-1] >= from; n = len(f.toBeClosed) {
+		if err := f.closeLast(types.GetNil()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// closeOnError 出错时用错误值调用所有待关闭变量的 __close 元方法, __close 出错时
+// 后面的变量收到新的错误. 协程被关闭时错误值为 nil, __close 的错误保存在协程中,
+// 调用栈继续展开
+func (f *Frame) closeOnError(err error) error {
+	co := f.vm.current
+	for len(f.toBeClosed) > 0 {
+		e := types.Value(types.GetNil())
+		switch {
+		case err != errCoroutineClosed:
+			e = errorValue(err)
+		case co != nil && co.closeErr != nil:
+			e = errorValue(co.closeErr)
+		}
+		cerr := f.closeLast(e)
+		switch {
+		case cerr == nil:
+		case f.vm.aborted(cerr):
+			return cerr
+		case err == errCoroutineClosed && co != nil:
+			co.closeErr = cerr
+		default:
+			err = cerr
+		}
+	}
+	return err
+}
+
+// closeLast 用错误值 e 调用最后一个待关闭变量的 __close 元方法
+func (f *Frame) closeLast(e types.Value) error {
+	n := len(f.toBeClosed)
+	v := f.Get(f.toBeClosed[n-1])
+	f.toBeClosed = f.toBeClosed[:n-1]
+	_, err := f.vm.Call(f.vm.metaField(v, "__close"), v, e)
+	return err
+}
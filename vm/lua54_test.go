@@ -0,0 +1,342 @@
+package vm
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/Salpadding/lua/types"
+	"github.com/Salpadding/lua/types/code"
+	"github.com/Salpadding/lua/types/code54"
+	"github.com/stretchr/testify/assert"
+)
+
+func abck(op code54.Type, a, b, c int, k bool) code54.Instruction {
+	return code54.CreateABCk(op, a, b, c, k)
+}
+
+// proto54 用 Lua 5.4 的指令创建主函数原型, upvalue 0 是 _ENV
+func proto54(maxStack byte, constants []types.Value, ins ...code54.Instruction) *types.Prototype {
+	p := &types.Prototype{
+		Source:       "=test",
+		IsVararg:     true,
+		MaxStackSize: maxStack,
+		Constants:    constants,
+		UpValues:     []types.UpValue{{1, 0}},
+		UpValueNames: []string{"_ENV"},
+		Version:      types.LuaVersion54,
+	}
+	for _, i := range ins {
+		p.Code = append(p.Code, code.Instruction(i))
+	}
+	return p
+}
+
+// load54 把函数原型写成二进制代码块后加载
+func load54(vm *LuaVM, p *types.Prototype) (*types.Function, error) {
+	var buf bytes.Buffer
+	if err := types.WritePrototype(&buf, p, false); err != nil {
+		return nil, err
+	}
+	return vm.load(&buf, "=test", "b", nil)
+}
+
+// run54 把函数原型写成二进制代码块后加载执行
+func run54(vm *LuaVM, p *types.Prototype) ([]types.Value, error) {
+	fn, err := load54(vm, p)
+	if err != nil {
+		return nil, err
+	}
+	return vm.Call(fn)
+}
+
+func TestLua54(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		p      *types.Prototype
+		expect []types.Value
+	}{
+		{
+			// local s = 0; for i = 1, 10 do s = s + i end; return s, s .. "!", s > 50
+			"integer loop",
+			proto54(5, []types.Value{types.String("!")},
+				abck(code54.VarArgPrep, 0, 0, 0, false),
+				code54.CreateAsBx(code54.LoadI, 0, 0),
+				code54.CreateAsBx(code54.LoadI, 1, 1),
+				code54.CreateAsBx(code54.LoadI, 2, 10),
+				code54.CreateAsBx(code54.LoadI, 3, 1),
+				code54.CreateABx(code54.ForPrep, 1, 2),
+				abck(code54.Add, 0, 0, 4, false),
+				abck(code54.MMBin, 0, 4, 6, false),
+				code54.CreateABx(code54.ForLoop, 1, 3),
+				abck(code54.Move, 1, 0, 0, false),
+				abck(code54.Move, 2, 0, 0, false),
+				code54.CreateABx(code54.LoadK, 3, 0),
+				abck(code54.Concat, 2, 2, 0, false),
+				abck(code54.GreaterThanI, 0, 50+code54.OffsetSC, 0, true),
+				code54.CreateSJ(code54.Jmp, 1),
+				abck(code54.LFalseSkip, 3, 0, 0, false),
+				abck(code54.LoadTrue, 3, 0, 0, false),
+				abck(code54.Return, 1, 4, 1, false),
+			),
+			[]types.Value{types.Integer(55), types.String("55!"), types.Boolean(true)},
+		},
+		{
+			// local s = 0; for i = 3, 1, -1 do s = s * 10 + i end; return s
+			"negative step",
+			proto54(5, []types.Value{types.Integer(10)},
+				code54.CreateAsBx(code54.LoadI, 0, 0),
+				code54.CreateAsBx(code54.LoadI, 1, 3),
+				code54.CreateAsBx(code54.LoadI, 2, 1),
+				code54.CreateAsBx(code54.LoadI, 3, -1),
+				code54.CreateABx(code54.ForPrep, 1, 3),
+				abck(code54.MulK, 0, 0, 0, false),
+				abck(code54.MMBinK, 0, 0, 8, false),
+				abck(code54.Add, 0, 0, 4, false),
+				code54.CreateABx(code54.ForLoop, 1, 4),
+				abck(code54.Return1, 0, 0, 0, false),
+			),
+			[]types.Value{types.Integer(321)},
+		},
+		{
+			// local s = 0.0; for i = 1, 2, 0.5 do s = s + i end; return s
+			"float loop",
+			proto54(5, []types.Value{types.Float(0.5)},
+				code54.CreateAsBx(code54.LoadF, 0, 0),
+				code54.CreateAsBx(code54.LoadI, 1, 1),
+				code54.CreateAsBx(code54.LoadI, 2, 2),
+				code54.CreateABx(code54.LoadK, 3, 0),
+				code54.CreateABx(code54.ForPrep, 1, 1),
+				abck(code54.Add, 0, 0, 4, false),
+				code54.CreateABx(code54.ForLoop, 1, 2),
+				abck(code54.Return1, 0, 0, 0, false),
+			),
+			[]types.Value{types.Float(4.5)},
+		},
+		{
+			// local t = {1, 2, 3}; t.x = "a"; t[4] = t.x; return #t, t[2], t.x, t[4]
+			"tables",
+			proto54(5, []types.Value{types.String("x"), types.String("a")},
+				abck(code54.NewTable, 0, 0, 0, false),
+				code54.CreateAx(code54.ExtraArg, 0),
+				code54.CreateAsBx(code54.LoadI, 1, 1),
+				code54.CreateAsBx(code54.LoadI, 2, 2),
+				code54.CreateAsBx(code54.LoadI, 3, 3),
+				abck(code54.SetList, 0, 3, 0, false),
+				abck(code54.SetField, 0, 0, 1, true),
+				abck(code54.GetField, 1, 0, 0, false),
+				abck(code54.SetI, 0, 4, 1, false),
+				abck(code54.Len, 1, 0, 0, false),
+				abck(code54.GetI, 2, 0, 2, false),
+				abck(code54.GetField, 3, 0, 0, false),
+				abck(code54.GetI, 4, 0, 4, false),
+				abck(code54.Return, 1, 5, 1, false),
+			),
+			[]types.Value{types.Integer(4), types.Integer(2), types.String("a"), types.String("a")},
+		},
+		{
+			// return tostring(42), 7 == 7.0, not nil
+			"globals",
+			proto54(4, []types.Value{types.String("tostring"), types.Float(7)},
+				abck(code54.GetTableUpValue, 0, 0, 0, false),
+				code54.CreateAsBx(code54.LoadI, 1, 42),
+				abck(code54.Call, 0, 2, 2, false),
+				code54.CreateAsBx(code54.LoadI, 1, 7),
+				abck(code54.EqualK, 1, 1, 0, true),
+				code54.CreateSJ(code54.Jmp, 1),
+				abck(code54.LFalseSkip, 1, 0, 0, false),
+				abck(code54.LoadTrue, 1, 0, 0, false),
+				abck(code54.LoadNil, 2, 0, 0, false),
+				abck(code54.LogicalNot, 2, 2, 0, false),
+				abck(code54.Return, 0, 4, 1, false),
+			),
+			[]types.Value{types.String("42"), types.Boolean(true), types.Boolean(true)},
+		},
+	} {
+		var vm LuaVM
+		values, err := run54(&vm, c.p)
+		assert.NoError(t, err, c.name)
+		assert.Equal(t, c.expect, values, c.name)
+	}
+}
+
+func TestLua54Closure(t *testing.T) {
+	// local n = 1; local function f() n = n + 1; return n end; f(); return f(), n
+	sub := &types.Prototype{
+		Source:       "=test",
+		LineDefined:  1,
+		MaxStackSize: 2,
+		UpValues:     []types.UpValue{{1, 0}},
+		UpValueNames: []string{"n"},
+		Version:      types.LuaVersion54,
+	}
+	for _, i := range []code54.Instruction{
+		abck(code54.GetUpValue, 0, 0, 0, false),
+		abck(code54.AddI, 0, 0, 1+code54.OffsetSC, false),
+		abck(code54.MMBinI, 0, 1+code54.OffsetSC, 6, false),
+		abck(code54.SetUpValue, 0, 0, 0, false),
+		abck(code54.Return1, 0, 0, 0, false),
+	} {
+		sub.Code = append(sub.Code, code.Instruction(i))
+	}
+	p := proto54(4, nil,
+		code54.CreateAsBx(code54.LoadI, 0, 1),
+		code54.CreateABx(code54.Closure, 1, 0),
+		abck(code54.Move, 2, 1, 0, false),
+		abck(code54.Call, 2, 1, 1, false),
+		abck(code54.Move, 2, 1, 0, false),
+		abck(code54.Call, 2, 1, 2, false),
+		abck(code54.Move, 3, 0, 0, false),
+		abck(code54.Return, 2, 3, 1, false),
+	)
+	p.Prototypes = []*types.Prototype{sub}
+
+	var vm LuaVM
+	values, err := run54(&vm, p)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{types.Integer(3), types.Integer(3)}, values)
+}
+
+func TestLua54ToBeClosed(t *testing.T) {
+	var vm LuaVM
+	var closed []types.Value
+	meta := types.NewTable()
+	assert.NoError(t, meta.Set(types.String("__close"), types.Native(func(args ...types.Value) ([]types.Value, error) {
+		closed = append(closed, args...)
+		return nil, nil
+	})))
+	obj := types.NewTable()
+	obj.SetMetatable(meta)
+	assert.NoError(t, vm.init())
+	assert.NoError(t, vm.global.Set(types.String("obj"), obj))
+
+	// local x <close> = obj; return 7
+	p := proto54(2, []types.Value{types.String("obj")},
+		abck(code54.GetTableUpValue, 0, 0, 0, false),
+		abck(code54.TBC, 0, 0, 0, false),
+		code54.CreateAsBx(code54.LoadI, 1, 7),
+		abck(code54.Return, 1, 2, 1, true),
+	)
+	values, err := run54(&vm, p)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{types.Integer(7)}, values)
+	assert.Equal(t, []types.Value{obj, types.GetNil()}, closed)
+
+	p.Code[0] = code.Instruction(code54.CreateAsBx(code54.LoadI, 0, 1))
+	_, err = run54(&vm, p)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "got a non-closable value")
+}
+
+func TestLua54ToBeClosedOnError(t *testing.T) {
+	var vm LuaVM
+	defer vm.Close()
+	var closed []types.Value
+	meta := types.NewTable()
+	assert.NoError(t, meta.Set(types.String("__close"), types.Native(func(args ...types.Value) ([]types.Value, error) {
+		closed = append(closed, args[1:]...)
+		return nil, nil
+	})))
+	obj := types.NewTable()
+	obj.SetMetatable(meta)
+	assert.NoError(t, vm.init())
+	assert.NoError(t, vm.global.Set(types.String("obj"), obj))
+
+	// local x <close> = obj; error("boom", 0)
+	fn, err := load54(&vm, proto54(4, []types.Value{types.String("obj"), types.String("error"), types.String("boom")},
+		abck(code54.GetTableUpValue, 0, 0, 0, false),
+		abck(code54.TBC, 0, 0, 0, false),
+		abck(code54.GetTableUpValue, 1, 0, 1, false),
+		code54.CreateABx(code54.LoadK, 2, 2),
+		code54.CreateAsBx(code54.LoadI, 3, 0),
+		abck(code54.Call, 1, 3, 1, false),
+		abck(code54.Return, 1, 1, 1, true),
+	))
+	assert.NoError(t, err)
+	assert.NoError(t, vm.global.Set(types.String("f"), fn))
+	_, err = vm.Call(fn)
+	assert.EqualError(t, err, "boom")
+
+	// local x <close> = obj; coroutine.yield()
+	gen, err := load54(&vm, proto54(2, []types.Value{types.String("obj"), types.String("coroutine"), types.String("yield")},
+		abck(code54.GetTableUpValue, 0, 0, 0, false),
+		abck(code54.TBC, 0, 0, 0, false),
+		abck(code54.GetTableUpValue, 1, 0, 1, false),
+		abck(code54.GetField, 1, 1, 2, true),
+		abck(code54.Call, 1, 1, 1, false),
+		abck(code54.Return, 1, 1, 1, true),
+	))
+	assert.NoError(t, err)
+	assert.NoError(t, vm.global.Set(types.String("gen"), gen))
+
+	values, err := vm.DoString(`
+local ok, msg = pcall(f)
+local co = coroutine.create(f)
+local ok2, msg2 = coroutine.resume(co)
+local co2 = coroutine.create(gen)
+coroutine.resume(co2)
+local ok3 = coroutine.close(co2)
+return ok, msg, ok2, msg2, ok3, coroutine.status(co2), coroutine.close(co)
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{
+		types.Boolean(false), types.String("boom"),
+		types.Boolean(false), types.String("boom"),
+		types.Boolean(true), types.String("dead"),
+		types.Boolean(false), types.String("boom"),
+	}, values)
+	assert.Equal(t, []types.Value{types.String("boom"), types.String("boom"), types.String("boom"), types.GetNil()}, closed)
+
+	// __close 的错误代替原来的错误
+	assert.NoError(t, meta.Set(types.String("__close"), types.Native(func(args ...types.Value) ([]types.Value, error) {
+		msg := "nil"
+		if s, ok := args[1].(types.String); ok {
+			msg = string(s)
+		}
+		return nil, &LuaError{Value: types.String("close: " + msg), Line: -1}
+	})))
+	_, err = vm.Call(fn)
+	assert.EqualError(t, err, "close: boom")
+	values, err = vm.DoString("local co = coroutine.create(gen); coroutine.resume(co); return coroutine.close(co)")
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{types.Boolean(false), types.String("close: nil")}, values)
+}
+
+func TestLua54Error(t *testing.T) {
+	// return x + 1
+	p := proto54(2, []types.Value{types.String("x")},
+		abck(code54.GetTableUpValue, 0, 0, 0, false),
+		abck(code54.AddI, 0, 0, 1+code54.OffsetSC, false),
+		abck(code54.MMBinI, 0, 1+code54.OffsetSC, 6, false),
+		abck(code54.Return1, 0, 0, 0, false),
+	)
+	var vm LuaVM
+	_, err := run54(&vm, p)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "attempt to perform arithmetic on a nil value (global 'x')")
+
+	// 5.3 的代码块仍然可以执行
+	values, err := vm.DoString("return 1 + 2")
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{types.Integer(3)}, values)
+}
+
+func TestLua54DivideByZero(t *testing.T) {
+	// local a, b = 1, 0; return a // b
+	p := proto54(3, nil,
+		code54.CreateAsBx(code54.LoadI, 0, 1),
+		code54.CreateAsBx(code54.LoadI, 1, 0),
+		abck(code54.IDiv, 2, 0, 1, false),
+		abck(code54.MMBin, 0, 1, 12, false),
+		abck(code54.Return1, 2, 0, 0, false),
+	)
+	var vm LuaVM
+	_, err := run54(&vm, p)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "attempt to perform 'n//0'")
+
+	p.Code[2] = code.Instruction(abck(code54.Mod, 2, 0, 1, false))
+	p.Code[3] = code.Instruction(abck(code54.MMBin, 0, 1, 9, false))
+	_, err = run54(&vm, p)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "attempt to perform 'n%0'")
+}
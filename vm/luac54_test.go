@@ -0,0 +1,44 @@
+package vm
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/Salpadding/lua/types"
+	"github.com/stretchr/testify/assert"
+)
+
+//go:generate sh testdata/luac54.sh
+
+// TestLuac54 执行 luac5.4 编译的 testdata/*54.lua, 代码块由 go generate 生成并提交到仓库,
+// 缺少代码块时测试失败
+func TestLuac54(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		expect []types.Value
+	}{
+		{"closure54", []types.Value{types.Integer(3), types.Integer(1)}},
+		{"vararg54", []types.Value{types.Integer(3), types.Integer(1), types.Integer(3), types.Integer(4), types.Integer(5)}},
+		{"genericfor54", []types.Value{types.Integer(140), types.String("a")}},
+		{"close54", []types.Value{types.String("b:nil a:nil c:boom"), types.Boolean(false)}},
+		{"forloop54", []types.Value{types.Integer(79), types.Float(5)}},
+		{"longstring54", []types.Value{types.Integer(75), types.String("this")}},
+		{"abslineinfo54", []types.Value{types.Integer(80), types.String("abslineinfo54.lua:282: here")}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			data, err := ioutil.ReadFile("testdata/" + c.name + ".o")
+			if os.IsNotExist(err) {
+				t.Fatalf("testdata/%s.o is missing, run go generate with luac5.4 installed and commit the output", c.name)
+			}
+			assert.NoError(t, err)
+			var vm LuaVM
+			fn, err := vm.load(bytes.NewReader(data), "="+c.name, "b", nil)
+			assert.NoError(t, err)
+			values, err := vm.Call(fn)
+			assert.NoError(t, err)
+			assert.Equal(t, c.expect, values)
+		})
+	}
+}
@@ -0,0 +1,332 @@
+package vm
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/Salpadding/lua/types"
+	"github.com/Salpadding/lua/types/value"
+)
+
+var mathFunctions = map[string]nativeFunction{
+	"abs":        mathAbs,
+	"ceil":       mathCeil,
+	"floor":      mathFloor,
+	"fmod":       mathFMod,
+	"modf":       mathModf,
+	"sqrt":       mathFloat("sqrt", math.Sqrt),
+	"exp":        mathFloat("exp", math.Exp),
+	"sin":        mathFloat("sin", math.Sin),
+	"cos":        mathFloat("cos", math.Cos),
+	"tan":        mathFloat("tan", math.Tan),
+	"asin":       mathFloat("asin", math.Asin),
+	"acos":       mathFloat("acos", math.Acos),
+	"atan":       mathAtan,
+	"log":        mathLog,
+	"max":        mathMax,
+	"min":        mathMin,
+	"tointeger":  mathToInteger,
+	"type":       mathType,
+	"ult":        mathUlt,
+	"random":     mathRandom,
+	"randomseed": mathRandomSeed,
+}
+
+// openMath 打开数学库并设置常量
+func (vm *LuaVM) openMath() error {
+	lib, err := vm.openLib("math", mathFunctions)
+	if err != nil {
+		return err
+	}
+	constants := map[string]types.Value{
+		"pi":         types.Float(math.Pi),
+		"huge":       types.Float(math.Inf(1)),
+		"maxinteger": types.Integer(math.MaxInt64),
+		"mininteger": types.Integer(math.MinInt64),
+	}
+	for k, v := range constants {
+		if err := lib.Set(types.String(k), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// floatToNumber 把浮点数转换为整数, 超出整数范围时保留浮点数
+func floatToNumber(f float64) types.Value {
+	if i, ok := types.FloatToInteger(types.Float(f)); ok {
+		return i
+	}
+	return types.Float(f)
+}
+
+// mathFloat 把单参数的浮点数函数包装为本地函数
+func mathFloat(fname string, fn func(float64) float64) nativeFunction {
+	return func(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+		x, err := checkFloat(args, 0, fname)
+		if err != nil {
+			return nil, err
+		}
+		return []types.Value{types.Float(fn(x))}, nil
+	}
+}
+
+func mathAbs(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	n, err := checkNumber(args, 0, "abs")
+	if err != nil {
+		return nil, err
+	}
+	switch x := n.(type) {
+	case types.Integer:
+		if x < 0 {
+			x = -x
+		}
+		return []types.Value{x}, nil
+	case types.Float:
+		return []types.Value{types.Float(math.Abs(float64(x)))}, nil
+	}
+	return []types.Value{n}, nil
+}
+
+// mathRound 实现 floor 和 ceil, 结果在整数范围内时返回整数
+func mathRound(args []types.Value, fname string, fn func(float64) float64) ([]types.Value, error) {
+	n, err := checkNumber(args, 0, fname)
+	if err != nil {
+		return nil, err
+	}
+	if i, ok := n.(types.Integer); ok {
+		return []types.Value{i}, nil
+	}
+	f, _ := n.ToFloat()
+	return []types.Value{floatToNumber(fn(float64(f)))}, nil
+}
+
+func mathFloor(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	return mathRound(args, "floor", math.Floor)
+}
+
+func mathCeil(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	return mathRound(args, "ceil", math.Ceil)
+}
+
+// fmod(x, y) 返回 x 除以 y 的余数, 商向零取整
+func mathFMod(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	a, err := checkNumber(args, 0, "fmod")
+	if err != nil {
+		return nil, err
+	}
+	b, err := checkNumber(args, 1, "fmod")
+	if err != nil {
+		return nil, err
+	}
+	x, ok1 := a.(types.Integer)
+	y, ok2 := b.(types.Integer)
+	if ok1 && ok2 {
+		switch y {
+		case 0:
+			return nil, errArgument(2, "fmod", "zero")
+		case -1:
+			// 避免 mininteger % -1 溢出
+			return []types.Value{types.Integer(0)}, nil
+		}
+		return []types.Value{x % y}, nil
+	}
+	fa, _ := a.ToFloat()
+	fb, _ := b.ToFloat()
+	return []types.Value{types.Float(math.Mod(float64(fa), float64(fb)))}, nil
+}
+
+// modf(x) 返回 x 的整数部分和小数部分
+func mathModf(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	n, err := checkNumber(args, 0, "modf")
+	if err != nil {
+		return nil, err
+	}
+	if i, ok := n.(types.Integer); ok {
+		return []types.Value{i, types.Float(0)}, nil
+	}
+	f, _ := n.ToFloat()
+	x := float64(f)
+	ip := math.Floor(x)
+	if x < 0 {
+		ip = math.Ceil(x)
+	}
+	frac := 0.0
+	if x != ip {
+		frac = x - ip
+	}
+	return []types.Value{types.Float(ip), types.Float(frac)}, nil
+}
+
+// atan(y [, x]) 返回 y/x 的反正切, 根据两个参数的符号确定象限
+func mathAtan(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	y, err := checkFloat(args, 0, "atan")
+	if err != nil {
+		return nil, err
+	}
+	x := 1.0
+	if !isNil(arg(args, 1)) {
+		if x, err = checkFloat(args, 1, "atan"); err != nil {
+			return nil, err
+		}
+	}
+	return []types.Value{types.Float(math.Atan2(y, x))}, nil
+}
+
+// log(x [, base]) 默认返回自然对数
+func mathLog(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	x, err := checkFloat(args, 0, "log")
+	if err != nil {
+		return nil, err
+	}
+	if isNil(arg(args, 1)) {
+		return []types.Value{types.Float(math.Log(x))}, nil
+	}
+	base, err := checkFloat(args, 1, "log")
+	if err != nil {
+		return nil, err
+	}
+	var res float64
+	switch base {
+	case 2:
+		res = math.Log2(x)
+	case 10:
+		res = math.Log10(x)
+	default:
+		res = math.Log(x) / math.Log(base)
+	}
+	return []types.Value{types.Float(res)}, nil
+}
+
+// mathMinMax 返回参数中的最小值或者最大值, 保留参数原来的类型
+func mathMinMax(args []types.Value, fname string, want value.Comparison) ([]types.Value, error) {
+	res, err := checkNumber(args, 0, fname)
+	if err != nil {
+		return nil, err
+	}
+	for i := 1; i < len(args); i++ {
+		n, err := checkNumber(args, i, fname)
+		if err != nil {
+			return nil, err
+		}
+		if cmp, _ := types.Compare(n, res); cmp == want {
+			res = n
+		}
+	}
+	return []types.Value{res}, nil
+}
+
+func mathMax(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	return mathMinMax(args, "max", value.GreaterThan)
+}
+
+func mathMin(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	return mathMinMax(args, "min", value.LessThan)
+}
+
+// tointeger(x) 把 x 转换为整数, 不能转换时返回 nil
+func mathToInteger(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	if len(args) == 0 {
+		return nil, errArgument(1, "tointeger", "value expected")
+	}
+	if i, ok := args[0].ToInteger(); ok {
+		return []types.Value{i}, nil
+	}
+	return []types.Value{types.GetNil()}, nil
+}
+
+// type(x) 返回 integer, float 或者 nil
+func mathType(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	if len(args) == 0 {
+		return nil, errArgument(1, "type", "value expected")
+	}
+	switch args[0].(type) {
+	case types.Integer:
+		return []types.Value{types.String("integer")}, nil
+	case types.Float:
+		return []types.Value{types.String("float")}, nil
+	}
+	return []types.Value{types.GetNil()}, nil
+}
+
+// ult(m, n) 把 m 和 n 作为无符号整数比较
+func mathUlt(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	m, err := checkInteger(args, 0, "ult")
+	if err != nil {
+		return nil, err
+	}
+	n, err := checkInteger(args, 1, "ult")
+	if err != nil {
+		return nil, err
+	}
+	return []types.Value{types.Boolean(uint64(m) < uint64(n))}, nil
+}
+
+// rand 返回虚拟机的随机数生成器, 没有设置种子时使用当前时间
+func (vm *LuaVM) rand() *rand.Rand {
+	if vm.random == nil {
+		vm.random = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return vm.random
+}
+
+// SetRandomSeed 设置 math.random 的种子, 相同的种子产生相同的随机数序列
+func (vm *LuaVM) SetRandomSeed(seed int64) {
+	vm.random = rand.New(rand.NewSource(seed))
+}
+
+// random([m [, n]]) 没有参数时返回 [0, 1) 之间的浮点数, 否则返回 [m, n] 之间的整数
+func mathRandom(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	r := vm.rand()
+	var low, up int64
+	var err error
+	switch len(args) {
+	case 0:
+		return []types.Value{types.Float(r.Float64())}, nil
+	case 1:
+		low = 1
+		if up, err = checkInteger(args, 0, "random"); err != nil {
+			return nil, err
+		}
+	case 2:
+		if low, err = checkInteger(args, 0, "random"); err != nil {
+			return nil, err
+		}
+		if up, err = checkInteger(args, 1, "random"); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("wrong number of arguments")
+	}
+	if low > up {
+		return nil, errArgument(len(args), "random", "interval is empty")
+	}
+	if low < 0 && up > math.MaxInt64+low {
+		return nil, errArgument(1, "random", "interval too large")
+	}
+	if up-low == math.MaxInt64 {
+		return []types.Value{types.Integer(low + r.Int63())}, nil
+	}
+	return []types.Value{types.Integer(low + r.Int63n(up-low+1))}, nil
+}
+
+// randomseed([x]) 设置随机数种子, 没有参数时使用当前时间
+func mathRandomSeed(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	if len(args) == 0 {
+		vm.SetRandomSeed(time.Now().UnixNano())
+		return nil, nil
+	}
+	n, err := checkNumber(args, 0, "randomseed")
+	if err != nil {
+		return nil, err
+	}
+	seed, ok := n.(types.Integer)
+	if !ok {
+		f, _ := n.ToFloat()
+		seed = types.Integer(math.Float64bits(float64(f)))
+	}
+	vm.SetRandomSeed(int64(seed))
+	return nil, nil
+}
@@ -0,0 +1,81 @@
+package vm
+
+import (
+	"math"
+	"testing"
+
+	"github.com/Salpadding/lua/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMath(t *testing.T) {
+	var vm LuaVM
+	values, err := vm.DoString(`
+return math.floor(3.7), math.floor(-3.2), math.ceil(3.2), math.floor(5), math.floor(1e100),
+  math.abs(-3), math.abs(-2.5), math.max(1, 5.5, 3), math.min(4, 2, 9), math.max(2, 2.0),
+  math.fmod(7, 3), math.fmod(-7, 3), math.fmod(7.5, 2), math.sqrt(16), math.log(8, 2), math.log(100, 10),
+  math.tointeger(3.0), math.tointeger(3.5), math.tointeger("8"), math.type(1), math.type(1.0), math.type("1"),
+  math.ult(1, -1), math.maxinteger, math.mininteger, math.huge, math.pi, math.mininteger // -1
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{
+		types.Integer(3), types.Integer(-4), types.Integer(4), types.Integer(5), types.Float(1e100),
+		types.Integer(3), types.Float(2.5), types.Float(5.5), types.Integer(2), types.Integer(2),
+		types.Integer(1), types.Integer(-1), types.Float(1.5), types.Float(4), types.Float(3), types.Float(2),
+		types.Integer(3), types.GetNil(), types.Integer(8), types.String("integer"), types.String("float"), types.GetNil(),
+		types.Boolean(true), types.Integer(math.MaxInt64), types.Integer(math.MinInt64), types.Float(math.Inf(1)),
+		types.Float(math.Pi), types.Integer(math.MinInt64),
+	}, values)
+
+	values, err = vm.DoString("local a, b = math.modf(-2.5); return a, b, math.modf(4)")
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{types.Float(-2), types.Float(-0.5), types.Integer(4), types.Float(0)}, values)
+
+	_, err = vm.DoString("return math.fmod(1, 0)")
+	assert.Contains(t, err.Error(), "bad argument #2 to 'fmod' (zero)")
+	_, err = vm.DoString("return math.floor('x')")
+	assert.Contains(t, err.Error(), "bad argument #1 to 'floor' (number expected, got string)")
+	_, err = vm.DoString("return math.max()")
+	assert.Contains(t, err.Error(), "bad argument #1 to 'max' (number expected, got no value)")
+}
+
+func TestMathRandom(t *testing.T) {
+	var vm LuaVM
+	src := `
+math.randomseed(42)
+local r = {}
+for i = 1, 5 do r[i] = math.random(1, 100) end
+local f = math.random()
+return r[1], r[2], r[3], r[4], r[5], f, math.random(3)
+`
+	first, err := vm.DoString(src)
+	assert.NoError(t, err)
+	second, err := vm.DoString(src)
+	assert.NoError(t, err)
+	assert.Equal(t, first, second)
+	for _, v := range first[:5] {
+		i := v.(types.Integer)
+		assert.True(t, i >= 1 && i <= 100)
+	}
+	f := first[5].(types.Float)
+	assert.True(t, f >= 0 && f < 1)
+
+	vm.SetRandomSeed(7)
+	a, err := vm.DoString("return math.random(1000)")
+	assert.NoError(t, err)
+	vm.SetRandomSeed(7)
+	b, err := vm.DoString("return math.random(1000)")
+	assert.NoError(t, err)
+	assert.Equal(t, a, b)
+
+	values, err := vm.DoString("return math.random(math.mininteger, -1) < 0, math.random(0, math.maxinteger) >= 0")
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{types.Boolean(true), types.Boolean(true)}, values)
+
+	_, err = vm.DoString("return math.random(5, 1)")
+	assert.Contains(t, err.Error(), "interval is empty")
+	_, err = vm.DoString("return math.random(math.mininteger, math.maxinteger)")
+	assert.Contains(t, err.Error(), "interval too large")
+	_, err = vm.DoString("return math.random(1, 2, 3)")
+	assert.Contains(t, err.Error(), "wrong number of arguments")
+}
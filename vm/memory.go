@@ -0,0 +1,249 @@
+package vm
+
+import (
+	"bytes"
+
+	"github.com/Salpadding/lua/types"
+)
+
+// memoryTracker 记录脚本创建的表, 字符串和闭包使用的内存
+// 超过限制时先调用 collect 重新统计可达对象的内存, 不可达的对象不再计入
+type memoryTracker struct {
+	used    int64
+	limit   int64        // 小于等于 0 时不限制
+	collect func() int64 // 返回可达对象使用的内存
+	pending int64        // 正在生成的字符串使用的内存, 它们还不可达, 回收时仍然计入
+}
+
+// Alloc 记录分配的内存, 回收不可达的对象之后仍然超过限制时返回 not enough memory
+func (m *memoryTracker) Alloc(size int) error {
+	if m.limit > 0 && m.used+int64(size) > m.limit {
+		m.gc()
+	}
+	if m.limit > 0 && m.used+int64(size) > m.limit {
+		return errNotEnoughMemory
+	}
+	m.used += int64(size)
+	return nil
+}
+
+// gc 把使用的内存减少到可达对象使用的内存, 可达对象中包括没有经过 Alloc 的常量
+// 和标准库的字符串, 所以统计结果不会超过回收之前的值
+func (m *memoryTracker) gc() {
+	if m.collect == nil {
+		return
+	}
+	if live := m.collect() + m.pending; live < m.used {
+		m.used = live
+	}
+}
+
+// Free 记录释放的内存
+func (m *memoryTracker) Free(size int) {
+	if m.used -= int64(size); m.used < 0 {
+		m.used = 0
+	}
+}
+
+// SetMemoryLimit 设置脚本可以使用的内存, 单位是字节, n 小于等于 0 时不限制
+// 达到限制时先回收不可达的对象, 可达对象的内存仍然超过限制时才返回错误
+func (vm *LuaVM) SetMemoryLimit(n int64) {
+	vm.memory.limit = n
+}
+
+// MemoryUsed 返回脚本创建的表, 字符串和闭包当前占用的内存, 单位是字节
+// 等于上一次回收时可达对象的内存加上之后分配的内存, 内存达到限制时才会回收
+func (vm *LuaVM) MemoryUsed() int64 {
+	return vm.memory.used
+}
+
+// CollectGarbage 结束不可达的挂起协程, 不再统计不可达的对象, 返回回收后的 MemoryUsed
+func (vm *LuaVM) CollectGarbage() int64 {
+	vm.releaseCollected()
+	vm.memory.gc()
+	return vm.memory.used
+}
+
+// ResetMemoryUsed 把内存统计清零, 例如在执行每个请求之前调用
+func (vm *LuaVM) ResetMemoryUsed() {
+	vm.memory.used = 0
+}
+
+// liveMemory 从注册表, 元表和所有线程的调用栈开始遍历可达的表, 闭包和字符串,
+// 返回它们使用的内存. 本地函数内部保存的值无法遍历, 不计入统计
+func (vm *LuaVM) liveMemory() int64 {
+	w := memoryWalker{seen: map[interface{}]struct{}{}}
+	w.push(vm.registry)
+	for _, mt := range vm.metatables {
+		w.push(mt)
+	}
+	w.push(vm.hookFn)
+	w.state(&vm.mainState)
+	for co := range vm.coroutines {
+		w.coroutine(co)
+	}
+	w.walk()
+	return w.size
+}
+
+// memoryWalker 遍历可达的对象并累加它们使用的内存, 每个对象只统计一次
+type memoryWalker struct {
+	seen    map[interface{}]struct{}
+	pending []types.Value
+	size    int64
+}
+
+func (w *memoryWalker) push(v types.Value) {
+	switch x := v.(type) {
+	case nil:
+		return
+	case *types.Table:
+		if x == nil {
+			return
+		}
+	case types.String, *types.Function, *types.Thread:
+	default:
+		return
+	}
+	if _, ok := w.seen[v]; ok {
+		return
+	}
+	w.seen[v] = struct{}{}
+	w.pending = append(w.pending, v)
+}
+
+// state 遍历线程的调用栈中的寄存器, 可变参数和返回值
+func (w *memoryWalker) state(st *threadState) {
+	for _, f := range st.frames {
+		w.push(f.fn)
+		if f.Register != nil {
+			for _, v := range *f.Register {
+				w.push(v)
+			}
+		}
+		for _, v := range f.varArgs {
+			w.push(v)
+		}
+		for _, v := range f.returned {
+			w.push(v)
+		}
+	}
+}
+
+func (w *memoryWalker) coroutine(co *coroutine) {
+	w.push(co.fn)
+	w.state(&co.threadState)
+}
+
+func (w *memoryWalker) walk() {
+	for len(w.pending) > 0 {
+		v := w.pending[len(w.pending)-1]
+		w.pending = w.pending[:len(w.pending)-1]
+		switch x := v.(type) {
+		case types.String:
+			w.size += int64(types.StringSize + len(x))
+		case *types.Table:
+			// 注册表, 全局变量和标准库的表不计入内存统计, 它们的键也不计入
+			size := x.Size()
+			w.size += int64(size)
+			if mt := x.Metatable(); mt != nil {
+				w.push(mt)
+			}
+			x.Range(func(k, v types.Value) {
+				if size > 0 {
+					w.push(k)
+				}
+				w.push(v)
+			})
+		case *types.Function:
+			w.size += int64(types.ClosureSize + types.UpValueSize*len(x.UpValues))
+			for _, uv := range x.UpValues {
+				if uv != nil {
+					w.push(uv.Get())
+				}
+			}
+		case *types.Thread:
+			if co, ok := x.Coroutine.(*coroutine); ok {
+				w.coroutine(co)
+			}
+		}
+	}
+}
+
+// newTable 创建表, 表增长时记录使用的内存
+func (vm *LuaVM) newTable() (*types.Table, error) {
+	if err := vm.memory.Alloc(types.TableSize); err != nil {
+		return nil, err
+	}
+	t := types.NewTable()
+	t.SetAllocator(&vm.memory)
+	return t, nil
+}
+
+// stringResult 记录字符串使用的内存, 并把字符串作为本地函数的返回值
+func (vm *LuaVM) stringResult(s string) ([]types.Value, error) {
+	v, err := vm.newString(s)
+	if err != nil {
+		return nil, err
+	}
+	return []types.Value{v}, nil
+}
+
+// newString 记录字符串使用的内存并返回字符串
+func (vm *LuaVM) newString(s string) (types.Value, error) {
+	if err := vm.memory.Alloc(types.StringSize + len(s)); err != nil {
+		return nil, err
+	}
+	return types.String(s), nil
+}
+
+// stringBuilder 在生成字符串的过程中记录写入的内存, 并且每个字节消耗一个单位的 gas,
+// 达到限制时立即停止, 不会先生成整个字符串再检查. 生成失败时调用 release 退还已经记录的内存
+type stringBuilder struct {
+	vm   *LuaVM
+	buf  bytes.Buffer
+	used int // 已经记录的内存
+}
+
+func (b *stringBuilder) WriteString(s string) error {
+	if err := b.vm.charge(uint64(len(s))); err != nil {
+		return err
+	}
+	if err := b.vm.memory.Alloc(len(s)); err != nil {
+		return err
+	}
+	b.vm.memory.pending += int64(len(s))
+	b.used += len(s)
+	b.buf.WriteString(s)
+	return nil
+}
+
+func (b *stringBuilder) WriteByte(c byte) error {
+	if err := b.vm.charge(1); err != nil {
+		return err
+	}
+	if err := b.vm.memory.Alloc(1); err != nil {
+		return err
+	}
+	b.vm.memory.pending++
+	b.used++
+	b.buf.WriteByte(c)
+	return nil
+}
+
+// release 退还已经记录的内存, 生成成功之后调用没有作用
+func (b *stringBuilder) release() {
+	b.vm.memory.Free(b.used)
+	b.vm.memory.pending -= int64(b.used)
+	b.used = 0
+}
+
+// String 返回生成的字符串, 内容的内存已经在写入时记录, 这里只记录字符串本身
+func (b *stringBuilder) String() (types.String, error) {
+	if err := b.vm.memory.Alloc(types.StringSize); err != nil {
+		return "", err
+	}
+	b.vm.memory.pending -= int64(b.used)
+	b.used = 0
+	return types.String(b.buf.String()), nil
+}
@@ -0,0 +1,103 @@
+package vm
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/Salpadding/lua/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryUsed(t *testing.T) {
+	var vm LuaVM
+	_, err := vm.DoString("return 1")
+	assert.NoError(t, err)
+	vm.ResetMemoryUsed()
+
+	_, err = vm.DoString("local t = {} for i = 1, 100 do t[i] = i end")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(types.TableSize+100*types.ArrayEntrySize), vm.MemoryUsed())
+
+	vm.ResetMemoryUsed()
+	_, err = vm.DoString("local t = {a = 1, b = 2} t.a = nil")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(types.TableSize+types.MapEntrySize), vm.MemoryUsed())
+
+	vm.ResetMemoryUsed()
+	_, err = vm.DoString("local s = string.rep('ab', 50) local c = s .. 'x' .. 'y'")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2*types.StringSize+100+102), vm.MemoryUsed())
+}
+
+func TestMemoryLimit(t *testing.T) {
+	vm := New(WithMemoryLimit(64 * 1024))
+	for _, src := range []string{
+		"local t = {} for i = 1, 1e6 do t[i] = i end",
+		"local t = {} for i = 1, 1e6 do t['k' .. i] = true end",
+		"local s = 'x' while true do s = s .. s end",
+		"return string.rep('x', 1e9)",
+		"local fs = {} for i = 1, 1e6 do fs[i] = function() return i end end",
+		"return table.concat({string.rep('x', 30000), string.rep('y', 30000), string.rep('z', 30000)})",
+	} {
+		vm.ResetMemoryUsed()
+		_, err := vm.DoString(src)
+		assert.EqualError(t, err, "not enough memory", src)
+		assert.True(t, vm.MemoryUsed() <= 64*1024, src)
+	}
+
+	vm.ResetMemoryUsed()
+	values, err := vm.DoString("local ok, msg = pcall(string.rep, 'x', 1e9) return ok, msg")
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{types.Boolean(false), types.String("not enough memory")}, values)
+
+	vm.SetMemoryLimit(0)
+	_, err = vm.DoString("return string.rep('x', 1e6)")
+	assert.NoError(t, err)
+}
+
+func TestMemoryCollect(t *testing.T) {
+	// 不可达的对象不计入使用的内存, 循环中创建的临时对象不会用完内存
+	vm := New(WithMemoryLimit(1 << 20))
+	for _, src := range []string{
+		"for i = 1, 100000 do local s = 'x' .. i end",
+		"for i = 1, 100000 do local t = {} end",
+		"for i = 1, 100000 do local f = function() return i end end",
+	} {
+		_, err := vm.DoString(src)
+		assert.NoError(t, err, src)
+		assert.True(t, vm.MemoryUsed() <= 1<<20, src)
+	}
+
+	// 全局变量引用的表仍然计入
+	vm.ResetMemoryUsed()
+	_, err := vm.DoString("keep = {} for i = 1, 100 do keep[i] = i end local t = {} for i = 1, 100 do t[i] = i end")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2*(types.TableSize+100*types.ArrayEntrySize)), vm.MemoryUsed())
+	// 标准库中还有少量计入统计的字符串
+	live := vm.CollectGarbage()
+	assert.True(t, live >= types.TableSize+100*types.ArrayEntrySize && live < types.TableSize+100*types.ArrayEntrySize+64, live)
+
+	_, err = vm.DoString("local t = {} for i = 1, 1e6 do t[i] = 'x' .. i end")
+	assert.EqualError(t, err, "not enough memory")
+}
+
+func TestMemoryLimitWhileBuilding(t *testing.T) {
+	const limit = 1 << 20
+	for _, src := range []string{
+		`return pcall(string.gsub, string.rep("x", 1e4), ".", string.rep("y", 1e4))`,
+		`return pcall(string.gsub, string.rep("x", 1e5), ".", "%0%0%0%0%0%0%0%0%0%0%0%0%0%0%0%0%0%0%0%0")`,
+		`local t = {} for i = 1, 1e4 do t[i] = "x" end return pcall(table.concat, t, string.rep("-", 1e4))`,
+	} {
+		vm := New(WithMemoryLimit(limit))
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		values, err := vm.DoString(src)
+		runtime.ReadMemStats(&after)
+		assert.NoError(t, err, src)
+		assert.Equal(t, types.Boolean(false), values[0], src)
+		assert.Equal(t, types.String("not enough memory"), values[1], src)
+		// 生成的字符串在达到限制时停止增长, 不会先分配整个结果
+		assert.True(t, after.TotalAlloc-before.TotalAlloc < 16*limit, "%s allocated %d bytes", src, after.TotalAlloc-before.TotalAlloc)
+		assert.True(t, vm.MemoryUsed() <= limit, src)
+	}
+}
@@ -0,0 +1,403 @@
+package vm
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/Salpadding/lua/types"
+	"github.com/Salpadding/lua/types/value"
+)
+
+// maxTagLoop 限制 __index 和 __newindex 链的长度, 防止死循环
+const maxTagLoop = 2000
+
+// arithmeticEvents 是算术和位运算对应的元方法
+var arithmeticEvents = map[value.ArithmeticOperator]string{
+	value.Add:        "__add",
+	value.Sub:        "__sub",
+	value.Mul:        "__mul",
+	value.Mod:        "__mod",
+	value.Pow:        "__pow",
+	value.Div:        "__div",
+	value.IDiv:       "__idiv",
+	value.BitwiseAnd: "__band",
+	value.BitwiseOr:  "__bor",
+	value.BitwiseXor: "__bxor",
+	value.ShiftLeft:  "__shl",
+	value.ShiftRight: "__shr",
+	value.UnaryMinus: "__unm",
+	value.BitwiseNot: "__bnot",
+}
+
+func isBitwise(op value.ArithmeticOperator) bool {
+	switch op {
+	case value.BitwiseAnd, value.BitwiseOr, value.BitwiseXor, value.ShiftLeft, value.ShiftRight, value.BitwiseNot:
+		return true
+	}
+	return false
+}
+
+// getMetatable 返回值的元表, 字符串等非表类型的元表由虚拟机保存
+func (vm *LuaVM) getMetatable(v types.Value) *types.Table {
+	switch x := v.(type) {
+	case *types.Table:
+		return x.Metatable()
+	case *types.Userdata:
+		return x.Metatable()
+	}
+	return vm.metatables[v.Type()]
+}
+
+// metaField 返回元表中的字段, 没有时返回 nil
+func (vm *LuaVM) metaField(v types.Value, event string) types.Value {
+	mt := vm.getMetatable(v)
+	if mt == nil {
+		return types.GetNil()
+	}
+	res, err := mt.Get(types.String(event))
+	if err != nil {
+		return types.GetNil()
+	}
+	return res
+}
+
+// callMeta 调用元方法并返回第一个返回值
+func (vm *LuaVM) callMeta(fn types.Value, args ...types.Value) (types.Value, error) {
+	values, err := vm.Call(fn, args...)
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return types.GetNil(), nil
+	}
+	return values[0], nil
+}
+
+// binaryMeta 依次在两个操作数中查找元方法, 找到时返回 true
+func (vm *LuaVM) binaryMeta(event string, a, b types.Value) (types.Value, bool, error) {
+	h := vm.metaField(a, event)
+	if isNil(h) {
+		h = vm.metaField(b, event)
+	}
+	if isNil(h) {
+		return nil, false, nil
+	}
+	v, err := vm.callMeta(h, a, b)
+	return v, true, err
+}
+
+func isNil(v types.Value) bool {
+	return v == nil || v.Type() == value.Nil
+}
+
+// typeName 返回错误信息中使用的类型名, 元表中有 __name 字段时使用 __name
+func (vm *LuaVM) typeName(v types.Value) string {
+	switch v.(type) {
+	case *types.Table, *types.Userdata:
+		if name, ok := vm.metaField(v, "__name").(types.String); ok {
+			return string(name)
+		}
+	}
+	return v.Type().String()
+}
+
+// arith 执行算术或者位运算, 操作数不是数字时调用元方法, 一元运算的两个操作数相同
+func (vm *LuaVM) arith(op value.ArithmeticOperator, a, b types.Value) (types.Value, error) {
+	var (
+		v  types.Value
+		ok bool
+	)
+	x, y := numberOperand(a), numberOperand(b)
+	if err := checkDivisor(op, x, y); err != nil {
+		return nil, err
+	}
+	if fn, isUnary := unaryOperators[op]; isUnary {
+		v, ok = fn(x)
+	} else {
+		v, ok = binaryOperators[op](x, y)
+	}
+	if ok {
+		return v, nil
+	}
+	v, ok, err := vm.binaryMeta(arithmeticEvents[op], a, b)
+	if err != nil || ok {
+		return v, err
+	}
+	bad, operand := b, 1
+	if _, isNumber := a.ToNumber(); !isNumber {
+		bad, operand = a, 0
+	}
+	if isBitwise(op) {
+		_, aNum := a.ToNumber()
+		_, bNum := b.ToNumber()
+		if aNum && bNum {
+			return nil, errNoIntegerRepresentation
+		}
+		return nil, errBitwise(vm.typeName(bad), operand)
+	}
+	return nil, errArithmetic(vm.typeName(bad), operand)
+}
+
+// checkDivisor 检查整数除法和取模的除数, 除数为 0 时返回错误
+func checkDivisor(op value.ArithmeticOperator, x, y types.Value) error {
+	if op != value.IDiv && op != value.Mod {
+		return nil
+	}
+	_, xInt := x.(types.Integer)
+	if d, ok := y.(types.Integer); !xInt || !ok || d != 0 {
+		return nil
+	}
+	if op == value.IDiv {
+		return errIntegerDivideByZero
+	}
+	return errIntegerModByZero
+}
+
+// numberOperand 把可以转换为数字的字符串转换为整数或者浮点数
+func numberOperand(v types.Value) types.Value {
+	if s, ok := v.(types.String); ok {
+		if n, ok := s.ToNumber(); ok {
+			return n
+		}
+	}
+	return v
+}
+
+// index 执行 t[k], 支持 __index 元方法
+func (vm *LuaVM) index(t, k types.Value) (types.Value, error) {
+	for i := 0; i < maxTagLoop; i++ {
+		var h types.Value
+		if tb, ok := t.(*types.Table); ok {
+			v, err := tb.Get(k)
+			if err != nil {
+				return nil, err
+			}
+			if !isNil(v) {
+				return v, nil
+			}
+			if h = vm.metaField(t, "__index"); isNil(h) {
+				return types.GetNil(), nil
+			}
+		} else if h = vm.metaField(t, "__index"); isNil(h) {
+			return nil, errIndex(vm.typeName(t))
+		}
+		if h.Type() == value.Function {
+			return vm.callMeta(h, t, k)
+		}
+		t = h
+	}
+	return nil, errLoop("__index")
+}
+
+// setIndex 执行 t[k] = v, 支持 __newindex 元方法
+func (vm *LuaVM) setIndex(t, k, v types.Value) error {
+	for i := 0; i < maxTagLoop; i++ {
+		var h types.Value
+		if tb, ok := t.(*types.Table); ok {
+			old, err := tb.Get(k)
+			if err != nil {
+				return err
+			}
+			if !isNil(old) {
+				return tb.Set(k, v)
+			}
+			if h = vm.metaField(t, "__newindex"); isNil(h) {
+				if isNil(k) {
+					return errNilIndex
+				}
+				return tb.Set(k, v)
+			}
+		} else if h = vm.metaField(t, "__newindex"); isNil(h) {
+			return errIndex(vm.typeName(t))
+		}
+		if h.Type() == value.Function {
+			_, err := vm.Call(h, t, k, v)
+			return err
+		}
+		t = h
+	}
+	return errLoop("__newindex")
+}
+
+// equal 比较两个值是否相等, 两个不同的表比较时调用 __eq
+func (vm *LuaVM) equal(a, b types.Value) (bool, error) {
+	cmp, _ := types.Equal(a, b)
+	if cmp == value.Equal {
+		return true, nil
+	}
+	_, ok1 := a.(*types.Table)
+	_, ok2 := b.(*types.Table)
+	if !ok1 || !ok2 {
+		return false, nil
+	}
+	v, ok, err := vm.binaryMeta("__eq", a, b)
+	if err != nil || !ok {
+		return false, err
+	}
+	return bool(v.ToBoolean()), nil
+}
+
+// lessThan 计算 a < b, 不是数字或者字符串时调用 __lt
+func (vm *LuaVM) lessThan(a, b types.Value) (bool, error) {
+	if cmp, ok := types.Compare(a, b); ok {
+		return cmp == value.LessThan, nil
+	}
+	v, ok, err := vm.binaryMeta("__lt", a, b)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		return false, vm.compareError(a, b)
+	}
+	return bool(v.ToBoolean()), nil
+}
+
+// lessEqual 计算 a <= b, 没有 __le 时用 not (b < a) 代替
+func (vm *LuaVM) lessEqual(a, b types.Value) (bool, error) {
+	if cmp, ok := types.Compare(a, b); ok {
+		return cmp&value.LessThanOrEqual != 0, nil
+	}
+	v, ok, err := vm.binaryMeta("__le", a, b)
+	if err != nil {
+		return false, err
+	}
+	if ok {
+		return bool(v.ToBoolean()), nil
+	}
+	v, ok, err = vm.binaryMeta("__lt", b, a)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		return false, vm.compareError(a, b)
+	}
+	return !bool(v.ToBoolean()), nil
+}
+
+func (vm *LuaVM) compareError(a, b types.Value) error {
+	t1, t2 := vm.typeName(a), vm.typeName(b)
+	if t1 == t2 {
+		return fmt.Errorf("attempt to compare two %s values", t1)
+	}
+	return fmt.Errorf("attempt to compare %s with %s", t1, t2)
+}
+
+// concat 从右向左连接多个值, 不是字符串或者数字时调用 __concat
+func (vm *LuaVM) concat(values []types.Value) (types.Value, error) {
+	if len(values) == 0 {
+		return types.String(""), nil
+	}
+	res := values[len(values)-1]
+	for i := len(values) - 2; i >= 0; i-- {
+		a := values[i]
+		s1, ok1 := toConcatString(a)
+		s2, ok2 := toConcatString(res)
+		if ok1 && ok2 {
+			var buf bytes.Buffer
+			buf.WriteString(s1)
+			buf.WriteString(s2)
+			res = types.String(buf.String())
+			continue
+		}
+		v, ok, err := vm.binaryMeta("__concat", a, res)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			bad, operand := a, i
+			if ok1 {
+				bad, operand = res, i+1
+			}
+			return nil, errConcat(vm.typeName(bad), operand)
+		}
+		res = v
+	}
+	if s, ok := res.(types.String); ok && len(values) > 1 {
+		return vm.newString(string(s))
+	}
+	return res, nil
+}
+
+func toConcatString(v types.Value) (string, bool) {
+	switch x := v.(type) {
+	case types.String:
+		return string(x), true
+	case types.Integer, types.Float:
+		return numberToString(x), true
+	}
+	return "", false
+}
+
+// length 计算 #v, 支持 __len 元方法
+func (vm *LuaVM) length(v types.Value) (types.Value, error) {
+	if s, ok := v.(types.String); ok {
+		return types.Integer(len(s)), nil
+	}
+	if h := vm.metaField(v, "__len"); !isNil(h) {
+		return vm.callMeta(h, v)
+	}
+	if tb, ok := v.(*types.Table); ok {
+		return types.Integer(tb.Len()), nil
+	}
+	return nil, errLength(vm.typeName(v))
+}
+
+// toString 把值转换为字符串, 支持 __tostring 和 __name
+func (vm *LuaVM) toString(v types.Value) (string, error) {
+	if h := vm.metaField(v, "__tostring"); !isNil(h) {
+		res, err := vm.callMeta(h, v)
+		if err != nil {
+			return "", err
+		}
+		s, ok := res.(types.String)
+		if !ok {
+			return "", errToStringResult
+		}
+		return string(s), nil
+	}
+	switch x := v.(type) {
+	case *types.Nil, *types.None:
+		return "nil", nil
+	case types.Boolean:
+		return x.String(), nil
+	case types.String:
+		return string(x), nil
+	case types.Integer, types.Float:
+		return numberToString(x), nil
+	case *types.Table, *types.Userdata:
+		return fmt.Sprintf("%s: %p", vm.typeName(x), x), nil
+	case types.LightUserdata:
+		return fmt.Sprintf("userdata: %p", x.Pointer), nil
+	case *types.Function:
+		return fmt.Sprintf("function: %p", x), nil
+	case types.Native:
+		return fmt.Sprintf("function: builtin: %p", x), nil
+	}
+	return fmt.Sprintf("%s: %p", v.Type(), v), nil
+}
+
+// numberToString 按照 lua 的格式把数字转换为字符串, 浮点数总是带有小数点或者指数
+func numberToString(v types.Value) string {
+	switch x := v.(type) {
+	case types.Integer:
+		return x.String()
+	case types.Float:
+		s := fmt.Sprintf("%.14g", float64(x))
+		if s == "+Inf" || s == "Inf" {
+			return "inf"
+		}
+		if s == "-Inf" {
+			return "-inf"
+		}
+		if s == "NaN" {
+			return "nan"
+		}
+		for _, c := range s {
+			if c == '.' || c == 'e' || c == 'n' || c == 'i' {
+				return s
+			}
+		}
+		return s + ".0"
+	}
+	return v.String()
+}
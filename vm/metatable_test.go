@@ -0,0 +1,93 @@
+package vm
+
+import (
+	"testing"
+
+	"github.com/Salpadding/lua/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIndexMeta(t *testing.T) {
+	var vm LuaVM
+	values, err := vm.DoString(`
+local Point = {}
+Point.__index = Point
+function Point.new(x, y) return setmetatable({x = x, y = y}, Point) end
+function Point:sum() return self.x + self.y end
+local defaults = setmetatable({}, {__index = function(t, k) return k .. "!" end})
+local log = {}
+local proxy = setmetatable({}, {__newindex = function(t, k, v) log[#log + 1] = k end})
+proxy.a = 1
+proxy.b = 2
+return Point.new(3, 4):sum(), defaults.foo, #log, proxy.a == nil, getmetatable(Point.new(1, 2)) == Point
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{types.Integer(7), types.String("foo!"), types.Integer(2), types.Boolean(true), types.Boolean(true)}, values)
+}
+
+func TestArithmeticMeta(t *testing.T) {
+	var vm LuaVM
+	values, err := vm.DoString(`
+local V = {}
+V.__add = function(a, b) return setmetatable({n = a.n + b.n}, V) end
+V.__unm = function(a) return setmetatable({n = -a.n}, V) end
+V.__band = function(a, b) return "band" end
+V.__concat = function(a, b)
+  if getmetatable(a) == V then a = a.n end
+  if getmetatable(b) == V then b = b.n end
+  return a .. "|" .. b
+end
+V.__len = function(a) return a.n * 10 end
+V.__eq = function(a, b) return a.n == b.n end
+V.__lt = function(a, b) return a.n < b.n end
+V.__le = function(a, b) return a.n <= b.n end
+V.__call = function(self, x) return self.n + x end
+V.__tostring = function(a) return "V(" .. a.n .. ")" end
+local a, b = setmetatable({n = 1}, V), setmetatable({n = 2}, V)
+local c = a + b
+return c.n, (-a).n, a & 1, "x" .. a .. b, #b, a == setmetatable({n = 1}, V), a < b, b <= a, a(5)
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{
+		types.Integer(3), types.Integer(-1), types.String("band"), types.String("x1|2"),
+		types.Integer(20), types.Boolean(true), types.Boolean(true), types.Boolean(false), types.Integer(6),
+	}, values)
+}
+
+func TestToString(t *testing.T) {
+	var vm LuaVM
+	_, err := vm.DoString("x = setmetatable({}, {__tostring = function() return 'point' end})")
+	assert.NoError(t, err)
+	v, err := vm.global.Get(types.String("x"))
+	assert.NoError(t, err)
+	s, err := vm.toString(v)
+	assert.NoError(t, err)
+	assert.Equal(t, "point", s)
+
+	_, err = vm.DoString("y = setmetatable({}, {__name = 'MyType'})")
+	assert.NoError(t, err)
+	v, _ = vm.global.Get(types.String("y"))
+	s, err = vm.toString(v)
+	assert.NoError(t, err)
+	assert.Regexp(t, "^MyType: 0x", s)
+
+	_, err = vm.DoString("return y + 1")
+	assert.EqualError(t, err, `[string "return y + 1"]:1: attempt to perform arithmetic on a MyType value (global 'y')`)
+	_, err = vm.DoString("return {} < {}")
+	assert.EqualError(t, err, `[string "return {} < {}"]:1: attempt to compare two table values`)
+	_, err = vm.DoString("return nil .. 'a'")
+	assert.EqualError(t, err, `[string "return nil .. 'a'"]:1: attempt to concatenate a nil value`)
+	_, err = vm.DoString("local t = nil; return t.x")
+	assert.EqualError(t, err, `[string "local t = nil; return t.x"]:1: attempt to index a nil value (local 't')`)
+	_, err = vm.DoString("local t = {}; t()")
+	assert.EqualError(t, err, `[string "local t = {}; t()"]:1: attempt to call a table value (local 't')`)
+}
+
+func TestProtectedMetatable(t *testing.T) {
+	var vm LuaVM
+	values, err := vm.DoString("local t = setmetatable({}, {__metatable = 'locked'})\nreturn getmetatable(t)")
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{types.String("locked")}, values)
+	_, err = vm.DoString("local t = setmetatable({}, {__metatable = 'locked'})\nsetmetatable(t, {})")
+	assert.Error(t, err)
+}
@@ -0,0 +1,116 @@
+package vm
+
+import "io"
+
+// Lib 是标准库的集合, 用于选择注册到全局环境中的库
+type Lib uint
+
+const (
+	LibBase Lib = 1 << iota // 基础函数, 例如 print, pcall, load
+	LibCoroutine
+	LibString
+	LibTable
+	LibMath
+	LibOS
+	LibIO
+	LibDebug
+
+	// LibSafe 是运行不可信代码时使用的库, 不能访问文件和操作系统, 也没有 debug 库
+	LibSafe = LibBase | LibCoroutine | LibString | LibTable | LibMath
+	// LibAll 包含所有的标准库
+	LibAll = LibSafe | LibOS | LibIO | LibDebug
+)
+
+// libOpeners 按照顺序打开标准库, 基础函数最先注册
+var libOpeners = []struct {
+	lib  Lib
+	open func(vm *LuaVM) error
+}{
+	{LibBase, (*LuaVM).openBase},
+	{LibCoroutine, func(vm *LuaVM) error {
+		_, err := vm.openLib("coroutine", coroutineFunctions)
+		return err
+	}},
+	{LibString, (*LuaVM).openString},
+	{LibTable, func(vm *LuaVM) error {
+		_, err := vm.openLib("table", tableFunctions)
+		return err
+	}},
+	{LibMath, (*LuaVM).openMath},
+	{LibOS, (*LuaVM).openOS},
+	{LibIO, (*LuaVM).openIO},
+	{LibDebug, (*LuaVM).openDebug},
+}
+
+// Option 是创建虚拟机时的选项
+type Option func(vm *LuaVM)
+
+// New 创建虚拟机, 没有选择标准库时打开所有的标准库
+func New(options ...Option) *LuaVM {
+	vm := &LuaVM{}
+	for _, option := range options {
+		option(vm)
+	}
+	return vm
+}
+
+// WithLibs 只打开 libs 中的标准库
+func WithLibs(libs Lib) Option {
+	return func(vm *LuaVM) {
+		vm.libs, vm.libsSet = libs, true
+	}
+}
+
+// Safe 是运行不可信代码的预设, 只打开 LibSafe 中的库, 并且不能加载二进制代码块.
+// 全局变量只有 _G, _VERSION, coroutine, string, table, math 和除了 dofile, loadfile 以外的基础函数
+func Safe() Option {
+	return func(vm *LuaVM) {
+		vm.libs, vm.libsSet = LibSafe, true
+		vm.safe = true
+	}
+}
+
+// WithMemoryLimit 设置脚本可以使用的内存, 单位是字节, 达到限制时不可达的对象不再计入
+func WithMemoryLimit(n int64) Option {
+	return func(vm *LuaVM) {
+		vm.memory.limit = n
+	}
+}
+
+// WithProcessExit 让 os.exit 直接结束宿主进程, 默认 os.exit 返回 ExitError
+func WithProcessExit() Option {
+	return func(vm *LuaVM) {
+		vm.processExit = true
+	}
+}
+
+// WithStdout 设置 print 和 io 库使用的标准输出
+func WithStdout(w io.Writer) Option {
+	return func(vm *LuaVM) {
+		vm.stdout = w
+	}
+}
+
+// WithStdin 设置 io 库使用的标准输入
+func WithStdin(r io.Reader) Option {
+	return func(vm *LuaVM) {
+		vm.stdin = r
+	}
+}
+
+// openLibs 打开选择的标准库, 零值的虚拟机打开所有的标准库
+func (vm *LuaVM) openLibs() error {
+	libs := vm.libs
+	if !vm.libsSet {
+		libs = LibAll
+	}
+	for _, opener := range libOpeners {
+		if libs&opener.lib == 0 {
+			continue
+		}
+		if err := opener.open(vm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
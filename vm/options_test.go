@@ -0,0 +1,107 @@
+package vm
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/Salpadding/lua/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLibOptions(t *testing.T) {
+	var all LuaVM
+	values, err := all.DoString("return type(io), type(os), type(debug), type(string), type(dofile)")
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{
+		types.String("table"), types.String("table"), types.String("table"), types.String("table"), types.String("function"),
+	}, values)
+
+	vm := New(WithLibs(LibBase | LibMath))
+	values, err = vm.DoString("return type(print), type(math), string, table, coroutine, io")
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{
+		types.String("function"), types.String("table"), types.GetNil(), types.GetNil(), types.GetNil(), types.GetNil(),
+	}, values)
+
+	vm = New(WithLibs(LibString))
+	_, err = vm.DoString("print('x')")
+	assert.Contains(t, err.Error(), "attempt to call a nil value (global 'print')")
+	values, err = vm.DoString("return ('abc'):upper()")
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{types.String("ABC")}, values)
+}
+
+func TestSafe(t *testing.T) {
+	var out bytes.Buffer
+	vm := New(Safe(), WithStdout(&out))
+	values, err := vm.DoString(`
+print("hello", 1)
+return io, os, debug, dofile, loadfile, type(load), type(string.format)
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{
+		types.GetNil(), types.GetNil(), types.GetNil(), types.GetNil(), types.GetNil(),
+		types.String("function"), types.String("function"),
+	}, values)
+	assert.Equal(t, "hello\t1\n", out.String())
+
+	values, err = vm.DoString(`return load("return 1 + 1")()`)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{types.Integer(2)}, values)
+
+	chunk, err := ioutil.ReadFile("testdata/test1.o")
+	assert.NoError(t, err)
+	for _, v := range []*LuaVM{vm, New()} {
+		_, err = v.DoString("function loadBinary(s) return load(s, 'bin', 't') end")
+		assert.NoError(t, err)
+		fn, err := v.DoString("return loadBinary")
+		assert.NoError(t, err)
+		values, err = v.Call(fn[0], types.String(chunk))
+		assert.NoError(t, err)
+		assert.Equal(t, []types.Value{types.GetNil(), types.String("attempt to load a binary chunk (mode is 't')")}, values)
+	}
+
+	_, err = vm.DoString(string(chunk))
+	assert.EqualError(t, err, "attempt to load a binary chunk (mode is 't')")
+	_, err = New().LoadString(string(chunk))
+	assert.NoError(t, err)
+}
+
+func TestSafeGlobals(t *testing.T) {
+	vm := New(Safe())
+	values, err := vm.DoString(`
+local names = {}
+for k in pairs(_G) do names[#names + 1] = k end
+table.sort(names)
+return table.concat(names, " ")
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{types.String("_G _VERSION assert collectgarbage coroutine error getmetatable " +
+		"ipairs load math next pairs pcall print rawequal rawget rawlen rawset select setmetatable string " +
+		"table tonumber tostring type xpcall")}, values)
+}
+
+func TestLoad(t *testing.T) {
+	var vm LuaVM
+	values, err := vm.DoString(`
+local parts = {"return ", "x ", "+ 1"}
+local i = 0
+local f = load(function() i = i + 1; return parts[i] end, "=parts", "t", {x = 41})
+local g, msg = load("return +", "=bad")
+local h = load("y = 5; return y", "chunk", "bt", {})
+return f(), g, type(msg), h(), y
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{
+		types.Integer(42), types.GetNil(), types.String("string"), types.Integer(5), types.GetNil(),
+	}, values)
+
+	values, err = vm.DoString(`return load("return 1", "=t", "b")`)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{types.GetNil(), types.String("attempt to load a text chunk (mode is 'b')")}, values)
+
+	values, err = vm.DoString(`return dofile("testdata/nothere.lua")`)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "cannot open testdata/nothere.lua")
+}
@@ -0,0 +1,325 @@
+package vm
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Salpadding/lua/types"
+)
+
+var osFunctions = map[string]nativeFunction{
+	"clock":    osClock,
+	"time":     osTime,
+	"date":     osDate,
+	"difftime": osDiffTime,
+	"getenv":   osGetenv,
+	"remove":   osRemove,
+	"rename":   osRename,
+	"tmpname":  osTmpName,
+	"exit":     osExit,
+}
+
+// startTime 是 os.clock 的起点
+var startTime = time.Now()
+
+func (vm *LuaVM) openOS() error {
+	_, err := vm.openLib("os", osFunctions)
+	return err
+}
+
+// fileError 返回文件操作的错误信息和错误码, 错误信息不包含操作和文件名
+func fileError(err error) (string, int) {
+	switch e := err.(type) {
+	case *os.PathError:
+		err = e.Err
+	case *os.LinkError:
+		err = e.Err
+	}
+	if n, ok := err.(syscall.Errno); ok {
+		return err.Error(), int(n)
+	}
+	return err.Error(), 0
+}
+
+// fileResult 把文件操作的结果转换为 lua 的返回值, 失败时返回 nil, 错误信息和错误码
+func fileResult(err error, filename string) []types.Value {
+	if err == nil {
+		return []types.Value{types.Boolean(true)}
+	}
+	msg, errno := fileError(err)
+	if filename != "" {
+		msg = filename + ": " + msg
+	}
+	return []types.Value{types.GetNil(), types.String(msg), types.Integer(errno)}
+}
+
+// clock() 返回程序使用的时间, 单位是秒
+func osClock(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	return []types.Value{types.Float(time.Since(startTime).Seconds())}, nil
+}
+
+// dateField 读取日期表中的字段, def 小于 0 时字段是必须的
+func dateField(tb *types.Table, key string, def int64) (int, error) {
+	v, err := tb.Get(types.String(key))
+	if err != nil {
+		return 0, err
+	}
+	if isNil(v) {
+		if def < 0 {
+			return 0, fmt.Errorf("field '%s' missing in date table", key)
+		}
+		return int(def), nil
+	}
+	n, ok := v.ToInteger()
+	if !ok {
+		return 0, fmt.Errorf("field '%s' is not an integer", key)
+	}
+	return int(n), nil
+}
+
+// time([t]) 返回当前时间, 或者日期表表示的时间
+func osTime(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	if isNil(arg(args, 0)) {
+		return []types.Value{types.Integer(time.Now().Unix())}, nil
+	}
+	tb, err := checkTable(args, 0, "time")
+	if err != nil {
+		return nil, err
+	}
+	var fields [6]int
+	for i, f := range []struct {
+		key string
+		def int64
+	}{{"year", -1}, {"month", -1}, {"day", -1}, {"hour", 12}, {"min", 0}, {"sec", 0}} {
+		if fields[i], err = dateField(tb, f.key, f.def); err != nil {
+			return nil, err
+		}
+	}
+	t := time.Date(fields[0], time.Month(fields[1]), fields[2], fields[3], fields[4], fields[5], 0, time.Local)
+	return []types.Value{types.Integer(t.Unix())}, nil
+}
+
+// dateTable 把时间转换为日期表
+func dateTable(t time.Time) (*types.Table, error) {
+	tb := types.NewTable()
+	fields := map[string]types.Value{
+		"year":  types.Integer(t.Year()),
+		"month": types.Integer(t.Month()),
+		"day":   types.Integer(t.Day()),
+		"hour":  types.Integer(t.Hour()),
+		"min":   types.Integer(t.Minute()),
+		"sec":   types.Integer(t.Second()),
+		"wday":  types.Integer(t.Weekday() + 1),
+		"yday":  types.Integer(t.YearDay()),
+		"isdst": types.Boolean(false),
+	}
+	for k, v := range fields {
+		if err := tb.Set(types.String(k), v); err != nil {
+			return nil, err
+		}
+	}
+	return tb, nil
+}
+
+// strftime 按照 C 语言 strftime 的格式转换时间
+func strftime(format string, t time.Time) (string, error) {
+	var buf strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			buf.WriteByte(format[i])
+			continue
+		}
+		if i++; i >= len(format) {
+			return "", fmt.Errorf("invalid conversion specifier '%%'")
+		}
+		switch c := format[i]; c {
+		case 'a':
+			buf.WriteString(t.Format("Mon"))
+		case 'A':
+			buf.WriteString(t.Format("Monday"))
+		case 'b', 'h':
+			buf.WriteString(t.Format("Jan"))
+		case 'B':
+			buf.WriteString(t.Format("January"))
+		case 'c':
+			buf.WriteString(t.Format("Mon Jan  2 15:04:05 2006"))
+		case 'd':
+			buf.WriteString(t.Format("02"))
+		case 'D', 'x':
+			buf.WriteString(t.Format("01/02/06"))
+		case 'e':
+			buf.WriteString(t.Format("_2"))
+		case 'F':
+			buf.WriteString(t.Format("2006-01-02"))
+		case 'H':
+			buf.WriteString(t.Format("15"))
+		case 'I':
+			buf.WriteString(t.Format("03"))
+		case 'j':
+			fmt.Fprintf(&buf, "%03d", t.YearDay())
+		case 'm':
+			buf.WriteString(t.Format("01"))
+		case 'M':
+			buf.WriteString(t.Format("04"))
+		case 'n':
+			buf.WriteByte('\n')
+		case 'p':
+			buf.WriteString(t.Format("PM"))
+		case 'R':
+			buf.WriteString(t.Format("15:04"))
+		case 'S':
+			buf.WriteString(t.Format("05"))
+		case 't':
+			buf.WriteByte('\t')
+		case 'T', 'X':
+			buf.WriteString(t.Format("15:04:05"))
+		case 'u':
+			wd := int(t.Weekday())
+			if wd == 0 {
+				wd = 7
+			}
+			fmt.Fprintf(&buf, "%d", wd)
+		case 'w':
+			fmt.Fprintf(&buf, "%d", t.Weekday())
+		case 'y':
+			buf.WriteString(t.Format("06"))
+		case 'Y':
+			buf.WriteString(t.Format("2006"))
+		case 'z':
+			buf.WriteString(t.Format("-0700"))
+		case 'Z':
+			buf.WriteString(t.Format("MST"))
+		case '%':
+			buf.WriteByte('%')
+		default:
+			return "", fmt.Errorf("invalid conversion specifier '%%%c'", c)
+		}
+	}
+	return buf.String(), nil
+}
+
+// date([format [, time]]) 格式化时间, 格式以 ! 开头时使用 UTC, *t 返回日期表
+func osDate(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	format, err := optString(args, 0, "date", "%c")
+	if err != nil {
+		return nil, err
+	}
+	t := time.Now()
+	if !isNil(arg(args, 1)) {
+		sec, err := checkInteger(args, 1, "date")
+		if err != nil {
+			return nil, err
+		}
+		t = time.Unix(sec, 0)
+	}
+	if strings.HasPrefix(format, "!") {
+		format, t = format[1:], t.UTC()
+	}
+	if strings.HasPrefix(format, "*t") {
+		tb, err := dateTable(t)
+		if err != nil {
+			return nil, err
+		}
+		return []types.Value{tb}, nil
+	}
+	s, err := strftime(format, t)
+	if err != nil {
+		return nil, errArgument(1, "date", err.Error())
+	}
+	return []types.Value{types.String(s)}, nil
+}
+
+// difftime(t2, t1) 返回两个时间相差的秒数
+func osDiffTime(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	t2, err := checkInteger(args, 0, "difftime")
+	if err != nil {
+		return nil, err
+	}
+	t1, err := optInteger(args, 1, "difftime", 0)
+	if err != nil {
+		return nil, err
+	}
+	return []types.Value{types.Float(float64(t2 - t1))}, nil
+}
+
+// getenv(name) 返回环境变量, 不存在时返回 nil
+func osGetenv(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	name, err := checkString(args, 0, "getenv")
+	if err != nil {
+		return nil, err
+	}
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return []types.Value{types.GetNil()}, nil
+	}
+	return []types.Value{types.String(v)}, nil
+}
+
+// remove(filename) 删除文件或者空目录
+func osRemove(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	name, err := checkString(args, 0, "remove")
+	if err != nil {
+		return nil, err
+	}
+	return fileResult(os.Remove(name), name), nil
+}
+
+// rename(oldname, newname) 重命名文件或者目录
+func osRename(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	from, err := checkString(args, 0, "rename")
+	if err != nil {
+		return nil, err
+	}
+	to, err := checkString(args, 1, "rename")
+	if err != nil {
+		return nil, err
+	}
+	return fileResult(os.Rename(from, to), from), nil
+}
+
+// tmpname() 返回可以用作临时文件的文件名
+func osTmpName(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	f, err := ioutil.TempFile("", "lua_")
+	if err != nil {
+		return nil, fmt.Errorf("unable to generate a unique filename")
+	}
+	f.Close()
+	return []types.Value{types.String(f.Name())}, nil
+}
+
+// ExitError 是 os.exit 返回的错误, 不能被 pcall 捕获, 调用栈展开后返回给宿主程序,
+// 待关闭变量的 __close 元方法不会被调用
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.Code)
+}
+
+// exit([code]) 结束程序, code 为 true 或者省略时表示成功
+// 只有使用 WithProcessExit 选项时才结束宿主进程, 否则返回 ExitError
+func osExit(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	code := 0
+	switch x := arg(args, 0).(type) {
+	case *types.Nil, *types.None:
+	case types.Boolean:
+		if !x {
+			code = 1
+		}
+	default:
+		n, err := optInteger(args, 0, "exit", 0)
+		if err != nil {
+			return nil, err
+		}
+		code = int(n)
+	}
+	if vm.processExit {
+		os.Exit(code)
+	}
+	return nil, &ExitError{Code: code}
+}
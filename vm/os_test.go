@@ -0,0 +1,55 @@
+package vm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Salpadding/lua/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOSTime(t *testing.T) {
+	var vm LuaVM
+	values, err := vm.DoString(`
+local t = os.time({year = 2020, month = 2, day = 29, hour = 13, min = 5, sec = 9})
+local d = os.date("*t", t)
+return t, os.date("%Y-%m-%d %H:%M:%S %j %%", t), d.year, d.month, d.day, d.wday, d.yday,
+  os.difftime(t + 60, t), type(os.clock()), type(os.time())
+`)
+	assert.NoError(t, err)
+	ts := time.Date(2020, 2, 29, 13, 5, 9, 0, time.Local).Unix()
+	assert.Equal(t, []types.Value{
+		types.Integer(ts), types.String("2020-02-29 13:05:09 060 %"), types.Integer(2020), types.Integer(2),
+		types.Integer(29), types.Integer(7), types.Integer(60), types.Float(60), types.String("number"), types.String("number"),
+	}, values)
+
+	values, err = vm.DoString(`return os.date("!%H:%M", 3600 * 5 + 60), os.getenv("LUA_SURELY_NOT_SET")`)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{types.String("05:01"), types.GetNil()}, values)
+
+	_, err = vm.DoString(`os.time({year = 2020})`)
+	assert.Contains(t, err.Error(), "field 'month' missing in date table")
+	_, err = vm.DoString(`os.date("%Q")`)
+	assert.Contains(t, err.Error(), "bad argument #1 to 'date' (invalid conversion specifier '%Q')")
+}
+
+func TestOSExit(t *testing.T) {
+	var vm LuaVM
+	for _, c := range []struct {
+		src  string
+		code int
+	}{
+		{"os.exit()", 0},
+		{"os.exit(false)", 1},
+		{"os.exit(3)", 3},
+		{"pcall(os.exit, 4) return 1", 4},
+		{"coroutine.wrap(function() os.exit(5) end)() return 1", 5},
+		{"coroutine.resume(coroutine.create(function() os.exit(6) end)) return 1", 6},
+	} {
+		_, err := vm.DoString(c.src)
+		assert.Equal(t, &ExitError{Code: c.code}, err, c.src)
+	}
+	values, err := vm.DoString("return 'still usable'")
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{types.String("still usable")}, values)
+}
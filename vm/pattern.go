@@ -0,0 +1,400 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Salpadding/lua/types"
+)
+
+const (
+	maxCaptures    = 32
+	maxMatchDepth  = 200
+	capUnfinished  = -1
+	capPosition    = -2
+	patternEscape  = '%'
+	patternSpecial = "^$*+?.([%-"
+)
+
+var errPatternTooComplex = errors.New("pattern too complex")
+
+type capture struct {
+	init int
+	len  int
+}
+
+// matchState 是一次模式匹配的状态, 匹配失败时位置为 -1
+type matchState struct {
+	vm      *LuaVM
+	src     string
+	pat     string
+	level   int
+	depth   int
+	capture [maxCaptures]capture
+}
+
+func newMatchState(vm *LuaVM, src, pat string) *matchState {
+	return &matchState{vm: vm, src: src, pat: pat, depth: maxMatchDepth}
+}
+
+// reset 在每次尝试匹配之前清空捕获
+func (ms *matchState) reset() {
+	ms.level = 0
+	ms.depth = maxMatchDepth
+}
+
+// classEnd 返回从 p 开始的单个字符类的结束位置
+func (ms *matchState) classEnd(p int) (int, error) {
+	c := ms.pat[p]
+	p++
+	switch c {
+	case patternEscape:
+		if p >= len(ms.pat) {
+			return 0, errors.New("malformed pattern (ends with '%')")
+		}
+		return p + 1, nil
+	case '[':
+		if p < len(ms.pat) && ms.pat[p] == '^' {
+			p++
+		}
+		// 第一个 ] 是普通字符
+		for {
+			if p >= len(ms.pat) {
+				return 0, errors.New("malformed pattern (missing ']')")
+			}
+			c := ms.pat[p]
+			p++
+			if c == patternEscape && p < len(ms.pat) {
+				p++
+			}
+			if p < len(ms.pat) && ms.pat[p] == ']' {
+				return p + 1, nil
+			}
+		}
+	}
+	return p, nil
+}
+
+func isAlpha(c byte) bool { return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' }
+func isDigit(c byte) bool { return '0' <= c && c <= '9' }
+func isLower(c byte) bool { return 'a' <= c && c <= 'z' }
+func isUpper(c byte) bool { return 'A' <= c && c <= 'Z' }
+func isSpace(c byte) bool { return c == ' ' || '\t' <= c && c <= '\r' }
+func isCntrl(c byte) bool { return c < 32 || c == 127 }
+func isGraph(c byte) bool { return 32 < c && c < 127 }
+func isAlnum(c byte) bool { return isAlpha(c) || isDigit(c) }
+func isPunct(c byte) bool { return isGraph(c) && !isAlnum(c) }
+func isXDigit(c byte) bool {
+	return isDigit(c) || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+// matchClass 判断字符 c 是否属于 %cl 表示的字符类
+func matchClass(c, cl byte) bool {
+	var res bool
+	switch cl | 0x20 {
+	case 'a':
+		res = isAlpha(c)
+	case 'c':
+		res = isCntrl(c)
+	case 'd':
+		res = isDigit(c)
+	case 'g':
+		res = isGraph(c)
+	case 'l':
+		res = isLower(c)
+	case 'p':
+		res = isPunct(c)
+	case 's':
+		res = isSpace(c)
+	case 'u':
+		res = isUpper(c)
+	case 'w':
+		res = isAlnum(c)
+	case 'x':
+		res = isXDigit(c)
+	default:
+		return cl == c
+	}
+	if isUpper(cl) {
+		return !res
+	}
+	return res
+}
+
+// matchBracketClass 判断字符 c 是否属于 [...] 字符集, p 指向 [, ec 指向 ]
+func (ms *matchState) matchBracketClass(c byte, p, ec int) bool {
+	sig := true
+	if ms.pat[p+1] == '^' {
+		sig = false
+		p++
+	}
+	for p++; p < ec; p++ {
+		switch {
+		case ms.pat[p] == patternEscape:
+			p++
+			if matchClass(c, ms.pat[p]) {
+				return sig
+			}
+		case ms.pat[p+1] == '-' && p+2 < ec:
+			p += 2
+			if ms.pat[p-2] <= c && c <= ms.pat[p] {
+				return sig
+			}
+		case ms.pat[p] == c:
+			return sig
+		}
+	}
+	return !sig
+}
+
+func (ms *matchState) singleMatch(s, p, ep int) bool {
+	if s >= len(ms.src) {
+		return false
+	}
+	c := ms.src[s]
+	switch ms.pat[p] {
+	case '.':
+		return true
+	case patternEscape:
+		return matchClass(c, ms.pat[p+1])
+	case '[':
+		return ms.matchBracketClass(c, p, ep-1)
+	}
+	return ms.pat[p] == c
+}
+
+// match 从 s 开始匹配模式 pat[p:], 返回匹配结束的位置, 失败时返回 -1
+func (ms *matchState) match(s, p int) (int, error) {
+	if ms.depth == 0 {
+		return -1, errPatternTooComplex
+	}
+	// 回溯可能执行很多次匹配, 每次匹配消耗一个单位的 gas
+	if err := ms.vm.charge(1); err != nil {
+		return -1, err
+	}
+	ms.depth--
+	defer func() { ms.depth++ }()
+	for p < len(ms.pat) {
+		switch ms.pat[p] {
+		case '(':
+			if p+1 < len(ms.pat) && ms.pat[p+1] == ')' {
+				return ms.startCapture(s, p+2, capPosition)
+			}
+			return ms.startCapture(s, p+1, capUnfinished)
+		case ')':
+			return ms.endCapture(s, p+1)
+		case '$':
+			if p+1 == len(ms.pat) {
+				if s == len(ms.src) {
+					return s, nil
+				}
+				return -1, nil
+			}
+		case patternEscape:
+			if p+1 >= len(ms.pat) {
+				break
+			}
+			switch next := ms.pat[p+1]; {
+			case next == 'b':
+				var err error
+				if s, err = ms.matchBalance(s, p+2); err != nil || s < 0 {
+					return -1, err
+				}
+				p += 4
+				continue
+			case next == 'f':
+				p += 2
+				if p >= len(ms.pat) || ms.pat[p] != '[' {
+					return -1, errors.New("missing '[' after '%f' in pattern")
+				}
+				ep, err := ms.classEnd(p)
+				if err != nil {
+					return -1, err
+				}
+				var prev, cur byte
+				if s > 0 {
+					prev = ms.src[s-1]
+				}
+				if s < len(ms.src) {
+					cur = ms.src[s]
+				}
+				if !ms.matchBracketClass(prev, p, ep-1) && ms.matchBracketClass(cur, p, ep-1) {
+					p = ep
+					continue
+				}
+				return -1, nil
+			case isDigit(next):
+				var err error
+				if s, err = ms.matchCapture(s, next); err != nil || s < 0 {
+					return -1, err
+				}
+				p += 2
+				continue
+			}
+		}
+		// 单个字符类, 可能带有重复后缀
+		ep, err := ms.classEnd(p)
+		if err != nil {
+			return -1, err
+		}
+		var suffix byte
+		if ep < len(ms.pat) {
+			suffix = ms.pat[ep]
+		}
+		if !ms.singleMatch(s, p, ep) {
+			if suffix == '*' || suffix == '?' || suffix == '-' {
+				p = ep + 1
+				continue
+			}
+			return -1, nil
+		}
+		switch suffix {
+		case '?':
+			res, err := ms.match(s+1, ep+1)
+			if err != nil || res >= 0 {
+				return res, err
+			}
+			p = ep + 1
+		case '+':
+			return ms.maxExpand(s+1, p, ep)
+		case '*':
+			return ms.maxExpand(s, p, ep)
+		case '-':
+			return ms.minExpand(s, p, ep)
+		default:
+			s++
+			p = ep
+		}
+	}
+	return s, nil
+}
+
+func (ms *matchState) maxExpand(s, p, ep int) (int, error) {
+	i := 0
+	for ms.singleMatch(s+i, p, ep) {
+		i++
+	}
+	for ; i >= 0; i-- {
+		res, err := ms.match(s+i, ep+1)
+		if err != nil || res >= 0 {
+			return res, err
+		}
+	}
+	return -1, nil
+}
+
+func (ms *matchState) minExpand(s, p, ep int) (int, error) {
+	for {
+		res, err := ms.match(s, ep+1)
+		if err != nil || res >= 0 {
+			return res, err
+		}
+		if !ms.singleMatch(s, p, ep) {
+			return -1, nil
+		}
+		s++
+	}
+}
+
+func (ms *matchState) startCapture(s, p, what int) (int, error) {
+	if ms.level >= maxCaptures {
+		return -1, errors.New("too many captures")
+	}
+	ms.capture[ms.level] = capture{init: s, len: what}
+	ms.level++
+	res, err := ms.match(s, p)
+	if res < 0 {
+		ms.level--
+	}
+	return res, err
+}
+
+func (ms *matchState) endCapture(s, p int) (int, error) {
+	l := -1
+	for i := ms.level - 1; i >= 0; i-- {
+		if ms.capture[i].len == capUnfinished {
+			l = i
+			break
+		}
+	}
+	if l < 0 {
+		return -1, errors.New("invalid pattern capture")
+	}
+	ms.capture[l].len = s - ms.capture[l].init
+	res, err := ms.match(s, p)
+	if res < 0 {
+		ms.capture[l].len = capUnfinished
+	}
+	return res, err
+}
+
+// matchBalance 匹配 %bxy
+func (ms *matchState) matchBalance(s, p int) (int, error) {
+	if p+1 >= len(ms.pat) {
+		return -1, errors.New("malformed pattern (missing arguments to '%b')")
+	}
+	if s >= len(ms.src) || ms.src[s] != ms.pat[p] {
+		return -1, nil
+	}
+	b, e := ms.pat[p], ms.pat[p+1]
+	cont := 1
+	for s++; s < len(ms.src); s++ {
+		switch ms.src[s] {
+		case e:
+			if cont--; cont == 0 {
+				return s + 1, nil
+			}
+		case b:
+			cont++
+		}
+	}
+	return -1, nil
+}
+
+// matchCapture 匹配 %1 到 %9 引用的捕获
+func (ms *matchState) matchCapture(s int, c byte) (int, error) {
+	l := int(c - '1')
+	if l < 0 || l >= ms.level || ms.capture[l].len == capUnfinished {
+		return -1, fmt.Errorf("invalid capture index %%%d", l+1)
+	}
+	capture := ms.src[ms.capture[l].init : ms.capture[l].init+ms.capture[l].len]
+	if len(ms.src)-s >= len(capture) && ms.src[s:s+len(capture)] == capture {
+		return s + len(capture), nil
+	}
+	return -1, nil
+}
+
+// getCapture 返回第 i 个捕获, 没有捕获时第 0 个捕获是整个匹配
+func (ms *matchState) getCapture(i, s, e int) (types.Value, error) {
+	if i >= ms.level {
+		if i == 0 {
+			return types.String(ms.src[s:e]), nil
+		}
+		return nil, fmt.Errorf("invalid capture index %%%d", i+1)
+	}
+	c := ms.capture[i]
+	switch c.len {
+	case capUnfinished:
+		return nil, errors.New("unfinished capture")
+	case capPosition:
+		return types.Integer(c.init + 1), nil
+	}
+	return types.String(ms.src[c.init : c.init+c.len]), nil
+}
+
+// captures 返回所有捕获, wholeIfNone 为真且没有捕获时返回整个匹配
+func (ms *matchState) captures(s, e int, wholeIfNone bool) ([]types.Value, error) {
+	n := ms.level
+	if n == 0 && wholeIfNone {
+		n = 1
+	}
+	res := make([]types.Value, n)
+	for i := range res {
+		c, err := ms.getCapture(i, s, e)
+		if err != nil {
+			return nil, err
+		}
+		res[i] = c
+	}
+	return res, nil
+}
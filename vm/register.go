@@ -38,6 +38,7 @@ func (r *Register) PushN(n int, values ...types.Value) error {
 			if err := r.Push(types.GetNil()); err != nil {
 				return err
 			}
+			continue
 		}
 		if err := r.Push(values[i]); err != nil {
 			return err
@@ -96,6 +97,14 @@ func (r *Register) Set(idx int, v types.Value) error {
 	return nil
 }
 
+// Resize 把寄存器的数量设置为 n, 不够时用 nil 补齐
+func (r *Register) Resize(n int) {
+	for len(*r) < n {
+		*r = append(*r, types.GetNil())
+	}
+	*r = (*r)[:n]
+}
+
 func (r *Register) reverse(from, to int) error {
 	if !r.IsValid(from) || !r.IsValid(to) {
 		return errors.New("reverse op fail, index overflow")
@@ -121,6 +130,10 @@ func (r *Register) String() string {
 }
 
 func(r *Register) Slice(start, end int) []types.Value {
+	// 栈顶低于 start 时没有值
+	if end <= start {
+		return nil
+	}
 	res := make([]types.Value, end - start)
 	for i := range res {
 		res[i] = r.Get(start + i)
@@ -0,0 +1,670 @@
+package vm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/Salpadding/lua/types"
+	"github.com/Salpadding/lua/types/value"
+)
+
+// maxStringSize 是 string.rep 等函数能够创建的最大字符串长度
+const maxStringSize = math.MaxInt32
+
+var errStringTooLarge = errors.New("resulting string too large")
+
+var stringFunctions = map[string]nativeFunction{
+	"len":     strLen,
+	"sub":     strSub,
+	"upper":   strUpper,
+	"lower":   strLower,
+	"rep":     strRep,
+	"reverse": strReverse,
+	"byte":    strByte,
+	"char":    strChar,
+	"format":  strFormat,
+	"find":    strFind,
+	"match":   strMatch,
+	"gmatch":  strGMatch,
+	"gsub":    strGSub,
+	"dump":    strDump,
+}
+
+// openString 打开字符串库, 并设置为字符串的元表的 __index
+func (vm *LuaVM) openString() error {
+	lib, err := vm.openLib("string", stringFunctions)
+	if err != nil {
+		return err
+	}
+	mt := types.NewTable()
+	if err := mt.Set(types.String("__index"), lib); err != nil {
+		return err
+	}
+	vm.metatables[value.String] = mt
+	return nil
+}
+
+// dump(f [, strip]) 把 lua 函数转换为二进制代码块, strip 为真时去掉调试信息
+func strDump(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	v, err := checkFunction(args, 0, "dump")
+	if err != nil {
+		return nil, err
+	}
+	fn, ok := v.(*types.Function)
+	if !ok {
+		return nil, errors.New("unable to dump given function")
+	}
+	var buf bytes.Buffer
+	if err := types.WritePrototype(&buf, fn.Prototype, bool(arg(args, 1).ToBoolean())); err != nil {
+		return nil, err
+	}
+	if err := vm.memory.Alloc(types.StringSize + buf.Len()); err != nil {
+		return nil, err
+	}
+	return []types.Value{types.String(buf.String())}, nil
+}
+
+// posRelative 把负数位置转换为从字符串开头计算的位置
+func posRelative(pos int64, length int) int64 {
+	if pos >= 0 {
+		return pos
+	}
+	if -pos > int64(length) {
+		return 0
+	}
+	return int64(length) + pos + 1
+}
+
+func strLen(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	s, err := checkString(args, 0, "len")
+	if err != nil {
+		return nil, err
+	}
+	return []types.Value{types.Integer(len(s))}, nil
+}
+
+// sub(s, i [, j]) 返回 s[i..j]
+func strSub(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	s, err := checkString(args, 0, "sub")
+	if err != nil {
+		return nil, err
+	}
+	i, err := checkInteger(args, 1, "sub")
+	if err != nil {
+		return nil, err
+	}
+	j, err := optInteger(args, 2, "sub", -1)
+	if err != nil {
+		return nil, err
+	}
+	i, j = posRelative(i, len(s)), posRelative(j, len(s))
+	if i < 1 {
+		i = 1
+	}
+	if j > int64(len(s)) {
+		j = int64(len(s))
+	}
+	if i > j {
+		return []types.Value{types.String("")}, nil
+	}
+	return []types.Value{types.String(s[i-1 : j])}, nil
+}
+
+func strUpper(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	s, err := checkString(args, 0, "upper")
+	if err != nil {
+		return nil, err
+	}
+	buf := []byte(s)
+	for i, c := range buf {
+		if isLower(c) {
+			buf[i] = c - 'a' + 'A'
+		}
+	}
+	return vm.stringResult(string(buf))
+}
+
+func strLower(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	s, err := checkString(args, 0, "lower")
+	if err != nil {
+		return nil, err
+	}
+	buf := []byte(s)
+	for i, c := range buf {
+		if isUpper(c) {
+			buf[i] = c - 'A' + 'a'
+		}
+	}
+	return vm.stringResult(string(buf))
+}
+
+// rep(s, n [, sep]) 返回 n 个 s 用 sep 连接的字符串
+func strRep(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	s, err := checkString(args, 0, "rep")
+	if err != nil {
+		return nil, err
+	}
+	n, err := checkInteger(args, 1, "rep")
+	if err != nil {
+		return nil, err
+	}
+	sep, err := optString(args, 2, "rep", "")
+	if err != nil {
+		return nil, err
+	}
+	if n <= 0 || len(s)+len(sep) == 0 {
+		return []types.Value{types.String("")}, nil
+	}
+	if l := int64(len(s) + len(sep)); l > maxStringSize/n {
+		return nil, errStringTooLarge
+	}
+	// 在生成字符串之前检查内存, 避免分配超过限制的内存
+	size := int64(len(s))*n + int64(len(sep))*(n-1)
+	if err := vm.memory.Alloc(types.StringSize + int(size)); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	for i := int64(0); i < n; i++ {
+		// 每个字节消耗一个单位的 gas, 停止时退还预先记录的内存
+		if err := vm.charge(uint64(len(s) + len(sep))); err != nil {
+			vm.memory.Free(types.StringSize + int(size))
+			return nil, err
+		}
+		if i > 0 {
+			buf.WriteString(sep)
+		}
+		buf.WriteString(s)
+	}
+	return []types.Value{types.String(buf.String())}, nil
+}
+
+func strReverse(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	s, err := checkString(args, 0, "reverse")
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, len(s))
+	for i := range buf {
+		buf[i] = s[len(s)-1-i]
+	}
+	return vm.stringResult(string(buf))
+}
+
+// byte(s [, i [, j]]) 返回 s[i..j] 中每个字节的值
+func strByte(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	s, err := checkString(args, 0, "byte")
+	if err != nil {
+		return nil, err
+	}
+	i, err := optInteger(args, 1, "byte", 1)
+	if err != nil {
+		return nil, err
+	}
+	i = posRelative(i, len(s))
+	j, err := optInteger(args, 2, "byte", i)
+	if err != nil {
+		return nil, err
+	}
+	j = posRelative(j, len(s))
+	if i < 1 {
+		i = 1
+	}
+	if j > int64(len(s)) {
+		j = int64(len(s))
+	}
+	if i > j {
+		return nil, nil
+	}
+	res := make([]types.Value, 0, j-i+1)
+	for k := i; k <= j; k++ {
+		res = append(res, types.Integer(s[k-1]))
+	}
+	return res, nil
+}
+
+func strChar(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	buf := make([]byte, len(args))
+	for i := range args {
+		c, err := checkInteger(args, i, "char")
+		if err != nil {
+			return nil, err
+		}
+		if c < 0 || c > math.MaxUint8 {
+			return nil, errArgument(i+1, "char", "value out of range")
+		}
+		buf[i] = byte(c)
+	}
+	return vm.stringResult(string(buf))
+}
+
+// format(fmt, ...) 按照 C 语言 printf 的规则格式化参数
+func strFormat(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	f, err := checkString(args, 0, "format")
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	n := 0
+	for i := 0; i < len(f); i++ {
+		if f[i] != '%' {
+			buf.WriteByte(f[i])
+			continue
+		}
+		i++
+		if i < len(f) && f[i] == '%' {
+			buf.WriteByte('%')
+			continue
+		}
+		spec, err := formatSpec(f[i:])
+		if err != nil {
+			return nil, err
+		}
+		i += len(spec)
+		if i >= len(f) {
+			return nil, fmt.Errorf("invalid conversion '%%%s' to 'format'", spec)
+		}
+		n++
+		if n >= len(args) {
+			return nil, errArgument(n+1, "format", "no value")
+		}
+		s, err := vm.formatValue(spec, f[i], args, n)
+		if err != nil {
+			return nil, err
+		}
+		buf.WriteString(s)
+	}
+	return vm.stringResult(buf.String())
+}
+
+// formatSpec 返回格式说明中的标志, 宽度和精度部分
+func formatSpec(f string) (string, error) {
+	i := 0
+	for i < len(f) && strings.IndexByte("-+ #0", f[i]) >= 0 {
+		i++
+	}
+	if i > 5 {
+		return "", errors.New("invalid format (repeated flags)")
+	}
+	digits := func() {
+		for k := 0; k < 2 && i < len(f) && isDigit(f[i]); k++ {
+			i++
+		}
+	}
+	digits()
+	if i < len(f) && f[i] == '.' {
+		i++
+		digits()
+	}
+	if i < len(f) && isDigit(f[i]) {
+		return "", errors.New("invalid format (width or precision too long)")
+	}
+	return f[:i], nil
+}
+
+func (vm *LuaVM) formatValue(spec string, verb byte, args []types.Value, n int) (string, error) {
+	switch verb {
+	case 'c':
+		c, err := checkInteger(args, n, "format")
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%"+spec+"s", string([]byte{byte(c)})), nil
+	case 'd', 'i':
+		i, err := checkInteger(args, n, "format")
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%"+spec+"d", i), nil
+	case 'o', 'x', 'X':
+		i, err := checkInteger(args, n, "format")
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%"+spec+string(verb), uint64(i)), nil
+	case 'a', 'A', 'e', 'E', 'f', 'F', 'g', 'G':
+		x, ok := args[n].ToFloat()
+		if !ok {
+			return "", errArgument(n+1, "format", fmt.Sprintf("number expected, got %s", typeNameOf(args, n)))
+		}
+		return formatFloat(spec, verb, float64(x)), nil
+	case 'q':
+		return vm.quoteLiteral(args, n)
+	case 's':
+		s, err := vm.toString(args[n])
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%"+spec+"s", s), nil
+	}
+	return "", fmt.Errorf("invalid option '%%%s' to 'format'", spec+string(verb))
+}
+
+// formatFloat 格式化浮点数, 输出和 C 语言保持一致
+func formatFloat(spec string, verb byte, x float64) string {
+	upper := verb >= 'A' && verb <= 'Z'
+	var s string
+	switch {
+	case math.IsInf(x, 0) || math.IsNaN(x):
+		s = numberToString(types.Float(x))
+		if x > 0 && strings.IndexByte(spec, '+') >= 0 {
+			s = "+" + s
+		}
+		spec = strings.Replace(spec, "0", "", -1)
+		if i := strings.IndexByte(spec, '.'); i >= 0 {
+			spec = spec[:i]
+		}
+	case verb == 'a' || verb == 'A':
+		s = hexFloat(x)
+		if x >= 0 && strings.IndexByte(spec, '+') >= 0 {
+			s = "+" + s
+		}
+		if i := strings.IndexByte(spec, '.'); i >= 0 {
+			spec = spec[:i]
+		}
+	default:
+		// C 语言默认精度为 6
+		if strings.IndexByte(spec, '.') < 0 {
+			spec += ".6"
+		}
+		return fmt.Sprintf("%"+spec+string(verb), x)
+	}
+	if upper {
+		s = strings.ToUpper(s)
+	}
+	return fmt.Sprintf("%"+spec+"s", s)
+}
+
+// hexFloat 返回十六进制浮点数, 例如 0x1.8p+1
+func hexFloat(x float64) string {
+	s := strconv.FormatFloat(x, 'x', -1, 64)
+	i := strings.IndexByte(s, 'p') + 2
+	exp := strings.TrimLeft(s[i:], "0")
+	if exp == "" {
+		exp = "0"
+	}
+	return s[:i] + exp
+}
+
+// quoteLiteral 把值转换为可以被 lua 读回的字面量
+func (vm *LuaVM) quoteLiteral(args []types.Value, n int) (string, error) {
+	switch x := args[n].(type) {
+	case types.String:
+		return quoteString(string(x)), nil
+	case types.Integer:
+		if x == math.MinInt64 {
+			return fmt.Sprintf("0x%x", uint64(x)), nil
+		}
+		return x.String(), nil
+	case types.Float:
+		f := float64(x)
+		switch {
+		case math.IsInf(f, 1):
+			return "1e9999", nil
+		case math.IsInf(f, -1):
+			return "-1e9999", nil
+		case math.IsNaN(f):
+			return "(0/0)", nil
+		}
+		return hexFloat(f), nil
+	case *types.Nil, types.Boolean:
+		return vm.toString(x)
+	}
+	return "", errArgument(n+1, "format", "value has no literal form")
+}
+
+func quoteString(s string) string {
+	var buf bytes.Buffer
+	buf.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\' || c == '\n':
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		case isCntrl(c):
+			// 后面是数字时必须使用三位数字
+			if i+1 < len(s) && isDigit(s[i+1]) {
+				fmt.Fprintf(&buf, "\\%03d", c)
+			} else {
+				fmt.Fprintf(&buf, "\\%d", c)
+			}
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	buf.WriteByte('"')
+	return buf.String()
+}
+
+// strFindAux 实现 find 和 match
+func strFindAux(vm *LuaVM, args []types.Value, find bool) ([]types.Value, error) {
+	fname := "match"
+	if find {
+		fname = "find"
+	}
+	s, err := checkString(args, 0, fname)
+	if err != nil {
+		return nil, err
+	}
+	p, err := checkString(args, 1, fname)
+	if err != nil {
+		return nil, err
+	}
+	init, err := optInteger(args, 2, fname, 1)
+	if err != nil {
+		return nil, err
+	}
+	init = posRelative(init, len(s))
+	if init < 1 {
+		init = 1
+	}
+	if init > int64(len(s))+1 {
+		return []types.Value{types.GetNil()}, nil
+	}
+	if find && (bool(arg(args, 3).ToBoolean()) || !strings.ContainsAny(p, patternSpecial)) {
+		// 不包含特殊字符时直接查找子串
+		if i := strings.Index(s[init-1:], p); i >= 0 {
+			start := int(init) + i
+			return []types.Value{types.Integer(start), types.Integer(start + len(p) - 1)}, nil
+		}
+		return []types.Value{types.GetNil()}, nil
+	}
+	anchor := len(p) > 0 && p[0] == '^'
+	if anchor {
+		p = p[1:]
+	}
+	ms := newMatchState(vm, s, p)
+	for s1 := int(init) - 1; s1 <= len(s); s1++ {
+		ms.reset()
+		e, err := ms.match(s1, 0)
+		if err != nil {
+			return nil, err
+		}
+		if e >= 0 {
+			if !find {
+				return ms.captures(s1, e, true)
+			}
+			captures, err := ms.captures(s1, e, false)
+			if err != nil {
+				return nil, err
+			}
+			return append([]types.Value{types.Integer(s1 + 1), types.Integer(e)}, captures...), nil
+		}
+		if anchor {
+			break
+		}
+	}
+	return []types.Value{types.GetNil()}, nil
+}
+
+// find(s, pattern [, init [, plain]]) 返回匹配的开始和结束位置以及所有捕获
+func strFind(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	return strFindAux(vm, args, true)
+}
+
+// match(s, pattern [, init]) 返回所有捕获, 没有捕获时返回整个匹配
+func strMatch(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	return strFindAux(vm, args, false)
+}
+
+// gmatch(s, pattern) 返回的迭代器每次返回下一个匹配的捕获
+func strGMatch(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	s, err := checkString(args, 0, "gmatch")
+	if err != nil {
+		return nil, err
+	}
+	p, err := checkString(args, 1, "gmatch")
+	if err != nil {
+		return nil, err
+	}
+	ms := newMatchState(vm, s, p)
+	src, lastMatch := 0, -1
+	iter := types.Native(func(...types.Value) ([]types.Value, error) {
+		for ; src <= len(s); src++ {
+			ms.reset()
+			e, err := ms.match(src, 0)
+			if err != nil {
+				return nil, err
+			}
+			if e >= 0 && e != lastMatch {
+				start := src
+				src, lastMatch = e, e
+				return ms.captures(start, e, true)
+			}
+		}
+		return []types.Value{types.GetNil()}, nil
+	})
+	return []types.Value{iter}, nil
+}
+
+// gsub(s, pattern, repl [, n]) 替换前 n 个匹配, 返回替换后的字符串和替换次数
+func strGSub(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	s, err := checkString(args, 0, "gsub")
+	if err != nil {
+		return nil, err
+	}
+	p, err := checkString(args, 1, "gsub")
+	if err != nil {
+		return nil, err
+	}
+	repl := arg(args, 2)
+	switch repl.(type) {
+	case types.String, types.Integer, types.Float, *types.Table, *types.Function, types.Native:
+	default:
+		return nil, errArgument(3, "gsub", fmt.Sprintf("string/function/table expected, got %s", typeNameOf(args, 2)))
+	}
+	maxN, err := optInteger(args, 3, "gsub", int64(len(s))+1)
+	if err != nil {
+		return nil, err
+	}
+	anchor := len(p) > 0 && p[0] == '^'
+	if anchor {
+		p = p[1:]
+	}
+	ms := newMatchState(vm, s, p)
+	buf := &stringBuilder{vm: vm}
+	defer buf.release()
+	src, lastMatch, n := 0, -1, int64(0)
+	for n < maxN {
+		ms.reset()
+		e, err := ms.match(src, 0)
+		if err != nil {
+			return nil, err
+		}
+		if e >= 0 && e != lastMatch {
+			n++
+			if err := vm.addValue(buf, ms, src, e, repl); err != nil {
+				return nil, err
+			}
+			src, lastMatch = e, e
+		} else if src < len(s) {
+			if err := buf.WriteByte(s[src]); err != nil {
+				return nil, err
+			}
+			src++
+		} else {
+			break
+		}
+		if anchor {
+			break
+		}
+	}
+	if err := buf.WriteString(s[src:]); err != nil {
+		return nil, err
+	}
+	res, err := buf.String()
+	if err != nil {
+		return nil, err
+	}
+	return []types.Value{res, types.Integer(n)}, nil
+}
+
+// addValue 把 s[src:e] 的替换结果写入 buf, 替换值为 false 或者 nil 时保留原字符串
+func (vm *LuaVM) addValue(buf *stringBuilder, ms *matchState, src, e int, repl types.Value) error {
+	var (
+		v   types.Value
+		err error
+	)
+	switch x := repl.(type) {
+	case *types.Table:
+		var key types.Value
+		if key, err = ms.getCapture(0, src, e); err == nil {
+			v, err = vm.index(x, key)
+		}
+	case *types.Function, types.Native:
+		var captures []types.Value
+		if captures, err = ms.captures(src, e, true); err == nil {
+			v, err = vm.callMeta(x, captures...)
+		}
+	default:
+		r, _ := toConcatString(repl)
+		return addString(buf, ms, src, e, r)
+	}
+	if err != nil {
+		return err
+	}
+	if !v.ToBoolean() {
+		return buf.WriteString(ms.src[src:e])
+	}
+	s, ok := toConcatString(v)
+	if !ok {
+		return fmt.Errorf("invalid replacement value (a %s)", v.Type())
+	}
+	return buf.WriteString(s)
+}
+
+// addString 展开替换字符串中的 %0 到 %9
+func addString(buf *stringBuilder, ms *matchState, src, e int, r string) error {
+	for i := 0; i < len(r); i++ {
+		var err error
+		if r[i] != patternEscape {
+			if err = buf.WriteByte(r[i]); err != nil {
+				return err
+			}
+			continue
+		}
+		i++
+		switch {
+		case i < len(r) && r[i] == patternEscape:
+			err = buf.WriteByte(patternEscape)
+		case i < len(r) && r[i] == '0':
+			err = buf.WriteString(ms.src[src:e])
+		case i < len(r) && isDigit(r[i]):
+			var c types.Value
+			if c, err = ms.getCapture(int(r[i]-'1'), src, e); err == nil {
+				s, _ := toConcatString(c)
+				err = buf.WriteString(s)
+			}
+		default:
+			return errors.New("invalid use of '%' in replacement string")
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package vm
+
+import (
+	"testing"
+
+	"github.com/Salpadding/lua/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStringBasic(t *testing.T) {
+	var vm LuaVM
+	values, err := vm.DoString(`
+local s = "Hello"
+return #s, s:len(), s:sub(2, -2), s:sub(-3), s:upper(), s:lower(), ("ab"):rep(3, ","),
+  s:reverse(), string.char(72, 105), ("x"):rep(0), s:byte(1, -1)
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{
+		types.Integer(5), types.Integer(5), types.String("ell"), types.String("llo"), types.String("HELLO"),
+		types.String("hello"), types.String("ab,ab,ab"), types.String("olleH"), types.String("Hi"), types.String(""),
+		types.Integer(72), types.Integer(101), types.Integer(108), types.Integer(108), types.Integer(111),
+	}, values)
+
+	_, err = vm.DoString("return string.rep()")
+	assert.EqualError(t, err, `[string "return string.rep()"]:1: bad argument #1 to 'rep' (string expected, got no value)`)
+	_, err = vm.DoString("return ('a'):sub(1.5)")
+	assert.EqualError(t, err, `[string "return ('a'):sub(1.5)"]:1: bad argument #2 to 'sub' (number has no integer representation)`)
+}
+
+func TestStringFormat(t *testing.T) {
+	var vm LuaVM
+	cases := map[string]string{
+		`string.format("%d items", 3)`:               "3 items",
+		`string.format("%5d|%-5d|%05d", 42, 42, 42)`: "   42|42   |00042",
+		`string.format("%x %X %o", 255, 255, 8)`:     "ff FF 10",
+		`string.format("%x", -1)`:                    "ffffffffffffffff",
+		`string.format("%.3f %e", 3.14159, 1000)`:    "3.142 1.000000e+03",
+		`string.format("%g %g %g", 1e20, 0.5, 100)`:  "1e+20 0.5 100",
+		`string.format("%s=%s", "k", 1.0)`:           "k=1.0",
+		`string.format("%10.3s|", "abcdef")`:         "       abc|",
+		`string.format("%q", 'a "b"\n\0c')`:          `"a \"b\"\` + "\n" + `\0c"`,
+		`string.format("%q %q", 1, 0.5)`:             "1 0x1p-1",
+		`string.format("%c%c", 76, 117)`:             "Lu",
+		`string.format("%a", 1)`:                     "0x1p+0",
+		`string.format("%5.1f|%%", 1/0)`:             "  inf|%",
+		`string.format("%s", setmetatable({}, {__tostring = function() return "obj" end}))`: "obj",
+	}
+	for src, expected := range cases {
+		values, err := vm.DoString("return " + src)
+		assert.NoError(t, err, src)
+		assert.Equal(t, []types.Value{types.String(expected)}, values, src)
+	}
+
+	for src, msg := range map[string]string{
+		`string.format("%d", 1.5)`:  "bad argument #2 to 'format' (number has no integer representation)",
+		`string.format("%d")`:       "bad argument #2 to 'format' (no value)",
+		`string.format("%y", 1)`:    "invalid option '%y' to 'format'",
+		`string.format("%123d", 1)`: "invalid format (width or precision too long)",
+	} {
+		_, err := vm.DoString("return " + src)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), msg, src)
+	}
+}
+
+func TestStringFind(t *testing.T) {
+	var vm LuaVM
+	values, err := vm.DoString(`
+local r = {}
+local function add(...) for _, v in ipairs({...}) do r[#r + 1] = v end end
+add(("hello world"):find("o w"))
+add(("hello world"):find("l+"))
+add(("a.b"):find(".", 1, true))
+add(("hello"):find("(l)(l)"))
+add(("hello"):find("xyz") == nil)
+add(("hello"):find("", 10) == nil)
+add(("  key = value  "):match("^%s*(%w+)%s*=%s*(%w+)%s*$"))
+add(("2024-01-15"):match("(%d+)-(%d+)-(%d+)"))
+add(("THE (quick) fox"):find("%((%a+)%)"))
+add(("f(a(b)c)d"):match("%b()"))
+add(("THE quick"):match("%f[%a]%a+", 4))
+add(("hello"):match("()ll()"))
+add(("abcabc"):match("(a)(b)c%1%2"))
+add(("abc"):match("^b") == nil)
+add(("[x]"):match("[]x[]+"))
+add(("aaa"):match("a-b") == nil)
+add(("aaab"):match("a-b"))
+return r
+`)
+	assert.NoError(t, err)
+	tb := values[0].(*types.Table)
+	var got []types.Value
+	for i := 1; i <= tb.Len(); i++ {
+		v, _ := tb.Get(types.Integer(i))
+		got = append(got, v)
+	}
+	assert.Equal(t, []types.Value{
+		types.Integer(5), types.Integer(7),
+		types.Integer(3), types.Integer(4),
+		types.Integer(2), types.Integer(2),
+		types.Integer(3), types.Integer(4), types.String("l"), types.String("l"),
+		types.Boolean(true),
+		types.Boolean(true),
+		types.String("key"), types.String("value"),
+		types.String("2024"), types.String("01"), types.String("15"),
+		types.Integer(5), types.Integer(11), types.String("quick"),
+		types.String("(a(b)c)"),
+		types.String("quick"),
+		types.Integer(3), types.Integer(5),
+		types.String("a"), types.String("b"),
+		types.Boolean(true),
+		types.String("[x]"),
+		types.Boolean(true),
+		types.String("aaab"),
+	}, got)
+
+	for src, msg := range map[string]string{
+		`("a"):find("%")`:   "malformed pattern (ends with '%')",
+		`("a"):find("[a")`:  "malformed pattern (missing ']')",
+		`("a"):find("(a")`:  "unfinished capture",
+		`("a"):match("a)")`: "invalid pattern capture",
+		`("a"):find("%1")`:  "invalid capture index %1",
+		`("a"):find("%f")`:  "missing '[' after '%f' in pattern",
+		`("a"):find("%b(")`: "malformed pattern (missing arguments to '%b')",
+	} {
+		_, err := vm.DoString("return " + src)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), msg, src)
+	}
+}
+
+func TestStringGMatchGSub(t *testing.T) {
+	var vm LuaVM
+	values, err := vm.DoString(`
+local words = {}
+for w in ("one two  three"):gmatch("%a+") do words[#words + 1] = w end
+local pairs_ = {}
+for k, v in ("a=1, b=2"):gmatch("(%w+)=(%w+)") do pairs_[#pairs_ + 1] = k .. ":" .. v end
+local s1, n1 = ("hello world"):gsub("o", "0")
+local s2 = ("hello world"):gsub("(%w+)", "<%1>")
+local s3 = ("hello world"):gsub("%w+", "%0 %0", 1)
+local s4 = ("$name is $age"):gsub("%$(%w+)", {name = "bob", age = 42})
+local s5 = ("1 2 3"):gsub("%d", function(d) return d * 2 end)
+local s6 = ("abc"):gsub("", "-")
+local s7 = ("keep"):gsub("%w+", function() return nil end)
+local s8, n8 = ("aaa"):gsub("^a", "b")
+return #words, words[3], pairs_[1], pairs_[2], s1, n1, s2, s3, s4, s5, s6, s7, s8, n8
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{
+		types.Integer(3), types.String("three"), types.String("a:1"), types.String("b:2"),
+		types.String("hell0 w0rld"), types.Integer(2), types.String("<hello> <world>"),
+		types.String("hello hello world"), types.String("bob is 42"), types.String("2 4 6"),
+		types.String("-a-b-c-"), types.String("keep"), types.String("baa"), types.Integer(1),
+	}, values)
+
+	_, err = vm.DoString(`return ("a"):gsub("a", "%2")`)
+	assert.Contains(t, err.Error(), "invalid capture index %2")
+	_, err = vm.DoString(`return ("a"):gsub("a", "%x")`)
+	assert.Contains(t, err.Error(), "invalid use of '%' in replacement string")
+	_, err = vm.DoString(`return ("a"):gsub("a", function() return {} end)`)
+	assert.Contains(t, err.Error(), "invalid replacement value (a table)")
+	_, err = vm.DoString(`return ("a"):gsub("a", true)`)
+	assert.Contains(t, err.Error(), "bad argument #3 to 'gsub' (string/function/table expected, got boolean)")
+}
+
+func TestStringDump(t *testing.T) {
+	var vm LuaVM
+	values, err := vm.DoString(`
+local n = 10
+local function add(a, b) return a + b + n end
+local f = load(string.dump(add))
+local g = load(string.dump(add, true))
+debug.setupvalue(f, 1, 1)
+debug.setupvalue(g, 1, 2)
+return f(2, 3), g(2, 3), #string.dump(add, true) < #string.dump(add)
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{types.Integer(6), types.Integer(7), types.Boolean(true)}, values)
+
+	_, err = vm.DoString("return string.dump(print)")
+	assert.Contains(t, err.Error(), "unable to dump given function")
+	_, err = vm.DoString("return string.dump(1)")
+	assert.Contains(t, err.Error(), "bad argument #1 to 'dump' (function expected, got number)")
+}
@@ -0,0 +1,504 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/Salpadding/lua/types"
+	"github.com/Salpadding/lua/types/value"
+)
+
+const (
+	// maxUnpack 限制 unpack 一次返回的值的数量
+	maxUnpack = 1000000
+	// sortRandomLimit 是使用随机主元的最小数组长度
+	sortRandomLimit = 100
+)
+
+// checkTab 使用的操作, 非表值的元表中有对应的元方法时也可以作为表使用
+const (
+	tabRead   = 1
+	tabWrite  = 2
+	tabLength = 4
+)
+
+var (
+	errInvalidOrder = errors.New("invalid order function for sorting")
+	errLengthNotInt = errors.New("object length is not an integer")
+)
+
+var tableFunctions = map[string]nativeFunction{
+	"insert": tabInsert,
+	"remove": tabRemove,
+	"concat": tabConcat,
+	"pack":   tabPack,
+	"unpack": tabUnpack,
+	"move":   tabMove,
+	"sort":   tabSort,
+}
+
+// checkTab 检查第 i 个参数是否是表, 或者是否有 what 所需的元方法
+func (vm *LuaVM) checkTab(args []types.Value, i int, fname string, what int) (types.Value, error) {
+	v := arg(args, i)
+	if _, ok := v.(*types.Table); ok {
+		return v, nil
+	}
+	if vm.getMetatable(v) != nil &&
+		(what&tabRead == 0 || !isNil(vm.metaField(v, "__index"))) &&
+		(what&tabWrite == 0 || !isNil(vm.metaField(v, "__newindex"))) &&
+		(what&tabLength == 0 || !isNil(vm.metaField(v, "__len"))) {
+		return v, nil
+	}
+	_, err := checkTable(args, i, fname)
+	return nil, err
+}
+
+// lenInteger 计算 #v, 结果必须是整数
+func (vm *LuaVM) lenInteger(v types.Value) (int64, error) {
+	n, err := vm.length(v)
+	if err != nil {
+		return 0, err
+	}
+	i, ok := n.(types.Integer)
+	if !ok {
+		if i, ok = n.ToInteger(); !ok {
+			return 0, errLengthNotInt
+		}
+	}
+	return int64(i), nil
+}
+
+// insert(t, [pos,] v) 在 pos 处插入 v, 默认插入到末尾
+func tabInsert(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	t, err := vm.checkTab(args, 0, "insert", tabRead|tabWrite|tabLength)
+	if err != nil {
+		return nil, err
+	}
+	n, err := vm.lenInteger(t)
+	if err != nil {
+		return nil, err
+	}
+	e := n + 1
+	var pos int64
+	switch len(args) {
+	case 2:
+		pos = e
+	case 3:
+		if pos, err = checkInteger(args, 1, "insert"); err != nil {
+			return nil, err
+		}
+		if pos < 1 || pos > e {
+			return nil, errArgument(2, "insert", "position out of bounds")
+		}
+		for i := e; i > pos; i-- {
+			v, err := vm.index(t, types.Integer(i-1))
+			if err != nil {
+				return nil, err
+			}
+			if err := vm.setIndex(t, types.Integer(i), v); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, errors.New("wrong number of arguments to 'insert'")
+	}
+	return nil, vm.setIndex(t, types.Integer(pos), args[len(args)-1])
+}
+
+// remove(t [, pos]) 删除并返回 pos 处的元素, 默认删除最后一个元素
+func tabRemove(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	t, err := vm.checkTab(args, 0, "remove", tabRead|tabWrite|tabLength)
+	if err != nil {
+		return nil, err
+	}
+	size, err := vm.lenInteger(t)
+	if err != nil {
+		return nil, err
+	}
+	pos, err := optInteger(args, 1, "remove", size)
+	if err != nil {
+		return nil, err
+	}
+	if pos != size && (pos < 1 || pos > size+1) {
+		return nil, errArgument(1, "remove", "position out of bounds")
+	}
+	res, err := vm.index(t, types.Integer(pos))
+	if err != nil {
+		return nil, err
+	}
+	for ; pos < size; pos++ {
+		v, err := vm.index(t, types.Integer(pos+1))
+		if err != nil {
+			return nil, err
+		}
+		if err := vm.setIndex(t, types.Integer(pos), v); err != nil {
+			return nil, err
+		}
+	}
+	if err := vm.setIndex(t, types.Integer(pos), types.GetNil()); err != nil {
+		return nil, err
+	}
+	return []types.Value{res}, nil
+}
+
+// concat(t [, sep [, i [, j]]]) 连接 t[i..j], 元素必须是字符串或者数字
+func tabConcat(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	t, err := vm.checkTab(args, 0, "concat", tabRead|tabLength)
+	if err != nil {
+		return nil, err
+	}
+	sep, err := optString(args, 1, "concat", "")
+	if err != nil {
+		return nil, err
+	}
+	i, err := optInteger(args, 2, "concat", 1)
+	if err != nil {
+		return nil, err
+	}
+	var j int64
+	if isNil(arg(args, 3)) {
+		if j, err = vm.lenInteger(t); err != nil {
+			return nil, err
+		}
+	} else if j, err = checkInteger(args, 3, "concat"); err != nil {
+		return nil, err
+	}
+	buf := &stringBuilder{vm: vm}
+	defer buf.release()
+	for k := i; k <= j; k++ {
+		v, err := vm.index(t, types.Integer(k))
+		if err != nil {
+			return nil, err
+		}
+		s, ok := toConcatString(v)
+		if !ok {
+			return nil, fmt.Errorf("invalid value (at index %d) in table for 'concat'", k)
+		}
+		if err := buf.WriteString(s); err != nil {
+			return nil, err
+		}
+		if k != j {
+			if err := buf.WriteString(sep); err != nil {
+				return nil, err
+			}
+		}
+		if k == math.MaxInt64 {
+			break
+		}
+	}
+	res, err := buf.String()
+	if err != nil {
+		return nil, err
+	}
+	return []types.Value{res}, nil
+}
+
+// pack(...) 返回包含所有参数的表, 字段 n 是参数的数量
+func tabPack(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	t, err := vm.newTable()
+	if err != nil {
+		return nil, err
+	}
+	for i, v := range args {
+		if err := t.Set(types.Integer(i+1), v); err != nil {
+			return nil, err
+		}
+	}
+	if err := t.Set(types.String("n"), types.Integer(len(args))); err != nil {
+		return nil, err
+	}
+	return []types.Value{t}, nil
+}
+
+// unpack(t [, i [, j]]) 返回 t[i..j]
+func tabUnpack(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	t := arg(args, 0)
+	i, err := optInteger(args, 1, "unpack", 1)
+	if err != nil {
+		return nil, err
+	}
+	var j int64
+	if isNil(arg(args, 2)) {
+		if j, err = vm.lenInteger(t); err != nil {
+			return nil, err
+		}
+	} else if j, err = checkInteger(args, 2, "unpack"); err != nil {
+		return nil, err
+	}
+	if i > j {
+		return nil, nil
+	}
+	if n := uint64(j) - uint64(i); n >= maxUnpack {
+		return nil, errors.New("too many results to unpack")
+	}
+	res := make([]types.Value, 0, j-i+1)
+	for k := i; ; k++ {
+		v, err := vm.index(t, types.Integer(k))
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, v)
+		if k == j {
+			break
+		}
+	}
+	return res, nil
+}
+
+// move(a1, f, e, t [, a2]) 把 a1[f..e] 复制到 a2[t..], 返回 a2
+func tabMove(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	a1, err := vm.checkTab(args, 0, "move", tabRead)
+	if err != nil {
+		return nil, err
+	}
+	f, err := checkInteger(args, 1, "move")
+	if err != nil {
+		return nil, err
+	}
+	e, err := checkInteger(args, 2, "move")
+	if err != nil {
+		return nil, err
+	}
+	t, err := checkInteger(args, 3, "move")
+	if err != nil {
+		return nil, err
+	}
+	a2 := a1
+	if !isNil(arg(args, 4)) {
+		if a2, err = vm.checkTab(args, 4, "move", tabWrite); err != nil {
+			return nil, err
+		}
+	}
+	if e < f {
+		return []types.Value{a2}, nil
+	}
+	if f <= 0 && e >= math.MaxInt64+f {
+		return nil, errArgument(3, "move", "too many elements to move")
+	}
+	n := e - f + 1
+	if t > math.MaxInt64-n+1 {
+		return nil, errArgument(4, "move", "destination wrap around")
+	}
+	move := func(i int64) error {
+		v, err := vm.index(a1, types.Integer(f+i))
+		if err != nil {
+			return err
+		}
+		return vm.setIndex(a2, types.Integer(t+i), v)
+	}
+	// 目标区间和源区间重叠时从后向前复制
+	if same, _ := types.Equal(a1, a2); t > e || t <= f || same != value.Equal {
+		for i := int64(0); i < n; i++ {
+			if err := move(i); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		for i := n - 1; i >= 0; i-- {
+			if err := move(i); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return []types.Value{a2}, nil
+}
+
+// sorter 在原表上执行快速排序, 和 lua 的实现保持一致以便检测无效的比较函数
+type sorter struct {
+	vm  *LuaVM
+	t   types.Value
+	cmp types.Value
+	rnd uint
+}
+
+func (s *sorter) get(i int64) (types.Value, error) {
+	return s.vm.index(s.t, types.Integer(i))
+}
+
+func (s *sorter) set(i int64, v types.Value) error {
+	return s.vm.setIndex(s.t, types.Integer(i), v)
+}
+
+// set2 执行 t[i] = a, t[j] = b
+func (s *sorter) set2(i, j int64, a, b types.Value) error {
+	if err := s.set(i, a); err != nil {
+		return err
+	}
+	return s.set(j, b)
+}
+
+func (s *sorter) less(a, b types.Value) (bool, error) {
+	// 每次比较消耗一个单位的 gas
+	if err := s.vm.charge(1); err != nil {
+		return false, err
+	}
+	if isNil(s.cmp) {
+		return s.vm.lessThan(a, b)
+	}
+	v, err := s.vm.callMeta(s.cmp, a, b)
+	if err != nil {
+		return false, err
+	}
+	return bool(v.ToBoolean()), nil
+}
+
+// choosePivot 在 [lo, up] 的中间一半中随机选择主元
+func (s *sorter) choosePivot(lo, up int64) int64 {
+	r4 := (up - lo) / 4
+	return int64(s.rnd%uint(r4*2)) + lo + r4
+}
+
+// partition 以 t[up-1] 为主元划分 [lo, up], 返回主元的位置
+func (s *sorter) partition(lo, up int64, pivot types.Value) (int64, error) {
+	i, j := lo, up-1
+	for {
+		var a, b types.Value
+		for {
+			i++
+			v, err := s.get(i)
+			if err != nil {
+				return 0, err
+			}
+			lt, err := s.less(v, pivot)
+			if err != nil {
+				return 0, err
+			}
+			if !lt {
+				a = v
+				break
+			}
+			if i == up-1 {
+				return 0, errInvalidOrder
+			}
+		}
+		for {
+			j--
+			v, err := s.get(j)
+			if err != nil {
+				return 0, err
+			}
+			lt, err := s.less(pivot, v)
+			if err != nil {
+				return 0, err
+			}
+			if !lt {
+				b = v
+				break
+			}
+			if j < i {
+				return 0, errInvalidOrder
+			}
+		}
+		if j < i {
+			return i, s.set2(up-1, i, a, pivot)
+		}
+		if err := s.set2(i, j, b, a); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// order 在 t[j] < t[i] 时交换两个元素, 返回是否交换
+func (s *sorter) order(i, j int64) (bool, error) {
+	a, err := s.get(i)
+	if err != nil {
+		return false, err
+	}
+	b, err := s.get(j)
+	if err != nil {
+		return false, err
+	}
+	lt, err := s.less(b, a)
+	if err != nil || !lt {
+		return false, err
+	}
+	return true, s.set2(i, j, b, a)
+}
+
+func (s *sorter) sort(lo, up int64) error {
+	for lo < up {
+		if _, err := s.order(lo, up); err != nil {
+			return err
+		}
+		if up-lo == 1 {
+			break
+		}
+		p := lo + (up-lo)/2
+		if up-lo >= sortRandomLimit && s.rnd != 0 {
+			p = s.choosePivot(lo, up)
+		}
+		swapped, err := s.order(lo, p)
+		if err != nil {
+			return err
+		}
+		if !swapped {
+			if _, err := s.order(p, up); err != nil {
+				return err
+			}
+		}
+		if up-lo == 2 {
+			break
+		}
+		// 把主元交换到 up - 1
+		pivot, err := s.get(p)
+		if err != nil {
+			return err
+		}
+		v, err := s.get(up - 1)
+		if err != nil {
+			return err
+		}
+		if err := s.set2(p, up-1, v, pivot); err != nil {
+			return err
+		}
+		if p, err = s.partition(lo, up, pivot); err != nil {
+			return err
+		}
+		// 递归处理较小的一半, 循环处理较大的一半
+		var n int64
+		if p-lo < up-p {
+			if err := s.sort(lo, p-1); err != nil {
+				return err
+			}
+			n, lo = p-lo, p+1
+		} else {
+			if err := s.sort(p+1, up); err != nil {
+				return err
+			}
+			n, up = up-p, p-1
+		}
+		// 划分太不平衡时使用随机主元
+		if (up-lo)/128 > n {
+			s.rnd = uint(time.Now().UnixNano())
+		}
+	}
+	return nil
+}
+
+// sort(t [, comp]) 原地排序 t[1..#t], comp(a, b) 在 a 应该排在 b 前面时返回真
+func tabSort(vm *LuaVM, args ...types.Value) ([]types.Value, error) {
+	t, err := vm.checkTab(args, 0, "sort", tabRead|tabWrite|tabLength)
+	if err != nil {
+		return nil, err
+	}
+	n, err := vm.lenInteger(t)
+	if err != nil {
+		return nil, err
+	}
+	if n <= 1 {
+		return nil, nil
+	}
+	if n >= math.MaxInt32 {
+		return nil, errArgument(1, "sort", "array too big")
+	}
+	cmp := arg(args, 1)
+	if !isNil(cmp) {
+		if cmp, err = checkFunction(args, 1, "sort"); err != nil {
+			return nil, err
+		}
+	}
+	s := &sorter{vm: vm, t: t, cmp: cmp}
+	return nil, s.sort(1, n)
+}
@@ -0,0 +1,127 @@
+package vm
+
+import (
+	"testing"
+
+	"github.com/Salpadding/lua/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTableInsertRemove(t *testing.T) {
+	var vm LuaVM
+	values, err := vm.DoString(`
+local t = {}
+table.insert(t, "a")
+table.insert(t, "c")
+table.insert(t, 2, "b")
+table.insert(t, 1, "z")
+local removed = table.remove(t, 1)
+local last = table.remove(t)
+local empty = {}
+local none = table.remove(empty)
+return table.concat(t, ","), removed, last, #t, none, #empty
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{
+		types.String("a,b"), types.String("z"), types.String("c"), types.Integer(2), types.GetNil(), types.Integer(0),
+	}, values)
+
+	_, err = vm.DoString("table.insert({}, 3, 1)")
+	assert.Contains(t, err.Error(), "bad argument #2 to 'insert' (position out of bounds)")
+	_, err = vm.DoString("table.insert({}, 1, 2, 3)")
+	assert.Contains(t, err.Error(), "wrong number of arguments to 'insert'")
+	_, err = vm.DoString("table.remove({1, 2}, 5)")
+	assert.Contains(t, err.Error(), "bad argument #1 to 'remove' (position out of bounds)")
+	_, err = vm.DoString("table.insert(nil, 1)")
+	assert.Contains(t, err.Error(), "bad argument #1 to 'insert' (table expected, got nil)")
+}
+
+func TestTableConcat(t *testing.T) {
+	var vm LuaVM
+	values, err := vm.DoString(`
+local t = {1, "two", 3.5}
+return table.concat(t), table.concat(t, "-"), table.concat(t, ", ", 2, 3), table.concat(t, "x", 3, 2)
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{
+		types.String("1two3.5"), types.String("1-two-3.5"), types.String("two, 3.5"), types.String(""),
+	}, values)
+
+	_, err = vm.DoString("table.concat({1, {}, 3})")
+	assert.Contains(t, err.Error(), "invalid value (at index 2) in table for 'concat'")
+}
+
+func TestTablePackUnpack(t *testing.T) {
+	var vm LuaVM
+	values, err := vm.DoString(`
+local p = table.pack(1, nil, 3)
+local a, b, c = table.unpack({1, 2, 3})
+return p.n, p[1], p[2], p[3], a, b, c, table.unpack(p, 2, p.n)
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{
+		types.Integer(3), types.Integer(1), types.GetNil(), types.Integer(3),
+		types.Integer(1), types.Integer(2), types.Integer(3),
+		types.GetNil(), types.Integer(3),
+	}, values)
+
+	values, err = vm.DoString("return table.unpack({}, 1, 0)")
+	assert.NoError(t, err)
+	assert.Empty(t, values)
+	_, err = vm.DoString("return table.unpack({}, 1, 1e7)")
+	assert.Contains(t, err.Error(), "too many results to unpack")
+}
+
+func TestTableMove(t *testing.T) {
+	var vm LuaVM
+	values, err := vm.DoString(`
+local a = {1, 2, 3, 4, 5}
+table.move(a, 1, 3, 2)
+local b = table.move({1, 2, 3}, 1, 3, 3, {"x", "y"})
+local c = {1, 2, 3, 4, 5}
+table.move(c, 2, 5, 1)
+return table.concat(a, ","), table.concat(b, ","), table.concat(c, ",")
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{
+		types.String("1,1,2,3,5"), types.String("x,y,1,2,3"), types.String("2,3,4,5,5"),
+	}, values)
+}
+
+func TestTableSort(t *testing.T) {
+	var vm LuaVM
+	values, err := vm.DoString(`
+local t = {5, 2, 8, 1, 9, 3, 7, 4, 6, 0}
+table.sort(t)
+local s = {"pear", "apple", "fig", "banana"}
+table.sort(s, function(a, b) return #a < #b end)
+local big = {}
+for i = 1, 500 do big[i] = (i * 7919) % 503 end
+table.sort(big, function(a, b) return a > b end)
+local ok = true
+for i = 2, #big do if big[i - 1] < big[i] then ok = false end end
+local objs = {}
+local mt = {__lt = function(a, b) return a.v < b.v end}
+for i, v in ipairs({3, 1, 2}) do objs[i] = setmetatable({v = v}, mt) end
+table.sort(objs)
+return table.concat(t, ","), table.concat(s, ","), ok, objs[1].v, objs[2].v, objs[3].v
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{
+		types.String("0,1,2,3,4,5,6,7,8,9"), types.String("fig,pear,apple,banana"), types.Boolean(true),
+		types.Integer(1), types.Integer(2), types.Integer(3),
+	}, values)
+
+	_, err = vm.DoString(`
+local t = {}
+for i = 1, 100 do t[i] = i % 10 end
+table.sort(t, function(a, b) return true end)
+`)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid order function for sorting")
+
+	_, err = vm.DoString("table.sort({1, 'a'})")
+	assert.Contains(t, err.Error(), "attempt to compare")
+	_, err = vm.DoString("table.sort({1, 2}, 3)")
+	assert.Contains(t, err.Error(), "bad argument #2 to 'sort' (function expected, got number)")
+}
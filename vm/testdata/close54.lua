@@ -0,0 +1,15 @@
+local log = {}
+local function closer(name)
+  return setmetatable({}, {__close = function(_, err)
+    log[#log + 1] = name .. ":" .. tostring(err)
+  end})
+end
+do
+  local a <close> = closer("a")
+  local b <close> = closer("b")
+end
+local ok = pcall(function()
+  local c <close> = closer("c")
+  error("boom", 0)
+end)
+return table.concat(log, " "), ok
@@ -0,0 +1,14 @@
+local s, f = 0, 0
+for i = 1, 10 do
+  s = s + i
+end
+for i = 10, 1, -3 do
+  s = s + i
+end
+for x = 0.5, 2, 0.5 do
+  f = f + x
+end
+for i = math.maxinteger - 1, math.maxinteger do
+  s = s + 1
+end
+return s, f
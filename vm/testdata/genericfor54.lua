@@ -0,0 +1,8 @@
+local keys, sum = {}, 0
+for i, v in ipairs({10, 20, 30}) do
+  sum = sum + i * v
+end
+for k in pairs({a = 1}) do
+  keys[#keys + 1] = k
+end
+return sum, keys[1]
@@ -0,0 +1,3 @@
+local s = [[
+this line is longer than forty characters, so it is stored as a long string]]
+return #s, s:sub(1, 4)
@@ -0,0 +1,7 @@
+#!/bin/sh
+# 用 luac5.4 编译 *54.lua, 生成同名的 .o 文件
+set -e
+cd "$(dirname "$0")"
+for f in *54.lua; do
+	luac5.4 -o "${f%.lua}.o" "$f"
+done
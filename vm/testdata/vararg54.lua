@@ -0,0 +1,8 @@
+local function pack(...)
+  return select("#", ...), {...}
+end
+local function tail(...)
+  return ...
+end
+local n, t = pack(1, nil, 3)
+return n, t[1], t[3], tail(4, 5)
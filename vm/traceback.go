@@ -0,0 +1,166 @@
+package vm
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/Salpadding/lua/types"
+	"github.com/Salpadding/lua/types/code"
+)
+
+// idSize 是代码块名字的最大长度
+const idSize = 60
+
+// threadState 是每个线程独立的调用状态
+type threadState struct {
+	frames   []*Frame      // 调用栈, 栈顶是正在执行的函数
+	handlers []types.Value // pcall 和 xpcall 设置的消息处理函数, pcall 对应 nil
+	nCalls   int           // 嵌套的 Call 的数量, 每一层都占用 Go 的栈
+}
+
+// state 返回当前线程的调用状态
+func (vm *LuaVM) state() *threadState {
+	if vm.current != nil {
+		return &vm.current.threadState
+	}
+	return &vm.mainState
+}
+
+// chunkID 把代码块名字转换为错误信息中显示的形式
+func chunkID(source string) string {
+	switch {
+	case strings.HasPrefix(source, "="):
+		if len(source) > idSize {
+			return source[1:idSize]
+		}
+		return source[1:]
+	case strings.HasPrefix(source, "@"):
+		if len(source) > idSize {
+			return "..." + source[len(source)-idSize+4:]
+		}
+		return source[1:]
+	}
+	const pre, rets, pos = `[string "`, "...", `"]`
+	bufLen := idSize - len(pre+rets+pos) - 1
+	nl := strings.IndexByte(source, '\n')
+	if len(source) < bufLen && nl < 0 {
+		return pre + source + pos
+	}
+	if nl >= 0 {
+		source = source[:nl]
+	}
+	if len(source) > bufLen {
+		source = source[:bufLen]
+	}
+	return pre + source + rets + pos
+}
+
+// currentLine 返回正在执行的指令的行号, 没有行号信息时返回 -1
+func (f *Frame) currentLine() int {
+	return f.lineAt(f.pc - 1)
+}
+
+// where 返回第 level 层函数的位置, 第 1 层是栈顶的 lua 函数
+func (vm *LuaVM) where(level int) (string, int) {
+	frames := vm.state().frames
+	if level < 1 || level > len(frames) {
+		return "", -1
+	}
+	f := frames[len(frames)-level]
+	line := f.currentLine()
+	if line < 0 {
+		return "", -1
+	}
+	return chunkID(f.fn.Source), line
+}
+
+// newError 创建错误, level 大于 0 时在字符串类型的错误值前面加上出错位置
+func (vm *LuaVM) newError(v types.Value, level int) *LuaError {
+	e := &LuaError{Value: v, Line: -1}
+	if s, ok := v.(types.String); ok && level > 0 {
+		if e.Source, e.Line = vm.where(level); e.Line >= 0 {
+			e.Value = types.String(fmt.Sprintf("%s:%d: %s", e.Source, e.Line, string(s)))
+		}
+	}
+	return vm.throw(e)
+}
+
+// throw 记录调用栈, 并在调用栈展开之前调用 xpcall 设置的消息处理函数
+func (vm *LuaVM) throw(e *LuaError) *LuaError {
+	e.Traceback = vm.traceback(1)
+	st := vm.state()
+	n := len(st.handlers)
+	if n == 0 || isNil(st.handlers[n-1]) || e.handled != nil {
+		return e
+	}
+	h := st.handlers[n-1]
+	// 消息处理函数出错时不再调用自己
+	st.handlers[n-1] = types.GetNil()
+	v, err := vm.callMeta(h, e.Value)
+	st.handlers[n-1] = h
+	if err != nil {
+		v = errorValue(err)
+	}
+	e.handled = v
+	return e
+}
+
+// runtimeError 把指令执行中的错误转换为 LuaError, 类型错误会补充变量信息
+func (vm *LuaVM) runtimeError(f *Frame, ins code.Instruction, err error) error {
+	if e, ok := err.(*LuaError); ok {
+		return e
+	}
+	if vm.aborted(err) {
+		return err
+	}
+	if err == errNotEnoughMemory {
+		// 和 lua 一样, 内存错误不带位置信息
+		return vm.newError(types.String(err.Error()), 0)
+	}
+	msg := err.Error()
+	if te, ok := err.(*typeError); ok {
+		msg += operandInfo(f.fn.Prototype, f.pc-1, ins, te.operand)
+	}
+	return vm.newError(types.String(msg), 1)
+}
+
+// traceback 返回当前线程从第 level 层开始的调用栈
+func (vm *LuaVM) traceback(level int) string {
+	return stackTraceback(vm.state().frames, level)
+}
+
+// stackTraceback 返回 frames 从第 level 层开始的调用栈
+func stackTraceback(frames []*Frame, level int) string {
+	var buf bytes.Buffer
+	buf.WriteString("stack traceback:")
+	for i := len(frames) - level; i >= 0; i-- {
+		f := frames[i]
+		buf.WriteString("\n\t")
+		buf.WriteString(chunkID(f.fn.Source))
+		if line := f.currentLine(); line >= 0 {
+			buf.WriteString(fmt.Sprintf(":%d:", line))
+		} else {
+			buf.WriteString(":")
+		}
+		buf.WriteString(" in ")
+		var kind, name string
+		if i > 0 && !f.tailCall {
+			kind, name = funcName(frames[i-1])
+		}
+		switch {
+		case kind == "global":
+			buf.WriteString(fmt.Sprintf("function '%s'", name))
+		case kind != "":
+			buf.WriteString(fmt.Sprintf("%s '%s'", kind, name))
+		case f.fn.LineDefined == 0:
+			buf.WriteString("main chunk")
+		default:
+			buf.WriteString(fmt.Sprintf("function <%s:%d>", chunkID(f.fn.Source), f.fn.LineDefined))
+		}
+		if f.tailCall {
+			buf.WriteString("\n\t(...tail calls...)")
+		}
+	}
+	return buf.String()
+}
@@ -0,0 +1,76 @@
+package vm
+
+import (
+	"testing"
+
+	"github.com/Salpadding/lua/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpValueCounter(t *testing.T) {
+	var vm LuaVM
+	values, err := vm.DoString(`
+local function counter()
+  local n = 0
+  local function inc() n = n + 1; return n end
+  local function get() return n end
+  return inc, get
+end
+local inc, get = counter()
+inc(); inc()
+local inc2, get2 = counter()
+inc2()
+return get(), get2(), inc()
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{types.Integer(2), types.Integer(1), types.Integer(3)}, values)
+}
+
+func TestUpValueShared(t *testing.T) {
+	var vm LuaVM
+	values, err := vm.DoString(`
+local x = 1
+local function set(v) x = v end
+local function get() return x end
+set(10)
+local before = x
+x = 20
+return before, get()
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{types.Integer(10), types.Integer(20)}, values)
+
+	values, err = vm.DoString(`
+local function fib(n) if n < 2 then return n end return fib(n - 1) + fib(n - 2) end
+return fib(20)
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{types.Integer(6765)}, values)
+}
+
+func TestUpValueInLoop(t *testing.T) {
+	var vm LuaVM
+	values, err := vm.DoString(`
+local fs = {}
+for i = 1, 3 do
+  local j = i * 10
+  fs[i] = function() j = j + 1; return i, j end
+end
+local gs = {}
+local k = 1
+while k <= 3 do
+  local v = k
+  gs[k] = function() return v end
+  k = k + 1
+end
+local a, b = fs[1]()
+local c, d = fs[1]()
+local e, f = fs[3]()
+return a, b, c, d, e, f, gs[1](), gs[2](), gs[3]()
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{
+		types.Integer(1), types.Integer(11), types.Integer(1), types.Integer(12),
+		types.Integer(3), types.Integer(31), types.Integer(1), types.Integer(2), types.Integer(3),
+	}, values)
+}
@@ -0,0 +1,191 @@
+package vm
+
+import (
+	"fmt"
+
+	"github.com/Salpadding/lua/types"
+	"github.com/Salpadding/lua/types/code"
+	"github.com/Salpadding/lua/types/code54"
+)
+
+// localName 返回 pc 处第 reg 个活跃的局部变量的名字, 没有则返回空字符串
+func localName(p *types.Prototype, reg, pc int) string {
+	for _, v := range p.LocalVariables {
+		if int(v.StartPC) > pc {
+			break
+		}
+		if pc < int(v.EndPC) {
+			if reg == 0 {
+				return v.Name
+			}
+			reg--
+		}
+	}
+	return ""
+}
+
+func upValueName(p *types.Prototype, idx int) string {
+	if idx < len(p.UpValueNames) && p.UpValueNames[idx] != "" {
+		return p.UpValueNames[idx]
+	}
+	return "?"
+}
+
+// findSetReg 查找 lastPC 之前最后一条修改寄存器 reg 的指令, 跳转目标之前的指令不可信
+func findSetReg(p *types.Prototype, lastPC, reg int) int {
+	setReg, jmpTarget := -1, 0
+	filter := func(pc int) int {
+		if pc < jmpTarget {
+			return -1
+		}
+		return pc
+	}
+	for pc := 0; pc < lastPC; pc++ {
+		ins := p.Code[pc]
+		op := ins.Opcode()
+		a, b, _ := ins.ABC()
+		switch op.Type {
+		case code.LoadNil:
+			if a <= reg && reg <= a+b {
+				setReg = filter(pc)
+			}
+		case code.TForCall:
+			if reg >= a+2 {
+				setReg = filter(pc)
+			}
+		case code.Call, code.TailCall:
+			if reg >= a {
+				setReg = filter(pc)
+			}
+		case code.Jmp:
+			_, sBx := ins.AsBx()
+			dest := pc + 1 + sBx
+			if pc < dest && dest <= lastPC && dest > jmpTarget {
+				jmpTarget = dest
+			}
+		default:
+			if op.SetAFlag == 1 && reg == a {
+				setReg = filter(pc)
+			}
+		}
+	}
+	return setReg
+}
+
+// constantName 返回常量字符串, 不是字符串时返回 ?
+func constantName(p *types.Prototype, rk int) string {
+	if rk&0x100 != 0 {
+		if s, ok := p.Constants[rk&0xff].(types.String); ok {
+			return string(s)
+		}
+	}
+	return "?"
+}
+
+// objName 根据字节码推测寄存器中的值的来源, 返回种类和名字, 例如 global 'x'
+func objName(p *types.Prototype, lastPC, reg int) (kind, name string) {
+	if name = localName(p, reg, lastPC); name != "" {
+		return "local", name
+	}
+	if p.Version == types.LuaVersion54 {
+		return objName54(p, lastPC, reg)
+	}
+	pc := findSetReg(p, lastPC, reg)
+	if pc < 0 {
+		return "", ""
+	}
+	ins := p.Code[pc]
+	a, b, c := ins.ABC()
+	switch ins.Opcode().Type {
+	case code.Move:
+		if b < a {
+			return objName(p, pc, b)
+		}
+	case code.GetTableUpValue:
+		name = constantName(p, c)
+		if upValueName(p, b) == "_ENV" {
+			return "global", name
+		}
+		return "field", name
+	case code.GetTable:
+		name = constantName(p, c)
+		if localName(p, b, pc) == "_ENV" {
+			return "global", name
+		}
+		return "field", name
+	case code.GetUpValue:
+		return "upvalue", upValueName(p, b)
+	case code.LoadK, code.LoadKX:
+		_, bx := ins.ABx()
+		if ins.Opcode().Type == code.LoadKX {
+			bx = p.Code[pc+1].Ax()
+		}
+		if s, ok := p.Constants[bx].(types.String); ok {
+			return "constant", string(s)
+		}
+	case code.Self:
+		return "method", constantName(p, c)
+	}
+	return "", ""
+}
+
+// varInfo 描述寄存器或者常量的来源, 用于错误信息
+func varInfo(p *types.Prototype, pc, rk int) string {
+	if rk&0x100 != 0 {
+		return ""
+	}
+	kind, name := objName(p, pc, rk)
+	if kind == "" {
+		return ""
+	}
+	return fmt.Sprintf(" (%s '%s')", kind, name)
+}
+
+// operandInfo 描述出错指令中第 operand 个操作数的来源
+func operandInfo(p *types.Prototype, pc int, ins code.Instruction, operand int) string {
+	if p.Version == types.LuaVersion54 {
+		return operandInfo54(p, pc, code54.Instruction(ins), operand)
+	}
+	a, b, c := ins.ABC()
+	switch ins.Opcode().Type {
+	case code.GetTableUpValue:
+		return fmt.Sprintf(" (upvalue '%s')", upValueName(p, b))
+	case code.SetTableUpValue:
+		return fmt.Sprintf(" (upvalue '%s')", upValueName(p, a))
+	case code.GetTable, code.Self, code.Len, code.UnaryMinus, code.BitwiseNot:
+		return varInfo(p, pc, b)
+	case code.SetTable, code.Call, code.TailCall:
+		return varInfo(p, pc, a)
+	case code.TForCall:
+		return " (for iterator 'for iterator')"
+	case code.Concat:
+		return varInfo(p, pc, b+operand)
+	}
+	if _, ok := opMapping[ins.Opcode().Type]; ok {
+		if operand == 0 {
+			return varInfo(p, pc, b)
+		}
+		return varInfo(p, pc, c)
+	}
+	return ""
+}
+
+// funcName 根据调用者正在执行的指令推测被调用函数的名字
+func funcName(caller *Frame) (kind, name string) {
+	pc := caller.pc - 1
+	if pc < 0 || pc >= len(caller.fn.Code) {
+		return "", ""
+	}
+	if caller.fn.Version == types.LuaVersion54 {
+		return funcName54(caller.fn.Prototype, pc)
+	}
+	ins := caller.fn.Code[pc]
+	switch ins.Opcode().Type {
+	case code.Call, code.TailCall:
+		a, _, _ := ins.ABC()
+		return objName(caller.fn.Prototype, pc, a)
+	case code.TForCall:
+		return "for iterator", "for iterator"
+	}
+	return "", ""
+}
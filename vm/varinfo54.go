@@ -0,0 +1,167 @@
+package vm
+
+import (
+	"fmt"
+
+	"github.com/Salpadding/lua/types"
+	"github.com/Salpadding/lua/types/code54"
+)
+
+// findSetReg54 和 findSetReg 相同, 用于 Lua 5.4 的指令
+func findSetReg54(p *types.Prototype, lastPC, reg int) int {
+	setReg, jmpTarget := -1, 0
+	filter := func(pc int) int {
+		if pc < jmpTarget {
+			return -1
+		}
+		return pc
+	}
+	for pc := 0; pc < lastPC; pc++ {
+		ins := code54.Instruction(p.Code[pc])
+		op := ins.Opcode()
+		a, b := ins.A(), ins.B()
+		switch op.Type {
+		case code54.LoadNil:
+			if a <= reg && reg <= a+b {
+				setReg = filter(pc)
+			}
+		case code54.TForCall:
+			if reg >= a+2 {
+				setReg = filter(pc)
+			}
+		case code54.Call, code54.TailCall:
+			if reg >= a {
+				setReg = filter(pc)
+			}
+		case code54.Jmp:
+			dest := pc + 1 + ins.SJ()
+			if pc < dest && dest <= lastPC && dest > jmpTarget {
+				jmpTarget = dest
+			}
+		default:
+			if op.SetAFlag == 1 && reg == a {
+				setReg = filter(pc)
+			}
+		}
+	}
+	return setReg
+}
+
+// constantName54 返回第 idx 个常量字符串, 不是字符串时返回 ?
+func constantName54(p *types.Prototype, idx int) string {
+	if idx < len(p.Constants) {
+		if s, ok := p.Constants[idx].(types.String); ok {
+			return string(s)
+		}
+	}
+	return "?"
+}
+
+// objName54 和 objName 相同, 用于 Lua 5.4 的指令
+func objName54(p *types.Prototype, lastPC, reg int) (kind, name string) {
+	pc := findSetReg54(p, lastPC, reg)
+	if pc < 0 {
+		return "", ""
+	}
+	ins := code54.Instruction(p.Code[pc])
+	a, b, c, k := ins.ABCk()
+	switch ins.Opcode().Type {
+	case code54.Move:
+		if b < a {
+			return objName(p, pc, b)
+		}
+	case code54.GetTableUpValue:
+		name = constantName54(p, c)
+		if upValueName(p, b) == "_ENV" {
+			return "global", name
+		}
+		return "field", name
+	case code54.GetTable:
+		name = "?"
+		if kind, n := objName(p, pc, c); kind == "constant" {
+			name = n
+		}
+		return "field", name
+	case code54.GetI:
+		return "field", "integer index"
+	case code54.GetField:
+		name = constantName54(p, c)
+		if _, n := objName(p, pc, b); n == "_ENV" {
+			return "global", name
+		}
+		return "field", name
+	case code54.GetUpValue:
+		return "upvalue", upValueName(p, b)
+	case code54.LoadK, code54.LoadKX:
+		_, bx := ins.ABx()
+		if ins.Opcode().Type == code54.LoadKX {
+			bx = code54.Instruction(p.Code[pc+1]).Ax()
+		}
+		if s, ok := p.Constants[bx].(types.String); ok {
+			return "constant", string(s)
+		}
+	case code54.Self:
+		if k {
+			return "method", constantName54(p, c)
+		}
+		return "method", "?"
+	}
+	return "", ""
+}
+
+// varInfo54 描述寄存器的来源, 用于错误信息
+func varInfo54(p *types.Prototype, pc, reg int) string {
+	kind, name := objName(p, pc, reg)
+	if kind == "" {
+		return ""
+	}
+	return fmt.Sprintf(" (%s '%s')", kind, name)
+}
+
+// operandInfo54 和 operandInfo 相同, 用于 Lua 5.4 的指令
+func operandInfo54(p *types.Prototype, pc int, ins code54.Instruction, operand int) string {
+	a, b, c, _ := ins.ABCk()
+	switch t := ins.Opcode().Type; t {
+	case code54.GetTableUpValue:
+		return fmt.Sprintf(" (upvalue '%s')", upValueName(p, b))
+	case code54.SetTableUpValue:
+		return fmt.Sprintf(" (upvalue '%s')", upValueName(p, a))
+	case code54.GetTable, code54.GetI, code54.GetField, code54.Self, code54.Len, code54.UnaryMinus, code54.BitwiseNot:
+		return varInfo54(p, pc, b)
+	case code54.SetTable, code54.SetI, code54.SetField, code54.Call, code54.TailCall:
+		return varInfo54(p, pc, a)
+	case code54.TForCall:
+		return " (for iterator 'for iterator')"
+	case code54.Concat:
+		return varInfo54(p, pc, a+operand)
+	case code54.ShiftLeftI:
+		// 立即数是第一个操作数
+		if operand == 1 {
+			return varInfo54(p, pc, b)
+		}
+	case code54.Add, code54.Sub, code54.Mul, code54.Mod, code54.Pow, code54.Div, code54.IDiv,
+		code54.BitwiseAnd, code54.BitwiseOr, code54.BitwiseXor, code54.ShiftLeft, code54.ShiftRight:
+		if operand == 0 {
+			return varInfo54(p, pc, b)
+		}
+		return varInfo54(p, pc, c)
+	default:
+		// 第二个操作数是常量或者立即数
+		if _, ok := opMapping54[t]; ok && operand == 0 {
+			return varInfo54(p, pc, b)
+		}
+	}
+	return ""
+}
+
+// funcName54 和 funcName 相同, 用于 Lua 5.4 的指令
+func funcName54(p *types.Prototype, pc int) (kind, name string) {
+	ins := code54.Instruction(p.Code[pc])
+	switch ins.Opcode().Type {
+	case code54.Call, code54.TailCall:
+		return objName(p, pc, ins.A())
+	case code54.TForCall:
+		return "for iterator", "for iterator"
+	}
+	return "", ""
+}
@@ -0,0 +1,97 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/Salpadding/lua/types"
+	"github.com/Salpadding/lua/types/code"
+	"github.com/Salpadding/lua/types/code54"
+)
+
+// randomPrototype 生成随机指令的函数原型, 操作数取较小的值, 这样更容易通过校验
+func randomPrototype(rnd *rand.Rand, version byte) *types.Prototype {
+	p := &types.Prototype{
+		Source:       "=random",
+		IsVararg:     rnd.Intn(2) == 0,
+		MaxStackSize: 8,
+		Constants:    []types.Value{types.Integer(1), types.String("x"), types.Float(1.5), types.GetNil(), types.Boolean(true)},
+		UpValues:     []types.UpValue{{1, 0}},
+		UpValueNames: []string{"_ENV"},
+		Version:      version,
+	}
+	operand := func() int { return rnd.Intn(8) }
+	n := 1 + rnd.Intn(8)
+	for i := 0; i < n; i++ {
+		var ins code.Instruction
+		if version == types.LuaVersion54 {
+			op := code54.Type(rnd.Intn(len(code54.OpCodes)))
+			switch rnd.Intn(3) {
+			case 0:
+				ins = code.Instruction(code54.CreateABCk(op, operand(), operand(), operand(), rnd.Intn(2) == 0))
+			case 1:
+				ins = code.Instruction(code54.CreateAsBx(op, operand(), rnd.Intn(9)-4))
+			default:
+				ins = code.Instruction(code54.CreateSJ(op, rnd.Intn(9)-4))
+			}
+		} else {
+			op := code.Type(rnd.Intn(len(code.OpCodes)))
+			if rnd.Intn(2) == 0 {
+				ins = code.CreateABC(op, operand(), operand(), operand())
+			} else {
+				ins = code.CreateAsBx(op, operand(), rnd.Intn(9)-4)
+			}
+		}
+		p.Code = append(p.Code, ins)
+	}
+	if version == types.LuaVersion54 {
+		p.Code = append(p.Code, code.Instruction(code54.CreateABCk(code54.Return, 0, 1, 1, false)))
+	} else {
+		p.Code = append(p.Code, code.CreateABC(code.Return, 0, 1, 0))
+	}
+	return p
+}
+
+// runVerified 执行通过校验的函数原型, 把 panic 转换成错误
+func runVerified(p *types.Prototype) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	var vm LuaVM
+	defer vm.Close()
+	fn, err := load54(&vm, p)
+	if err != nil {
+		return nil
+	}
+	vm.CallContext(context.Background(), 1000, fn)
+	return nil
+}
+
+func TestVerifiedNoPanic(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for _, version := range []byte{0, types.LuaVersion54} {
+		for i := 0; i < 20000; i++ {
+			p := randomPrototype(rnd, version)
+			if types.Verify(p) != nil {
+				continue
+			}
+			if err := runVerified(p); err != nil {
+				var ops []string
+				for _, ins := range p.Code {
+					if version == types.LuaVersion54 {
+						a, b, c, k := code54.Instruction(ins).ABCk()
+						ops = append(ops, fmt.Sprintf("%s %d %d %d %v", code54.Instruction(ins).OpName(), a, b, c, k))
+					} else {
+						a, b, c := ins.ABC()
+						ops = append(ops, fmt.Sprintf("%s %d %d %d", ins.OpName(), a, b, c))
+					}
+				}
+				t.Fatalf("version %d, vararg %v, code %v: %v", version, p.IsVararg, ops, err)
+			}
+		}
+	}
+}
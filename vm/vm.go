@@ -1,80 +1,262 @@
 package vm
 
 import (
+	"bufio"
+	"context"
 	"errors"
 	"fmt"
-	"github.com/Salpadding/lua/types/code"
 	"io"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
 
+	"github.com/Salpadding/lua/compiler"
 	"github.com/Salpadding/lua/types"
+	"github.com/Salpadding/lua/types/value"
 )
 
 var natives = map[types.Value]types.Native{
-	types.String("print"): func(args ...types.Value) (values []types.Value, e error) {
-		for _, v := range args {
-			fmt.Println(v)
-		}
-		return []types.Value{types.GetNil()}, nil
-	},
 	types.String("fail"): func(args ...types.Value) (values []types.Value, e error) {
 		return []types.Value{types.GetNil()}, errors.New("assertion fail")
 	},
 }
 
-type Hook func(code *code.OpCode)
-
-type gasCounter struct{
-	gas int
-}
-
-func(g *gasCounter) hook(code *code.OpCode){
-	g.gas += 50
-}
-
 type LuaVM struct {
 	main     *Frame       // 主函数帧栈
 	registry *types.Table // lua 注册表
 	global   *types.Table // 全局变量
-	hooks    []Hook
+
+	metatables map[value.Type]*types.Table // 非表类型共享的元表
+
+	current    *coroutine              // 正在运行的协程, 主线程为 nil
+	coroutines map[*coroutine]struct{} // 启动过但是没有结束的协程
+	collected  []*coroutine            // Thread 已经不可达的协程, 由终结器加入
+	collectMu  sync.Mutex              // 终结器在其他 goroutine 中执行, 保护 collected
+	mainThread *types.Thread
+	mainState  threadState
+
+	random       *rand.Rand // math.random 使用的随机数生成器
+	maxCallDepth int        // lua 函数调用栈的最大深度
+
+	libs        Lib       // 打开的标准库
+	libsSet     bool      // 是否通过选项选择了标准库
+	safe        bool      // 安全模式下不能访问文件, 也不能加载二进制代码块
+	processExit bool      // os.exit 是否结束宿主进程
+	stdout      io.Writer // 标准输出, 为 nil 时使用 os.Stdout
+	stdin       io.Reader // 标准输入, 为 nil 时使用 os.Stdin
+
+	ctx      context.Context // 取消时停止执行
+	gasLimit uint64          // 最多可以执行的指令数量, 0 表示不限制
+	gasUsed  uint64          // 已经执行的指令数量
+	abort    error           // 中止执行的原因, 不能被 lua 代码捕获
+
+	memory memoryTracker // 脚本使用的内存
+
+	hook        Hook        // 调试钩子
+	hookMask    HookMask    // 触发钩子的事件
+	hookCount   int         // 触发 count 事件的指令间隔
+	hookCounter int         // 距离下一次 count 事件的指令数量
+	hookFn      types.Value // debug.sethook 设置的 lua 函数
+	inHook      bool        // 正在执行钩子, 这时不会再触发钩子
 }
 
-func (vm *LuaVM) Load(rd io.Reader) error {
-	proto, err := types.ReadPrototype(rd)
-	if err != nil {
-		return err
-	}
-	vm.main = &Frame{
-		Register: &Register{},
-		fn: &types.Function{
-			Prototype: proto,
-			UpValues:  make([]*types.ValuePointer, len(proto.UpValues)),
-		},
-		pc: 0,
-		vm: vm,
-	}
-	for i := range vm.main.fn.UpValues {
-		vm.main.fn.UpValues[i] = &types.ValuePointer{Value: types.GetNil()}
+// init 创建注册表和全局变量, 同一个虚拟机加载的所有代码块共享全局变量
+func (vm *LuaVM) init() error {
+	if vm.global != nil {
+		return nil
 	}
 	vm.registry = types.NewTable()
-	// global
 	vm.global = types.NewTable()
-	for k, v := range natives {
-		if err = vm.global.Set(k, v); err != nil {
-			return err
-		}
+	vm.metatables = map[value.Type]*types.Table{}
+	vm.memory.collect = vm.liveMemory
+	if err := vm.registry.Set(types.String("_ENV"), vm.global); err != nil {
+		return err
 	}
-	if err = vm.registry.Set(types.String("_ENV"), vm.global); err != nil {
+	return vm.openLibs()
+}
+
+// Load 加载代码块作为主函数, 由 Execute 执行
+func (vm *LuaVM) Load(rd io.Reader) error {
+	fn, err := vm.load(rd, "=?", "bt", nil)
+	if err != nil {
 		return err
 	}
+	vm.main = vm.NewFrame(fn)
 	return nil
 }
 
 func (vm *LuaVM) Execute() error {
-	_, err := vm.main.execute()
+	_, err := vm.Call(vm.main.fn)
+	return err
+}
+
+// LoadString 把字符串形式的源码或者二进制代码块加载为函数
+func (vm *LuaVM) LoadString(src string) (*types.Function, error) {
+	return vm.load(strings.NewReader(src), src, "bt", nil)
+}
+
+// LoadEnv 把代码块加载为函数, 并使用 env 作为它的 _ENV, 用于在沙箱中运行代码
+func (vm *LuaVM) LoadEnv(rd io.Reader, chunkName string, env types.Value) (*types.Function, error) {
+	if env == nil {
+		env = types.GetNil()
+	}
+	return vm.load(rd, chunkName, "bt", env)
+}
+
+// LoadFile 把文件加载为函数
+func (vm *LuaVM) LoadFile(path string) (*types.Function, error) {
+	f, err := os.Open(path)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	defer f.Close()
+	return vm.load(f, "@"+path, "bt", nil)
+}
+
+// DoString 加载并执行字符串, 返回代码块的返回值
+func (vm *LuaVM) DoString(src string) ([]types.Value, error) {
+	fn, err := vm.LoadString(src)
+	if err != nil {
+		return nil, err
+	}
+	return vm.Call(fn)
+}
+
+// DoFile 加载并执行文件, 返回代码块的返回值
+func (vm *LuaVM) DoFile(path string) ([]types.Value, error) {
+	fn, err := vm.LoadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return vm.Call(fn)
+}
+
+// load 读取二进制代码块或者编译源码, 以签名的第一个字节区分
+// mode 是允许的代码块种类, b 表示二进制, t 表示文本, 安全模式下不能加载二进制代码块
+// env 为 nil 时使用注册表中的全局环境
+func (vm *LuaVM) load(rd io.Reader, chunkName, mode string, env types.Value) (*types.Function, error) {
+	if err := vm.init(); err != nil {
+		return nil, err
+	}
+	return vm.loadChunk(rd, chunkName, mode, env)
+}
+
+// loadChunk 加载代码块, 调用前虚拟机必须已经初始化
+func (vm *LuaVM) loadChunk(rd io.Reader, chunkName, mode string, env types.Value) (*types.Function, error) {
+	buf := bufio.NewReader(rd)
+	var (
+		proto *types.Prototype
+		err   error
+	)
+	if vm.safe {
+		mode = strings.Replace(mode, "b", "", -1)
+	}
+	first, _ := buf.Peek(1)
+	binary := len(first) == 1 && first[0] == types.LuaSignature[0]
+	kind := "text"
+	if binary {
+		kind = "binary"
+	}
+	if !strings.Contains(mode, kind[:1]) {
+		return nil, fmt.Errorf("attempt to load a %s chunk (mode is '%s')", kind, mode)
+	}
+	if binary {
+		proto, err = types.ReadPrototype(buf)
+		// 二进制代码块可能来自不可信的来源, 执行前检查指令的参数
+		if err == nil {
+			err = types.Verify(proto)
+		}
+	} else {
+		proto, err = compiler.CompileReader(buf, chunkName)
+	}
+	if err != nil {
+		return nil, err
+	}
+	fn := &types.Function{
+		Prototype: proto,
+		UpValues:  make([]*types.ValuePointer, len(proto.UpValues)),
+	}
+	for i := range fn.UpValues {
+		fn.UpValues[i] = &types.ValuePointer{Value: types.GetNil()}
+	}
+	// 主函数的第一个 upvalue 是 _ENV
+	if len(fn.UpValues) > 0 {
+		if env == nil {
+			if env, err = vm.registry.Get(types.String("_ENV")); err != nil {
+				return nil, err
+			}
+		}
+		fn.UpValues[0].Set(env)
+	}
+	return fn, nil
+}
+
+// Call 调用 lua 函数或者本地函数, 返回所有返回值
+func (vm *LuaVM) Call(fn types.Value, args ...types.Value) ([]types.Value, error) {
+	switch x := fn.(type) {
+	case *types.Function:
+		st := vm.state()
+		if st.nCalls >= maxCCalls {
+			return nil, errCStackOverflow
+		}
+		st.nCalls++
+		base := len(st.frames)
+		defer func() {
+			st.nCalls--
+			// 出错时调用栈没有正常返回, 需要关闭剩下的帧的 upvalue
+			for _, f := range st.frames[base:] {
+				f.closeUpValues(0)
+			}
+			st.frames = st.frames[:base]
+		}()
+		frame, err := vm.newCallFrame(x, args)
+		if err != nil {
+			return nil, err
+		}
+		if err := vm.pushFrame(st, frame); err != nil {
+			return nil, err
+		}
+		values, err := vm.execute(st, base)
+		if err != nil {
+			err = vm.unwind(st, base, err)
+		}
+		return values, err
+	case types.Native:
+		if co := vm.current; co != nil {
+			co.nCcalls++
+			defer func() { co.nCcalls-- }()
+		}
+		values, err := x(args...)
+		if _, ok := err.(*typeError); ok {
+			// 变量信息只对调用本地函数的指令有效
+			err = errors.New(err.Error())
+		}
+		return values, err
+	default:
+		fn, args, err := vm.callable(fn, args)
+		if err != nil {
+			return nil, err
+		}
+		return vm.Call(fn, args...)
+	}
+}
+
+// unwind 出错时从栈顶开始弹出 base 以上的帧, 关闭帧的 upvalue 和待关闭变量,
+// 返回展开之后的错误, 资源用完导致的中止不调用 __close
+func (vm *LuaVM) unwind(st *threadState, base int, err error) error {
+	for n := len(st.frames); n > base; n = len(st.frames) {
+		f := st.frames[n-1]
+		f.closeUpValues(0)
+		// 回收的协程和 os.exit 不调用 __close 元方法
+		collected := vm.current != nil && vm.current.collected
+		_, exit := err.(*ExitError)
+		if (vm.abort == nil || err != vm.abort) && !collected && !exit {
+			err = f.closeOnError(err)
+		}
+		st.frames = st.frames[:n-1]
+	}
+	return err
 }
 
 func (vm *LuaVM) NewFrame(fn *types.Function) *Frame {
@@ -82,5 +264,71 @@ func (vm *LuaVM) NewFrame(fn *types.Function) *Frame {
 		vm:       vm,
 		Register: &Register{},
 		fn:       fn,
+		results:  -1,
+	}
+}
+
+// newCallFrame 创建调用 fn 的帧, 并把参数放到寄存器中
+func (vm *LuaVM) newCallFrame(fn *types.Function, args []types.Value) (*Frame, error) {
+	frame := vm.NewFrame(fn)
+	if err := frame.PushN(int(fn.NumParams), args...); err != nil {
+		return nil, err
+	}
+	if fn.IsVararg && len(args) > int(fn.NumParams) {
+		frame.varArgs = args[fn.NumParams:]
+	}
+	return frame, nil
+}
+
+// pushFrame 把帧压入调用栈, 超过最大深度时返回 stack overflow
+func (vm *LuaVM) pushFrame(st *threadState, frame *Frame) error {
+	if len(st.frames) >= vm.maxDepth() {
+		return errStackOverflow
+	}
+	st.frames = append(st.frames, frame)
+	return vm.callHook(frame)
+}
+
+// SetMaxCallDepth 设置 lua 函数调用栈的最大深度, n 小于等于 0 时使用默认值
+func (vm *LuaVM) SetMaxCallDepth(n int) {
+	vm.maxCallDepth = n
+}
+
+func (vm *LuaVM) maxDepth() int {
+	if vm.maxCallDepth <= 0 {
+		return defaultMaxCallDepth
+	}
+	return vm.maxCallDepth
+}
+
+// callable 返回实际被调用的函数, 不是函数的值通过 __call 元方法调用
+func (vm *LuaVM) callable(fn types.Value, args []types.Value) (types.Value, []types.Value, error) {
+	for i := 0; i < maxTagLoop; i++ {
+		switch fn.(type) {
+		case *types.Function, types.Native:
+			return fn, args, nil
+		}
+		h := vm.metaField(fn, "__call")
+		if isNil(h) {
+			return nil, nil, errCall(vm.typeName(fn))
+		}
+		fn, args = h, append([]types.Value{fn}, args...)
+	}
+	return nil, nil, errLoop("__call")
+}
+
+// output 返回标准输出
+func (vm *LuaVM) output() io.Writer {
+	if vm.stdout == nil {
+		return os.Stdout
+	}
+	return vm.stdout
+}
+
+// input 返回标准输入
+func (vm *LuaVM) input() io.Reader {
+	if vm.stdin == nil {
+		return os.Stdin
 	}
+	return vm.stdin
 }
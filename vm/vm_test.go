@@ -1,10 +1,15 @@
 package vm
 
 import (
+	"bytes"
 	"fmt"
 	"os"
+	"strings"
 	"testing"
 
+	"github.com/Salpadding/lua/compiler"
+	"github.com/Salpadding/lua/types"
+	"github.com/Salpadding/lua/types/code"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -20,10 +25,66 @@ func TestUpValue(t *testing.T){
 	f, err := os.Open("testdata/test4.o")
 	assert.NoError(t, err)
 	var vm LuaVM
-	counter := &gasCounter{}
-	vm.hooks = []Hook{counter.hook}
 	assert.NoError(t, vm.Load(f))
 	assert.NoError(t, vm.Execute())
-	fmt.Print(counter.gas)
+	fmt.Print(vm.GasUsed())
 
-}
\ No newline at end of file
+}
+func TestDoString(t *testing.T) {
+	var vm LuaVM
+	values, err := vm.DoString("local a, b = 3, 4\nreturn a * b, a .. b, ...")
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{types.Integer(12), types.String("34")}, values)
+
+	values, err = vm.DoString("local function f(...) return ... end\nreturn f(1, nil, 3)")
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{types.Integer(1), types.GetNil(), types.Integer(3)}, values)
+
+	values, err = vm.DoString("local t = {1, 2, (function() return 3, 4 end)()}\nreturn #t, t[4]")
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{types.Integer(4), types.Integer(4)}, values)
+
+	_, err = vm.DoString("local x = = 1")
+	assert.Error(t, err)
+}
+
+func TestSharedGlobal(t *testing.T) {
+	var vm LuaVM
+	_, err := vm.DoString("counter = 1\nfunction inc(n) counter = counter + n; return counter end")
+	assert.NoError(t, err)
+	values, err := vm.DoString("return inc(41)")
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{types.Integer(42)}, values)
+
+	fn, err := vm.LoadString("return counter")
+	assert.NoError(t, err)
+	values, err = vm.Call(fn)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Value{types.Integer(42)}, values)
+}
+
+func TestDoFile(t *testing.T) {
+	var vm LuaVM
+	// 二进制代码块
+	_, err := vm.DoFile("testdata/test4.o")
+	assert.NoError(t, err)
+	// 源码
+	_, err = vm.DoFile("testdata/test1.lua")
+	assert.NoError(t, err)
+	_, err = vm.DoFile("testdata/test3.lua")
+	assert.Error(t, err) // assertion fail error, native function
+	_, err = vm.DoFile("testdata/not_exists.lua")
+	assert.Error(t, err)
+}
+
+func TestLoadInvalidBinary(t *testing.T) {
+	p, err := compiler.CompileReader(strings.NewReader("local a = 1; return a + 1"), "=test")
+	assert.NoError(t, err)
+	p.Code[1] = code.CreateABC(code.Add, 200, 0, 0)
+	var buf bytes.Buffer
+	assert.NoError(t, types.WritePrototype(&buf, p, false))
+
+	var vm LuaVM
+	_, err = vm.LoadEnv(&buf, "=test", nil)
+	assert.EqualError(t, err, "bad binary chunk: function <test:0,0> instruction 2 (ADD): register 200 out of range (max stack size 2)")
+}